@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+
+	"eosc/tools/blocksource"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var toolsRecordBlocksCmd = &cobra.Command{
+	Use:   "record-blocks [start block] [end block] [output dir]",
+	Short: "Record get_info and get_block responses for a range of irreversible blocks, to replay them offline in watcher tests.",
+	Long: `Record get_info and get_block responses for a range of irreversible blocks, to replay them offline in watcher tests.
+
+Blocks from [start block] up to, but not including, [end block] are written to [output dir]. The recorded
+get_info reports [end block] as head and last irreversible block, so a replaying watcher stops right after
+the recorded range. Replay the directory with blocksource.NewFileSource.
+
+With --transactions, get_transaction is also recorded for every transaction in the range (the node needs
+the history plugin), together with get_abi for every contract those transactions touch, so that the
+watcher can follow inline and deferred transfers and decode actions by ABI while replaying.
+`,
+	Args: cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		start, err := strconv.ParseUint(args[0], 10, 32)
+		errorCheck(`"start block" invalid`, err)
+		end, err := strconv.ParseUint(args[1], 10, 32)
+		errorCheck(`"end block" invalid`, err)
+
+		source := blocksource.NewHTTPSource(viper.GetString("global-api-url"), nil)
+		err = blocksource.Record(source, args[2], uint32(start), uint32(end), viper.GetBool("tools-record-blocks-cmd-transactions"))
+		errorCheck("recording blocks", err)
+
+		fmt.Printf("Recorded blocks %d to %d in %s\n", start, end-1, args[2])
+	},
+}
+
+func init() {
+	toolsCmd.AddCommand(toolsRecordBlocksCmd)
+
+	toolsRecordBlocksCmd.Flags().BoolP("transactions", "", false, "Also record get_transaction and get_abi for the transactions in the range")
+
+	for _, flag := range []string{"transactions"} {
+		if err := viper.BindPFlag("tools-record-blocks-cmd-"+flag, toolsRecordBlocksCmd.Flags().Lookup(flag)); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var toolsRescanCmd = &cobra.Command{
+	Use:   "rescan [start block] [end block] [contract] [contract...]",
+	Short: "Ask a running eos watcher to re-scan a block range for the given token contracts.",
+	Long: `Ask a running eos watcher to re-scan a block range for the given token contracts.
+
+Blocks from [start block] up to, but not including, [end block] are scanned again for the selected
+contracts, given as "action_account" or "action_account/SYMBOL". Only events that were never delivered
+are emitted, and the watcher's live scan height is left untouched. The rescan runs inside the watcher,
+through its admin API (api_addr, api_token), alongside the live scan; it resumes after a restart.
+
+Run without arguments to list rescan tasks and their progress.
+`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 && len(args) < 3 {
+			return fmt.Errorf("requires a start block, an end block and at least one contract")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		url := strings.TrimRight(viper.GetString("tools-rescan-cmd-watcher-api"), "/") + "/v1/admin/rescan"
+
+		var req *http.Request
+		var err error
+		if len(args) == 0 {
+			req, err = http.NewRequest("GET", url, nil)
+		} else {
+			var start, end uint64
+			var body []byte
+			start, err = strconv.ParseUint(args[0], 10, 32)
+			errorCheck(`"start block" invalid`, err)
+			end, err = strconv.ParseUint(args[1], 10, 32)
+			errorCheck(`"end block" invalid`, err)
+
+			body, err = json.Marshal(map[string]interface{}{
+				"from":      start,
+				"to":        end,
+				"contracts": args[2:],
+			})
+			errorCheck("marshalling rescan request", err)
+			req, err = http.NewRequest("POST", url, bytes.NewReader(body))
+		}
+		errorCheck("creating rescan request", err)
+		req.Header.Set("Authorization", "Bearer "+viper.GetString("tools-rescan-cmd-watcher-api-token"))
+
+		resp, err := http.DefaultClient.Do(req)
+		errorCheck("calling watcher api", err)
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		errorCheck("reading watcher api response", err)
+		if resp.StatusCode != http.StatusOK {
+			errorCheck("rescan", fmt.Errorf("watcher api returned %s: %s", resp.Status, strings.TrimSpace(string(data))))
+		}
+
+		var out bytes.Buffer
+		errorCheck("formatting watcher api response", json.Indent(&out, data, "", "  "))
+		fmt.Println(out.String())
+	},
+}
+
+func init() {
+	toolsCmd.AddCommand(toolsRescanCmd)
+
+	toolsRescanCmd.Flags().StringP("watcher-api", "", "http://127.0.0.1:9100", "Base URL of the watcher admin API")
+	toolsRescanCmd.Flags().StringP("watcher-api-token", "", "", "Bearer token of the watcher admin API")
+
+	for _, flag := range []string{"watcher-api", "watcher-api-token"} {
+		if err := viper.BindPFlag("tools-rescan-cmd-"+flag, toolsRescanCmd.Flags().Lookup(flag)); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -2,8 +2,26 @@ package eoswatcher
 
 import (
 	"encoding/hex"
-	"encoding/json"
+	"fmt"
 	"github.com/eoscanada/eos-go"
+	"github.com/pkg/errors"
+)
+
+// 事件类型
+const (
+	EventTypeUnknown		uint32 = 0
+	// 溶币的memo 不符合合约配置的格式，见MemoSchema
+	EventTypeInvalidMemo	uint32 = 1
+	// 转账给网关（溶币）
+	EventTypeDeposit		uint32 = 2
+	// 调用网关合约的溶币方法
+	EventTypeSolvent		uint32 = 3
+	// 网关合约铸币
+	EventTypeIssue			uint32 = 4
+	// 网关退回用户的转账
+	EventTypeRefund			uint32 = 5
+	// 网关转出，完成提现
+	EventTypeWithdrawalConfirmed	uint32 = 6
 )
 
 type PushEvent interface {
@@ -15,16 +33,21 @@ type PushEvent interface {
 	GetTranxIx()		int
 	GetAmount()			uint64
 	GetFee()			uint64
-	GetFrom()			byte
-	GetTo()				byte
-	GetData()			[]byte
+	GetFrom()			string
+	GetTo()				string
+	GetData()			([]byte, error)
 }
 
+var _ PushEvent = (*EOSPushEvent)(nil)
+
 type EOSPushEvent struct {
 	TxID				eos.SHA256Bytes
 
 	Account				eos.AccountName
 	Name				eos.ActionName
+	// 付款方、收款方。 溶币方法没有收款方，铸币方法没有付款方
+	From				eos.AccountName
+	To					eos.AccountName
 	Memo				string
 	Amount				uint64
 	Symbol				string
@@ -32,6 +55,31 @@ type EOSPushEvent struct {
 
 	BlockNum			uint32
 	Index				int
+	// action 在交易中的序号，与TxID 一起唯一确定一个事件
+	ActionIndex			int
+
+	// inline action 的调用深度，交易中直接声明的action 为0
+	TraceDepth			int
+	// 产生该inline action 的父action，直接声明的action 为空
+	CreatorAccount		eos.AccountName
+	CreatorName			eos.ActionName
+
+	// 匹配到的监控账户（溶币、提现为收款、付款账户），见EOSWatcherMain.WatchedAccounts
+	WatchedAccount		eos.AccountName
+
+	// 事件类型，见EventType*
+	EventType			uint32
+	// 业务标签，来自TokenContract.Business
+	Business			string
+	// 网关发起的交易对应的提案ID，见EOSWatcherMain.BindProposal
+	Proposal			string
+	// 按memo 格式规范化后的数据，GetData 返回
+	NormalizedMemo		[]byte
+	// memo 不符合格式的原因
+	MemoError			string
+
+	// 交易的确认信息，只有GetEventByTxid 返回的事件填充
+	Confirmation		*TxConfirmation
 }
 
 type JsonMemo struct {
@@ -40,15 +88,15 @@ type JsonMemo struct {
 }
 
 func (event *EOSPushEvent) GetBusiness() string {
-	return ""
+	return event.Business
 }
 
 func (event *EOSPushEvent) GetEventType() uint32 {
-	return 0
+	return event.EventType
 }
 
 func (event *EOSPushEvent) GetProposal() string {
-	return ""
+	return event.Proposal
 }
 
 func (event *EOSPushEvent) GetTxID() string {
@@ -63,50 +111,51 @@ func (event *EOSPushEvent) GetTranxIx() int {
 	return event.Index
 }
 
+func (event *EOSPushEvent) GetActionIndex() int {
+	return event.ActionIndex
+}
+
+// 事件唯一标识：txid:actionIndex
+func (event *EOSPushEvent) GetEventKey() string {
+	return fmt.Sprintf("%s:%d", event.GetTxID(), event.ActionIndex)
+}
+
 func (event *EOSPushEvent) GetAmount() uint64 {
 	//return uint64(event.Transfer.Quantity.Amount)
 	return event.Amount
 }
 
+// EOS 转账没有手续费
 func (event *EOSPushEvent) GetFee() uint64 {
 	return 0
 }
 
-func (event *EOSPushEvent) GetFrom() byte {
-	return 0
+func (event *EOSPushEvent) GetFrom() string {
+	return string(event.From)
 }
 
-func (event *EOSPushEvent) GetTo() byte {
-	return 0
+func (event *EOSPushEvent) GetTo() string {
+	return string(event.To)
 }
 
+func (event *EOSPushEvent) GetWatchedAccount() string {
+	return string(event.WatchedAccount)
+}
+
+// 交给网关的memo 数据。 watcher 生成的事件已经按合约配置的memo 格式规范化，
+// 其他事件按货币名称的默认格式处理（WBCH、WBTC 为json，注入Chain 字段）
 func (event *EOSPushEvent) GetData() ([]byte, error) {
-	if (event.Symbol == "WBCH" || event.Symbol == "WBTC") {
-		var tmpMemo JsonMemo
-		err := json.Unmarshal([]byte(event.Memo), &tmpMemo)
-		if err != nil {
-			return []byte{}, err
-		}
-
-		if event.Symbol == "WBCH" {
-			tmpMemo.Chain = "bch"
-			byteMemo, err := json.Marshal(tmpMemo)
-			if err != nil {
-				return []byte{}, err
-			}
-			return byteMemo, nil
-		}
-		if event.Symbol == "WBTC" {
-			tmpMemo.Chain = "btc"
-			byteMemo, err := json.Marshal(tmpMemo)
-			if err != nil {
-				return []byte{}, err
-			}
-			return byteMemo, nil
-		}
+	if event.EventType == EventTypeInvalidMemo {
+		return []byte{}, errors.New(event.MemoError)
+	}
+	if event.NormalizedMemo != nil {
+		return event.NormalizedMemo, nil
+	}
+	data, err := DefaultMemoSchemas[event.Symbol].Normalize(event.Memo)
+	if err != nil {
+		return []byte{}, err
 	}
-	return []byte(event.Memo), nil
-	//return []byte{}
+	return data, nil
 }
 
 func (event *EOSPushEvent) GetSymbol() string {
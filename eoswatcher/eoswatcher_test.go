@@ -0,0 +1,179 @@
+package eoswatcher
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// 100-103 四个块并发扫描，102 一直取不到，其余的块都已处理
+type testScanner interface {
+	StartWatch(ctx context.Context, scanBlockHeight, scanBlockIndex uint32, eventChan chan<- *EOSPushEvent, channelCount int)
+	Stop()
+}
+
+func testStopMidScan(t *testing.T, newScanner func(db *leveldb.DB, getInfo func() (*eos.InfoResp, error), getBlock func(id string) (*eos.BlockResp, error)) testScanner) {
+	dirName, err := ioutil.TempDir("", "eoswatcher")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dirName)
+	db, err := leveldb.OpenFile(dirName, nil)
+	assert.Nil(t, err)
+
+	var lock sync.Mutex
+	requested := make(map[string]bool)
+	allRequested := make(chan struct{})
+	getInfo := func() (*eos.InfoResp, error) {
+		return &eos.InfoResp{HeadBlockNum: 110, LastIrreversibleBlockNum: 104}, nil
+	}
+	getBlock := func(id string) (*eos.BlockResp, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if !requested[id] {
+			requested[id] = true
+			if len(requested) == 4 {
+				close(allRequested)
+			}
+		}
+		if id == "102" {
+			return nil, errors.New("timeout")
+		}
+		return &eos.BlockResp{}, nil
+	}
+
+	scanner := newScanner(db, getInfo, getBlock)
+	eventChan := make(chan *EOSPushEvent, 10)
+	scanner.StartWatch(context.Background(), 100, 0, eventChan, 4)
+	select {
+	case <-allRequested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocks not requested")
+	}
+	scanner.Stop()
+	_, open := <-eventChan
+	assert.False(t, open)
+
+	// 102 没处理，重启后从102 开始
+	db, err = leveldb.OpenFile(dirName, nil)
+	assert.Nil(t, err)
+	defer db.Close()
+	data, err := db.Get([]byte(scanBlockHeightKey), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(102), binary.LittleEndian.Uint32(data))
+}
+
+func TestEOSWatcherStopMidScan(t *testing.T) {
+	testStopMidScan(t, func(db *leveldb.DB, getInfo func() (*eos.InfoResp, error), getBlock func(id string) (*eos.BlockResp, error)) testScanner {
+		return &EOSWatcher{EosAPI: &eos.API{}, DB: db, getInfo: getInfo, getBlock: getBlock}
+	})
+}
+
+func TestEOSWatcherContractStopMidScan(t *testing.T) {
+	testStopMidScan(t, func(db *leveldb.DB, getInfo func() (*eos.InfoResp, error), getBlock func(id string) (*eos.BlockResp, error)) testScanner {
+		return &EOSWatcherContract{EosAPI: &eos.API{}, DB: db, getInfo: getInfo, getBlock: getBlock}
+	})
+}
+
+// 块中的交易，每笔交易的action 由unpackTx 返回
+func newLegacyTestBlock(blockNum uint32, txActions ...[]*eos.Action) (*eos.BlockResp, func(packed *eos.PackedTransaction) (*eos.SignedTransaction, error)) {
+	blockResp := &eos.BlockResp{BlockNum: blockNum}
+	signedTxs := make(map[*eos.PackedTransaction]*eos.SignedTransaction)
+	for i, actions := range txActions {
+		packed := &eos.PackedTransaction{}
+		signedTxs[packed] = &eos.SignedTransaction{Transaction: &eos.Transaction{Actions: actions}}
+		receipt := eos.TransactionReceipt{Transaction: eos.TransactionWithID{ID: eos.SHA256Bytes{byte(i + 1)}, Packed: packed}}
+		blockResp.SignedBlock.Transactions = append(blockResp.SignedBlock.Transactions, receipt)
+	}
+	unpackTx := func(packed *eos.PackedTransaction) (*eos.SignedTransaction, error) {
+		return signedTxs[packed], nil
+	}
+	return blockResp, unpackTx
+}
+
+func newLegacyTestAction(account, name string, data interface{}) *eos.Action {
+	action := &eos.Action{Account: eos.AN(account), Name: eos.ActN(name)}
+	action.ActionData.Data = data
+	return action
+}
+
+// 一笔交易中的每个匹配的action 单独生成事件，ActionIndex 为action 在交易中的位置
+func TestEOSWatcherMultiActionEvents(t *testing.T) {
+	ew := &EOSWatcher{ActionDecoders: NewActionDecoderRegistry(), ScanBlockHeight: 1}
+	ew.ActionNameDestroy = eos.ActN("destroytoken")
+	ew.ActionNameCreate = eos.ActN("createtoken")
+	ew.UpdateActionAccount("xintoken1111")
+
+	blockResp, unpackTx := newLegacyTestBlock(500,
+		[]*eos.Action{
+			newLegacyTestAction("xintoken1111", "destroytoken", &DestroyToken{User: "alice1111111", Amount: 5, Memo: "a"}),
+			newLegacyTestAction("xintoken2222", "destroytoken", &DestroyToken{User: "alice1111111", Amount: 6, Memo: "b"}),
+			newLegacyTestAction("xintoken1111", "destroytoken", &DestroyToken{User: "alice1111111", Amount: 7, Memo: "c"}),
+		},
+		[]*eos.Action{
+			newLegacyTestAction("xintoken1111", "createtoken", &CreateToken{User: "alice1111111", Amount: 8}),
+			newLegacyTestAction("xintoken1111", "destroytoken", &DestroyToken{User: "alice1111111", Amount: 9, Memo: "d"}),
+		})
+	ew.unpackTx = unpackTx
+
+	eventChan := make(chan *EOSPushEvent, 10)
+	ew.UpdateEOSPushEvent(context.Background(), blockResp, 0, eventChan)
+	close(eventChan)
+
+	var events []*EOSPushEvent
+	for event := range eventChan {
+		events = append(events, event)
+	}
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, []string{"a", "c", "d"}, []string{events[0].Memo, events[1].Memo, events[2].Memo})
+		assert.Equal(t, []int{0, 2, 1}, []int{events[0].ActionIndex, events[1].ActionIndex, events[2].ActionIndex})
+		assert.Equal(t, []int{0, 0, 1}, []int{events[0].Index, events[1].Index, events[2].Index})
+		assert.Equal(t, uint64(7), events[1].Amount)
+		assert.Equal(t, uint32(500), events[2].BlockNum)
+	}
+
+	// 从第二笔交易开始扫
+	eventChan = make(chan *EOSPushEvent, 10)
+	ew.UpdateEOSPushEvent(context.Background(), blockResp, 1, eventChan)
+	close(eventChan)
+	assert.Len(t, eventChan, 1)
+}
+
+func TestEOSWatcherContractMultiActionEvents(t *testing.T) {
+	ew := &EOSWatcherContract{ActionDecoders: NewActionDecoderRegistry(), Gateway: eos.AN("gateway11111"), ActionAccount: eos.AN("gatewaytoken"),
+		ActionNameDestroy: eos.ActN("solvent"), ActionNameCreate: eos.ActN("issue"), Symbol: "WBTC", Precision: 8}
+	ew.registerActionDecoders()
+
+	wbtc := eos.Symbol{Precision: 8, Symbol: "WBTC"}
+	blockResp, unpackTx := newLegacyTestBlock(600,
+		[]*eos.Action{
+			newLegacyTestAction("gatewaytoken", "issue", &Solvent{From: "alice1111111", Quantity: eos.Asset{Amount: 1, Symbol: wbtc}}),
+			newLegacyTestAction("gatewaytoken", "solvent", &Solvent{From: "alice1111111", Quantity: eos.Asset{Amount: 2, Symbol: wbtc}, Memo: "a"}),
+			// 货币名称不一致
+			newLegacyTestAction("gatewaytoken", "solvent", &Solvent{From: "alice1111111", Quantity: eos.Asset{Amount: 3, Symbol: eos.Symbol{Precision: 4, Symbol: "EOS"}}, Memo: "b"}),
+			newLegacyTestAction("gatewaytoken", "solvent", &Solvent{From: "alice1111111", Quantity: eos.Asset{Amount: 4, Symbol: wbtc}, Memo: "c"}),
+		})
+	ew.unpackTx = unpackTx
+
+	eventChan := make(chan *EOSPushEvent, 10)
+	ew.UpdateEOSPushEvent(context.Background(), blockResp, 0, eventChan)
+	close(eventChan)
+
+	var events []*EOSPushEvent
+	for event := range eventChan {
+		events = append(events, event)
+	}
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, []string{"a", "c"}, []string{events[0].Memo, events[1].Memo})
+		assert.Equal(t, []int{1, 3}, []int{events[0].ActionIndex, events[1].ActionIndex})
+		assert.Equal(t, []uint64{2, 4}, []uint64{events[0].Amount, events[1].Amount})
+		assert.Equal(t, uint32(600), events[1].BlockNum)
+	}
+}
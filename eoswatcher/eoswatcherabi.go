@@ -0,0 +1,391 @@
+package eoswatcher
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/eoscanada/eos-go"
+	"github.com/pkg/errors"
+	"math"
+	"strings"
+	"time"
+)
+
+// 类型嵌套的最大深度，防止ABI 中的循环定义
+const abiMaxDepth = 32
+
+// 合约ABI，字段与get_abi 返回的json 一致。 只保留解析action 数据需要的部分
+type ContractABI struct {
+	Version				string				`json:"version"`
+	Types				[]ABITypeDef		`json:"types"`
+	Structs				[]ABIStructDef		`json:"structs"`
+	Actions				[]ABIActionDef		`json:"actions"`
+}
+
+type ABITypeDef struct {
+	NewTypeName			string				`json:"new_type_name"`
+	Type				string				`json:"type"`
+}
+
+type ABIStructDef struct {
+	Name				string				`json:"name"`
+	Base				string				`json:"base"`
+	Fields				[]ABIFieldDef		`json:"fields"`
+}
+
+type ABIFieldDef struct {
+	Name				string				`json:"name"`
+	Type				string				`json:"type"`
+}
+
+type ABIActionDef struct {
+	Name				eos.ActionName		`json:"name"`
+	Type				string				`json:"type"`
+}
+
+// 解析二进制ABI（setabi 的abi 字段），只读取types、structs、actions
+func ParseBinaryABI(data []byte) (*ContractABI, error) {
+	reader := &abiReader{data: data}
+	abi := &ContractABI{}
+	abi.Version = reader.readString()
+
+	count := reader.readVaruint32()
+	for i := uint64(0); i < count && reader.err == nil; i++ {
+		abi.Types = append(abi.Types, ABITypeDef{
+			NewTypeName:	reader.readString(),
+			Type:			reader.readString(),
+		})
+	}
+
+	count = reader.readVaruint32()
+	for i := uint64(0); i < count && reader.err == nil; i++ {
+		structDef := ABIStructDef{
+			Name:		reader.readString(),
+			Base:		reader.readString(),
+		}
+		fieldCount := reader.readVaruint32()
+		for j := uint64(0); j < fieldCount && reader.err == nil; j++ {
+			structDef.Fields = append(structDef.Fields, ABIFieldDef{
+				Name:		reader.readString(),
+				Type:		reader.readString(),
+			})
+		}
+		abi.Structs = append(abi.Structs, structDef)
+	}
+
+	count = reader.readVaruint32()
+	for i := uint64(0); i < count && reader.err == nil; i++ {
+		name := reader.readName()
+		actionType := reader.readString()
+		// ricardian_contract
+		reader.readString()
+		abi.Actions = append(abi.Actions, ABIActionDef{
+			Name:		eos.ActionName(name),
+			Type:		actionType,
+		})
+	}
+
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	return abi, nil
+}
+
+// 按ABI 解析action 的二进制数据，返回字段名 -> 值。
+// name、asset、symbol、时间等类型与history API 的json 格式一致，为字符串；整数为int64、uint64，bytes、checksum、key 等为hex 字符串
+func (abi *ContractABI) DecodeAction(name eos.ActionName, data []byte) (map[string]interface{}, error) {
+	for _, action := range abi.Actions {
+		if action.Name != name {
+			continue
+		}
+		reader := &abiReader{data: data}
+		value, err := abi.decodeType(reader, action.Type, 0)
+		if err != nil {
+			return nil, err
+		}
+		if reader.err != nil {
+			return nil, reader.err
+		}
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("ABI action '" + string(name) + "' type is not struct.")
+		}
+		return fields, nil
+	}
+	return nil, errors.New("ABI action '" + string(name) + "' not found.")
+}
+
+// 展开typedef
+func (abi *ContractABI) resolveType(typeName string) string {
+	for i := 0; i < abiMaxDepth; i++ {
+		found := false
+		for _, typeDef := range abi.Types {
+			if typeDef.NewTypeName == typeName {
+				typeName = typeDef.Type
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return typeName
+}
+
+func (abi *ContractABI) findStruct(name string) *ABIStructDef {
+	for i := range abi.Structs {
+		if abi.Structs[i].Name == name {
+			return &abi.Structs[i]
+		}
+	}
+	return nil
+}
+
+func (abi *ContractABI) decodeType(reader *abiReader, typeName string, depth int) (interface{}, error) {
+	if depth > abiMaxDepth {
+		return nil, errors.New("ABI type '" + typeName + "' nested too deep.")
+	}
+	typeName = abi.resolveType(typeName)
+
+	if strings.HasSuffix(typeName, "[]") {
+		count := reader.readVaruint32()
+		var values []interface{}
+		for i := uint64(0); i < count && reader.err == nil; i++ {
+			value, err := abi.decodeType(reader, strings.TrimSuffix(typeName, "[]"), depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, reader.err
+	}
+	if strings.HasSuffix(typeName, "?") {
+		if reader.readByte() == 0 {
+			return nil, reader.err
+		}
+		return abi.decodeType(reader, strings.TrimSuffix(typeName, "?"), depth + 1)
+	}
+
+	if value, ok := reader.readBuiltin(typeName); ok {
+		return value, reader.err
+	}
+
+	structDef := abi.findStruct(typeName)
+	if structDef == nil {
+		return nil, errors.New("ABI type '" + typeName + "' not found.")
+	}
+	fields := make(map[string]interface{})
+	if structDef.Base != "" {
+		base, err := abi.decodeType(reader, structDef.Base, depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		baseFields, ok := base.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("ABI base type '" + structDef.Base + "' is not struct.")
+		}
+		for name, value := range baseFields {
+			fields[name] = value
+		}
+	}
+	for _, field := range structDef.Fields {
+		fieldType := field.Type
+		// 二进制扩展字段，数据结束时可以省略
+		if strings.HasSuffix(fieldType, "$") {
+			if reader.remaining() == 0 {
+				continue
+			}
+			fieldType = strings.TrimSuffix(fieldType, "$")
+		}
+		value, err := abi.decodeType(reader, fieldType, depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		fields[field.Name] = value
+	}
+	return fields, reader.err
+}
+
+// 二进制读取器，出错后记录第一个错误，之后的读取返回零值
+type abiReader struct {
+	data				[]byte
+	pos					int
+	err					error
+}
+
+func (reader *abiReader) remaining() int {
+	return len(reader.data) - reader.pos
+}
+
+func (reader *abiReader) read(n int) []byte {
+	if reader.err != nil {
+		return make([]byte, n)
+	}
+	if n < 0 || reader.remaining() < n {
+		reader.err = errors.New("ABI data too short.")
+		return make([]byte, n)
+	}
+	bytes := reader.data[reader.pos:reader.pos + n]
+	reader.pos += n
+	return bytes
+}
+
+func (reader *abiReader) readByte() byte {
+	return reader.read(1)[0]
+}
+
+func (reader *abiReader) readUint16() uint16 {
+	return binary.LittleEndian.Uint16(reader.read(2))
+}
+
+func (reader *abiReader) readUint32() uint32 {
+	return binary.LittleEndian.Uint32(reader.read(4))
+}
+
+func (reader *abiReader) readUint64() uint64 {
+	return binary.LittleEndian.Uint64(reader.read(8))
+}
+
+func (reader *abiReader) readVaruint32() uint64 {
+	var value uint64
+	for shift := uint(0); shift < 35; shift += 7 {
+		b := reader.readByte()
+		value |= uint64(b & 0x7f) << shift
+		if b & 0x80 == 0 {
+			return value
+		}
+	}
+	if reader.err == nil {
+		reader.err = errors.New("ABI varuint32 overflow.")
+	}
+	return 0
+}
+
+func (reader *abiReader) readString() string {
+	length := reader.readVaruint32()
+	if length > uint64(reader.remaining()) {
+		reader.read(reader.remaining() + 1)
+		return ""
+	}
+	return string(reader.read(int(length)))
+}
+
+func (reader *abiReader) readName() string {
+	return eos.NameToString(reader.readUint64())
+}
+
+func (reader *abiReader) readSymbol() (uint8, string) {
+	value := reader.readUint64()
+	return uint8(value & 0xff), symbolCode(value >> 8)
+}
+
+func (reader *abiReader) readAsset() string {
+	amount := int64(reader.readUint64())
+	precision, symbol := reader.readSymbol()
+	return formatAsset(amount, precision, symbol)
+}
+
+// 解析内置类型，不是内置类型时返回false
+func (reader *abiReader) readBuiltin(typeName string) (interface{}, bool) {
+	switch typeName {
+	case "bool":
+		return reader.readByte() != 0, true
+	case "int8":
+		return int64(int8(reader.readByte())), true
+	case "uint8":
+		return uint64(reader.readByte()), true
+	case "int16":
+		return int64(int16(reader.readUint16())), true
+	case "uint16":
+		return uint64(reader.readUint16()), true
+	case "int32":
+		return int64(int32(reader.readUint32())), true
+	case "uint32":
+		return uint64(reader.readUint32()), true
+	case "int64":
+		return int64(reader.readUint64()), true
+	case "uint64":
+		return reader.readUint64(), true
+	case "varuint32":
+		return reader.readVaruint32(), true
+	case "varint32":
+		value := reader.readVaruint32()
+		return int64(value >> 1) ^ -int64(value & 1), true
+	case "float32":
+		return float64(math.Float32frombits(reader.readUint32())), true
+	case "float64":
+		return math.Float64frombits(reader.readUint64()), true
+	case "int128", "uint128", "float128":
+		return hex.EncodeToString(reader.read(16)), true
+	case "checksum160":
+		return hex.EncodeToString(reader.read(20)), true
+	case "checksum256":
+		return hex.EncodeToString(reader.read(32)), true
+	case "checksum512":
+		return hex.EncodeToString(reader.read(64)), true
+	case "public_key":
+		return hex.EncodeToString(reader.read(34)), true
+	case "signature":
+		return hex.EncodeToString(reader.read(66)), true
+	case "name", "account_name", "action_name", "permission_name", "table_name", "scope_name":
+		return reader.readName(), true
+	case "string":
+		return reader.readString(), true
+	case "bytes":
+		length := reader.readVaruint32()
+		if length > uint64(reader.remaining()) {
+			reader.read(reader.remaining() + 1)
+			return "", true
+		}
+		return hex.EncodeToString(reader.read(int(length))), true
+	case "time_point":
+		microseconds := int64(reader.readUint64())
+		return time.Unix(0, microseconds * 1000).UTC().Format("2006-01-02T15:04:05.000"), true
+	case "time_point_sec", "time":
+		return time.Unix(int64(reader.readUint32()), 0).UTC().Format("2006-01-02T15:04:05"), true
+	case "block_timestamp_type":
+		// 块时间戳为2000-01-01 起的半秒数
+		halfSeconds := int64(reader.readUint32())
+		return time.Unix(946684800 + halfSeconds / 2, halfSeconds % 2 * 500000000).UTC().Format("2006-01-02T15:04:05.000"), true
+	case "symbol":
+		precision, symbol := reader.readSymbol()
+		return fmt.Sprintf("%d,%s", precision, symbol), true
+	case "symbol_code":
+		return symbolCode(reader.readUint64()), true
+	case "asset":
+		return reader.readAsset(), true
+	case "extended_asset":
+		quantity := reader.readAsset()
+		return map[string]interface{}{
+			"quantity":		quantity,
+			"contract":		reader.readName(),
+		}, true
+	}
+	return nil, false
+}
+
+// 货币名称：低位在前，每字节一个字符
+func symbolCode(value uint64) string {
+	var code []byte
+	for ; value > 0 && len(code) < 7; value >>= 8 {
+		code = append(code, byte(value & 0xff))
+	}
+	return string(code)
+}
+
+// 与eos.NewAsset 互逆，例如 12345, 4, EOS -> "1.2345 EOS"
+func formatAsset(amount int64, precision uint8, symbol string) string {
+	sign := ""
+	value := uint64(amount)
+	if amount < 0 {
+		sign = "-"
+		value = uint64(-amount)
+	}
+	digits := fmt.Sprintf("%0*d", int(precision) + 1, value)
+	if precision == 0 {
+		return sign + digits + " " + symbol
+	}
+	split := len(digits) - int(precision)
+	return sign + digits[:split] + "." + digits[split:] + " " + symbol
+}
@@ -0,0 +1,224 @@
+package eoswatcher
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/stretchr/testify/assert"
+)
+
+type abiWriter struct {
+	bytes.Buffer
+}
+
+func (writer *abiWriter) varuint32(value uint64) {
+	for value >= 0x80 {
+		writer.WriteByte(byte(value) | 0x80)
+		value >>= 7
+	}
+	writer.WriteByte(byte(value))
+}
+
+func (writer *abiWriter) str(value string) {
+	writer.varuint32(uint64(len(value)))
+	writer.WriteString(value)
+}
+
+func (writer *abiWriter) uint64(value uint64) {
+	binary.Write(writer, binary.LittleEndian, value)
+}
+
+func (writer *abiWriter) name(value string) {
+	name, _ := eos.StringToName(value)
+	writer.uint64(name)
+}
+
+func (writer *abiWriter) asset(amount int64, precision uint8, symbol string) {
+	writer.uint64(uint64(amount))
+	code := uint64(precision)
+	for i := 0; i < len(symbol); i++ {
+		code |= uint64(symbol[i]) << uint(8 * (i + 1))
+	}
+	writer.uint64(code)
+}
+
+// token 合约的transfer，memo 为typedef
+func newTokenABIBinary() []byte {
+	writer := &abiWriter{}
+	writer.str("eosio::abi/1.0")
+	writer.varuint32(1)
+	writer.str("memo_t")
+	writer.str("string")
+	writer.varuint32(1)
+	writer.str("transfer")
+	writer.str("")
+	writer.varuint32(4)
+	for _, field := range [][2]string{{"from", "account_name"}, {"to", "account_name"}, {"quantity", "asset"}, {"memo", "memo_t"}} {
+		writer.str(field[0])
+		writer.str(field[1])
+	}
+	writer.varuint32(1)
+	writer.name("transfer")
+	writer.str("transfer")
+	writer.str("")
+	// tables 等之后的部分不解析
+	writer.varuint32(0)
+	return writer.Bytes()
+}
+
+func newTransferBinary(from, to string, amount int64) []byte {
+	writer := &abiWriter{}
+	writer.name(from)
+	writer.name(to)
+	writer.asset(amount, 4, "EOS")
+	writer.str("memo")
+	return writer.Bytes()
+}
+
+func TestContractABIDecodeAction(t *testing.T) {
+	abi, err := ParseBinaryABI(newTokenABIBinary())
+	assert.Nil(t, err)
+	assert.Equal(t, eos.ActN("transfer"), abi.Actions[0].Name)
+
+	fields, err := abi.DecodeAction(eos.ActN("transfer"), newTransferBinary("alice1111111", "gateway11111", 12345))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"from":			"alice1111111",
+		"to":			"gateway11111",
+		"quantity":		"1.2345 EOS",
+		"memo":			"memo",
+	}, fields)
+
+	_, err = abi.DecodeAction(eos.ActN("transfer"), newTransferBinary("alice1111111", "gateway11111", 12345)[:20])
+	assert.NotNil(t, err)
+	_, err = abi.DecodeAction(eos.ActN("issue"), nil)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, "-0.0001 EOS", formatAsset(-1, 4, "EOS"))
+	assert.Equal(t, "12 SYS", formatAsset(12, 0, "SYS"))
+}
+
+func TestABICacheVersions(t *testing.T) {
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+
+	fetched := 0
+	current := &ContractABI{Version: "current"}
+	cache := NewABICache(db, func(account eos.AccountName) (*ContractABI, error) {
+		fetched++
+		return current, nil
+	})
+
+	abi, err := cache.ABIAt(eos.AN("eosio.token"), 100)
+	assert.Nil(t, err)
+	assert.Equal(t, "current", abi.Version)
+
+	assert.Nil(t, cache.SetABI(eos.AN("eosio.token"), 200, &ContractABI{Version: "v2"}))
+	assert.Equal(t, uint64(1), cache.Changes())
+	// 同样的版本不重复记录
+	assert.Nil(t, cache.SetABI(eos.AN("eosio.token"), 200, &ContractABI{Version: "v2"}))
+	assert.Equal(t, uint64(1), cache.Changes())
+
+	// 重启后从leveldb 读取，不再请求
+	cache = NewABICache(db, nil)
+	abi, err = cache.ABIAt(eos.AN("eosio.token"), 199)
+	assert.Nil(t, err)
+	assert.Equal(t, "current", abi.Version)
+	abi, err = cache.ABIAt(eos.AN("eosio.token"), 200)
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", abi.Version)
+	assert.Equal(t, 1, fetched)
+
+	// ABI 解析出的字段交给DecodeJSON，网关转出为完成提现
+	abi, err = ParseBinaryABI(newTokenABIBinary())
+	assert.Nil(t, err)
+	ctx := &ActionDecodeContext{
+		Gateway:		eos.AN("gateway11111"),
+		TokenContract:	&TokenContract{Symbol: "EOS", Precision: 4},
+		ABI:			abi,
+	}
+	action := &eos.Action{Account: eos.AN("eosio.token"), Name: eos.ActN("transfer")}
+	action.ActionData.HexData = newTransferBinary("alice1111111", "gateway11111", 12345)
+	eosPushEvent, err := NewActionDecoderRegistry().Decode(action, ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(12345), eosPushEvent.Amount)
+	assert.Equal(t, "alice1111111", eosPushEvent.GetFrom())
+
+	action.ActionData.HexData = newTransferBinary("gateway11111", "alice1111111", 12345)
+	eosPushEvent, err = NewActionDecoderRegistry().Decode(action, ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, EventTypeWithdrawalConfirmed, eosPushEvent.GetEventType())
+
+	action.ActionData.HexData = newTransferBinary("alice1111111", "bob111111111", 12345)
+	_, err = NewActionDecoderRegistry().Decode(action, ctx)
+	assert.NotNil(t, err)
+}
+
+func TestABICacheConcurrentFetch(t *testing.T) {
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+
+	// 获取ABI 期间不持有锁，同一合约只请求一次
+	var lock sync.Mutex
+	fetched := 0
+	release := make(chan struct{})
+	cache := NewABICache(db, func(account eos.AccountName) (*ContractABI, error) {
+		lock.Lock()
+		fetched++
+		lock.Unlock()
+		<-release
+		return &ContractABI{Version: "current"}, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			abi, err := cache.ABIAt(eos.AN("eosio.token"), 100)
+			assert.Nil(t, err)
+			assert.Equal(t, "current", abi.Version)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	changes := make(chan uint64)
+	go func() { changes <- cache.Changes() }()
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Error("cache locked while fetching abi")
+	}
+	close(release)
+	wg.Wait()
+	assert.Equal(t, 1, fetched)
+}
+
+func TestRecordSetABIIrreversibleOnly(t *testing.T) {
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+
+	ew := &EOSWatcherMain{
+		DB:					db,
+		Gateway:			eos.AN("gateway11111"),
+		ActionDecoders:		NewActionDecoderRegistry(),
+		TokenContracts:		[]*TokenContract{{ActionAccount: eos.AN("eosio.token"), ActionNameDestroy: eos.ActN("transfer"), Symbol: "EOS", Precision: 4}},
+	}
+	ew.ABIs = NewABICache(db, func(account eos.AccountName) (*ContractABI, error) {
+		return &ContractABI{Version: "current"}, nil
+	})
+	setABI := newTrace(1, "eosio", "eosio", "setabi")
+	setABI.Action.ActionData.Data = map[string]interface{}{"account": "eosio.token", "abi": hex.EncodeToString(newTokenABIBinary())}
+	transactionResp := &eos.TransactionResp{BlockNum: 200}
+	transactionResp.Traces = []eos.ActionTrace{setABI}
+
+	// 可能还未不可逆的交易（分叉跟踪、按txid 查询），不记录
+	ew.TraceEOSPushEvents(transactionResp, 0, 0, false)
+	assert.Equal(t, uint64(0), ew.ABIs.Changes())
+	ew.traceEOSPushEvents(transactionResp, 0, 0, false, ew.watchedAccounts(), true)
+	assert.Equal(t, uint64(1), ew.ABIs.Changes())
+}
@@ -0,0 +1,288 @@
+package eoswatcher
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/eoscanada/eos-go"
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leveldb 中ABI 的key 前缀，完整key 为 前缀 + 合约名/生效块高（10 位，补0）
+const abiKeyPrefix = "ABI/"
+
+// 从链上获取ABI 失败后，间隔这么久再重试
+const abiFetchRetryInterval = time.Minute
+
+// 合约从某个块高开始生效的ABI
+type abiVersion struct {
+	BlockNum			uint32
+	ABI					*ContractABI
+}
+
+// 一次从链上获取ABI 的请求，done 关闭后versions、err 可读
+type abiFetch struct {
+	done				chan struct{}
+	versions			[]*abiVersion
+	err					error
+}
+
+// 合约ABI 缓存：启动后第一次用到合约时从链上获取当前ABI（作为块高0 的版本），
+// 之后扫到的setabi 按块高记录新版本，解析action 时使用该块高生效的版本。 所有版本保存在leveldb 中，重启后不再请求
+type ABICache struct {
+	lock				sync.RWMutex
+	db					*leveldb.DB
+	// 从链上获取当前ABI
+	fetch				func(account eos.AccountName) (*ContractABI, error)
+	versions			map[eos.AccountName][]*abiVersion
+	// 获取失败的时间，重试间隔内不再请求
+	fetchFailed			map[eos.AccountName]time.Time
+	// 正在从链上获取的合约，同一合约只请求一次，其他协程等待结果
+	fetching			map[eos.AccountName]*abiFetch
+	// 记录新版本的次数，见Changes
+	changes				uint64
+}
+
+func NewABICache(db *leveldb.DB, fetch func(account eos.AccountName) (*ContractABI, error)) *ABICache {
+	return &ABICache{
+		db:				db,
+		fetch:			fetch,
+		versions:		make(map[eos.AccountName][]*abiVersion),
+		fetchFailed:	make(map[eos.AccountName]time.Time),
+		fetching:		make(map[eos.AccountName]*abiFetch),
+	}
+}
+
+func abiKey(account eos.AccountName, blockNum uint32) []byte {
+	return []byte(fmt.Sprintf("%s%s/%010d", abiKeyPrefix, account, blockNum))
+}
+
+// 合约在blockNum 生效的ABI。 块高早于所有版本时，使用最早的版本
+func (cache *ABICache) ABIAt(account eos.AccountName, blockNum uint32) (*ContractABI, error) {
+	versions, err := cache.load(account)
+	if err != nil {
+		return nil, err
+	}
+	index := sort.Search(len(versions), func(i int) bool {
+		return versions[i].BlockNum > blockNum
+	})
+	if index == 0 {
+		return versions[0].ABI, nil
+	}
+	return versions[index - 1].ABI, nil
+}
+
+// 记录合约从blockNum 开始生效的ABI。 同一块高已有版本时覆盖
+func (cache *ABICache) SetABI(account eos.AccountName, blockNum uint32, abi *ContractABI) error {
+	// 没有基础版本时先获取，否则之前的块会使用新版本
+	if _, err := cache.load(account); err != nil {
+		log.Error("fetch eos abi err", "Account", account, "info", err)
+	}
+
+	data, err := json.Marshal(abi)
+	if err != nil {
+		return err
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if previous, err := cache.db.Get(abiKey(account, blockNum), nil); err == nil && string(previous) == string(data) {
+		return nil
+	}
+	if err := cache.db.Put(abiKey(account, blockNum), data, nil); err != nil {
+		return err
+	}
+	if versions, ok := cache.versions[account]; ok {
+		cache.versions[account] = insertABIVersion(versions, &abiVersion{BlockNum: blockNum, ABI: abi})
+	}
+	cache.changes++
+	log.Info("EOS contract abi updated", "Account", account, "BlockNum", blockNum)
+	return nil
+}
+
+// 记录新版本的次数。 扫块时一个块解析前后次数不同，说明其间有新的ABI，需要重新解析
+func (cache *ABICache) Changes() uint64 {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	return cache.changes
+}
+
+// 读取合约的所有版本，leveldb 中没有时从链上获取。 请求链上时不持有锁，同一合约同时只请求一次
+func (cache *ABICache) load(account eos.AccountName) ([]*abiVersion, error) {
+	cache.lock.RLock()
+	versions, ok := cache.versions[account]
+	cache.lock.RUnlock()
+	if ok {
+		return versions, nil
+	}
+
+	cache.lock.Lock()
+	if versions, ok := cache.versions[account]; ok {
+		cache.lock.Unlock()
+		return versions, nil
+	}
+	if call, ok := cache.fetching[account]; ok {
+		cache.lock.Unlock()
+		<-call.done
+		return call.versions, call.err
+	}
+	versions, err := cache.read(account)
+	if err != nil || len(versions) > 0 {
+		if err == nil {
+			cache.versions[account] = versions
+		}
+		cache.lock.Unlock()
+		return versions, err
+	}
+	if failed, ok := cache.fetchFailed[account]; ok && time.Since(failed) < abiFetchRetryInterval {
+		cache.lock.Unlock()
+		return nil, errors.New("EOS contract '" + string(account) + "' abi not available.")
+	}
+	call := &abiFetch{done: make(chan struct{})}
+	cache.fetching[account] = call
+	cache.lock.Unlock()
+
+	call.versions, call.err = cache.fetchBase(account)
+
+	cache.lock.Lock()
+	delete(cache.fetching, account)
+	if call.err != nil {
+		cache.fetchFailed[account] = time.Now()
+	} else {
+		delete(cache.fetchFailed, account)
+		cache.versions[account] = call.versions
+	}
+	cache.lock.Unlock()
+	close(call.done)
+	return call.versions, call.err
+}
+
+// 从链上获取当前ABI，作为块高0 的版本写入leveldb，返回leveldb 中的所有版本（请求期间可能记录了新的setabi）
+func (cache *ABICache) fetchBase(account eos.AccountName) ([]*abiVersion, error) {
+	abi, err := cache.fetch(account)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(abi)
+	if err != nil {
+		return nil, err
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if err := cache.db.Put(abiKey(account, 0), data, nil); err != nil {
+		return nil, err
+	}
+	return cache.read(account)
+}
+
+// 从leveldb 读取合约的所有版本，按块高排序
+func (cache *ABICache) read(account eos.AccountName) ([]*abiVersion, error) {
+	prefix := abiKeyPrefix + string(account) + "/"
+	iter := cache.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+
+	var versions []*abiVersion
+	for iter.Next() {
+		blockNum, err := strconv.ParseUint(strings.TrimPrefix(string(iter.Key()), prefix), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		var abi ContractABI
+		if err := json.Unmarshal(iter.Value(), &abi); err != nil {
+			return nil, err
+		}
+		versions = insertABIVersion(versions, &abiVersion{BlockNum: uint32(blockNum), ABI: &abi})
+	}
+	return versions, iter.Error()
+}
+
+// 按块高插入（不修改原列表），同一块高时替换
+func insertABIVersion(versions []*abiVersion, version *abiVersion) []*abiVersion {
+	inserted := make([]*abiVersion, 0, len(versions) + 1)
+	for _, previous := range versions {
+		if previous.BlockNum != version.BlockNum {
+			inserted = append(inserted, previous)
+		}
+	}
+	inserted = append(inserted, version)
+	sort.Slice(inserted, func(i, j int) bool {
+		return inserted[i].BlockNum < inserted[j].BlockNum
+	})
+	return inserted
+}
+
+// 扫到eosio::setabi 时调用，记录监控合约的新ABI。 扫块时data 为二进制数据，查询交易时为json（abi 为hex 字符串）
+func (ew *EOSWatcherMain) recordSetABI(action *eos.Action, blockNum uint32, accounts []*WatchedAccount) {
+	if ew.ABIs == nil || action.Account != eos.AN("eosio") || action.Name != eos.ActN("setabi") {
+		return
+	}
+
+	var account eos.AccountName
+	var abiData []byte
+	if data, ok := action.ActionData.Data.(map[string]interface{}); ok {
+		name, _ := data["account"].(string)
+		hexABI, _ := data["abi"].(string)
+		decoded, err := hex.DecodeString(hexABI)
+		if err != nil {
+			log.Error("decode eos setabi err", "BlockNum", blockNum, "info", err)
+			return
+		}
+		account, abiData = eos.AN(name), decoded
+	} else {
+		reader := &abiReader{data: action.ActionData.HexData}
+		account = eos.AN(reader.readName())
+		abiData = reader.read(int(reader.readVaruint32()))
+		if reader.err != nil {
+			log.Error("decode eos setabi err", "BlockNum", blockNum, "info", reader.err)
+			return
+		}
+	}
+	if !isWatchedContract(accounts, account) {
+		return
+	}
+
+	abi, err := ParseBinaryABI(abiData)
+	if err != nil {
+		log.Error("parse eos setabi err", "Account", account, "BlockNum", blockNum, "info", err)
+		return
+	}
+	if err := ew.ABIs.SetABI(account, blockNum, abi); err != nil {
+		log.Error("write eos leveldb abi err", "Account", account, "BlockNum", blockNum, "info", err)
+	}
+}
+
+// 解析action 使用的ABI：数据为二进制、且合约ABI 可用时返回，否则返回nil，使用内置的结构体解析
+func (ew *EOSWatcherMain) actionABI(action *eos.Action, blockNum uint32) *ContractABI {
+	if ew.ABIs == nil || len(action.ActionData.HexData) == 0 {
+		return nil
+	}
+	if _, ok := action.ActionData.Data.(map[string]interface{}); ok {
+		return nil
+	}
+	abi, err := ew.ABIs.ABIAt(action.Account, blockNum)
+	if err != nil {
+		log.Debug("EOS contract abi not available", "Account", action.Account, "info", err)
+		return nil
+	}
+	return abi
+}
+
+// 是否是监控账户配置的合约
+func isWatchedContract(accounts []*WatchedAccount, account eos.AccountName) bool {
+	for _, watchedAccount := range accounts {
+		for _, tokenContract := range watchedAccount.TokenContracts {
+			if tokenContract.ActionAccount == account {
+				return true
+			}
+		}
+	}
+	return false
+}
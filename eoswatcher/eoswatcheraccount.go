@@ -0,0 +1,240 @@
+package eoswatcher
+
+import (
+	"github.com/eoscanada/eos-go"
+	"github.com/fsnotify/fsnotify"
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// 监控的收款账户（冷、热钱包等），每个账户有自己的合约、方法列表
+type WatchedAccount struct {
+	// 账户名，转给该账户的转账为溶币
+	Account				eos.AccountName			`mapstructure:"account"`
+	// 该账户监控的合约、方法列表
+	TokenContracts		[]*TokenContract		`mapstructure:"token_contracts"`
+}
+
+// 从viper 配置中读取监控账户列表，key 下为数组，例如：
+//	[[EOS.watched_accounts]]
+//	account = "gatewayhot11"
+//	[[EOS.watched_accounts.token_contracts]]
+//	action_account = "eosio.token"
+//	action_name_destroy = "transfer"
+//	symbol = "EOS"
+//	precision = 4
+//	start_block = 12000000
+func LoadWatchedAccounts(key string) ([]*WatchedAccount, error) {
+	var accounts []*WatchedAccount
+	if err := viper.UnmarshalKey(key, &accounts); err != nil {
+		return nil, err
+	}
+	if err := checkWatchedAccounts(accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// 检查监控账户配置：账户名不能为空、不能重复，同一账户下 合约+货币 不能重复
+func checkWatchedAccounts(accounts []*WatchedAccount) error {
+	seen := make(map[eos.AccountName]bool)
+	for _, account := range accounts {
+		if account.Account == "" {
+			return errors.New("Watched account name is empty.")
+		}
+		if seen[account.Account] {
+			return errors.New("Watched account '" + string(account.Account) + "' is duplicated.")
+		}
+		seen[account.Account] = true
+		contracts := make(map[string]bool)
+		for _, tokenContract := range account.TokenContracts {
+			if tokenContract.ActionAccount == "" || tokenContract.Symbol == "" {
+				return errors.New("Token contract of '" + string(account.Account) + "' needs action account and symbol.")
+			}
+			if contracts[tokenContract.key()] {
+				return errors.New("Token contract '" + tokenContract.key() + "' of '" + string(account.Account) + "' is duplicated.")
+			}
+			contracts[tokenContract.key()] = true
+			if tokenContract.MemoSchema == nil {
+				continue
+			}
+			if err := tokenContract.MemoSchema.Check(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 合约在账户下的唯一标识：合约名/货币名称
+func (tokenContract *TokenContract) key() string {
+	return string(tokenContract.ActionAccount) + "/" + tokenContract.Symbol
+}
+
+// 增加监控账户，账户已存在时替换它的合约列表。 运行中也可以调用，新合约不回溯扫描，需要时使用AddTokenContract
+func (ew *EOSWatcherMain) AddWatchedAccount(account string, tokenContracts []*TokenContract) error {
+	return ew.updateWatchedAccounts(func(accounts []*WatchedAccount) ([]*WatchedAccount, error) {
+		return replaceWatchedAccount(accounts, &WatchedAccount{
+			Account:			eos.AN(account),
+			TokenContracts:		tokenContracts,
+		}), nil
+	}, false)
+}
+
+// 当前监控账户的快照。 返回的列表和其中的配置不会再被修改，需要修改时使用SetWatchedAccounts 等方法
+func (ew *EOSWatcherMain) GetWatchedAccounts() []*WatchedAccount {
+	return ew.watchedAccounts()
+}
+
+// 替换全部监控账户，运行中立即生效（正在扫描的块仍使用旧配置）。
+// backfill 为true 时，新增的、配置了StartBlock 的合约从StartBlock 回溯扫描到当前不可逆块，见Backfill
+func (ew *EOSWatcherMain) SetWatchedAccounts(accounts []*WatchedAccount, backfill bool) error {
+	return ew.updateWatchedAccounts(func([]*WatchedAccount) ([]*WatchedAccount, error) {
+		return accounts, nil
+	}, backfill)
+}
+
+// 给账户增加或替换（合约名、货币名称相同）一个合约，账户不存在时新增账户
+func (ew *EOSWatcherMain) AddTokenContract(account string, tokenContract *TokenContract, backfill bool) error {
+	return ew.updateWatchedAccounts(func(accounts []*WatchedAccount) ([]*WatchedAccount, error) {
+		watchedAccount := &WatchedAccount{Account: eos.AN(account)}
+		if previous := findWatchedAccount(accounts, eos.AN(account)); previous != nil {
+			watchedAccount.TokenContracts = previous.withoutTokenContract(tokenContract.key())
+		}
+		watchedAccount.TokenContracts = append(watchedAccount.TokenContracts, tokenContract)
+		return replaceWatchedAccount(accounts, watchedAccount), nil
+	}, backfill)
+}
+
+// 删除账户下的一个合约
+func (ew *EOSWatcherMain) RemoveTokenContract(account, actionAccount, symbol string) error {
+	key := (&TokenContract{ActionAccount: eos.AN(actionAccount), Symbol: symbol}).key()
+	return ew.updateWatchedAccounts(func(accounts []*WatchedAccount) ([]*WatchedAccount, error) {
+		previous := findWatchedAccount(accounts, eos.AN(account))
+		if previous == nil || previous.findTokenContract(key) == nil {
+			return nil, errors.New("Token contract '" + key + "' of '" + account + "' not found.")
+		}
+		return replaceWatchedAccount(accounts, &WatchedAccount{
+			Account:			previous.Account,
+			TokenContracts:		previous.withoutTokenContract(key),
+		}), nil
+	}, false)
+}
+
+// 在锁内根据当前配置生成新配置并替换，之后对新增的合约回溯扫描
+func (ew *EOSWatcherMain) updateWatchedAccounts(update func([]*WatchedAccount) ([]*WatchedAccount, error), backfill bool) error {
+	ew.accountsLock.Lock()
+	previous := ew.currentWatchedAccounts()
+	accounts, err := update(previous)
+	if err == nil {
+		err = checkWatchedAccounts(accounts)
+	}
+	if err != nil {
+		ew.accountsLock.Unlock()
+		return err
+	}
+	ew.WatchedAccounts = accounts
+	ew.accountsLock.Unlock()
+	log.Info("EOS watched accounts updated", "accounts", len(accounts))
+
+	if !backfill {
+		return nil
+	}
+	for _, account := range accounts {
+		previousAccount := findWatchedAccount(previous, account.Account)
+		for _, tokenContract := range account.TokenContracts {
+			if tokenContract.StartBlock == 0 {
+				continue
+			}
+			if previousAccount != nil && previousAccount.findTokenContract(tokenContract.key()) != nil {
+				continue
+			}
+			if err := ew.Backfill(account.Account, tokenContract); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 重新读取配置中的监控账户，见LoadWatchedAccounts
+func (ew *EOSWatcherMain) ReloadWatchedAccounts(key string, backfill bool) error {
+	accounts, err := LoadWatchedAccounts(key)
+	if err != nil {
+		return err
+	}
+	return ew.SetWatchedAccounts(accounts, backfill)
+}
+
+// 监听配置文件，修改后重新读取监控账户，新增的合约回溯扫描。 读取失败时保留原配置
+func (ew *EOSWatcherMain) WatchAccountsConfig(key string) {
+	viper.OnConfigChange(func(in fsnotify.Event) {
+		if err := ew.ReloadWatchedAccounts(key, true); err != nil {
+			log.Error("reload eos watched accounts err", "file", in.Name, "info", err)
+		}
+	})
+	viper.WatchConfig()
+}
+
+// 实际监控的账户：没有配置WatchedAccounts 时，只监控Gateway，使用TokenContracts
+func (ew *EOSWatcherMain) watchedAccounts() []*WatchedAccount {
+	ew.accountsLock.RLock()
+	defer ew.accountsLock.RUnlock()
+	return ew.currentWatchedAccounts()
+}
+
+// 调用前需要持有锁
+func (ew *EOSWatcherMain) currentWatchedAccounts() []*WatchedAccount {
+	if len(ew.WatchedAccounts) > 0 {
+		return ew.WatchedAccounts
+	}
+	return []*WatchedAccount{{Account: ew.Gateway, TokenContracts: ew.TokenContracts}}
+}
+
+// 返回替换（或追加）了watchedAccount 的新列表，不修改原列表
+func replaceWatchedAccount(accounts []*WatchedAccount, watchedAccount *WatchedAccount) []*WatchedAccount {
+	replaced := make([]*WatchedAccount, 0, len(accounts) + 1)
+	found := false
+	for _, account := range accounts {
+		if account.Account == watchedAccount.Account {
+			replaced = append(replaced, watchedAccount)
+			found = true
+		} else {
+			replaced = append(replaced, account)
+		}
+	}
+	if !found {
+		replaced = append(replaced, watchedAccount)
+	}
+	return replaced
+}
+
+func findWatchedAccount(accounts []*WatchedAccount, account eos.AccountName) *WatchedAccount {
+	for _, watchedAccount := range accounts {
+		if watchedAccount.Account == account {
+			return watchedAccount
+		}
+	}
+	return nil
+}
+
+// 去掉key 对应合约后的合约列表（新列表）
+func (watchedAccount *WatchedAccount) withoutTokenContract(key string) []*TokenContract {
+	var tokenContracts []*TokenContract
+	for _, tokenContract := range watchedAccount.TokenContracts {
+		if tokenContract.key() != key {
+			tokenContracts = append(tokenContracts, tokenContract)
+		}
+	}
+	return tokenContracts
+}
+
+func (watchedAccount *WatchedAccount) findTokenContract(key string) *TokenContract {
+	for _, tokenContract := range watchedAccount.TokenContracts {
+		if tokenContract.key() == key {
+			return tokenContract
+		}
+	}
+	return nil
+}
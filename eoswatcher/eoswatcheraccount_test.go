@@ -0,0 +1,105 @@
+package eoswatcher
+
+import (
+	"testing"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/eoscanada/eos-go/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func newWatchedTransfer(from, to, quantity string) *eos.Action {
+	asset, _ := eos.NewAsset(quantity)
+	action := &eos.Action{Account: eos.AN("eosio.token"), Name: eos.ActN("transfer")}
+	action.ActionData.Data = &token.Transfer{
+		From:		eos.AN(from),
+		To:			eos.AN(to),
+		Quantity:	asset,
+		Memo:		"memo",
+	}
+	return action
+}
+
+func TestParseTokenActionWatchedAccounts(t *testing.T) {
+	eosContract := &TokenContract{ActionAccount: eos.AN("eosio.token"), ActionNameDestroy: eos.ActN("transfer"), Symbol: "EOS", Precision: 4, Business: "hot"}
+	coldContract := &TokenContract{ActionAccount: eos.AN("eosio.token"), ActionNameDestroy: eos.ActN("transfer"), Symbol: "EOS", Precision: 4, Business: "cold"}
+	ew := &EOSWatcherMain{
+		Gateway:			eos.AN("gateway11111"),
+		TokenContracts:		[]*TokenContract{eosContract},
+		ActionDecoders:		NewActionDecoderRegistry(),
+	}
+
+	// 没有配置监控账户时，只监控Gateway
+	eosPushEvent := ew.ParseTokenAction(newWatchedTransfer("alice1111111", "gateway11111", "1.0000 EOS"), false)
+	assert.NotNil(t, eosPushEvent)
+	assert.Equal(t, "gateway11111", eosPushEvent.GetWatchedAccount())
+	assert.Nil(t, ew.ParseTokenAction(newWatchedTransfer("alice1111111", "gatewaycold1", "1.0000 EOS"), false))
+
+	assert.Nil(t, ew.AddWatchedAccount("gateway11111", []*TokenContract{eosContract}))
+	assert.Nil(t, ew.AddWatchedAccount("gatewaycold1", []*TokenContract{coldContract}))
+
+	eosPushEvent = ew.ParseTokenAction(newWatchedTransfer("alice1111111", "gatewaycold1", "1.0000 EOS"), false)
+	assert.NotNil(t, eosPushEvent)
+	assert.Equal(t, "gatewaycold1", eosPushEvent.GetWatchedAccount())
+	assert.Equal(t, "cold", eosPushEvent.GetBusiness())
+	assert.Equal(t, EventTypeDeposit, eosPushEvent.GetEventType())
+
+	// 监控账户之间的转账，作为收款账户的溶币事件
+	data := map[string]interface{}{"from": "gateway11111", "to": "gatewaycold1", "quantity": "1.0000 EOS", "memo": "memo"}
+	action := &eos.Action{Account: eos.AN("eosio.token"), Name: eos.ActN("transfer")}
+	action.ActionData.Data = data
+	eosPushEvent = ew.ParseTokenAction(action, true)
+	assert.Equal(t, "gatewaycold1", eosPushEvent.GetWatchedAccount())
+	assert.Equal(t, EventTypeDeposit, eosPushEvent.GetEventType())
+
+	// 转出到外部账户为提现
+	data["to"] = "alice1111111"
+	eosPushEvent = ew.ParseTokenAction(action, true)
+	assert.Equal(t, "gateway11111", eosPushEvent.GetWatchedAccount())
+	assert.Equal(t, EventTypeWithdrawalConfirmed, eosPushEvent.GetEventType())
+
+	assert.True(t, ew.isWatchedAccountTransfer(newWatchedTransfer("alice1111111", "gatewaycold1", "1.0000 EOS")))
+	assert.True(t, ew.isWatchedAccountTransfer(newWatchedTransfer("gatewaycold1", "alice1111111", "1.0000 EOS")))
+	assert.False(t, ew.isWatchedAccountTransfer(newWatchedTransfer("alice1111111", "bob111111111", "1.0000 EOS")))
+
+	// 扫块时网关转出的二进制转账也作为提现事件
+	eosPushEvent = ew.parseTokenAction(newWatchedTransfer("gatewaycold1", "alice1111111", "1.0000 EOS"), false, ew.watchedAccounts(), 0)
+	assert.NotNil(t, eosPushEvent)
+	assert.Equal(t, "gatewaycold1", eosPushEvent.GetWatchedAccount())
+	assert.Equal(t, "gatewaycold1", eosPushEvent.GetFrom())
+	assert.Equal(t, EventTypeWithdrawalConfirmed, eosPushEvent.GetEventType())
+	assert.Nil(t, ew.parseTokenAction(newWatchedTransfer("alice1111111", "bob111111111", "1.0000 EOS"), false, ew.watchedAccounts(), 0))
+}
+
+func TestUpdateWatchedAccounts(t *testing.T) {
+	eosContract := &TokenContract{ActionAccount: eos.AN("eosio.token"), ActionNameDestroy: eos.ActN("transfer"), Symbol: "EOS", Precision: 4}
+	ew := &EOSWatcherMain{
+		Gateway:			eos.AN("gateway11111"),
+		TokenContracts:		[]*TokenContract{eosContract},
+		ActionDecoders:		NewActionDecoderRegistry(),
+	}
+	snapshot := ew.GetWatchedAccounts()
+
+	// 新增合约不影响已取出的快照
+	wbtcContract := &TokenContract{ActionAccount: eos.AN("gatewaytoken"), ActionNameDestroy: eos.ActN("transfer"), Symbol: "WBTC", Precision: 8}
+	assert.Nil(t, ew.AddTokenContract("gateway11111", wbtcContract, false))
+	assert.Len(t, snapshot[0].TokenContracts, 1)
+	accounts := ew.GetWatchedAccounts()
+	assert.Len(t, accounts, 1)
+	assert.Len(t, accounts[0].TokenContracts, 2)
+	wbtcTransfer := newWatchedTransfer("alice1111111", "gateway11111", "1.00000000 WBTC")
+	wbtcTransfer.Account = eos.AN("gatewaytoken")
+	assert.NotNil(t, ew.ParseTokenAction(wbtcTransfer, false))
+
+	// 替换同一合约
+	assert.Nil(t, ew.AddTokenContract("gateway11111", &TokenContract{ActionAccount: eos.AN("gatewaytoken"), ActionNameDestroy: eos.ActN("transfer"), Symbol: "WBTC", Precision: 8, Business: "btc"}, false))
+	assert.Len(t, ew.GetWatchedAccounts()[0].TokenContracts, 2)
+
+	assert.Nil(t, ew.RemoveTokenContract("gateway11111", "gatewaytoken", "WBTC"))
+	assert.NotNil(t, ew.RemoveTokenContract("gateway11111", "gatewaytoken", "WBTC"))
+	assert.Nil(t, ew.ParseTokenAction(wbtcTransfer, false))
+
+	// 配置错误时保留原配置
+	assert.NotNil(t, ew.SetWatchedAccounts([]*WatchedAccount{{Account: eos.AN("gateway11111")}, {Account: eos.AN("gateway11111")}}, false))
+	assert.Len(t, ew.GetWatchedAccounts()[0].TokenContracts, 1)
+}
@@ -0,0 +1,251 @@
+package eoswatcher
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 查询、管理API：
+//   GET  /v1/status                           扫块高度、不可逆块、落后块数、是否暂停
+//   GET  /v1/contracts                        监控账户及其合约
+//   GET  /v1/events?txid=                     交易的事件，没有交付过时从链上查询（GetEventByTxid），
+//                                             require_executed=true、require_irreversible=true 时拒绝未执行成功、未不可逆的交易
+//   GET  /v1/events?from=&to=&account=&limit= 块高在[from, to) 内已交付的事件，account 不为空时只返回该账户的事件
+//   POST /v1/admin/pause                      暂停扫块
+//   POST /v1/admin/resume                     恢复扫块
+//   POST /v1/admin/scan_height                设置扫块高度（需先暂停），body 为 {"height": 块高}
+//   GET  /v1/admin/rescan                     所有重新扫描任务及进度
+//   POST /v1/admin/rescan                     重新扫描[from, to) 的块（Rescan），body 为 {"from": 块高, "to": 块高, "contracts": ["合约名/货币名称"]}
+// 所有请求需要 Authorization: Bearer <token>
+type watcherAPI struct {
+	ew					*EOSWatcherMain
+	token				string
+}
+
+// 监听addr 提供查询、管理API，token 不能为空。 地址被占用等错误直接返回，之后的错误只记录日志
+func (ew *EOSWatcherMain) ServeAPI(addr, token string) (*http.Server, error) {
+	if token == "" {
+		return nil, errors.New("API token is empty.")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Addr: addr, Handler: ew.APIHandler(token)}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error("eos watcher api server stopped", "addr", addr, "err", err)
+		}
+	}()
+	return server, nil
+}
+
+// 查询、管理API 的handler，可以挂到已有的http 服务上
+func (ew *EOSWatcherMain) APIHandler(token string) http.Handler {
+	api := &watcherAPI{ew: ew, token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", api.method("GET", api.status))
+	mux.HandleFunc("/v1/contracts", api.method("GET", api.contracts))
+	mux.HandleFunc("/v1/events", api.method("GET", api.events))
+	mux.HandleFunc("/v1/admin/pause", api.method("POST", api.pause))
+	mux.HandleFunc("/v1/admin/resume", api.method("POST", api.resume))
+	mux.HandleFunc("/v1/admin/scan_height", api.method("POST", api.scanHeight))
+	mux.HandleFunc("/v1/admin/rescan", api.rescan)
+	return api.authorize(mux)
+}
+
+func (api *watcherAPI) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(api.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, errors.New("Unauthorized."))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (api *watcherAPI) method(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeAPIError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed."))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("write eos watcher api response err", "info", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeAPIJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (api *watcherAPI) status(w http.ResponseWriter, r *http.Request) {
+	writeAPIJSON(w, http.StatusOK, api.ew.Status())
+}
+
+func (api *watcherAPI) contracts(w http.ResponseWriter, r *http.Request) {
+	// TokenContracts 运行中可能被替换，只返回加锁取得的监控账户快照（未配置时为网关及其TokenContracts）
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"watched_accounts":		api.ew.GetWatchedAccounts(),
+	})
+}
+
+func (api *watcherAPI) events(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if txid := query.Get("txid"); txid != "" {
+		api.txEvents(w, txid, &TxQueryOptions{
+			RequireExecuted:		query.Get("require_executed") == "true",
+			RequireIrreversible:	query.Get("require_irreversible") == "true",
+		})
+		return
+	}
+
+	from, err := parseUint32Param(query.Get("from"), 0)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	to, err := parseUint32Param(query.Get("to"), math.MaxUint32)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if query.Get("limit") != "" && err != nil {
+		writeAPIError(w, http.StatusBadRequest, errors.New("Invalid limit."))
+		return
+	}
+
+	var events []*WebhookEvent
+	if account := query.Get("account"); account != "" {
+		events, err = api.ew.GetAccountEvents(account, from, to, limit)
+	} else {
+		events, err = api.ew.GetEvents(from, to, limit)
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{"events": nonNilEvents(events)})
+}
+
+// 先查已交付的事件，没有时从链上查询
+func (api *watcherAPI) txEvents(w http.ResponseWriter, txid string, options *TxQueryOptions) {
+	events, err := api.ew.GetDeliveredEvents(txid)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(events) > 0 {
+		writeAPIJSON(w, http.StatusOK, map[string]interface{}{"events": events, "delivered": true})
+		return
+	}
+
+	eosPushEvents, err := api.ew.GetEventByTxidWithOptions(txid, options)
+	switch err.(type) {
+	case nil:
+	case *TxNotExecutedError, *TxNotIrreversibleError, *TxNotInBlockError:
+		writeAPIError(w, http.StatusConflict, err)
+		return
+	default:
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	for _, eosPushEvent := range eosPushEvents {
+		events = append(events, NewWebhookEvent(eosPushEvent))
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{"events": events, "delivered": false})
+}
+
+func nonNilEvents(events []*WebhookEvent) []*WebhookEvent {
+	if events == nil {
+		return []*WebhookEvent{}
+	}
+	return events
+}
+
+func parseUint32Param(value string, defaultValue uint32) (uint32, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, errors.New("Invalid block height '" + value + "'.")
+	}
+	return uint32(parsed), nil
+}
+
+func (api *watcherAPI) pause(w http.ResponseWriter, r *http.Request) {
+	api.ew.PauseScan()
+	writeAPIJSON(w, http.StatusOK, api.ew.Status())
+}
+
+func (api *watcherAPI) resume(w http.ResponseWriter, r *http.Request) {
+	api.ew.ResumeScan()
+	writeAPIJSON(w, http.StatusOK, api.ew.Status())
+}
+
+func (api *watcherAPI) scanHeight(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Height			uint32			`json:"height"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := api.ew.SetScanHeight(body.Height); err != nil {
+		writeAPIError(w, http.StatusConflict, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, api.ew.Status())
+}
+
+func (api *watcherAPI) rescan(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		tasks, err := api.ew.GetRescanTasks()
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if tasks == nil {
+			tasks = []*RescanTask{}
+		}
+		writeAPIJSON(w, http.StatusOK, map[string]interface{}{"tasks": tasks})
+	case "POST":
+		var body struct {
+			From			uint32			`json:"from"`
+			To				uint32			`json:"to"`
+			Contracts		[]string		`json:"contracts"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		task, err := api.ew.Rescan(body.From, body.To, body.Contracts)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeAPIJSON(w, http.StatusOK, task)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed."))
+	}
+}
@@ -0,0 +1,98 @@
+package eoswatcher
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func apiRequest(t *testing.T, server *httptest.Server, method, path, token, body string, out interface{}) int {
+	req, err := http.NewRequest(method, server.URL + path, strings.NewReader(body))
+	assert.Nil(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer " + token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	if out != nil {
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(out))
+	}
+	return resp.StatusCode
+}
+
+func TestWatcherAPI(t *testing.T) {
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+
+	ew := &EOSWatcherMain{
+		Gateway:					eos.AN("gateway11111"),
+		TokenContracts:				[]*TokenContract{{ActionAccount: eos.AN("eosio.token"), Symbol: "EOS", Precision: 4}},
+		LastIrreversibleBlockNum:	120,
+		DB:							db,
+		committedBlockHeight:		100,
+	}
+	server := httptest.NewServer(ew.APIHandler("secret"))
+	defer server.Close()
+
+	assert.Equal(t, http.StatusUnauthorized, apiRequest(t, server, "GET", "/v1/status", "", "", nil))
+	assert.Equal(t, http.StatusUnauthorized, apiRequest(t, server, "GET", "/v1/status", "wrong", "", nil))
+
+	var status WatcherStatus
+	assert.Equal(t, http.StatusOK, apiRequest(t, server, "GET", "/v1/status", "secret", "", &status))
+	assert.Equal(t, uint32(20), status.Lag)
+	assert.False(t, status.Paused)
+
+	var contracts struct {
+		WatchedAccounts			[]*WatchedAccount		`json:"watched_accounts"`
+	}
+	assert.Equal(t, http.StatusOK, apiRequest(t, server, "GET", "/v1/contracts", "secret", "", &contracts))
+	if assert.Len(t, contracts.WatchedAccounts, 1) {
+		assert.Equal(t, eos.AN("gateway11111"), contracts.WatchedAccounts[0].Account)
+		assert.Len(t, contracts.WatchedAccounts[0].TokenContracts, 1)
+	}
+
+	// 设置扫块高度需要先暂停
+	assert.Equal(t, http.StatusConflict, apiRequest(t, server, "POST", "/v1/admin/scan_height", "secret", `{"height": 50}`, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, apiRequest(t, server, "GET", "/v1/admin/pause", "secret", "", nil))
+	assert.Equal(t, http.StatusOK, apiRequest(t, server, "POST", "/v1/admin/pause", "secret", "", &status))
+	assert.True(t, status.Paused)
+	assert.Equal(t, http.StatusOK, apiRequest(t, server, "POST", "/v1/admin/scan_height", "secret", `{"height": 50}`, nil))
+	assert.True(t, ew.scanControl.heightSet)
+	assert.Equal(t, uint32(50), ew.scanControl.height)
+	assert.Equal(t, http.StatusOK, apiRequest(t, server, "POST", "/v1/admin/resume", "secret", "", &status))
+	assert.False(t, status.Paused)
+
+	// 已交付的事件
+	for i, blockNum := range []uint32{101, 102, 105} {
+		event := &EOSPushEvent{TxID: eos.SHA256Bytes{byte(i + 1)}, Account: eos.AN("eosio.token"), From: eos.AN("alice1111111"),
+			To: eos.AN("gateway11111"), Amount: 10000, Symbol: "EOS", Precision: 4, BlockNum: blockNum, EventType: EventTypeDeposit}
+		if i == 2 {
+			event.From = eos.AN("bob111111111")
+		}
+		ew.putEvent(event)
+		ew.putDeliveryRecord(event, DeliveryStatusDelivered, false)
+	}
+
+	var events struct {
+		Events			[]*WebhookEvent			`json:"events"`
+		Delivered		bool					`json:"delivered"`
+	}
+	assert.Equal(t, http.StatusOK, apiRequest(t, server, "GET", "/v1/events?from=101&to=105", "secret", "", &events))
+	assert.Len(t, events.Events, 2)
+	assert.Equal(t, "1.0000 EOS", events.Events[0].Quantity)
+	assert.Equal(t, http.StatusOK, apiRequest(t, server, "GET", "/v1/events?account=bob111111111", "secret", "", &events))
+	assert.Len(t, events.Events, 1)
+	assert.Equal(t, uint32(105), events.Events[0].BlockNum)
+	assert.Equal(t, http.StatusOK, apiRequest(t, server, "GET", "/v1/events?account=gateway11111&limit=2", "secret", "", &events))
+	assert.Len(t, events.Events, 2)
+	assert.Equal(t, http.StatusOK, apiRequest(t, server, "GET", "/v1/events?txid=02", "secret", "", &events))
+	assert.True(t, events.Delivered)
+	assert.Equal(t, uint32(102), events.Events[0].BlockNum)
+	assert.Equal(t, http.StatusBadRequest, apiRequest(t, server, "GET", "/v1/events?from=abc", "secret", "", nil))
+}
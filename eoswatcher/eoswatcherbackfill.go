@@ -0,0 +1,188 @@
+package eoswatcher
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/eoscanada/eos-go"
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"sync"
+)
+
+// leveldb 中回溯扫描任务的key 前缀，完整key 为 前缀 + 账户/合约名/货币名称
+const backfillKeyPrefix = "Backfill/"
+
+// 新增合约的回溯扫描任务：只按该合约扫描[From, To) 的块，进度单独保存，不影响主扫块进度
+type BackfillTask struct {
+	Account				eos.AccountName		`json:"account"`
+	TokenContract		*TokenContract		`json:"token_contract"`
+	From				uint32				`json:"from"`
+	// 新增合约时的不可逆块高，之后的块由主扫块按新配置扫描
+	To					uint32				`json:"to"`
+	// 下一个要扫描的块高
+	Next				uint32				`json:"next"`
+	Done				bool				`json:"done"`
+}
+
+func (task *BackfillTask) key() []byte {
+	return []byte(backfillKeyPrefix + string(task.Account) + "/" + task.TokenContract.key())
+}
+
+// 回溯扫描协程，与StartWatch 的扫块同生命周期。 扫块未开始时，任务只保存到leveldb，StartWatch 时启动
+type backfillRunner struct {
+	lock				sync.Mutex
+	ctx					context.Context
+	eventChan			chan<- *EOSPushEvent
+	running				sync.WaitGroup
+}
+
+// 从tokenContract.StartBlock 回溯扫描到当前不可逆块，事件发给StartWatch 的eventChan（与主扫块的事件交错，已交付的事件不再发出）。
+// 重启后从中断的地方继续
+func (ew *EOSWatcherMain) Backfill(account eos.AccountName, tokenContract *TokenContract) error {
+	infoResp, err := ew.chainInfo()
+	if err != nil {
+		return err
+	}
+	task := &BackfillTask{
+		Account:			account,
+		TokenContract:		tokenContract,
+		From:				tokenContract.StartBlock,
+		To:					infoResp.LastIrreversibleBlockNum,
+		Next:				tokenContract.StartBlock,
+	}
+	if task.From >= task.To {
+		return nil
+	}
+
+	previous, err := ew.getBackfillTask(task.key())
+	if err != nil {
+		return err
+	}
+	if previous != nil && !previous.Done {
+		return errors.New("Backfill of '" + string(task.key()) + "' is running.")
+	}
+	if err := ew.putBackfillTask(task); err != nil {
+		return err
+	}
+	log.Info("EOS backfill scheduled", "Account", account, "Contract", tokenContract.ActionAccount, "Symbol", tokenContract.Symbol, "From", task.From, "To", task.To)
+	ew.launchBackfill(task)
+	return nil
+}
+
+// 所有回溯扫描任务
+func (ew *EOSWatcherMain) GetBackfillTasks() ([]*BackfillTask, error) {
+	iter := ew.DB.NewIterator(util.BytesPrefix([]byte(backfillKeyPrefix)), nil)
+	defer iter.Release()
+
+	var tasks []*BackfillTask
+	for iter.Next() {
+		var task BackfillTask
+		if err := json.Unmarshal(iter.Value(), &task); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, &task)
+	}
+	return tasks, iter.Error()
+}
+
+func (ew *EOSWatcherMain) getBackfillTask(key []byte) (*BackfillTask, error) {
+	data, err := ew.DB.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var task BackfillTask
+	if err := json.Unmarshal(data, &task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+func (ew *EOSWatcherMain) putBackfillTask(task *BackfillTask) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	return ew.DB.Put(task.key(), data, nil)
+}
+
+// StartWatch 时调用，继续未完成的回溯扫描、重新扫描
+func (ew *EOSWatcherMain) startBackfills(ctx context.Context, eventChan chan<- *EOSPushEvent) {
+	ew.backfills.lock.Lock()
+	ew.backfills.ctx = ctx
+	ew.backfills.eventChan = eventChan
+	ew.backfills.lock.Unlock()
+
+	tasks, err := ew.GetBackfillTasks()
+	if err != nil {
+		log.Error("read eos leveldb backfill tasks err", "info", err)
+		return
+	}
+	for _, task := range tasks {
+		if !task.Done {
+			ew.launchBackfill(task)
+		}
+	}
+	ew.startRescans()
+}
+
+// 扫块退出时调用，等待回溯扫描、重新扫描协程退出（ctx 已结束）
+func (ew *EOSWatcherMain) stopBackfills() {
+	ew.backfills.lock.Lock()
+	ew.backfills.ctx = nil
+	ew.backfills.eventChan = nil
+	ew.backfills.lock.Unlock()
+	ew.backfills.running.Wait()
+}
+
+func (ew *EOSWatcherMain) launchBackfill(task *BackfillTask) {
+	ew.launchScanTask(func(ctx context.Context, eventChan chan<- *EOSPushEvent) {
+		ew.runBackfill(ctx, task, eventChan)
+	})
+}
+
+// 在回溯扫描协程中运行run（回溯扫描、重新扫描），扫块未开始时不运行
+func (ew *EOSWatcherMain) launchScanTask(run func(ctx context.Context, eventChan chan<- *EOSPushEvent)) {
+	ew.backfills.lock.Lock()
+	defer ew.backfills.lock.Unlock()
+	if ew.backfills.ctx == nil {
+		return
+	}
+	ctx, eventChan := ew.backfills.ctx, ew.backfills.eventChan
+	ew.backfills.running.Add(1)
+	go func() {
+		defer ew.backfills.running.Done()
+		run(ctx, eventChan)
+	}()
+}
+
+// 按块高顺序扫描，每个块的事件交付后保存进度
+func (ew *EOSWatcherMain) runBackfill(ctx context.Context, task *BackfillTask, eventChan chan<- *EOSPushEvent) {
+	accounts := []*WatchedAccount{{Account: task.Account, TokenContracts: []*TokenContract{task.TokenContract}}}
+	for task.Next < task.To {
+		blockResp, err := ew.UpdateBlock(ctx, task.Next)
+		if err != nil {
+			return
+		}
+		eosPushEvents, err := ew.extractEOSPushEvents(ctx, blockResp, 0, accounts, true)
+		if err != nil {
+			return
+		}
+		for _, eosPushEvent := range eosPushEvents {
+			ew.deliverEvent(eosPushEvent, eventChan)
+		}
+		task.Next++
+		if err := ew.putBackfillTask(task); err != nil {
+			log.Error("write eos leveldb backfill task err", "key", string(task.key()), "info", err)
+		}
+	}
+	task.Done = true
+	if err := ew.putBackfillTask(task); err != nil {
+		log.Error("write eos leveldb backfill task err", "key", string(task.key()), "info", err)
+	}
+	log.Info("EOS backfill done", "Account", task.Account, "Contract", task.TokenContract.ActionAccount, "Symbol", task.TokenContract.Symbol, "To", task.To)
+}
@@ -0,0 +1,189 @@
+package eoswatcher
+
+import (
+	"context"
+	"encoding/binary"
+	"eosc/tools/metrics"
+	"github.com/eoscanada/eos-go"
+	log "github.com/inconshreveable/log15"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"sync"
+	"sync/atomic"
+)
+
+// leveldb 中保存扫块进度的key，值为下一个要交付的块高
+const scanBlockHeightKey = "ScanBlockHeight"
+
+// 监控指标中的扫块程序名
+const metricsScanner = "eoswatcher"
+
+// 一个块扫描完成后的结果
+type scannedBlock struct {
+	BlockNum			uint32
+	Events				[]*EOSPushEvent
+	// 块数据，用于跟踪网关发出的交易
+	Block				*eos.BlockResp
+	// 从块中第几笔交易开始扫描
+	ScanBlockIndex		uint32
+	// 开始解析时ABICache 的版本记录次数，交付时不同则重新解析
+	ABIChanges			uint64
+	// 为true 时不是扫描结果，而是设置了扫块高度（见SetScanHeight）：之前的块都已交付，从BlockNum 重新开始
+	Reset				bool
+}
+
+// 块排序器：扫块协程乱序完成，排序器按块高顺序交出已扫描完成的块
+type blockSequencer struct {
+	// 下一个要交付的块高
+	next				uint32
+	pending				map[uint32]*scannedBlock
+}
+
+func newBlockSequencer(next uint32) *blockSequencer {
+	return &blockSequencer{
+		next:		next,
+		pending:	make(map[uint32]*scannedBlock),
+	}
+}
+
+// 加入一个扫描完成的块，返回按块高顺序可以交付的块（可能为空）
+func (bs *blockSequencer) Add(block *scannedBlock) []*scannedBlock {
+	if block.BlockNum < bs.next {
+		// 已经交付过的块，忽略
+		return nil
+	}
+	bs.pending[block.BlockNum] = block
+
+	var ready []*scannedBlock
+	for {
+		nextBlock, ok := bs.pending[bs.next]
+		if !ok {
+			return ready
+		}
+		delete(bs.pending, bs.next)
+		ready = append(ready, nextBlock)
+		bs.next++
+	}
+}
+
+// 下一个要交付的块高
+func (bs *blockSequencer) Next() uint32 {
+	return bs.next
+}
+
+// 直接发出事件、不排序交付的扫块（EOSWatcher、EOSWatcherContract）的进度：块乱序处理完，
+// 只推进到该高度以下的块都已处理完的位置，没处理完的块（如ctx 结束时还在请求）重启后重新扫描
+type scanProgress struct {
+	lock				sync.Mutex
+	sequencer			*blockSequencer
+	// 写入进度
+	commit				func(next uint32, sync bool)
+}
+
+func newScanProgress(next uint32, commit func(next uint32, sync bool)) *scanProgress {
+	return &scanProgress{
+		sequencer:		newBlockSequencer(next),
+		commit:			commit,
+	}
+}
+
+// 标记一个块已处理完，进度推进时写入
+func (sp *scanProgress) Done(blockNum uint32) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if len(sp.sequencer.Add(&scannedBlock{BlockNum: blockNum})) > 0 {
+		sp.commit(sp.sequencer.Next(), false)
+	}
+}
+
+// 同步写入最终进度，在途的块都结束后调用
+func (sp *scanProgress) Flush() {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	sp.commit(sp.sequencer.Next(), true)
+}
+
+// ABICache 的版本记录次数，没有ABICache 时为0
+func (ew *EOSWatcherMain) abiChanges() uint64 {
+	if ew.ABIs == nil {
+		return 0
+	}
+	return ew.ABIs.Changes()
+}
+
+// 已交付的块高：该高度以下所有块的事件，都已经按顺序发给网关。 重启时从这里继续扫块
+func (ew *EOSWatcherMain) CommittedBlockHeight() uint32 {
+	return atomic.LoadUint32(&ew.committedBlockHeight)
+}
+
+// 更新已交付的块高，并写入leveldb
+func (ew *EOSWatcherMain) commitBlockHeight(height uint32, sync bool) {
+	atomic.StoreUint32(&ew.committedBlockHeight, height)
+	metrics.SetScanHeight(metricsScanner, atomic.LoadUint32(&ew.LastIrreversibleBlockNum), height)
+
+	bytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(bytes, height)
+	err := ew.DB.Put([]byte(scanBlockHeightKey), bytes, &opt.WriteOptions{Sync: sync})
+	if err != nil {
+		metrics.CheckpointWriteFailures.WithLabelValues(metricsScanner).Inc()
+		log.Error("write eos leveldb ScanBlockHeight err", "info", err)
+	}
+}
+
+// 按块高顺序，把扫描完成的块的事件发给网关，每交付完一个块推进一次进度。
+// 交付后才释放协程池，保证乱序完成、等待交付的块不超过协程池大小。
+// ctx 结束后不再交付新的块（已开始交付的块会完整发出），resultChan 关闭后写入最终进度，等待回溯扫描、附属协程退出，关闭leveldb 和eventChan
+func (ew *EOSWatcherMain) deliverScannedBlocks(ctx context.Context, next uint32, resultChan <-chan *scannedBlock, tmpChannel <-chan struct{}, eventChan chan<- *EOSPushEvent) {
+	defer ew.finishLifecycle()
+
+	sequencer := newBlockSequencer(next)
+	for scanned := range resultChan {
+		if scanned.Reset {
+			sequencer = newBlockSequencer(scanned.BlockNum)
+			ew.commitBlockHeight(scanned.BlockNum, true)
+			continue
+		}
+		for _, block := range sequencer.Add(scanned) {
+			if ctx.Err() != nil {
+				// 正在退出，剩下的块不再交付，只等待在途的块结束
+				break
+			}
+			if block.Block != nil && ew.abiChanges() != block.ABIChanges {
+				// 解析之后记录了新的ABI（可能来自之前的块），按新ABI 重新解析
+				eosPushEvents, err := ew.ExtractEOSPushEvents(ctx, block.Block, block.ScanBlockIndex)
+				if err != nil {
+					// ctx 已结束，块不交付，也不推进进度
+					break
+				}
+				block.Events = eosPushEvents
+			}
+			for _, eosPushEvent := range block.Events {
+				// 已交付过的事件不再发出，见deliverEvent
+				ew.deliverEvent(eosPushEvent, eventChan)
+			}
+			if block.Block != nil {
+				ew.observeOutgoingTxs(block.Block, true)
+			}
+			ew.commitBlockHeight(block.BlockNum + 1, false)
+			<-tmpChannel
+			metrics.WorkerPoolInUse.WithLabelValues(metricsScanner).Set(float64(len(tmpChannel)))
+		}
+	}
+
+	ew.commitBlockHeight(ew.CommittedBlockHeight(), true)
+	ew.stopBackfills()
+	if ew.Webhooks != nil {
+		ew.Webhooks.Stop()
+	}
+	if ew.Endpoints != nil {
+		ew.Endpoints.Stop()
+	}
+	if ew.P2PBlocks != nil {
+		ew.P2PBlocks.Close()
+	}
+	// 跟随最新块的协程会写入发出交易的状态
+	ew.waitHelpers()
+	if err := ew.DB.Close(); err != nil {
+		log.Error("close eos leveldb err", "info", err)
+	}
+	close(eventChan)
+}
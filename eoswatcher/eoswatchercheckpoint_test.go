@@ -0,0 +1,73 @@
+package eoswatcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func blockNums(blocks []*scannedBlock) []uint32 {
+	nums := []uint32{}
+	for _, block := range blocks {
+		nums = append(nums, block.BlockNum)
+	}
+	return nums
+}
+
+func TestBlockSequencerInOrder(t *testing.T) {
+	sequencer := newBlockSequencer(100)
+
+	// 乱序完成的块，要等更低的块完成后才能交付
+	assert.Empty(t, sequencer.Add(&scannedBlock{BlockNum: 102}))
+	assert.Empty(t, sequencer.Add(&scannedBlock{BlockNum: 101}))
+	assert.Equal(t, uint32(100), sequencer.Next())
+
+	ready := sequencer.Add(&scannedBlock{BlockNum: 100})
+	assert.Equal(t, []uint32{100, 101, 102}, blockNums(ready))
+	assert.Equal(t, uint32(103), sequencer.Next())
+
+	ready = sequencer.Add(&scannedBlock{BlockNum: 103})
+	assert.Equal(t, []uint32{103}, blockNums(ready))
+}
+
+func TestBlockSequencerIgnoreDelivered(t *testing.T) {
+	sequencer := newBlockSequencer(10)
+
+	assert.Equal(t, []uint32{10}, blockNums(sequencer.Add(&scannedBlock{BlockNum: 10})))
+	assert.Empty(t, sequencer.Add(&scannedBlock{BlockNum: 9}))
+	assert.Empty(t, sequencer.Add(&scannedBlock{BlockNum: 10}))
+	assert.Equal(t, uint32(11), sequencer.Next())
+}
+
+// 附属协程退出后才关闭leveldb
+func TestDeliverScannedBlocksWaitsHelpers(t *testing.T) {
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+	ew := &EOSWatcherMain{DB: db}
+	ctx := ew.startLifecycle(context.Background())
+
+	var putErr error
+	helperDone := make(chan struct{})
+	ew.goHelper(func() {
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		putErr = ew.DB.Put([]byte("helper"), []byte("done"), nil)
+		close(helperDone)
+	})
+	ew.cancel()
+
+	resultChan := make(chan *scannedBlock)
+	close(resultChan)
+	eventChan := make(chan *EOSPushEvent)
+	ew.deliverScannedBlocks(ctx, 1, resultChan, make(chan struct{}, 1), eventChan)
+	select {
+	case <-helperDone:
+	default:
+		t.Fatal("leveldb closed before the helper exited")
+	}
+	assert.Nil(t, putErr)
+	_, open := <-eventChan
+	assert.False(t, open)
+}
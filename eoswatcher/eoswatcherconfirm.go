@@ -0,0 +1,147 @@
+package eoswatcher
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/eoscanada/eos-go"
+	log "github.com/inconshreveable/log15"
+	"time"
+)
+
+// 交易的确认信息，GetEventByTxid 填充到EOSPushEvent.Confirmation
+type TxConfirmation struct {
+	// 交易收据状态，只有executed 的交易才真正执行
+	Status						eos.TransactionStatus	`json:"status"`
+	BlockNum					uint32					`json:"block_num"`
+	// 交易所在块的ID（已确认块中包含该交易），获取块失败时为空
+	BlockID						string					`json:"block_id"`
+	BlockTime					time.Time				`json:"block_time"`
+	HeadBlockNum				uint32					`json:"head_block_num"`
+	LastIrreversibleBlockNum	uint32					`json:"last_irreversible_block_num"`
+	// 块高不超过不可逆块，且该块中包含该交易。 获取块失败时为false
+	Irreversible				bool					`json:"irreversible"`
+	// 交易所在块（含）到最新块的块数
+	Confirmations				uint32					`json:"confirmations"`
+}
+
+// GetEventByTxidWithOptions 的选项，默认不拒绝任何交易
+type TxQueryOptions struct {
+	// 收据状态不是executed 时返回 *TxNotExecutedError
+	RequireExecuted				bool
+	// 块未不可逆时返回 *TxNotIrreversibleError
+	RequireIrreversible			bool
+}
+
+// 交易没有执行成功（soft_fail、hard_fail、delayed、expired）
+type TxNotExecutedError struct {
+	TxID						string
+	Status						eos.TransactionStatus
+}
+
+func (err *TxNotExecutedError) Error() string {
+	return fmt.Sprintf("Transaction %s is not executed, status %s.", err.TxID, err.Status)
+}
+
+// 交易所在块还未不可逆，可能被回滚
+type TxNotIrreversibleError struct {
+	TxID						string
+	BlockNum					uint32
+	LastIrreversibleBlockNum	uint32
+}
+
+func (err *TxNotIrreversibleError) Error() string {
+	return fmt.Sprintf("Transaction %s in block %d is not irreversible, last irreversible block %d.",
+		err.TxID, err.BlockNum, err.LastIrreversibleBlockNum)
+}
+
+// get_transaction 返回的块高上的块不包含该交易（节点数据不一致，或交易所在块已被分叉掉）
+type TxNotInBlockError struct {
+	TxID						string
+	BlockNum					uint32
+	BlockID						string
+}
+
+func (err *TxNotInBlockError) Error() string {
+	return fmt.Sprintf("Transaction %s is not in block %d (%s).", err.TxID, err.BlockNum, err.BlockID)
+}
+
+func newTxConfirmation(transactionResp *eos.TransactionResp, headBlockNum, lastIrreversibleBlockNum uint32) *TxConfirmation {
+	if headBlockNum < lastIrreversibleBlockNum {
+		headBlockNum = lastIrreversibleBlockNum
+	}
+	confirmation := &TxConfirmation{
+		Status:						transactionResp.Receipt.Status,
+		BlockNum:					transactionResp.BlockNum,
+		BlockTime:					transactionResp.BlockTime.Time,
+		HeadBlockNum:				headBlockNum,
+		LastIrreversibleBlockNum:	lastIrreversibleBlockNum,
+		Irreversible:				transactionResp.BlockNum <= lastIrreversibleBlockNum,
+	}
+	if headBlockNum >= transactionResp.BlockNum {
+		confirmation.Confirmations = headBlockNum - transactionResp.BlockNum + 1
+	}
+	return confirmation
+}
+
+func (confirmation *TxConfirmation) Executed() bool {
+	return confirmation.Status == eos.TransactionStatusExecuted
+}
+
+// 按options 检查，不满足时返回对应的错误
+func (confirmation *TxConfirmation) check(txid string, options *TxQueryOptions) error {
+	if options == nil {
+		return nil
+	}
+	if options.RequireExecuted && !confirmation.Executed() {
+		return &TxNotExecutedError{TxID: txid, Status: confirmation.Status}
+	}
+	if options.RequireIrreversible && !confirmation.Irreversible {
+		return &TxNotIrreversibleError{TxID: txid, BlockNum: confirmation.BlockNum, LastIrreversibleBlockNum: confirmation.LastIrreversibleBlockNum}
+	}
+	return nil
+}
+
+// 查询最新块、不可逆块及交易所在块的ID。 获取链信息失败时使用get_transaction 返回的不可逆块。
+// 块中不包含该交易时返回 *TxNotInBlockError
+func (ew *EOSWatcherMain) txConfirmation(transactionResp *eos.TransactionResp) (*TxConfirmation, error) {
+	headBlockNum, lastIrreversibleBlockNum := transactionResp.LastIrreversibleBlock, transactionResp.LastIrreversibleBlock
+	if infoResp, err := ew.chainInfo(); err != nil {
+		log.Warn("get eos info for transaction confirmation err", "TxID", hex.EncodeToString(transactionResp.ID), "info", err)
+	} else {
+		headBlockNum = infoResp.HeadBlockNum
+		if infoResp.LastIrreversibleBlockNum > lastIrreversibleBlockNum {
+			lastIrreversibleBlockNum = infoResp.LastIrreversibleBlockNum
+		}
+	}
+
+	confirmation := newTxConfirmation(transactionResp, headBlockNum, lastIrreversibleBlockNum)
+	// 还没有不可逆时，从最健康的节点取块，只用于填充BlockID
+	block := ew.reversibleBlock
+	if confirmation.Irreversible {
+		block = ew.block
+	}
+	blockResp, err := block(transactionResp.BlockNum)
+	if err != nil {
+		log.Warn("get eos block for transaction confirmation err", "BlockNum", transactionResp.BlockNum, "info", err)
+	}
+	if err := confirmation.confirmBlock(transactionResp.ID, blockResp); err != nil {
+		return nil, err
+	}
+	return confirmation, nil
+}
+
+// 确认交易在块中，填充BlockID。 blockResp 为nil（获取块失败）时无法确认，不算不可逆
+func (confirmation *TxConfirmation) confirmBlock(txID eos.SHA256Bytes, blockResp *eos.BlockResp) error {
+	if blockResp == nil {
+		confirmation.Irreversible = false
+		return nil
+	}
+	for _, transactionReceipt := range blockResp.SignedBlock.Transactions {
+		if bytes.Equal(transactionReceipt.Transaction.ID, txID) {
+			confirmation.BlockID = hex.EncodeToString(blockResp.ID)
+			return nil
+		}
+	}
+	return &TxNotInBlockError{TxID: hex.EncodeToString(txID), BlockNum: confirmation.BlockNum, BlockID: hex.EncodeToString(blockResp.ID)}
+}
@@ -0,0 +1,120 @@
+package eoswatcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"eosc/tools/blocksource"
+	"github.com/eoscanada/eos-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxConfirmation(t *testing.T) {
+	transactionResp := &eos.TransactionResp{ID: eos.SHA256Bytes{0x01}, BlockNum: 100, LastIrreversibleBlock: 90}
+	transactionResp.BlockTime.Time = time.Unix(1546300800, 0)
+
+	// 未不可逆
+	confirmation := newTxConfirmation(transactionResp, 110, 90)
+	assert.False(t, confirmation.Irreversible)
+	assert.True(t, confirmation.Executed())
+	assert.Equal(t, uint32(11), confirmation.Confirmations)
+	assert.Equal(t, time.Unix(1546300800, 0), confirmation.BlockTime)
+	assert.Nil(t, confirmation.check("01", nil))
+	assert.Nil(t, confirmation.check("01", &TxQueryOptions{RequireExecuted: true}))
+	err := confirmation.check("01", &TxQueryOptions{RequireIrreversible: true})
+	notIrreversible, ok := err.(*TxNotIrreversibleError)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(100), notIrreversible.BlockNum)
+	assert.Equal(t, uint32(90), notIrreversible.LastIrreversibleBlockNum)
+
+	// 块高等于不可逆块
+	confirmation = newTxConfirmation(transactionResp, 120, 100)
+	assert.True(t, confirmation.Irreversible)
+	assert.Nil(t, confirmation.check("01", &TxQueryOptions{RequireExecuted: true, RequireIrreversible: true}))
+
+	// 最新块落后于交易所在块时没有确认数
+	confirmation = newTxConfirmation(transactionResp, 95, 90)
+	assert.Equal(t, uint32(0), confirmation.Confirmations)
+
+	transactionResp.Receipt.Status = eos.TransactionStatusHardFail
+	confirmation = newTxConfirmation(transactionResp, 120, 100)
+	assert.False(t, confirmation.Executed())
+	err = confirmation.check("01", &TxQueryOptions{RequireExecuted: true, RequireIrreversible: true})
+	notExecuted, ok := err.(*TxNotExecutedError)
+	assert.True(t, ok)
+	assert.Equal(t, eos.TransactionStatusHardFail, notExecuted.Status)
+}
+
+func TestTxConfirmationBlock(t *testing.T) {
+	transactionResp := &eos.TransactionResp{ID: eos.SHA256Bytes{0x01}, BlockNum: 100}
+	blockResp := &eos.BlockResp{BlockNum: 100, ID: eos.SHA256Bytes{0xbb}}
+	blockResp.SignedBlock.Transactions = []eos.TransactionReceipt{
+		{Transaction: eos.TransactionWithID{ID: eos.SHA256Bytes{0x02}}},
+		{Transaction: eos.TransactionWithID{ID: eos.SHA256Bytes{0x01}}},
+	}
+
+	// 块中包含交易
+	confirmation := newTxConfirmation(transactionResp, 120, 100)
+	assert.Nil(t, confirmation.confirmBlock(transactionResp.ID, blockResp))
+	assert.True(t, confirmation.Irreversible)
+	assert.Equal(t, "bb", confirmation.BlockID)
+
+	// 获取块失败时无法确认，不算不可逆
+	confirmation = newTxConfirmation(transactionResp, 120, 100)
+	assert.Nil(t, confirmation.confirmBlock(transactionResp.ID, nil))
+	assert.False(t, confirmation.Irreversible)
+	assert.Equal(t, "", confirmation.BlockID)
+
+	// 该块高上的块不包含交易
+	blockResp.SignedBlock.Transactions = blockResp.SignedBlock.Transactions[:1]
+	confirmation = newTxConfirmation(transactionResp, 120, 100)
+	err := confirmation.confirmBlock(transactionResp.ID, blockResp)
+	notInBlock, ok := err.(*TxNotInBlockError)
+	assert.True(t, ok)
+	assert.Equal(t, "01", notInBlock.TxID)
+	assert.Equal(t, uint32(100), notInBlock.BlockNum)
+	assert.Equal(t, "bb", notInBlock.BlockID)
+}
+
+// 查询交易与确认用的链信息来自同一个来源（回放录制的数据时不请求节点）
+func TestGetEventByTxidReplay(t *testing.T) {
+	dirName, err := ioutil.TempDir("", "eoswatcherconfirm")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dirName)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dirName, "get_transaction_aa01.json"), []byte(`{
+		"id": "aa01",
+		"block_num": 100,
+		"last_irreversible_block": 90,
+		"traces": [{
+			"receipt": {"receiver": "eosio.token", "global_sequence": 1},
+			"act": {"account": "eosio.token", "name": "transfer", "data": {"from": "alice1111111", "to": "gateway11111", "quantity": "1.0000 EOS", "memo": "alice"}}
+		}]
+	}`), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dirName, "get_info.json"), []byte(`{"head_block_num": 110, "last_irreversible_block_num": 95}`), 0644))
+
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+
+	ew := &EOSWatcherMain{
+		DB:					db,
+		Gateway:			eos.AN("gateway11111"),
+		Blocks:				blocksource.NewFileSource(dirName),
+		ActionDecoders:		NewActionDecoderRegistry(),
+		TokenContracts:		[]*TokenContract{{ActionAccount: eos.AN("eosio.token"), ActionNameDestroy: eos.ActN("transfer"), Symbol: "EOS", Precision: 4}},
+	}
+	eosPushEvents, err := ew.GetEventByTxidWithOptions("aa01", nil)
+	assert.Nil(t, err)
+	if assert.Len(t, eosPushEvents, 1) {
+		assert.Equal(t, uint32(100), eosPushEvents[0].BlockNum)
+		assert.Equal(t, "alice", eosPushEvents[0].Memo)
+	}
+
+	_, err = ew.GetEventByTxidWithOptions("aa01", &TxQueryOptions{RequireIrreversible: true})
+	notIrreversible, ok := err.(*TxNotIrreversibleError)
+	if assert.True(t, ok) {
+		assert.Equal(t, uint32(95), notIrreversible.LastIrreversibleBlockNum)
+	}
+}
@@ -1,6 +1,7 @@
 package eoswatcher
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"encoding/binary"
 	"encoding/hex"
@@ -20,6 +21,7 @@ import (
 	"math/big"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -48,7 +50,17 @@ type EOSWatcherContract struct {
 	Symbol						string
 	Precision					uint8
 
+	// action 解析器，ActionAccount 的溶币、铸币方法分别使用SolventDecoder、IssueDecoder
+	ActionDecoders				*ActionDecoderRegistry
+
 	DB							*leveldb.DB
+
+	watchLifecycle
+
+	// 请求链信息、块，解压交易，默认使用EosAPI、eos-go，测试时替换
+	getInfo						func() (*eos.InfoResp, error)
+	getBlock					func(id string) (*eos.BlockResp, error)
+	unpackTx					func(packed *eos.PackedTransaction) (*eos.SignedTransaction, error)
 }
 
 func NewEosWatcherContract(url, pubKeyHash, actionAccount, gateway, actionNameDestroy, actionNameCreate, symbol string, precision uint8, dirName string) (*EOSWatcherContract) {
@@ -73,9 +85,6 @@ func NewEosWatcherContract(url, pubKeyHash, actionAccount, gateway, actionNameDe
 		Compress: eos.CompressionZlib,
 	}
 
-	eos.RegisterAction(eos.AN(actionAccount), eos.ActN(actionNameDestroy), Solvent{})
-	eos.RegisterAction(eos.AN(actionAccount), eos.ActN(actionNameCreate), token.Issue{})
-
 	//dirname := viper.GetString("LEVELDB.eos_db_path")
 	db, err := leveldb.OpenFile(dirName, &opt.Options{
 		OpenFilesCacheCapacity: 16,
@@ -92,7 +101,7 @@ func NewEosWatcherContract(url, pubKeyHash, actionAccount, gateway, actionNameDe
 	//defer db.Close()
 
 	var temp_sacn uint32 = 0
-	data, err := db.Get([]byte("ScanBlockHeight"), nil)
+	data, err := db.Get([]byte(scanBlockHeightKey), nil)
 	if err != nil {
 		log.Error("read eos leveldb ScanBlockHeight err", "info", err)
 	} else {
@@ -113,19 +122,44 @@ func NewEosWatcherContract(url, pubKeyHash, actionAccount, gateway, actionNameDe
 		ActionNameCreate:			eos.ActN(actionNameCreate),
 		Symbol:						symbol,
 		Precision:					precision,
+		ActionDecoders:				NewActionDecoderRegistry(),
 		DB:							db,
+		getInfo:					api.GetInfo,
+		getBlock:					api.GetBlockByID,
+		unpackTx:					(*eos.PackedTransaction).Unpack,
 	}
+	ew.registerActionDecoders()
 	return ew
 }
 
+// 为当前的合约、溶币、铸币方法注册解析器，只对本watcher 生效
+func (ew *EOSWatcherContract) registerActionDecoders() {
+	ew.ActionDecoders.Register(ew.ActionAccount, ew.ActionNameDestroy, &SolventDecoder{})
+	ew.ActionDecoders.Register(ew.ActionAccount, ew.ActionNameCreate, &IssueDecoder{})
+}
+
+// 解析action 时的上下文，金额按配置的货币名称、精度检查
+func (ew *EOSWatcherContract) actionDecodeContext(blockNum uint32) *ActionDecodeContext {
+	return &ActionDecodeContext{
+		Gateway:		ew.Gateway,
+		TokenContract:	&TokenContract{
+			ActionAccount:		ew.ActionAccount,
+			ActionNameDestroy:	ew.ActionNameDestroy,
+			ActionNameCreate:	ew.ActionNameCreate,
+			Symbol:				ew.Symbol,
+			Precision:			ew.Precision,
+		},
+		BlockNum:		blockNum,
+	}
+}
+
 func (ew *EOSWatcherContract) UpdatePubKeyHash(pubKeyHash string) {
 	ew.PubKeyHash = pubKeyHash
 }
 
 func (ew *EOSWatcherContract) UpdateActionAccount(actionAccount string) {
 	ew.ActionAccount = eos.AN(actionAccount)
-	eos.RegisterAction(ew.ActionAccount, ew.ActionNameDestroy, Solvent{})
-	eos.RegisterAction(ew.ActionAccount, ew.ActionNameCreate, token.Issue{})
+	ew.registerActionDecoders()
 }
 
 func (ew *EOSWatcherContract) UpdateGateway(gateway string) {
@@ -134,16 +168,17 @@ func (ew *EOSWatcherContract) UpdateGateway(gateway string) {
 
 func (ew *EOSWatcherContract) UpdateActionNameDestroy(actionNameDestroy string) {
 	ew.ActionNameDestroy = eos.ActN(actionNameDestroy)
-	eos.RegisterAction(ew.ActionAccount, ew.ActionNameDestroy, Solvent{})
+	ew.registerActionDecoders()
 }
 
 func (ew *EOSWatcherContract) UpdateActionNameCreate(actionNameCreate string) {
 	ew.ActionNameCreate = eos.ActN(actionNameCreate)
-	eos.RegisterAction(ew.ActionAccount, ew.ActionNameCreate, token.Issue{})
+	ew.registerActionDecoders()
 }
 
 //扫块开始
-func (ew *EOSWatcherContract) StartWatch(scanBlockHeight, scanBlockIndex uint32, eventChan chan<- *EOSPushEvent, channelCount int)  {
+// ctx 结束（或调用Stop）后，等待在途的块处理完，写入最终进度，关闭leveldb 和eventChan
+func (ew *EOSWatcherContract) StartWatch(ctx context.Context, scanBlockHeight, scanBlockIndex uint32, eventChan chan<- *EOSPushEvent, channelCount int)  {
 	if scanBlockHeight <= 0 {
 		scanBlockHeight = 1
 	}
@@ -151,16 +186,34 @@ func (ew *EOSWatcherContract) StartWatch(scanBlockHeight, scanBlockIndex uint32,
 	if scanBlockHeight > ew.ScanBlockHeight {
 		ew.ScanBlockHeight = scanBlockHeight
 	}
+	if channelCount <= 0 {
+		channelCount = 1
+	}
+	ctx = ew.startLifecycle(ctx)
 
 	go func() {
-		defer ew.DB.Close()
+		var workers sync.WaitGroup
+		progress := newScanProgress(ew.ScanBlockHeight, ew.writeScanBlockHeight)
+		defer ew.finishLifecycle()
+		defer func() {
+			// 等待在途的块结束，ctx 结束时没取到的块不计入进度
+			workers.Wait()
+			progress.Flush()
+			if err := ew.DB.Close(); err != nil {
+				log.Error("close eos leveldb err", "info", err)
+			}
+			close(eventChan)
+		}()
+
+		// 创建channelCount个goroutine，去请求块
+		var tmpChannel = make(chan struct{}, channelCount)
 		for {
-			// 更新 最新不可逆转块的高度。 返回则表明一定执行成功，不成功则会在该函数中阻塞
-			ew.UpdateInfo()
+			// 更新 最新不可逆转块的高度。 返回nil 则表明一定执行成功，否则ctx 已结束
+			if err := ew.UpdateInfo(ctx); err != nil {
+				return
+			}
 			//log.Debug("-------- Scan Block Height", "info", ew.ScanBlockHeight)
 
-			// 创建50个goroutine，去请求块
-			var tmpChannel = make(chan struct{}, channelCount)
 			if ew.ScanBlockHeight < ew.LastIrreversibleBlockNum {
 				for ; ew.ScanBlockHeight < ew.LastIrreversibleBlockNum;  {
 					if ew.ScanBlockHeight % 100 == 0 {
@@ -168,128 +221,125 @@ func (ew *EOSWatcherContract) StartWatch(scanBlockHeight, scanBlockIndex uint32,
 					}
 
 					// 协程池中，没用空闲的协程，等待
-					for len(tmpChannel) >= channelCount {
-						time.Sleep(time.Duration(10) * time.Millisecond)
+					select {
+					case tmpChannel <- struct{}{}:
+					case <-ctx.Done():
+						return
 					}
 					//log.Debug("len(tmpChannel)", "length", len(tmpChannel))
 
 					scanHeightx := ew.ScanBlockHeight
 
-					// 将扫块高度，写入leveldb
-					bytes := make([]byte, 4)
-					binary.LittleEndian.PutUint32(bytes, scanHeightx)
-					err := ew.DB.Put([]byte("ScanBlockHeight"), bytes, nil)
-					if err != nil {
-						log.Error("write eos leveldb ScanBlockHeight err", "info", err)
-					}
-					go func(scanHeightx uint32) {
-						tmpChannel <- struct{}{}
-
-						blockResp := ew.UpdateBlock(scanHeightx)
+					workers.Add(1)
+					go func(scanHeightx, scanBlockIndex uint32) {
+						defer workers.Done()
+						defer func() { <-tmpChannel }()
 
-						ew.UpdateEOSPushEvent(blockResp, scanBlockIndex, eventChan)
+						blockResp, err := ew.UpdateBlock(ctx, scanHeightx)
+						if err != nil {
+							return
+						}
 
-						<-tmpChannel
-					}(scanHeightx)
+						if err := ew.UpdateEOSPushEvent(ctx, blockResp, scanBlockIndex, eventChan); err != nil {
+							return
+						}
+						// 这个块处理完，之前的块也都处理完时，才写入扫块进度
+						progress.Done(scanHeightx)
+					}(scanHeightx, scanBlockIndex)
 
 					ew.ScanBlockHeight ++
 					scanBlockIndex = 0
 				}
-			} else {
-				time.Sleep(1 * time.Second)
+			} else if !sleepContext(ctx, 1 * time.Second) {
+				return
 			}
 		}
 	}()
 }
 
-// 更新 最后一个不可逆转块块高、最高块块高。 如果rpc请求报错，那么继续请求，阻塞在这里
-func (ew *EOSWatcherContract) UpdateInfo () {
+// 将扫块高度，写入leveldb
+func (ew *EOSWatcherContract) writeScanBlockHeight(scanBlockHeight uint32, sync bool) {
+	bytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(bytes, scanBlockHeight)
+	err := ew.DB.Put([]byte(scanBlockHeightKey), bytes, &opt.WriteOptions{Sync: sync})
+	if err != nil {
+		log.Error("write eos leveldb ScanBlockHeight err", "info", err)
+	}
+}
+
+// 更新 最后一个不可逆转块块高、最高块块高。 如果rpc请求报错，那么继续请求，阻塞在这里，直到ctx 结束
+func (ew *EOSWatcherContract) UpdateInfo (ctx context.Context) error {
 	for {
-		infoResp, err := ew.EosAPI.GetInfo()
+		infoResp, err := ew.getInfo()
 		if err != nil {
 			log.Error("Get info error!", "EosAPI.BaseURL", ew.EosAPI.BaseURL)
-			time.Sleep(500 * time.Millisecond)
+			if !sleepContext(ctx, 500 * time.Millisecond) {
+				return ctx.Err()
+			}
 			continue
 		}
 		ew.HeadBlockNum = infoResp.HeadBlockNum
 		ew.LastIrreversibleBlockNum = infoResp.LastIrreversibleBlockNum
-		return
+		return nil
 	}
 }
 
-// 更新 要扫描块的信息。 如果rpc请求报错，那么继续请求，阻塞在这里
-func (ew *EOSWatcherContract) UpdateBlock (scanBlockHeight uint32)  *eos.BlockResp {
+// 更新 要扫描块的信息。 如果rpc请求报错，那么继续请求，阻塞在这里，直到ctx 结束
+func (ew *EOSWatcherContract) UpdateBlock (ctx context.Context, scanBlockHeight uint32)  (*eos.BlockResp, error) {
 	for {
-		blockResp, err := ew.EosAPI.GetBlockByID(fmt.Sprintf("%d", scanBlockHeight))
+		blockResp, err := ew.getBlock(fmt.Sprintf("%d", scanBlockHeight))
 		if err != nil {
 			log.Debug("Get block error! Wait 100ms to request.",
 				"EosAPI.BaseURL", ew.EosAPI.BaseURL,
 				"ScanBlockHeight", scanBlockHeight,
 				/*err.Error()*/)
-			time.Sleep(100 * time.Millisecond)
+			if !sleepContext(ctx, 100 * time.Millisecond) {
+				return nil, ctx.Err()
+			}
 			continue
 		}
-		return blockResp
+		return blockResp, nil
 	}
 
 }
 
 // 更新 根据获得到的 块收据 信息，生成EOSPush事件，发给网关
-func (ew *EOSWatcherContract) UpdateEOSPushEvent (scanBlockResp *eos.BlockResp, scanBlockIndex uint32, eventChan chan<- *EOSPushEvent) {
-	// 首先清空EOSPush事件数组
-	ew.EOSPushEvents = []*EOSPushEvent{}
-
+func (ew *EOSWatcherContract) UpdateEOSPushEvent (ctx context.Context, scanBlockResp *eos.BlockResp, scanBlockIndex uint32, eventChan chan<- *EOSPushEvent) error {
+	// 多个块并发处理，事件直接发到eventChan，不再写入共享的EOSPushEvents
 	for index, transactionReceipt := range scanBlockResp.SignedBlock.Transactions{
 		if uint32(index) < scanBlockIndex {
 			continue
 		}
 		if transactionReceipt.Transaction.Packed != nil {
-			signedTx, err := transactionReceipt.Transaction.Packed.Unpack()
+			signedTx, err := ew.unpackTx(transactionReceipt.Transaction.Packed)
 			if err != nil {
 				// 如果解压失败，忽略该交易
 				log.Error("Unpack error", "TxID", hex.EncodeToString(transactionReceipt.Transaction.ID))
 				continue
 			}
-			// 暂时忽略一笔交易中有多个action 的情况。（待优化）
-			if len(signedTx.Transaction.Actions) != 1 {
-				continue
-			}
-			action := signedTx.Transaction.Actions[0]
-
-			// 判断是否是ew.ActionAccount 合约 的ew.ActionNameDestroy操作
-			if action.Account != ew.ActionAccount || action.Name != ew.ActionNameDestroy {
-				continue
-			}
-
-			//dataType := reflect.TypeOf(action.ActionData.Data)
-			//			//fmt.Println(dataType)
-			// 解析action 中具体传给合约的参数 data
-			destroyToken, ok := action.ActionData.Data.(*Solvent)
-			if ok == false {
-				continue
-			}
-			if destroyToken.Quantity.Symbol.Precision != ew.Precision {
-				continue
-			}
-			if destroyToken.Quantity.Symbol.Symbol != ew.Symbol {
-				continue
-			}
-
-			eosPushEvent := &EOSPushEvent{
-				TxID:				transactionReceipt.Transaction.ID,
-
-				Account:			action.Account,
-				Name:				action.Name,
-				Memo:				destroyToken.Memo,
-				Amount:				uint64(destroyToken.Quantity.Amount),
+			// 一笔交易中可能有多个action，每个匹配的action 单独生成一个事件
+			for actionIndex, action := range signedTx.Transaction.Actions {
+				// 判断是否是ew.ActionAccount 合约 的ew.ActionNameDestroy操作
+				if action.Account != ew.ActionAccount || action.Name != ew.ActionNameDestroy {
+					continue
+				}
 
-				BlockNum:			scanBlockResp.BlockNum,
-				Index:				index,
+				// 解析action 中具体传给合约的参数 data，金额的货币名称、精度与配置不一致时忽略
+				eosPushEvent, err := ew.ActionDecoders.Decode(action, ew.actionDecodeContext(scanBlockResp.BlockNum))
+				if err != nil {
+					continue
+				}
+				eosPushEvent.TxID = transactionReceipt.Transaction.ID
+				eosPushEvent.Account = action.Account
+				eosPushEvent.Name = action.Name
+				eosPushEvent.BlockNum = scanBlockResp.BlockNum
+				eosPushEvent.Index = index
+				eosPushEvent.ActionIndex = actionIndex
+
+				//ew.EOSPushEvents = append(ew.EOSPushEvents, eosPushEvent)
+				eventChan <- eosPushEvent
 			}
 
-			//ew.EOSPushEvents = append(ew.EOSPushEvents, eosPushEvent)
-			eventChan <- eosPushEvent
-
 		} //else {
 		//	// 暂时忽略特殊交易，比如misg 的exec 产生的交易。（待优化）
 		//	log.Error("Ignore transaction without transaction body.", "Block Height", ew.ScanBlockHeight)
@@ -298,142 +348,52 @@ func (ew *EOSWatcherContract) UpdateEOSPushEvent (scanBlockResp *eos.BlockResp,
 
 	//更新下一块，从第几笔交易开始扫
 	//ew.ScanBlockIndex = 0
+	return nil
 }
 
-func (ew *EOSWatcherContract) GetEventByTxid(txid string) (*EOSPushEvent, error) {
+// 查询交易中所有匹配的溶币、铸币事件
+func (ew *EOSWatcherContract) GetEventByTxid(txid string) ([]*EOSPushEvent, error) {
 	transactionResp, err := ew.EosAPI.GetTransaction(txid)
 	if err != nil {
 		return nil, err
 	}
 
-	// 暂时忽略一笔交易中有多个action 的情况。（待优化）
-	if len(transactionResp.Transaction.Transaction.Actions) != 1 {
-		return nil, errors.New("Transaction actions' length is not one.")
+	var eosPushEvents []*EOSPushEvent
+	for actionIndex, action := range transactionResp.Transaction.Transaction.Actions {
+		eosPushEvent, err := ew.actionToEOSPushEvent(transactionResp, action)
+		if err != nil {
+			continue
+		}
+		eosPushEvent.ActionIndex = actionIndex
+		eosPushEvents = append(eosPushEvents, eosPushEvent)
 	}
-	action := transactionResp.Transaction.Transaction.Actions[0]
 
+	if len(eosPushEvents) == 0 {
+		return nil, errors.New("Transaction has no matched action.")
+	}
+	return eosPushEvents, nil
+}
+
+// 解析交易中的单个action
+func (ew *EOSWatcherContract) actionToEOSPushEvent(transactionResp *eos.TransactionResp, action *eos.Action) (*EOSPushEvent, error) {
 	if action.Account != ew.ActionAccount {
 		return nil, errors.New("Account doesn't match.")
 	}
-
-	//dataType := reflect.TypeOf(action.ActionData.Data)
-	//fmt.Println(dataType)
-
-	// 处理溶币
-	if action.Name == ew.ActionNameDestroy {
-		solvent, ok := action.ActionData.Data.(map[string]interface{})
-		if ok == false {
-			return nil, errors.New("Action Data reflect error.")
-		}
-
-		if len(solvent) != 3 {
-			return nil, errors.New("Action Data length error.")
-		}
-
-		// 解析actionData的具体字段
-		from, ok := solvent["from"].(string)
-		if ok == false {
-			return nil, errors.New("Action Data 'user' field error")
-		}
-
-		quantity, ok := solvent["quantity"].(string)
-		if ok == false {
-			return nil, errors.New("Action Data 'amount' field error")
-		}
-		assert, err := eos.NewAsset(quantity)
-		if err != nil {
-			return nil, errors.New("Action Data 'quantity' field unmarshal error.")
-		}
-		if assert.Symbol.Precision != ew.Precision {
-			return nil, errors.New("Action Data 'quantity' field precision error.")
-		}
-		if assert.Symbol.Symbol != ew.Symbol {
-			return nil, errors.New("Action Data 'quantity' field symbol error.")
-		}
-
-		memo, ok := solvent["memo"].(string)
-		if ok == false {
-			return nil, errors.New("Action Data 'user' field  error")
-		}
-
-		destroyToken := &Solvent{
-			From:		eos.AN(from),
-			Quantity:	assert,
-			Memo:		memo,
-		}
-
-		eosPushEvent := &EOSPushEvent{
-			TxID:				transactionResp.ID,
-
-			Account:			action.Account,
-			Name:				action.Name,
-			Memo:				destroyToken.Memo,
-			Amount:				uint64(destroyToken.Quantity.Amount),
-
-			BlockNum:			transactionResp.BlockNum,
-			Index:				0, // 暂时没有好方法获取index
-		}
-		return eosPushEvent, nil
+	// 处理溶币、铸币
+	if action.Name != ew.ActionNameDestroy && action.Name != ew.ActionNameCreate {
+		return nil, errors.New("Name doesn't match.")
 	}
 
-	// 处理铸币
-	if action.Name == ew.ActionNameCreate {
-		issue, ok := action.ActionData.Data.(map[string]interface{})
-		if ok == false {
-			return nil, errors.New("Action Data reflect error.")
-		}
-
-		if len(issue) != 3 {
-			return nil, errors.New("Action Data length error.")
-		}
-
-		// 解析actionData的具体字段
-		to, ok := issue["to"].(string)
-		if ok == false {
-			return nil, errors.New("Action Data 'user' field error")
-		}
-
-		quantity, ok := issue["quantity"].(string)
-		if ok == false {
-			return nil, errors.New("Action Data 'amount' field error")
-		}
-		assert, err := eos.NewAsset(quantity)
-		if err != nil {
-			return nil, errors.New("Action Data 'quantity' field unmarshal error.")
-		}
-		if assert.Symbol.Precision != ew.Precision {
-			return nil, errors.New("Action Data 'quantity' field precision error.")
-		}
-		if assert.Symbol.Symbol != ew.Symbol {
-			return nil, errors.New("Action Data 'quantity' field symbol error.")
-		}
-
-		memo, ok := issue["memo"].(string)
-		if ok == false {
-			return nil, errors.New("Action Data 'user' field  error")
-		}
-
-		createToken := &token.Issue{
-			To:			eos.AN(to),
-			Quantity:	assert,
-			Memo:		memo,
-		}
-
-		eosPushEvent := &EOSPushEvent{
-			TxID:				transactionResp.ID,
-
-			Account:			action.Account,
-			Name:				action.Name,
-			Memo:				createToken.Memo,
-			Amount:				uint64(createToken.Quantity.Amount),
-
-			BlockNum:			transactionResp.BlockNum,
-			Index:				0, // 暂时没有好方法获取index
-		}
-		return eosPushEvent, nil
+	eosPushEvent, err := ew.ActionDecoders.Decode(action, ew.actionDecodeContext(transactionResp.BlockNum))
+	if err != nil {
+		return nil, err
 	}
-
-	return nil, errors.New("Name doesn't match.")
+	eosPushEvent.TxID = transactionResp.ID
+	eosPushEvent.Account = action.Account
+	eosPushEvent.Name = action.Name
+	eosPushEvent.BlockNum = transactionResp.BlockNum
+	eosPushEvent.Index = 0 // 暂时没有好方法获取index
+	return eosPushEvent, nil
 }
 
 // 根据multisig下的PKMSign代码，移植过来
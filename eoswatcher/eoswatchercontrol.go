@@ -0,0 +1,117 @@
+package eoswatcher
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	log "github.com/inconshreveable/log15"
+	"sync"
+	"sync/atomic"
+)
+
+// 扫块的暂停、恢复，及暂停期间设置扫块高度。 只在内存中，重启后恢复扫块
+type scanControl struct {
+	lock				sync.Mutex
+	paused				bool
+	// 暂停时创建，恢复时关闭
+	resumed				chan struct{}
+	// 暂停期间设置的扫块高度，恢复时生效
+	height				uint32
+	heightSet			bool
+}
+
+// 扫块状态
+type WatcherStatus struct {
+	// 下一个要请求的块高
+	ScanBlockHeight				uint32		`json:"scan_block_height"`
+	// 已交付的块高，见CommittedBlockHeight
+	CommittedBlockHeight		uint32		`json:"committed_block_height"`
+	HeadBlockNum				uint32		`json:"head_block_num"`
+	LastIrreversibleBlockNum	uint32		`json:"last_irreversible_block_num"`
+	// 已交付的块高落后不可逆块的块数
+	Lag							uint32		`json:"lag"`
+	Paused						bool		`json:"paused"`
+}
+
+func (ew *EOSWatcherMain) Status() *WatcherStatus {
+	status := &WatcherStatus{
+		ScanBlockHeight:			atomic.LoadUint32(&ew.ScanBlockHeight),
+		CommittedBlockHeight:		ew.CommittedBlockHeight(),
+		HeadBlockNum:				atomic.LoadUint32(&ew.HeadBlockNum),
+		LastIrreversibleBlockNum:	atomic.LoadUint32(&ew.LastIrreversibleBlockNum),
+		Paused:						ew.ScanPaused(),
+	}
+	if status.LastIrreversibleBlockNum > status.CommittedBlockHeight {
+		status.Lag = status.LastIrreversibleBlockNum - status.CommittedBlockHeight
+	}
+	return status
+}
+
+// 暂停扫块：不再请求新的块，已开始的块照常交付。 可逆块跟踪、回溯扫描不受影响
+func (ew *EOSWatcherMain) PauseScan() {
+	ew.scanControl.lock.Lock()
+	defer ew.scanControl.lock.Unlock()
+	if !ew.scanControl.paused {
+		ew.scanControl.paused = true
+		ew.scanControl.resumed = make(chan struct{})
+		log.Info("EOS scan paused")
+	}
+}
+
+func (ew *EOSWatcherMain) ResumeScan() {
+	ew.scanControl.lock.Lock()
+	defer ew.scanControl.lock.Unlock()
+	if ew.scanControl.paused {
+		ew.scanControl.paused = false
+		close(ew.scanControl.resumed)
+		log.Info("EOS scan resumed")
+	}
+}
+
+func (ew *EOSWatcherMain) ScanPaused() bool {
+	ew.scanControl.lock.Lock()
+	defer ew.scanControl.lock.Unlock()
+	return ew.scanControl.paused
+}
+
+// 设置扫块高度，恢复后从这里重新扫描。 只能在暂停时设置；往回设置时，已交付的事件不会重复发出
+func (ew *EOSWatcherMain) SetScanHeight(height uint32) error {
+	if height == 0 {
+		return errors.New("Scan height must be positive.")
+	}
+	ew.scanControl.lock.Lock()
+	defer ew.scanControl.lock.Unlock()
+	if !ew.scanControl.paused {
+		return errors.New("Pause scanning before setting scan height.")
+	}
+	ew.scanControl.height = height
+	ew.scanControl.heightSet = true
+	log.Info("EOS scan height set", "ScanBlockHeight", height)
+	return nil
+}
+
+// 暂停时阻塞，直到恢复或ctx 结束（ok 为false）。
+// 暂停期间设置了扫块高度时，等待已开始的块扫描完，通知交付协程从新高度开始，reset 为true
+func (ew *EOSWatcherMain) waitScanResumed(ctx context.Context, workers *sync.WaitGroup, resultChan chan<- *scannedBlock) (reset bool, ok bool) {
+	ew.scanControl.lock.Lock()
+	paused, resumed := ew.scanControl.paused, ew.scanControl.resumed
+	ew.scanControl.lock.Unlock()
+	if paused {
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return false, false
+		}
+	}
+
+	ew.scanControl.lock.Lock()
+	height, heightSet := ew.scanControl.height, ew.scanControl.heightSet
+	ew.scanControl.heightSet = false
+	ew.scanControl.lock.Unlock()
+	if heightSet {
+		// 在途的块全部进入resultChan 之后，交付协程才会收到重置
+		workers.Wait()
+		resultChan <- &scannedBlock{BlockNum: height, Reset: true}
+		atomic.StoreUint32(&ew.ScanBlockHeight, height)
+	}
+	return heightSet, true
+}
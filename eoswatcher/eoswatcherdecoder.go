@@ -0,0 +1,303 @@
+package eoswatcher
+
+import (
+	"github.com/eoscanada/eos-go"
+	"github.com/eoscanada/eos-go/token"
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// 解析action 时的上下文
+type ActionDecodeContext struct {
+	// 网关名
+	Gateway				eos.AccountName
+	// action 匹配到的合约配置
+	TokenContract		*TokenContract
+	// action 所在的块高，查询交易时为交易的块高
+	BlockNum			uint32
+	// 块高生效的合约ABI，不为nil 时二进制数据先按ABI 解析成字段，再交给DecodeJSON，见ABICache
+	ABI					*ContractABI
+}
+
+// action 解析器：把action 数据解析成EOSPush事件，只需填充From、To、Memo、Amount、Symbol、Precision、EventType 等数据相关字段，
+// TxID、BlockNum 等交易相关字段由watcher 填充
+type ActionDecoder interface {
+	// 扫块时调用：action 数据为二进制。 合约在eos-go 中注册过时，ActionData.Data 为解析好的结构体，否则需要从ActionData.HexData 解析
+	DecodeBinary(action *eos.Action, ctx *ActionDecodeContext) (*EOSPushEvent, error)
+	// 查询交易时调用：data 为history API 返回的json
+	DecodeJSON(data map[string]interface{}, ctx *ActionDecodeContext) (*EOSPushEvent, error)
+}
+
+type actionDecoderKey struct {
+	Account				eos.AccountName
+	Name				eos.ActionName
+}
+
+// action 解析器注册表，按 合约名+方法名 查找解析器。
+// 合约名为空的解析器，对所有合约的该方法生效；同时注册时，指定合约的解析器优先
+type ActionDecoderRegistry struct {
+	lock				sync.RWMutex
+	decoders			map[actionDecoderKey]ActionDecoder
+}
+
+// 创建注册表，并注册内置的 transfer、solvent、issue 解析器
+func NewActionDecoderRegistry() *ActionDecoderRegistry {
+	registry := &ActionDecoderRegistry{
+		decoders:	make(map[actionDecoderKey]ActionDecoder),
+	}
+	registry.Register("", eos.ActN("transfer"), &TransferDecoder{})
+	registry.Register("", eos.ActN("solvent"), &SolventDecoder{})
+	registry.Register("", eos.ActN("issue"), &IssueDecoder{})
+	return registry
+}
+
+// 注册解析器，account 为空时对所有合约生效。 重复注册会覆盖之前的解析器
+func (registry *ActionDecoderRegistry) Register(account eos.AccountName, name eos.ActionName, decoder ActionDecoder) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.decoders[actionDecoderKey{Account: account, Name: name}] = decoder
+}
+
+// 查找解析器，找不到返回nil
+func (registry *ActionDecoderRegistry) Lookup(account eos.AccountName, name eos.ActionName) ActionDecoder {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	if decoder, ok := registry.decoders[actionDecoderKey{Account: account, Name: name}]; ok {
+		return decoder
+	}
+	return registry.decoders[actionDecoderKey{Name: name}]
+}
+
+// 已注册的 合约名:方法名 列表，合约名为空时为 *
+func (registry *ActionDecoderRegistry) List() []string {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	var list []string
+	for key := range registry.decoders {
+		account := string(key.Account)
+		if account == "" {
+			account = "*"
+		}
+		list = append(list, account + ":" + string(key.Name))
+	}
+	sort.Strings(list)
+	return list
+}
+
+// 解析action 数据。 扫块时为二进制数据，合约ABI 可用时按ABI 解析成字段；查询交易时为json
+func (registry *ActionDecoderRegistry) Decode(action *eos.Action, ctx *ActionDecodeContext) (*EOSPushEvent, error) {
+	decoder := registry.Lookup(action.Account, action.Name)
+	if decoder == nil {
+		return nil, errors.New("Action data parse error.")
+	}
+	if data, ok := action.ActionData.Data.(map[string]interface{}); ok {
+		return decoder.DecodeJSON(data, ctx)
+	}
+	if ctx.ABI != nil {
+		data, err := ctx.ABI.DecodeAction(action.Name, action.ActionData.HexData)
+		if err == nil {
+			return decoder.DecodeJSON(data, ctx)
+		}
+		// ABI 中没有该action 或者数据不匹配，使用内置的结构体解析
+		log.Debug("Action data abi decode error", "Account", action.Account, "Name", action.Name, "BlockNum", ctx.BlockNum, "info", err)
+	}
+	return decoder.DecodeBinary(action, ctx)
+}
+
+// 取出二进制action 数据：已经解析成obj 同类型的结构体时直接复制，否则从HexData 解析
+func UnmarshalActionData(action *eos.Action, obj interface{}) error {
+	data := action.ActionData.Data
+	if data != nil && reflect.TypeOf(data) == reflect.TypeOf(obj) {
+		reflect.ValueOf(obj).Elem().Set(reflect.ValueOf(data).Elem())
+		return nil
+	}
+	if len(action.ActionData.HexData) == 0 {
+		return errors.New("Action Data reflect error.")
+	}
+	return eos.UnmarshalBinary(action.ActionData.HexData, obj)
+}
+
+// 检查金额的精度、货币名称是否与合约配置一致
+func checkQuantity(quantity eos.Asset, tokenContract *TokenContract) error {
+	if quantity.Symbol.Precision != tokenContract.Precision {
+		return errors.New("Action Data 'quantity' field precision error.")
+	}
+	if quantity.Symbol.Symbol != tokenContract.Symbol {
+		return errors.New("Action Data 'quantity' field symbol error.")
+	}
+	return nil
+}
+
+// 解析json 中的金额字段
+func parseJSONQuantity(data map[string]interface{}, tokenContract *TokenContract) (eos.Asset, error) {
+	quantity, ok := data["quantity"].(string)
+	if ok == false {
+		return eos.Asset{}, errors.New("Action Data 'quantity' field error")
+	}
+	asset, err := eos.NewAsset(quantity)
+	if err != nil {
+		return eos.Asset{}, errors.New("Action Data 'quantity' field unmarshal error.")
+	}
+	if err := checkQuantity(asset, tokenContract); err != nil {
+		return eos.Asset{}, err
+	}
+	return asset, nil
+}
+
+func newEOSPushEventFromAsset(quantity eos.Asset, memo string) *EOSPushEvent {
+	return &EOSPushEvent{
+		Memo:		memo,
+		Amount:		uint64(quantity.Amount),
+		Symbol:		quantity.Symbol.Symbol,
+		Precision:	quantity.Symbol.Precision,
+	}
+}
+
+// 内置解析器：转账。 转入网关的为溶币，网关转出的为完成提现，与网关无关的转账不解析
+type TransferDecoder struct{}
+
+func (decoder *TransferDecoder) DecodeBinary(action *eos.Action, ctx *ActionDecodeContext) (*EOSPushEvent, error) {
+	var transferToken token.Transfer
+	if err := UnmarshalActionData(action, &transferToken); err != nil {
+		return nil, err
+	}
+	if transferToken.From != ctx.Gateway && transferToken.To != ctx.Gateway {
+		return nil, errors.New("Transaction is not related to the gateway")
+	}
+	if err := checkQuantity(transferToken.Quantity, ctx.TokenContract); err != nil {
+		return nil, err
+	}
+	return newTransferEvent(transferToken.From, transferToken.To, transferToken.Quantity, transferToken.Memo, ctx), nil
+}
+
+// 转入网关为溶币，网关转出为完成提现（退款需要通过BindProposal 标记）
+func newTransferEvent(from, to eos.AccountName, quantity eos.Asset, memo string, ctx *ActionDecodeContext) *EOSPushEvent {
+	eosPushEvent := newEOSPushEventFromAsset(quantity, memo)
+	eosPushEvent.From = from
+	eosPushEvent.To = to
+	if to == ctx.Gateway {
+		eosPushEvent.EventType = EventTypeDeposit
+	} else {
+		eosPushEvent.EventType = EventTypeWithdrawalConfirmed
+	}
+	return eosPushEvent
+}
+
+func (decoder *TransferDecoder) DecodeJSON(data map[string]interface{}, ctx *ActionDecodeContext) (*EOSPushEvent, error) {
+	if len(data) != 4 {
+		return nil, errors.New("Action Data length error.")
+	}
+
+	// 解析actionData的具体字段
+	from, ok := data["from"].(string)
+	if ok == false {
+		return nil, errors.New("Action Data 'from' field error")
+	}
+	to, ok := data["to"].(string)
+	if ok == false {
+		return nil, errors.New("Action Data 'to' field error")
+	}
+	if eos.AN(from) != ctx.Gateway && eos.AN(to) != ctx.Gateway {
+		return nil, errors.New("Transaction is not related to the gateway")
+	}
+
+	quantity, err := parseJSONQuantity(data, ctx.TokenContract)
+	if err != nil {
+		return nil, err
+	}
+
+	memo, ok := data["memo"].(string)
+	if ok == false {
+		return nil, errors.New("Action Data 'memo' field error")
+	}
+	return newTransferEvent(eos.AN(from), eos.AN(to), quantity, memo, ctx), nil
+}
+
+// 内置解析器：网关合约的溶币方法
+type SolventDecoder struct{}
+
+func (decoder *SolventDecoder) DecodeBinary(action *eos.Action, ctx *ActionDecodeContext) (*EOSPushEvent, error) {
+	var solventToken Solvent
+	if err := UnmarshalActionData(action, &solventToken); err != nil {
+		return nil, err
+	}
+	if err := checkQuantity(solventToken.Quantity, ctx.TokenContract); err != nil {
+		return nil, err
+	}
+	eosPushEvent := newEOSPushEventFromAsset(solventToken.Quantity, solventToken.Memo)
+	eosPushEvent.From = solventToken.From
+	eosPushEvent.EventType = EventTypeSolvent
+	return eosPushEvent, nil
+}
+
+func (decoder *SolventDecoder) DecodeJSON(data map[string]interface{}, ctx *ActionDecodeContext) (*EOSPushEvent, error) {
+	if len(data) != 3 {
+		return nil, errors.New("Action Data length error.")
+	}
+
+	// 解析actionData的具体字段
+	from, ok := data["from"].(string)
+	if ok == false {
+		return nil, errors.New("Action Data 'from' field error")
+	}
+
+	quantity, err := parseJSONQuantity(data, ctx.TokenContract)
+	if err != nil {
+		return nil, err
+	}
+
+	memo, ok := data["memo"].(string)
+	if ok == false {
+		return nil, errors.New("Action Data 'memo' field error")
+	}
+	eosPushEvent := newEOSPushEventFromAsset(quantity, memo)
+	eosPushEvent.From = eos.AN(from)
+	eosPushEvent.EventType = EventTypeSolvent
+	return eosPushEvent, nil
+}
+
+// 内置解析器：网关合约的铸币方法
+type IssueDecoder struct{}
+
+func (decoder *IssueDecoder) DecodeBinary(action *eos.Action, ctx *ActionDecodeContext) (*EOSPushEvent, error) {
+	var issueToken token.Issue
+	if err := UnmarshalActionData(action, &issueToken); err != nil {
+		return nil, err
+	}
+	if err := checkQuantity(issueToken.Quantity, ctx.TokenContract); err != nil {
+		return nil, err
+	}
+	eosPushEvent := newEOSPushEventFromAsset(issueToken.Quantity, issueToken.Memo)
+	eosPushEvent.To = issueToken.To
+	eosPushEvent.EventType = EventTypeIssue
+	return eosPushEvent, nil
+}
+
+func (decoder *IssueDecoder) DecodeJSON(data map[string]interface{}, ctx *ActionDecodeContext) (*EOSPushEvent, error) {
+	if len(data) != 3 {
+		return nil, errors.New("Action Data length error.")
+	}
+
+	// 解析actionData的具体字段
+	to, ok := data["to"].(string)
+	if ok == false {
+		return nil, errors.New("Action Data 'to' field error")
+	}
+
+	quantity, err := parseJSONQuantity(data, ctx.TokenContract)
+	if err != nil {
+		return nil, err
+	}
+
+	memo, ok := data["memo"].(string)
+	if ok == false {
+		return nil, errors.New("Action Data 'memo' field error")
+	}
+	eosPushEvent := newEOSPushEventFromAsset(quantity, memo)
+	eosPushEvent.To = eos.AN(to)
+	eosPushEvent.EventType = EventTypeIssue
+	return eosPushEvent, nil
+}
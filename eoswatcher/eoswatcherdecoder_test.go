@@ -0,0 +1,149 @@
+package eoswatcher
+
+import (
+	"testing"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/eoscanada/eos-go/token"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoDecoder struct{}
+
+func (decoder *memoDecoder) DecodeBinary(action *eos.Action, ctx *ActionDecodeContext) (*EOSPushEvent, error) {
+	return &EOSPushEvent{Memo: "binary", Symbol: ctx.TokenContract.Symbol}, nil
+}
+
+func (decoder *memoDecoder) DecodeJSON(data map[string]interface{}, ctx *ActionDecodeContext) (*EOSPushEvent, error) {
+	return &EOSPushEvent{Memo: "json", Symbol: ctx.TokenContract.Symbol}, nil
+}
+
+func TestActionDecoderRegistryLookup(t *testing.T) {
+	registry := NewActionDecoderRegistry()
+	assert.Equal(t, []string{"*:issue", "*:solvent", "*:transfer"}, registry.List())
+
+	// 指定合约的解析器优先于通用解析器
+	registry.Register(eos.AN("gatewaytoken"), eos.ActN("transfer"), &memoDecoder{})
+	_, ok := registry.Lookup(eos.AN("gatewaytoken"), eos.ActN("transfer")).(*memoDecoder)
+	assert.True(t, ok)
+	_, ok = registry.Lookup(eos.AN("eosio.token"), eos.ActN("transfer")).(*TransferDecoder)
+	assert.True(t, ok)
+
+	assert.Nil(t, registry.Lookup(eos.AN("eosio.token"), eos.ActN("destroytoken")))
+
+	ctx := &ActionDecodeContext{
+		Gateway:		eos.AN("gateway11111"),
+		TokenContract:	&TokenContract{Symbol: "WBTC", Precision: 8},
+	}
+	action := &eos.Action{Account: eos.AN("gatewaytoken"), Name: eos.ActN("transfer")}
+	action.ActionData.Data = map[string]interface{}{}
+	eosPushEvent, err := registry.Decode(action, ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "json", eosPushEvent.Memo)
+	assert.Equal(t, "WBTC", eosPushEvent.Symbol)
+
+	action.Name = eos.ActN("destroytoken")
+	_, err = registry.Decode(action, ctx)
+	assert.NotNil(t, err)
+}
+
+func TestTransferDecoder(t *testing.T) {
+	ctx := &ActionDecodeContext{
+		Gateway:		eos.AN("gateway11111"),
+		TokenContract:	&TokenContract{Symbol: "EOS", Precision: 4},
+	}
+	quantity := eos.Asset{Amount: 12345, Symbol: eos.Symbol{Precision: 4, Symbol: "EOS"}}
+	action := &eos.Action{Account: eos.AN("eosio.token"), Name: eos.ActN("transfer")}
+	action.ActionData.Data = &token.Transfer{
+		From:		eos.AN("alice1111111"),
+		To:			eos.AN("gateway11111"),
+		Quantity:	quantity,
+		Memo:		"memo",
+	}
+
+	decoder := &TransferDecoder{}
+	eosPushEvent, err := decoder.DecodeBinary(action, ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(12345), eosPushEvent.Amount)
+	assert.Equal(t, "memo", eosPushEvent.Memo)
+	assert.Equal(t, "alice1111111", eosPushEvent.GetFrom())
+	assert.Equal(t, "gateway11111", eosPushEvent.GetTo())
+	assert.Equal(t, EventTypeDeposit, eosPushEvent.GetEventType())
+
+	// 网关转出为完成提现
+	action.ActionData.Data = &token.Transfer{
+		From:		eos.AN("gateway11111"),
+		To:			eos.AN("alice1111111"),
+		Quantity:	quantity,
+	}
+	eosPushEvent, err = decoder.DecodeBinary(action, ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, EventTypeWithdrawalConfirmed, eosPushEvent.GetEventType())
+
+	// 与网关无关的转账不解析
+	action.ActionData.Data = &token.Transfer{
+		From:		eos.AN("alice1111111"),
+		To:			eos.AN("bob111111111"),
+		Quantity:	quantity,
+	}
+	_, err = decoder.DecodeBinary(action, ctx)
+	assert.NotNil(t, err)
+
+	// 查询交易时接受网关转出
+	eosPushEvent, err = decoder.DecodeJSON(map[string]interface{}{
+		"from":		"gateway11111",
+		"to":		"alice1111111",
+		"quantity":	"1.2345 EOS",
+		"memo":		"refund",
+	}, ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "refund", eosPushEvent.Memo)
+	assert.Equal(t, EventTypeWithdrawalConfirmed, eosPushEvent.GetEventType())
+
+	_, err = decoder.DecodeJSON(map[string]interface{}{
+		"from":		"gateway11111",
+		"to":		"alice1111111",
+		"quantity":	"1.2345 WBTC",
+		"memo":		"refund",
+	}, ctx)
+	assert.NotNil(t, err)
+}
+
+func TestLegacyWatcherActionDecoders(t *testing.T) {
+	// 每个watcher 有自己的解析器，修改合约后旧合约的action 不再被解析成溶币
+	ew := &EOSWatcher{ActionDecoders: NewActionDecoderRegistry(), ActionNameDestroy: eos.ActN("destroytoken"), ActionNameCreate: eos.ActN("createtoken")}
+	ew.UpdateActionAccount("xintoken1111")
+	other := &EOSWatcher{ActionDecoders: NewActionDecoderRegistry(), ActionNameDestroy: eos.ActN("destroytoken"), ActionNameCreate: eos.ActN("createtoken")}
+	other.UpdateActionAccount("xintoken2222")
+
+	action := &eos.Action{Account: eos.AN("xintoken1111"), Name: eos.ActN("destroytoken")}
+	action.ActionData.Data = &DestroyToken{User: eos.AN("alice1111111"), Amount: 12, Memo: "memo"}
+	eosPushEvent, err := ew.ActionDecoders.Decode(action, &ActionDecodeContext{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(12), eosPushEvent.Amount)
+	assert.Equal(t, "memo", eosPushEvent.Memo)
+	assert.Equal(t, "XIN", eosPushEvent.Symbol)
+	_, err = other.ActionDecoders.Decode(action, &ActionDecodeContext{})
+	assert.NotNil(t, err)
+
+	// 查询交易时的json 数据
+	action.ActionData.Data = map[string]interface{}{"user": "alice1111111", "amount": float64(7), "memo": "json"}
+	eosPushEvent, err = ew.actionToEOSPushEvent(&eos.TransactionResp{ID: eos.SHA256Bytes{0x01}, BlockNum: 100}, action)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), eosPushEvent.Amount)
+	assert.Equal(t, uint32(100), eosPushEvent.BlockNum)
+
+	// 合约watcher 按配置的货币名称、精度检查金额
+	ewc := &EOSWatcherContract{ActionDecoders: NewActionDecoderRegistry(), ActionAccount: eos.AN("gatewaytoken"),
+		ActionNameDestroy: eos.ActN("solvent"), ActionNameCreate: eos.ActN("issue"), Symbol: "WBTC", Precision: 8}
+	ewc.registerActionDecoders()
+	action = &eos.Action{Account: eos.AN("gatewaytoken"), Name: eos.ActN("solvent")}
+	action.ActionData.Data = &Solvent{Quantity: eos.Asset{Amount: 100, Symbol: eos.Symbol{Precision: 8, Symbol: "WBTC"}}, Memo: "addr"}
+	eosPushEvent, err = ewc.ActionDecoders.Decode(action, ewc.actionDecodeContext(100))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), eosPushEvent.Amount)
+	assert.Equal(t, "addr", eosPushEvent.Memo)
+	action.ActionData.Data = &Solvent{Quantity: eos.Asset{Amount: 100, Symbol: eos.Symbol{Precision: 4, Symbol: "EOS"}}, Memo: "addr"}
+	_, err = ewc.ActionDecoders.Decode(action, ewc.actionDecodeContext(100))
+	assert.NotNil(t, err)
+}
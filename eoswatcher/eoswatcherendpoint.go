@@ -0,0 +1,543 @@
+package eoswatcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"eosc/tools/metrics"
+	"fmt"
+	"github.com/eoscanada/eos-go"
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 错误率、延迟的滑动平均权重
+	endpointStatsWeight = 0.2
+	// 健康评分中，错误率为1 相当于多少秒延迟
+	endpointErrorPenalty = 10.0
+	// 健康评分中，不可逆块落后一个块相当于多少秒延迟
+	endpointLagPenalty = 0.5
+	// 定时探测所有节点的间隔，更新不可逆块高、链ID
+	endpointProbeInterval = 10 * time.Second
+)
+
+// 一个nodeos 节点及其健康状况
+type Endpoint struct {
+	API							*eos.API
+
+	// 最近一次get_info 返回的不可逆块高
+	LastIrreversibleBlockNum	uint32
+	// 错误率、延迟，滑动平均
+	ErrorRate					float64
+	Latency						time.Duration
+	// 链ID 与节点池的不一致，不使用。 定时探测时链ID 恢复一致后重新启用
+	Disabled					bool
+}
+
+// 健康评分，越小越健康。 maxLIB 为所有节点中最高的不可逆块高
+func (endpoint *Endpoint) score(maxLIB uint32) float64 {
+	score := endpoint.Latency.Seconds() + endpoint.ErrorRate * endpointErrorPenalty
+	if maxLIB > endpoint.LastIrreversibleBlockNum {
+		score += float64(maxLIB - endpoint.LastIrreversibleBlockNum) * endpointLagPenalty
+	}
+	return score
+}
+
+// 多节点池：get_info、get_block、push_transaction 按健康评分依次尝试，出错时切换到下一个节点；
+// Start 之后定时探测所有节点（含停用的），更新不可逆块高、检查链ID，节点恢复后也能重新被选中
+type EndpointPool struct {
+	lock						sync.Mutex
+	endpoints					[]*Endpoint
+	// 所有节点应当一致的链ID：创建时指定，或VerifyChainID 时所有节点一致才确定；只有一个节点时为它第一次返回的链ID
+	chainID						eos.SHA256Bytes
+	// 探测协程，见Start
+	running						sync.WaitGroup
+
+	// 请求一个节点的链信息、块，向一个节点发送交易，测试时替换
+	getInfo						func(api *eos.API) (*eos.InfoResp, error)
+	getBlock					func(api *eos.API, id string) (*eos.BlockResp, error)
+	pushTransaction				func(api *eos.API, tx *eos.PackedTransaction) (*eos.PushTransactionFullResp, error)
+}
+
+// 一个节点的请求错误
+type EndpointError struct {
+	URL							string
+	Err							error
+}
+
+// push_transaction 在所有节点上都失败。 前面的节点可能超时后已接收交易，只看最后一个节点的错误会误判
+type PushTransactionError struct {
+	// 各节点的错误，按请求顺序
+	Errors						[]*EndpointError
+}
+
+func (err *PushTransactionError) Error() string {
+	var messages []string
+	for _, endpointErr := range err.Errors {
+		messages = append(messages, endpointErr.URL + ": " + endpointErr.Err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// 与链交互的API，nodeos 不支持keep alive
+func newEosAPI(url string) *eos.API {
+	return &eos.API{
+		HttpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: (&net.Dialer{
+					Timeout:   5 * time.Second,
+					KeepAlive: 5 * time.Second,
+					DualStack: true,
+				}).DialContext,
+				MaxIdleConns:          100,
+				IdleConnTimeout:       90 * time.Second,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ExpectContinueTimeout: 1 * time.Second,
+				DisableKeepAlives:     true, // default behavior, because of `nodeos`'s lack of support for Keep alives.
+			},
+		},
+		BaseURL:  url,
+		Compress: eos.CompressionZlib,
+	}
+}
+
+// 创建节点池，不请求网络。 chainID 为期望的链ID，为nil 时见VerifyChainID
+func NewEndpointPool(urls []string, chainID eos.SHA256Bytes) *EndpointPool {
+	pool := &EndpointPool{
+		chainID:			chainID,
+		getInfo:			(*eos.API).GetInfo,
+		getBlock:			(*eos.API).GetBlockByID,
+		pushTransaction:	(*eos.API).PushTransaction,
+	}
+	for _, url := range urls {
+		pool.endpoints = append(pool.endpoints, &Endpoint{API: newEosAPI(url)})
+	}
+	return pool
+}
+
+// 第一个节点的API，用于get_transaction 等不需要切换节点的请求
+func (pool *EndpointPool) Primary() *eos.API {
+	return pool.endpoints[0].API
+}
+
+// 所有节点的url
+func (pool *EndpointPool) URLs() []string {
+	var urls []string
+	for _, endpoint := range pool.endpoints {
+		urls = append(urls, endpoint.API.BaseURL)
+	}
+	return urls
+}
+
+// 链ID，还没有确定时为nil
+func (pool *EndpointPool) ChainID() eos.SHA256Bytes {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return pool.chainID
+}
+
+// 各节点健康状况的快照
+func (pool *EndpointPool) Endpoints() []Endpoint {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	var endpoints []Endpoint
+	for _, endpoint := range pool.endpoints {
+		endpoints = append(endpoints, *endpoint)
+	}
+	return endpoints
+}
+
+// 请求所有节点的链信息，检查链ID。 没有指定链ID 时，所有返回的节点链ID 一致才确定下来。
+// 所有节点都请求失败、或有节点链ID 不一致时返回错误
+func (pool *EndpointPool) VerifyChainID() error {
+	infoResps := pool.probe()
+	if len(infoResps) == 0 {
+		return errors.New("No available EOS endpoint.")
+	}
+	if err := pool.pinChainID(infoResps); err != nil {
+		return err
+	}
+	for _, endpoint := range pool.Endpoints() {
+		if endpoint.Disabled {
+			return errors.New("EOS endpoint " + endpoint.API.BaseURL + " chain id mismatch.")
+		}
+	}
+	return nil
+}
+
+// 请求链信息，按健康评分依次尝试，链ID 不一致的节点被停用
+func (pool *EndpointPool) GetInfo() (out *eos.InfoResp, err error) {
+	err = pool.call("get_info", func(api *eos.API) (err error) {
+		infoResp, err := pool.getInfo(api)
+		if err != nil {
+			return err
+		}
+		if !pool.checkChainID(pool.endpoint(api), infoResp) {
+			return errors.New("EOS endpoint " + api.BaseURL + " chain id mismatch.")
+		}
+		out = infoResp
+		return nil
+	})
+	return
+}
+
+// 定时探测所有节点，ctx 结束后退出，见Stop
+func (pool *EndpointPool) Start(ctx context.Context) {
+	pool.running.Add(1)
+	go func() {
+		defer pool.running.Done()
+		for sleepContext(ctx, endpointProbeInterval) {
+			if err := pool.pinChainID(pool.probe()); err != nil {
+				log.Error("EOS endpoints chain id not pinned", "info", err)
+			}
+		}
+	}()
+}
+
+// 等待探测协程退出（ctx 已结束）
+func (pool *EndpointPool) Stop() {
+	pool.running.Wait()
+}
+
+// 请求块，出错时切换节点。 节点的不可逆块高可能低于id，返回的块可能是可逆的，不可逆的块使用GetIrreversibleBlock
+func (pool *EndpointPool) GetBlockByID(id string) (out *eos.BlockResp, err error) {
+	err = pool.call("get_block", func(api *eos.API) (err error) {
+		out, err = pool.getBlock(api, id)
+		return
+	})
+	return
+}
+
+// 请求不可逆的块，只使用不可逆块高不低于blockNum 的节点，落后、分叉的节点可能返回可逆的块
+func (pool *EndpointPool) GetIrreversibleBlock(blockNum uint32) (out *eos.BlockResp, err error) {
+	endpoints := pool.irreversible(blockNum)
+	if len(endpoints) == 0 {
+		return nil, errors.New(fmt.Sprintf("No EOS endpoint has block %d irreversible.", blockNum))
+	}
+	endpointErrs := pool.callEndpoints("get_block", endpoints, func(api *eos.API) (err error) {
+		out, err = pool.getBlock(api, fmt.Sprintf("%d", blockNum))
+		return
+	})
+	if len(endpointErrs) > 0 {
+		return nil, endpointErrs[len(endpointErrs) - 1].Err
+	}
+	return out, nil
+}
+
+// 发送交易，出错时切换节点。 同一笔交易重复发送会被节点拒绝，不会重复执行。
+// 所有节点都失败时返回 *PushTransactionError，含每个节点的错误
+func (pool *EndpointPool) PushTransaction(tx *eos.PackedTransaction) (out *eos.PushTransactionFullResp, err error) {
+	endpointErrs := pool.callEach("push_transaction", func(api *eos.API) (err error) {
+		out, err = pool.pushTransaction(api, tx)
+		return
+	})
+	if len(endpointErrs) > 0 {
+		return nil, &PushTransactionError{Errors: endpointErrs}
+	}
+	return out, nil
+}
+
+// 请求交易的执行结果（需要history 插件），出错时切换节点
+func (pool *EndpointPool) GetTransaction(txid string) (out *eos.TransactionResp, err error) {
+	err = pool.call("get_transaction", func(api *eos.API) (err error) {
+		out, err = api.GetTransaction(txid)
+		return
+	})
+	return
+}
+
+// 请求账户信息（权限、资源），出错时切换节点
+func (pool *EndpointPool) GetAccount(account eos.AccountName) (out *eos.AccountResp, err error) {
+	err = pool.call("get_account", func(api *eos.API) (err error) {
+		out, err = api.GetAccount(account)
+		return
+	})
+	return
+}
+
+// 请求系统合约的RAM 市场（rammarket 表）：RAM 余额（字节）、EOS 余额（最小单位）
+func (pool *EndpointPool) GetRAMMarket() (ramBytes, quote int64, err error) {
+	err = pool.call("get_table_rows", func(api *eos.API) (err error) {
+		ramBytes, quote, err = getRAMMarket(api)
+		return
+	})
+	return
+}
+
+func getRAMMarket(api *eos.API) (int64, int64, error) {
+	body, err := json.Marshal(map[string]interface{}{"code": "eosio", "scope": "eosio", "table": "rammarket", "json": true})
+	if err != nil {
+		return 0, 0, err
+	}
+	resp, err := api.HttpClient.Post(api.BaseURL + "/v1/chain/get_table_rows", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("get_table_rows status %d", resp.StatusCode)
+	}
+
+	var tableResp struct {
+		Rows			[]struct {
+			Base		struct {
+				Balance		string		`json:"balance"`
+			}								`json:"base"`
+			Quote		struct {
+				Balance		string		`json:"balance"`
+			}								`json:"quote"`
+		}									`json:"rows"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tableResp); err != nil {
+		return 0, 0, err
+	}
+	if len(tableResp.Rows) == 0 {
+		return 0, 0, errors.New("EOS rammarket is empty.")
+	}
+	base, err := eos.NewAsset(tableResp.Rows[0].Base.Balance)
+	if err != nil {
+		return 0, 0, err
+	}
+	quote, err := eos.NewAsset(tableResp.Rows[0].Quote.Balance)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int64(base.Amount), int64(quote.Amount), nil
+}
+
+// 请求合约当前的ABI，合约没有ABI 时返回错误
+func (pool *EndpointPool) GetABI(account eos.AccountName) (out *ContractABI, err error) {
+	err = pool.call("get_abi", func(api *eos.API) error {
+		abi, err := getABI(api, account)
+		out = abi
+		return err
+	})
+	return
+}
+
+func getABI(api *eos.API, account eos.AccountName) (*ContractABI, error) {
+	body, err := json.Marshal(map[string]string{"account_name": string(account)})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := api.HttpClient.Post(api.BaseURL + "/v1/chain/get_abi", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get_abi status %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseABIResp(account, data)
+}
+
+// 解析get_abi 的返回
+func parseABIResp(account eos.AccountName, data []byte) (*ContractABI, error) {
+	var abiResp struct {
+		AccountName		string				`json:"account_name"`
+		ABI				*ContractABI		`json:"abi"`
+	}
+	if err := json.Unmarshal(data, &abiResp); err != nil {
+		return nil, err
+	}
+	if abiResp.ABI == nil {
+		return nil, errors.New("EOS contract '" + string(account) + "' has no abi.")
+	}
+	return abiResp.ABI, nil
+}
+
+// 并发请求所有节点（含停用的）的get_info，更新健康状况，返回链ID 一致的节点的结果
+func (pool *EndpointPool) probe() map[*Endpoint]*eos.InfoResp {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	infoResps := make(map[*Endpoint]*eos.InfoResp)
+	for _, endpoint := range pool.endpoints {
+		wg.Add(1)
+		go func(endpoint *Endpoint) {
+			defer wg.Done()
+			start := time.Now()
+			infoResp, err := pool.getInfo(endpoint.API)
+			pool.record(endpoint, "get_info", time.Since(start), err)
+			if err != nil {
+				log.Debug("Get info error!", "EosAPI.BaseURL", endpoint.API.BaseURL, "info", err)
+				return
+			}
+			if !pool.checkChainID(endpoint, infoResp) {
+				return
+			}
+			lock.Lock()
+			infoResps[endpoint] = infoResp
+			lock.Unlock()
+		}(endpoint)
+	}
+	wg.Wait()
+	return infoResps
+}
+
+// 还没有链ID 时，探测到的节点链ID 全部一致才确定，否则返回错误
+func (pool *EndpointPool) pinChainID(infoResps map[*Endpoint]*eos.InfoResp) error {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if pool.chainID != nil || len(infoResps) == 0 {
+		return nil
+	}
+	var chainID eos.SHA256Bytes
+	for endpoint, infoResp := range infoResps {
+		if chainID != nil && !bytes.Equal(chainID, infoResp.ChainID) {
+			return errors.New("EOS endpoint " + endpoint.API.BaseURL + " chain id mismatch.")
+		}
+		chainID = infoResp.ChainID
+	}
+	pool.chainID = chainID
+	log.Info("EOS endpoints chain id pinned", "ChainID", hex.EncodeToString(chainID))
+	return nil
+}
+
+// 按健康评分依次尝试，直到成功，返回最后一个节点的错误
+func (pool *EndpointPool) call(method string, request func(api *eos.API) error) error {
+	endpointErrs := pool.callEach(method, request)
+	if len(endpointErrs) > 0 {
+		return endpointErrs[len(endpointErrs) - 1].Err
+	}
+	return nil
+}
+
+// 按健康评分依次尝试，直到成功。 成功时返回nil，否则返回每个节点的错误
+func (pool *EndpointPool) callEach(method string, request func(api *eos.API) error) []*EndpointError {
+	return pool.callEndpoints(method, pool.ordered(), request)
+}
+
+// 依次尝试endpoints，直到成功
+func (pool *EndpointPool) callEndpoints(method string, endpoints []*Endpoint, request func(api *eos.API) error) []*EndpointError {
+	if len(endpoints) == 0 {
+		return []*EndpointError{{Err: errors.New("No available EOS endpoint.")}}
+	}
+	var endpointErrs []*EndpointError
+	for _, endpoint := range endpoints {
+		start := time.Now()
+		err := request(endpoint.API)
+		pool.record(endpoint, method, time.Since(start), err)
+		if err == nil {
+			return nil
+		}
+		log.Debug("EOS endpoint request error, try next endpoint", "EosAPI.BaseURL", endpoint.API.BaseURL, "info", err)
+		endpointErrs = append(endpointErrs, &EndpointError{URL: endpoint.API.BaseURL, Err: err})
+	}
+	return endpointErrs
+}
+
+// 检查节点返回的链ID，不一致时停用节点，一致时（重新）启用并更新不可逆块高。
+// 还没有链ID 时不检查；只有一个节点时，以它返回的链ID 为准
+func (pool *EndpointPool) checkChainID(endpoint *Endpoint, infoResp *eos.InfoResp) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if pool.chainID == nil && len(pool.endpoints) == 1 {
+		pool.chainID = infoResp.ChainID
+	}
+	if pool.chainID != nil && !bytes.Equal(pool.chainID, infoResp.ChainID) {
+		if !endpoint.Disabled {
+			log.Error("EOS endpoint chain id mismatch, disabled",
+				"EosAPI.BaseURL", endpoint.API.BaseURL,
+				"ChainID", hex.EncodeToString(infoResp.ChainID),
+				"Expected", hex.EncodeToString(pool.chainID))
+		}
+		endpoint.Disabled = true
+		return false
+	}
+	if endpoint.Disabled {
+		endpoint.Disabled = false
+		log.Info("EOS endpoint chain id matches, enabled", "EosAPI.BaseURL", endpoint.API.BaseURL)
+	}
+	if infoResp.LastIrreversibleBlockNum > endpoint.LastIrreversibleBlockNum {
+		endpoint.LastIrreversibleBlockNum = infoResp.LastIrreversibleBlockNum
+	}
+	return true
+}
+
+// api 所属的节点
+func (pool *EndpointPool) endpoint(api *eos.API) *Endpoint {
+	for _, endpoint := range pool.endpoints {
+		if endpoint.API == api {
+			return endpoint
+		}
+	}
+	return nil
+}
+
+// 记录一次请求的结果，更新健康状况和监控指标
+func (pool *EndpointPool) record(endpoint *Endpoint, method string, latency time.Duration, err error) {
+	metrics.ObserveRPC(endpoint.API.BaseURL, method, latency, err)
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	var failed float64
+	if err != nil {
+		failed = 1
+	}
+	endpoint.ErrorRate = endpoint.ErrorRate * (1 - endpointStatsWeight) + failed * endpointStatsWeight
+	endpoint.Latency = time.Duration(float64(endpoint.Latency) * (1 - endpointStatsWeight) + float64(latency) * endpointStatsWeight)
+}
+
+// 可用的节点
+func (pool *EndpointPool) active() []*Endpoint {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	var endpoints []*Endpoint
+	for _, endpoint := range pool.endpoints {
+		if !endpoint.Disabled {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// 可用的节点，按健康评分从好到差排序
+func (pool *EndpointPool) ordered() []*Endpoint {
+	endpoints := pool.active()
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	var maxLIB uint32
+	for _, endpoint := range endpoints {
+		if endpoint.LastIrreversibleBlockNum > maxLIB {
+			maxLIB = endpoint.LastIrreversibleBlockNum
+		}
+	}
+	scores := make(map[*Endpoint]float64)
+	for _, endpoint := range endpoints {
+		scores[endpoint] = endpoint.score(maxLIB)
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return scores[endpoints[i]] < scores[endpoints[j]]
+	})
+	return endpoints
+}
+
+// 不可逆块高不低于blockNum 的可用节点，按健康评分从好到差排序
+func (pool *EndpointPool) irreversible(blockNum uint32) []*Endpoint {
+	endpoints := pool.ordered()
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	var irreversible []*Endpoint
+	for _, endpoint := range endpoints {
+		if endpoint.LastIrreversibleBlockNum >= blockNum {
+			irreversible = append(irreversible, endpoint)
+		}
+	}
+	return irreversible
+}
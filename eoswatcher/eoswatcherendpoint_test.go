@@ -0,0 +1,162 @@
+package eoswatcher
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpointPoolOrdered(t *testing.T) {
+	pool := NewEndpointPool([]string{"http://a", "http://b", "http://c"}, eos.SHA256Bytes("chain"))
+	a, b, c := pool.endpoints[0], pool.endpoints[1], pool.endpoints[2]
+
+	for _, endpoint := range pool.endpoints {
+		assert.True(t, pool.checkChainID(endpoint, &eos.InfoResp{ChainID: eos.SHA256Bytes("chain"), LastIrreversibleBlockNum: 1000}))
+		pool.record(endpoint, "get_info", 50 * time.Millisecond, nil)
+	}
+	assert.Equal(t, []*Endpoint{a, b, c}, pool.ordered())
+
+	// a 落后10 个块，b 连续出错
+	pool.checkChainID(b, &eos.InfoResp{ChainID: eos.SHA256Bytes("chain"), LastIrreversibleBlockNum: 1010})
+	pool.checkChainID(c, &eos.InfoResp{ChainID: eos.SHA256Bytes("chain"), LastIrreversibleBlockNum: 1010})
+	for i := 0; i < 5; i++ {
+		pool.record(b, "get_block", time.Second, errors.New("timeout"))
+	}
+	assert.Equal(t, []*Endpoint{c, a, b}, pool.ordered())
+
+	// b 恢复
+	for i := 0; i < 40; i++ {
+		pool.record(b, "get_block", time.Millisecond, nil)
+	}
+	assert.Equal(t, []*Endpoint{b, c, a}, pool.ordered())
+
+	// 链ID 不一致的节点被停用
+	assert.False(t, pool.checkChainID(c, &eos.InfoResp{ChainID: eos.SHA256Bytes("other")}))
+	assert.Equal(t, []*Endpoint{b, a}, pool.ordered())
+	assert.Equal(t, eos.SHA256Bytes("chain"), pool.ChainID())
+	// 链ID 恢复一致后重新启用
+	assert.True(t, pool.checkChainID(c, &eos.InfoResp{ChainID: eos.SHA256Bytes("chain")}))
+	assert.Len(t, pool.ordered(), 3)
+}
+
+func TestEndpointPoolGetInfo(t *testing.T) {
+	pool := NewEndpointPool([]string{"http://a", "http://b", "http://c"}, nil)
+	chainIDs := map[string]eos.SHA256Bytes{"http://a": eos.SHA256Bytes("chain"), "http://b": eos.SHA256Bytes("chain"), "http://c": eos.SHA256Bytes("other")}
+	var lock sync.Mutex
+	var requested []string
+	pool.getInfo = func(api *eos.API) (*eos.InfoResp, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		requested = append(requested, api.BaseURL)
+		return &eos.InfoResp{ChainID: chainIDs[api.BaseURL], LastIrreversibleBlockNum: 1000}, nil
+	}
+
+	// 没有指定链ID，节点不一致时不确定链ID
+	assert.NotNil(t, pool.VerifyChainID())
+	assert.Nil(t, pool.ChainID())
+
+	// 节点一致后确定链ID，之后c 返回别的链ID 时被停用
+	chainIDs["http://c"] = eos.SHA256Bytes("chain")
+	assert.Nil(t, pool.VerifyChainID())
+	assert.Equal(t, eos.SHA256Bytes("chain"), pool.ChainID())
+
+	// get_info 只请求最健康的节点
+	best := pool.ordered()[0]
+	requested = nil
+	infoResp, err := pool.GetInfo()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1000), infoResp.LastIrreversibleBlockNum)
+	assert.Equal(t, []string{best.API.BaseURL}, requested)
+
+	// 链ID 不一致的节点被停用，切换到下一个节点；探测到恢复一致后重新启用
+	best = pool.ordered()[0]
+	chainIDs[best.API.BaseURL] = eos.SHA256Bytes("other")
+	requested = nil
+	_, err = pool.GetInfo()
+	assert.Nil(t, err)
+	assert.Len(t, requested, 2)
+	assert.Len(t, pool.ordered(), 2)
+	chainIDs[best.API.BaseURL] = eos.SHA256Bytes("chain")
+	pool.probe()
+	assert.Len(t, pool.ordered(), 3)
+}
+
+func TestEndpointPoolGetIrreversibleBlock(t *testing.T) {
+	pool := NewEndpointPool([]string{"http://a", "http://b"}, eos.SHA256Bytes("chain"))
+	a, b := pool.endpoints[0], pool.endpoints[1]
+	var requested []string
+	pool.getBlock = func(api *eos.API, id string) (*eos.BlockResp, error) {
+		requested = append(requested, api.BaseURL)
+		return &eos.BlockResp{}, nil
+	}
+
+	// a 最健康，但不可逆块高落后，不可逆的块只从b 获取
+	pool.checkChainID(a, &eos.InfoResp{ChainID: eos.SHA256Bytes("chain"), LastIrreversibleBlockNum: 1000})
+	pool.checkChainID(b, &eos.InfoResp{ChainID: eos.SHA256Bytes("chain"), LastIrreversibleBlockNum: 1005})
+	for i := 0; i < 5; i++ {
+		pool.record(b, "get_block", time.Second, errors.New("timeout"))
+	}
+	assert.Equal(t, a, pool.ordered()[0])
+
+	_, err := pool.GetIrreversibleBlock(1003)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"http://b"}, requested)
+
+	requested = nil
+	_, err = pool.GetIrreversibleBlock(1000)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"http://a"}, requested)
+
+	// 所有节点都还没有不可逆
+	requested = nil
+	_, err = pool.GetIrreversibleBlock(1006)
+	assert.NotNil(t, err)
+	assert.Len(t, requested, 0)
+}
+
+func TestChainIDConfig(t *testing.T) {
+	// 链ID 格式错误、离线签名没有链ID 时返回错误
+	_, _, err := parseChainIDConfig("abcd", false)
+	assert.NotNil(t, err)
+	_, _, err = parseChainIDConfig("", true)
+	assert.NotNil(t, err)
+	chainID, offline, err := parseChainIDConfig("", false)
+	assert.Nil(t, err)
+	assert.Nil(t, chainID)
+	assert.False(t, offline)
+
+	// 离线签名不请求节点，节点池和签名使用配置的链ID
+	expected := strings.Repeat("ab", 32)
+	chainID, offline, err = parseChainIDConfig(expected, true)
+	assert.Nil(t, err)
+	assert.True(t, offline)
+	pool := NewEndpointPool([]string{"http://a", "http://b"}, chainID)
+	pool.getInfo = func(api *eos.API) (*eos.InfoResp, error) {
+		t.Error("offline chain id requested " + api.BaseURL)
+		return nil, errors.New("offline")
+	}
+	chainIDPin, err := newChainIDPin(pool, chainID, offline)
+	assert.Nil(t, err)
+	assert.True(t, chainIDPin.Offline())
+	pinned, err := chainIDPin.ChainID()
+	assert.Nil(t, err)
+	assert.Equal(t, expected, hex.EncodeToString(pinned))
+	assert.Equal(t, expected, hex.EncodeToString(pool.ChainID()))
+
+	// 在线时向节点池请求，必须与配置一致
+	chainID, offline, _ = parseChainIDConfig(expected, false)
+	pool = NewEndpointPool([]string{"http://a"}, chainID)
+	pool.getInfo = func(api *eos.API) (*eos.InfoResp, error) {
+		return &eos.InfoResp{ChainID: eos.SHA256Bytes(strings.Repeat("c", 32))}, nil
+	}
+	chainIDPin, err = newChainIDPin(pool, chainID, offline)
+	assert.Nil(t, err)
+	_, err = chainIDPin.ChainID()
+	assert.NotNil(t, err)
+}
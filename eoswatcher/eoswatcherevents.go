@@ -0,0 +1,132 @@
+package eoswatcher
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/inconshreveable/log15"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	// leveldb 中已交付事件的key 前缀，完整key 为 前缀 + 块高（10 位，补0）/txid:actionIndex，值为WebhookEvent 的json
+	eventKeyPrefix = "Event/"
+	// 按账户（付款方、收款方、监控账户）的索引，完整key 为 前缀 + 账户/块高/txid:actionIndex，值为空
+	eventAccountKeyPrefix = "EventAccount/"
+)
+
+// 查询事件时的默认、最大条数
+const (
+	eventQueryDefaultLimit = 100
+	eventQueryMaxLimit = 1000
+)
+
+func eventKey(blockNum uint32, eventKey string) []byte {
+	return []byte(fmt.Sprintf("%s%010d/%s", eventKeyPrefix, blockNum, eventKey))
+}
+
+func eventAccountKey(account string, blockNum uint32, eventKey string) []byte {
+	return []byte(fmt.Sprintf("%s%s/%010d/%s", eventAccountKeyPrefix, account, blockNum, eventKey))
+}
+
+// 保存已交付的事件及账户索引，供查询API 使用
+func (ew *EOSWatcherMain) putEvent(event *EOSPushEvent) {
+	data, err := json.Marshal(NewWebhookEvent(event))
+	if err != nil {
+		log.Error("marshal eos event err", "info", err)
+		return
+	}
+	batch := new(leveldb.Batch)
+	batch.Put(eventKey(event.BlockNum, event.GetEventKey()), data)
+	for _, account := range []string{event.GetFrom(), event.GetTo(), event.GetWatchedAccount()} {
+		if account != "" {
+			batch.Put(eventAccountKey(account, event.BlockNum, event.GetEventKey()), nil)
+		}
+	}
+	if err := ew.DB.Write(batch, nil); err != nil {
+		log.Error("write eos leveldb event err", "TxID", event.GetTxID(), "ActionIndex", event.ActionIndex, "info", err)
+	}
+}
+
+func queryLimit(limit int) int {
+	if limit <= 0 {
+		return eventQueryDefaultLimit
+	}
+	if limit > eventQueryMaxLimit {
+		return eventQueryMaxLimit
+	}
+	return limit
+}
+
+// 块高在[from, to) 内的已交付事件，按块高排序，最多limit 条（为0 时100 条，最多1000 条）
+func (ew *EOSWatcherMain) GetEvents(from, to uint32, limit int) ([]*WebhookEvent, error) {
+	limit = queryLimit(limit)
+	iter := ew.DB.NewIterator(&util.Range{
+		Start:		[]byte(fmt.Sprintf("%s%010d/", eventKeyPrefix, from)),
+		Limit:		[]byte(fmt.Sprintf("%s%010d/", eventKeyPrefix, to)),
+	}, nil)
+	defer iter.Release()
+
+	var events []*WebhookEvent
+	for iter.Next() && len(events) < limit {
+		var event WebhookEvent
+		if err := json.Unmarshal(iter.Value(), &event); err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+	return events, iter.Error()
+}
+
+// 账户（付款方、收款方或监控账户）块高在[from, to) 内的已交付事件，按块高排序
+func (ew *EOSWatcherMain) GetAccountEvents(account string, from, to uint32, limit int) ([]*WebhookEvent, error) {
+	limit = queryLimit(limit)
+	prefix := eventAccountKeyPrefix + account + "/"
+	iter := ew.DB.NewIterator(&util.Range{
+		Start:		[]byte(fmt.Sprintf("%s%010d/", prefix, from)),
+		Limit:		[]byte(fmt.Sprintf("%s%010d/", prefix, to)),
+	}, nil)
+	defer iter.Release()
+
+	var events []*WebhookEvent
+	for iter.Next() && len(events) < limit {
+		data, err := ew.DB.Get(append([]byte(eventKeyPrefix), iter.Key()[len(prefix):]...), nil)
+		if err != nil {
+			return nil, err
+		}
+		var event WebhookEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+	return events, iter.Error()
+}
+
+// 交易中已交付的事件，按action 序号排序。 没有交付过时返回空
+func (ew *EOSWatcherMain) GetDeliveredEvents(txid string) ([]*WebhookEvent, error) {
+	records, err := ew.GetDeliveryRecords(txid)
+	if err != nil {
+		return nil, err
+	}
+	var events []*WebhookEvent
+	for _, record := range records {
+		if record.Status != DeliveryStatusDelivered {
+			continue
+		}
+		data, err := ew.DB.Get(eventKey(record.BlockNum, fmt.Sprintf("%s:%d", record.TxID, record.ActionIndex)), nil)
+		if err == leveldb.ErrNotFound {
+			// 查询API 之前交付的事件没有保存
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var event WebhookEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+	return events, nil
+}
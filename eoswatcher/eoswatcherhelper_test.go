@@ -0,0 +1,27 @@
+package eoswatcher
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// 临时目录中的leveldb，测试结束时调用返回的方法关闭并删除
+func newTestDB(t *testing.T) (*leveldb.DB, func()) {
+	dirName, err := ioutil.TempDir("", "eoswatcher")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	db, err := leveldb.OpenFile(dirName, nil)
+	if !assert.Nil(t, err) {
+		os.RemoveAll(dirName)
+		t.FailNow()
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dirName)
+	}
+}
@@ -1,6 +1,7 @@
 package eoswatcher
 
 import (
+	"context"
 	"github.com/eoscanada/eos-go"
 	"github.com/eoscanada/eos-go/ecc"
 	"time"
@@ -9,13 +10,15 @@ import (
 type EOSWatcherInterface interface {
 	UpdatePubKeyHash(pubKeyHash string)
 
-	StartWatch(scanBlockHeight, scanBlockIndex uint32, eventChan chan<- *EOSPushEvent, channelCount int)
+	StartWatch(ctx context.Context, scanBlockHeight, scanBlockIndex uint32, eventChan chan<- *EOSPushEvent, channelCount int)
+	Stop()
+	Wait()
 
-	UpdateInfo()
-	UpdateBlock(scanBlockHeight uint32)		*eos.BlockResp
-	UpdateEOSPushEvent(scanBlockResp *eos.BlockResp, scanBlockIndex uint32, eventChan chan<- *EOSPushEvent)
+	UpdateInfo(ctx context.Context)		error
+	UpdateBlock(ctx context.Context, scanBlockHeight uint32)		(*eos.BlockResp, error)
+	UpdateEOSPushEvent(ctx context.Context, scanBlockResp *eos.BlockResp, scanBlockIndex uint32, eventChan chan<- *EOSPushEvent)	error
 
-	GetEventByTxid(txid string) (*EOSPushEvent, error)
+	GetEventByTxid(txid string) ([]*EOSPushEvent, error)
 
 	PKMSign(tx *eos.SignedTransaction) (sig *ecc.Signature, err error)
 	GetPublickeyFromTx(tx *eos.SignedTransaction, sig *ecc.Signature) (out ecc.PublicKey, err error)
@@ -0,0 +1,148 @@
+package eoswatcher
+
+import (
+	"encoding/json"
+	"eosc/tools/metrics"
+	"fmt"
+	log "github.com/inconshreveable/log15"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"sort"
+	"time"
+)
+
+// leveldb 中交付记录的key 前缀，完整key 为 前缀 + txid:actionIndex
+const deliveryKeyPrefix = "Delivered/"
+
+// 事件交付状态
+type DeliveryStatus int
+
+const (
+	// 正在发给网关。 发送过程中进程退出时停留在这个状态，重新扫块时会再次发出
+	DeliveryStatusSending DeliveryStatus = 1
+	// 已发给网关，重新扫块时不再发出
+	DeliveryStatusDelivered DeliveryStatus = 2
+)
+
+// 一个事件的交付记录
+type DeliveryRecord struct {
+	TxID				string				`json:"txid"`
+	ActionIndex			int					`json:"action_index"`
+	BlockNum			uint32				`json:"block_num"`
+	Status				DeliveryStatus		`json:"status"`
+	// 状态更新时间，unix 秒
+	Time				int64				`json:"time"`
+}
+
+func deliveryKey(eventKey string) []byte {
+	return []byte(deliveryKeyPrefix + eventKey)
+}
+
+// 读取事件的交付记录，没有记录时返回nil
+func (ew *EOSWatcherMain) getDeliveryRecord(eventKey string) (*DeliveryRecord, error) {
+	data, err := ew.DB.Get(deliveryKey(eventKey), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record DeliveryRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// 写入事件的交付状态
+func (ew *EOSWatcherMain) putDeliveryRecord(event *EOSPushEvent, status DeliveryStatus, sync bool) {
+	record := &DeliveryRecord{
+		TxID:			event.GetTxID(),
+		ActionIndex:	event.ActionIndex,
+		BlockNum:		event.BlockNum,
+		Status:			status,
+		Time:			time.Now().Unix(),
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Error("marshal eos delivery record err", "info", err)
+		return
+	}
+	if err := ew.DB.Put(deliveryKey(event.GetEventKey()), data, &opt.WriteOptions{Sync: sync}); err != nil {
+		log.Error("write eos leveldb delivery record err", "TxID", record.TxID, "ActionIndex", record.ActionIndex, "info", err)
+	}
+}
+
+// 把事件发给网关，并记录交付状态。 已交付过的事件（重启、重新扫块）不再发出，返回false
+func (ew *EOSWatcherMain) deliverEvent(event *EOSPushEvent, eventChan chan<- *EOSPushEvent) bool {
+	ew.deliverLock.Lock()
+	defer ew.deliverLock.Unlock()
+
+	record, err := ew.getDeliveryRecord(event.GetEventKey())
+	if err != nil {
+		log.Error("read eos leveldb delivery record err", "TxID", event.GetTxID(), "ActionIndex", event.ActionIndex, "info", err)
+	}
+	if record != nil && record.Status == DeliveryStatusDelivered {
+		log.Debug("EOS event already delivered, skip", "TxID", record.TxID, "ActionIndex", record.ActionIndex)
+		return false
+	}
+
+	ew.putDeliveryRecord(event, DeliveryStatusSending, false)
+	eventChan <- event
+	if ew.Webhooks != nil {
+		if err := ew.Webhooks.Push(event); err != nil {
+			log.Error("write eos leveldb webhook delivery err", "TxID", event.GetTxID(), "ActionIndex", event.ActionIndex, "info", err)
+		}
+	}
+	ew.putEvent(event)
+	ew.putDeliveryRecord(event, DeliveryStatusDelivered, false)
+	metrics.EventsEmitted.WithLabelValues(metricsScanner, string(event.Account), event.Symbol).Inc()
+	return true
+}
+
+// 交易的所有交付记录，按action 序号排序
+func (ew *EOSWatcherMain) GetDeliveryRecords(txid string) ([]*DeliveryRecord, error) {
+	iter := ew.DB.NewIterator(util.BytesPrefix(deliveryKey(txid + ":")), nil)
+	defer iter.Release()
+
+	var records []*DeliveryRecord
+	for iter.Next() {
+		var record DeliveryRecord
+		if err := json.Unmarshal(iter.Value(), &record); err != nil {
+			return nil, err
+		}
+		records = append(records, &record)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	// key 按字符串排序，action 序号超过9 时需要重新排序
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].ActionIndex < records[j].ActionIndex
+	})
+	return records, nil
+}
+
+// 交易中是否有事件已经发给网关。 网关入账前检查，避免重复入账
+func (ew *EOSWatcherMain) IsTxDelivered(txid string) (bool, error) {
+	records, err := ew.GetDeliveryRecords(txid)
+	if err != nil {
+		return false, err
+	}
+	for _, record := range records {
+		if record.Status == DeliveryStatusDelivered {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// 交易中的某个action 的事件是否已经发给网关
+func (ew *EOSWatcherMain) IsEventDelivered(txid string, actionIndex int) (bool, error) {
+	record, err := ew.getDeliveryRecord(fmt.Sprintf("%s:%d", txid, actionIndex))
+	if err != nil {
+		return false, err
+	}
+	return record != nil && record.Status == DeliveryStatusDelivered, nil
+}
@@ -0,0 +1,47 @@
+package eoswatcher
+
+import (
+	"testing"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliverEventSkipsDelivered(t *testing.T) {
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+	ew := &EOSWatcherMain{DB: db}
+
+	txID := eos.SHA256Bytes{0xab, 0xcd}
+	eventChan := make(chan *EOSPushEvent, 10)
+	for _, actionIndex := range []int{0, 10, 2} {
+		assert.True(t, ew.deliverEvent(&EOSPushEvent{TxID: txID, ActionIndex: actionIndex, BlockNum: 100}, eventChan))
+	}
+	assert.Len(t, eventChan, 3)
+
+	// 重新扫块，已交付的事件不再发出
+	assert.False(t, ew.deliverEvent(&EOSPushEvent{TxID: txID, ActionIndex: 2, BlockNum: 100}, eventChan))
+	assert.Len(t, eventChan, 3)
+
+	records, err := ew.GetDeliveryRecords("abcd")
+	assert.Nil(t, err)
+	assert.Len(t, records, 3)
+	assert.Equal(t, []int{0, 2, 10}, []int{records[0].ActionIndex, records[1].ActionIndex, records[2].ActionIndex})
+	assert.Equal(t, DeliveryStatusDelivered, records[0].Status)
+
+	delivered, err := ew.IsTxDelivered("abcd")
+	assert.Nil(t, err)
+	assert.True(t, delivered)
+
+	delivered, err = ew.IsTxDelivered("abc")
+	assert.Nil(t, err)
+	assert.False(t, delivered)
+
+	delivered, err = ew.IsEventDelivered("abcd", 1)
+	assert.Nil(t, err)
+	assert.False(t, delivered)
+
+	// 发送中断的事件，重新扫块时再次发出
+	ew.putDeliveryRecord(&EOSPushEvent{TxID: txID, ActionIndex: 1}, DeliveryStatusSending, false)
+	assert.True(t, ew.deliverEvent(&EOSPushEvent{TxID: txID, ActionIndex: 1}, eventChan))
+}
@@ -0,0 +1,70 @@
+package eoswatcher
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 扫块协程的生命周期管理，嵌入到各个watcher 中，提供Stop、Wait
+type watchLifecycle struct {
+	cancel				context.CancelFunc
+	done				chan struct{}
+	// 扫块之外的附属协程（如跟随最新块），Wait 时一并等待
+	helpers				sync.WaitGroup
+}
+
+// StartWatch 时调用，返回扫块协程使用的ctx
+func (wl *watchLifecycle) startLifecycle(ctx context.Context) context.Context {
+	ctx, wl.cancel = context.WithCancel(ctx)
+	wl.done = make(chan struct{})
+	return ctx
+}
+
+// 启动附属协程，ctx 结束后需要自行退出
+func (wl *watchLifecycle) goHelper(helper func()) {
+	wl.helpers.Add(1)
+	go func() {
+		defer wl.helpers.Done()
+		helper()
+	}()
+}
+
+// 等待附属协程退出（ctx 已结束），它们可能还在写leveldb，关闭leveldb 之前调用
+func (wl *watchLifecycle) waitHelpers() {
+	wl.helpers.Wait()
+}
+
+// 扫块协程完全退出时调用
+func (wl *watchLifecycle) finishLifecycle() {
+	close(wl.done)
+}
+
+// 停止扫块，并等待扫块协程退出
+func (wl *watchLifecycle) Stop() {
+	if wl.cancel != nil {
+		wl.cancel()
+	}
+	wl.Wait()
+}
+
+// 等待扫块协程退出：在途的块处理完毕、扫块进度写入、leveldb 关闭、eventChan 关闭之后返回。
+// 未调用StartWatch 时直接返回
+func (wl *watchLifecycle) Wait() {
+	if wl.done != nil {
+		<-wl.done
+	}
+	wl.helpers.Wait()
+}
+
+// 等待一段时间，ctx 结束时提前返回false
+func sleepContext(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
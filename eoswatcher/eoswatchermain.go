@@ -1,9 +1,13 @@
 package eoswatcher
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"eosc/tools/blocksource"
+	"eosc/tools/metrics"
 	"eosc/tools/utils"
 	"fmt"
 	"github.com/eoscanada/eos-go"
@@ -18,30 +22,46 @@ import (
 	"github.com/syndtr/goleveldb/leveldb/filter"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"math/big"
-	"net"
 	"net/http"
 	//"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type TokenContract struct {
 	// 合约名
-	ActionAccount				eos.AccountName
+	ActionAccount				eos.AccountName			`mapstructure:"action_account"`
 	// 溶币方法名
-	ActionNameDestroy			eos.ActionName
+	ActionNameDestroy			eos.ActionName			`mapstructure:"action_name_destroy"`
 	// 铸币方法名
-	ActionNameCreate			eos.ActionName
+	ActionNameCreate			eos.ActionName			`mapstructure:"action_name_create"`
 
 	// 货币名称、精度
-	Symbol						string
-	Precision					uint8
+	Symbol						string					`mapstructure:"symbol"`
+	Precision					uint8					`mapstructure:"precision"`
+
+	// 溶币memo 的格式，为nil 时见EOSWatcherMain.MemoSchemaFor
+	MemoSchema					*MemoSchema				`mapstructure:"memo_schema"`
+	// 业务标签，写入该合约产生的事件
+	Business					string					`mapstructure:"business"`
+
+	// 合约上线的块高。 运行中新增合约时，从这里回溯扫描，为0 时不回溯，见SetWatchedAccounts
+	StartBlock					uint32					`mapstructure:"start_block"`
 }
 
 type EOSWatcherMain struct {
-	// 链API url
+	// 链API url，第一个节点。 get_transaction 等请求使用
 	EosAPI						*eos.API
+	// 所有节点，get_info、get_block、push_transaction 按健康状况选择节点
+	Endpoints					*EndpointPool
 	// 网关名
 	Gateway						eos.AccountName
+	// 扫块的get_info、get_block、get_transaction（执行轨迹）、get_abi 来源，为nil 时使用Endpoints。
+	// 离线测试时回放录制的块，见blocksource.FileSource。 签名、发交易仍使用Endpoints
+	Blocks						blocksource.BlockSource
+	// 不为nil 时，扫描不可逆块先通过nodeos 的p2p 端口获取，缺块时回退到Blocks 或Endpoints，见EnableP2P
+	P2PBlocks					*P2PBlockSource
 
 	ScanBlockHeight				uint32
 
@@ -50,42 +70,95 @@ type EOSWatcherMain struct {
 
 	// 签名所用私钥 对应的公钥哈希值
 	PubKeyHash 					string
+	// 签名用的链ID，只请求一次并缓存。 创建时按配置EOS.chain_id、EOS.offline 固定，见PinChainID、EnableOfflineSigning
+	ChainIDPin					*utils.ChainIDPin
 
 	// 合约、方法列表
 	TokenContracts				[]*TokenContract
 
+	// 监控的收款账户，每个块只请求一次，按账户匹配各自的合约。 为空时只监控Gateway，使用TokenContracts。
+	// 扫块开始后通过SetWatchedAccounts、AddTokenContract 等方法修改
+	WatchedAccounts				[]*WatchedAccount
+	accountsLock				sync.RWMutex
+
+	// 是否对所有交易都请求执行轨迹，扫描其中的inline action（需要节点开启history 插件，每笔交易多一次rpc 请求）。
+	// 为false 时，只对没有交易体的交易（延迟交易、msig exec 产生的交易）请求执行轨迹
+	TraceInlineActions			bool
+
+	// 货币名称 -> 溶币memo 格式，合约没有单独配置时使用，见LoadMemoSchemas
+	MemoSchemas					map[string]*MemoSchema
+
+	// 跟随最新块模式：不为nil 时，StartWatch 同时扫描可逆块，把临时事件、撤回事件、确认事件发到这里（见followReversibleBlocks），
+	// 不影响eventChan 中的不可逆事件。 扫块退出时关闭
+	ReversibleEventChan			chan<- *ReversibleEvent
+
+	// 网关发出交易的状态变化（pending、included、irreversible、expired、failed），不为nil 时发到这里，见TrackOutgoingTx。
+	// 不阻塞发送，channel 满时事件在内存中排队，按顺序发出，需要及时读取
+	OutgoingTxChan				chan<- *OutgoingTx
+
+	// 不为nil 时，交付的事件同时投递到webhook，见EnableWebhooks
+	Webhooks					*WebhookSink
+
+	// action 解析器，按 合约名+方法名 查找，见RegisterActionDecoder
+	ActionDecoders				*ActionDecoderRegistry
+	// 监控合约的ABI，扫块时按块高生效的ABI 解析action 数据。 为nil 时只用内置的结构体解析
+	ABIs						*ABICache
+
 	DB							*leveldb.DB
+
+	// 已交付的块高，见CommittedBlockHeight
+	committedBlockHeight		uint32
+
+	// 网关发出的未结束交易
+	outgoingTxs					outgoingTxTracker
+	// 新增合约的回溯扫描
+	backfills					backfillRunner
+	// 主扫块、回溯扫描同时交付事件时，保证同一事件只发出一次
+	deliverLock					sync.Mutex
+	// 扫块的暂停、恢复，见PauseScan
+	scanControl					scanControl
+
+	watchLifecycle
 }
 
+// 链ID 按配置EOS.chain_id、EOS.offline 固定，见loadChainIDConfig。 配置错误时panic
 func NewEosWatcherMain(url, pubKeyHash, gateway, dirName string, tokenContracts []*TokenContract) (*EOSWatcherMain) {
-	api := &eos.API{
-		HttpClient: &http.Client{
-			Transport: &http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-				DialContext: (&net.Dialer{
-					Timeout:   5 * time.Second,
-					KeepAlive: 5 * time.Second,
-					DualStack: true,
-				}).DialContext,
-				MaxIdleConns:          100,
-				IdleConnTimeout:       90 * time.Second,
-				TLSHandshakeTimeout:   10 * time.Second,
-				ExpectContinueTimeout: 1 * time.Second,
-				DisableKeepAlives:     true, // default behavior, because of `nodeos`'s lack of support for Keep alives.
-			},
-		},
-		BaseURL:  url,
-		Compress: eos.CompressionZlib,
+	chainID, offline, err := loadChainIDConfig()
+	if err != nil {
+		panic("invalid eos chain id config: " + err.Error())
 	}
+	endpoints := NewEndpointPool([]string{url}, chainID)
+	chainIDPin, err := newChainIDPin(endpoints, chainID, offline)
+	if err != nil {
+		panic("invalid eos chain id config: " + err.Error())
+	}
+	return newEosWatcherMain(endpoints, chainIDPin, pubKeyHash, gateway, dirName, tokenContracts)
+}
 
-	// 方法注册
-	for _, tokenContract := range tokenContracts{
-		if tokenContract.ActionAccount != eos.AN("eosio.token") {
-			eos.RegisterAction(tokenContract.ActionAccount, tokenContract.ActionNameDestroy, Solvent{})
-			eos.RegisterAction(tokenContract.ActionAccount, tokenContract.ActionNameCreate, token.Issue{})
+// 使用多个节点扫块、发交易，节点不可用或落后时自动切换。 所有节点的链ID 必须一致，
+// 配置了EOS.chain_id 时必须与配置一致（离线签名时不请求节点检查，链ID 不一致的节点扫块时被停用）
+func NewEosWatcherMainWithEndpoints(urls []string, pubKeyHash, gateway, dirName string, tokenContracts []*TokenContract) (*EOSWatcherMain, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("No EOS endpoint.")
+	}
+	chainID, offline, err := loadChainIDConfig()
+	if err != nil {
+		return nil, err
+	}
+	endpoints := NewEndpointPool(urls, chainID)
+	if !offline {
+		if err := endpoints.VerifyChainID(); err != nil {
+			return nil, err
 		}
 	}
+	chainIDPin, err := newChainIDPin(endpoints, chainID, offline)
+	if err != nil {
+		return nil, err
+	}
+	return newEosWatcherMain(endpoints, chainIDPin, pubKeyHash, gateway, dirName, tokenContracts), nil
+}
 
+func newEosWatcherMain(endpoints *EndpointPool, chainIDPin *utils.ChainIDPin, pubKeyHash, gateway, dirName string, tokenContracts []*TokenContract) (*EOSWatcherMain) {
 	db, err := leveldb.OpenFile(dirName, &opt.Options{
 		OpenFilesCacheCapacity: 16,
 		BlockCacheCapacity:     16 / 2 * opt.MiB,
@@ -101,7 +174,7 @@ func NewEosWatcherMain(url, pubKeyHash, gateway, dirName string, tokenContracts
 	//defer db.Close()
 
 	var temp_sacn uint32 = 0
-	data, err := db.Get([]byte("ScanBlockHeight"), nil)
+	data, err := db.Get([]byte(scanBlockHeightKey), nil)
 	if err != nil {
 		log.Error("read eos leveldb ScanBlockHeight err", "info", err)
 	} else {
@@ -110,24 +183,35 @@ func NewEosWatcherMain(url, pubKeyHash, gateway, dirName string, tokenContracts
 	}
 
 	ew := &EOSWatcherMain{
-		EosAPI:						api,
+		EosAPI:						endpoints.Primary(),
+		Endpoints:					endpoints,
 		ScanBlockHeight:			temp_sacn,
 		HeadBlockNum:				0,
 		LastIrreversibleBlockNum:	0,
 		PubKeyHash:					pubKeyHash,
+		ChainIDPin:					chainIDPin,
 		Gateway:					eos.AN(gateway),
 		TokenContracts:				tokenContracts,
+		ActionDecoders:				NewActionDecoderRegistry(),
 		DB:							db,
+		committedBlockHeight:		temp_sacn,
 	}
+	ew.ABIs = NewABICache(db, ew.contractABI)
 	return ew
 }
 
 func (ew *EOSWatcherMain) ShowRegist() {
-	for contract := range eos.RegisteredActions {
-		fmt.Printf("ContractRegister:%s->%s\n", contract, eos.RegisteredActions[contract])
+	for _, decoder := range ew.ActionDecoders.List() {
+		fmt.Printf("ContractRegister:%s\n", decoder)
 	}
 }
 
+// 注册action 解析器，只对本watcher 生效。 account 为空时对所有合约的该方法生效，
+// 合约的溶币、铸币方法不是 transfer、solvent、issue 时，需要在StartWatch 之前注册对应的解析器
+func (ew *EOSWatcherMain) RegisterActionDecoder(account, name string, decoder ActionDecoder) {
+	ew.ActionDecoders.Register(eos.AccountName(account), eos.ActionName(name), decoder)
+}
+
 func (ew *EOSWatcherMain) UpdatePubKeyHash(pubKeyHash string) {
 	ew.PubKeyHash = pubKeyHash
 }
@@ -136,459 +220,453 @@ func (ew *EOSWatcherMain) UpdateGateway(gateway string) {
 	ew.Gateway = eos.AN(gateway)
 }
 
+// 在addr 上提供prometheus 监控指标（/metrics），不调用则不监听
+func (ew *EOSWatcherMain) ServeMetrics(addr string) (*http.Server, error) {
+	return metrics.StartServer(addr)
+}
+
 //扫块开始
-func (ew *EOSWatcherMain) StartWatch(scanBlockHeight, scanBlockIndex uint32, eventChan chan<- *EOSPushEvent, channelCount int)  {
+// 最多channelCount 个块并发请求，但事件严格按块高顺序发给eventChan；
+// 一个块的事件全部发出后，才推进leveldb 中的扫块进度，重启后从交付停止的地方继续。
+// ctx 结束（或调用Stop）后，等待在途的块处理完，写入最终进度，关闭leveldb 和eventChan
+func (ew *EOSWatcherMain) StartWatch(ctx context.Context, scanBlockHeight, scanBlockIndex uint32, eventChan chan<- *EOSPushEvent, channelCount int)  {
 	if scanBlockHeight <= 0 {
 		scanBlockHeight = 1
 	}
 	// 扫块代码
 	if scanBlockHeight > ew.ScanBlockHeight {
-		ew.ScanBlockHeight = scanBlockHeight
+		atomic.StoreUint32(&ew.ScanBlockHeight, scanBlockHeight)
+	}
+	if channelCount <= 0 {
+		channelCount = 1
+	}
+	atomic.StoreUint32(&ew.committedBlockHeight, ew.ScanBlockHeight)
+	ctx = ew.startLifecycle(ctx)
+	metrics.WorkerPoolSize.WithLabelValues(metricsScanner).Set(float64(channelCount))
+
+	// 协程池：块的事件交付之后才释放
+	var tmpChannel = make(chan struct{}, channelCount)
+	var resultChan = make(chan *scannedBlock, channelCount)
+	go ew.deliverScannedBlocks(ctx, ew.ScanBlockHeight, resultChan, tmpChannel, eventChan)
+	ew.startBackfills(ctx, eventChan)
+	if ew.Webhooks != nil {
+		ew.Webhooks.Start(ctx)
+	}
+	if ew.Endpoints != nil {
+		ew.Endpoints.Start(ctx)
+	}
+
+	if ew.ReversibleEventChan != nil {
+		reversibleChan := ew.ReversibleEventChan
+		ew.goHelper(func() {
+			ew.followReversibleBlocks(ctx, reversibleChan)
+		})
 	}
 
 	go func() {
-		defer ew.DB.Close()
+		var workers sync.WaitGroup
+		defer func() {
+			// 等待在途的块处理完，交付协程随之退出
+			workers.Wait()
+			close(resultChan)
+		}()
 		for {
-			// 更新 最新不可逆转块的高度。 返回则表明一定执行成功，不成功则会在该函数中阻塞
-			ew.UpdateInfo()
+			// 暂停时等待恢复，见PauseScan
+			reset, ok := ew.waitScanResumed(ctx, &workers, resultChan)
+			if !ok {
+				return
+			}
+			if reset {
+				scanBlockIndex = 0
+			}
+			// 更新 最新不可逆转块的高度。 返回nil 则表明一定执行成功，否则ctx 已结束
+			if err := ew.UpdateInfo(ctx); err != nil {
+				return
+			}
 			//log.Debug("-------- Scan Block Height", "info", ew.ScanBlockHeight)
 
-			// 创建50个goroutine，去请求块
-			var tmpChannel = make(chan struct{}, channelCount)
 			if ew.ScanBlockHeight < ew.LastIrreversibleBlockNum {
-				for ; ew.ScanBlockHeight < ew.LastIrreversibleBlockNum;  {
+				for ; ew.ScanBlockHeight < ew.LastIrreversibleBlockNum && !ew.ScanPaused();  {
 					if ew.ScanBlockHeight % 100 == 0 {
 						log.Debug("EOS Scan Block Height", "info", ew.ScanBlockHeight)
 					}
 
 					// 协程池中，没用空闲的协程，等待
-					for len(tmpChannel) >= channelCount {
-						time.Sleep(time.Duration(10) * time.Millisecond)
+					select {
+					case tmpChannel <- struct{}{}:
+					case <-ctx.Done():
+						return
 					}
-					//log.Debug("len(tmpChannel)", "length", len(tmpChannel))
+					metrics.WorkerPoolInUse.WithLabelValues(metricsScanner).Set(float64(len(tmpChannel)))
 
-					scanHeightx := ew.ScanBlockHeight
-
-					// 将扫块高度，写入leveldb
-					bytes := make([]byte, 4)
-					binary.LittleEndian.PutUint32(bytes, scanHeightx)
-					err := ew.DB.Put([]byte("ScanBlockHeight"), bytes, nil)
-					if err != nil {
-						log.Error("write eos leveldb ScanBlockHeight err", "info", err)
-					}
-					go func(scanHeightx uint32) {
-						tmpChannel <- struct{}{}
+					workers.Add(1)
+					go func(scanHeightx, scanBlockIndex uint32) {
+						defer workers.Done()
 
-						blockResp := ew.UpdateBlock(scanHeightx)
-
-						ew.UpdateEOSPushEvent(blockResp, scanBlockIndex, eventChan)
+						blockResp, err := ew.scanBlock(ctx, scanHeightx)
+						if err != nil {
+							return
+						}
 
-						<-tmpChannel
-					}(scanHeightx)
+						abiChanges := ew.abiChanges()
+						eosPushEvents, err := ew.ExtractEOSPushEvents(ctx, blockResp, scanBlockIndex)
+						if err != nil {
+							// ctx 已结束，块没有完整解析，不交付
+							return
+						}
+						resultChan <- &scannedBlock{
+							BlockNum:		scanHeightx,
+							Events:			eosPushEvents,
+							Block:			blockResp,
+							ScanBlockIndex:	scanBlockIndex,
+							ABIChanges:		abiChanges,
+						}
+					}(ew.ScanBlockHeight, scanBlockIndex)
 
-					ew.ScanBlockHeight ++
+					atomic.StoreUint32(&ew.ScanBlockHeight, ew.ScanBlockHeight + 1)
 					scanBlockIndex = 0
 				}
-			} else {
-				time.Sleep(1 * time.Second)
+			} else if !sleepContext(ctx, 1 * time.Second) {
+				return
 			}
 		}
 	}()
 }
 
-// 更新 最后一个不可逆转块块高、最高块块高。 如果rpc请求报错，那么继续请求，阻塞在这里
-func (ew *EOSWatcherMain) UpdateInfo () {
+// 更新 最后一个不可逆转块块高、最高块块高。 如果rpc请求报错，那么继续请求，阻塞在这里，直到ctx 结束
+func (ew *EOSWatcherMain) UpdateInfo (ctx context.Context) error {
+	infoResp, err := ew.getInfo(ctx)
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint32(&ew.HeadBlockNum, infoResp.HeadBlockNum)
+	atomic.StoreUint32(&ew.LastIrreversibleBlockNum, infoResp.LastIrreversibleBlockNum)
+	metrics.SetChainHeights(metricsScanner, ew.HeadBlockNum, ew.LastIrreversibleBlockNum, ew.CommittedBlockHeight())
+	return nil
+}
+
+// 请求链信息，rpc 报错时一直重试，直到ctx 结束
+func (ew *EOSWatcherMain) getInfo(ctx context.Context) (*eos.InfoResp, error) {
 	for {
-		infoResp, err := ew.EosAPI.GetInfo()
+		infoResp, err := ew.chainInfo()
 		if err != nil {
-			log.Error("Get info error!", "EosAPI.BaseURL", ew.EosAPI.BaseURL)
-			time.Sleep(500 * time.Millisecond)
+			log.Error("Get info error!", "Endpoints", ew.Endpoints.URLs())
+			if !sleepContext(ctx, 500 * time.Millisecond) {
+				return nil, ctx.Err()
+			}
 			continue
 		}
-		ew.HeadBlockNum = infoResp.HeadBlockNum
-		ew.LastIrreversibleBlockNum = infoResp.LastIrreversibleBlockNum
-		return
+		return infoResp, nil
 	}
 }
 
-// 更新 要扫描块的信息。 如果rpc请求报错，那么继续请求，阻塞在这里
-func (ew *EOSWatcherMain) UpdateBlock (scanBlockHeight uint32)  *eos.BlockResp {
+// 更新 要扫描块的信息。 如果rpc请求报错，那么继续请求，阻塞在这里，直到ctx 结束
+func (ew *EOSWatcherMain) UpdateBlock (ctx context.Context, scanBlockHeight uint32)  (*eos.BlockResp, error) {
+	return ew.retryBlock(ctx, scanBlockHeight, ew.block)
+}
+
+// 请求块，出错时每100ms 重试，直到ctx 结束
+func (ew *EOSWatcherMain) retryBlock(ctx context.Context, scanBlockHeight uint32, block func(blockNum uint32) (*eos.BlockResp, error)) (*eos.BlockResp, error) {
 	for {
-		blockResp, err := ew.EosAPI.GetBlockByID(fmt.Sprintf("%d", scanBlockHeight))
+		blockResp, err := block(scanBlockHeight)
 		if err != nil {
 			log.Debug("Get block error! Wait 100ms to request.",
-				"EosAPI.BaseURL", ew.EosAPI.BaseURL,
+				"Endpoints", ew.Endpoints.URLs(),
 				"ScanBlockHeight", scanBlockHeight,
 				/*err.Error()*/)
-			time.Sleep(100 * time.Millisecond)
+			if !sleepContext(ctx, 100 * time.Millisecond) {
+				return nil, ctx.Err()
+			}
 			continue
 		}
-		return blockResp
+		return blockResp, nil
 	}
 
 }
 
-// 更新 根据获得到的 块收据 信息，生成EOSPush事件，发给网关
-func (ew *EOSWatcherMain) UpdateEOSPushEvent (scanBlockResp *eos.BlockResp, scanBlockIndex uint32, eventChan chan<- *EOSPushEvent) {
-
-	for index, transactionReceipt := range scanBlockResp.SignedBlock.Transactions{
-		if uint32(index) < scanBlockIndex {
-			continue
-		}
-		if transactionReceipt.Transaction.Packed != nil {
-			signedTx, err := transactionReceipt.Transaction.Packed.Unpack()
-			if err != nil {
-				// 如果解压失败，忽略该交易
-				log.Error("Unpack error", "TxID", hex.EncodeToString(transactionReceipt.Transaction.ID))
-				continue
-			}
-			// 暂时忽略一笔交易中有多个action 的情况。（待优化）
-			if len(signedTx.Transaction.Actions) != 1 {
-				continue
-			}
-			action := signedTx.Transaction.Actions[0]
-
-			for _, tokenContract := range ew.TokenContracts {
-				// 检查是否是需要的合约中交易
-				if action.Account == tokenContract.ActionAccount {
-					if action.Name == tokenContract.ActionNameDestroy {
-						eosPushEvent, err := ew.ActionDataParse(action.Name, action.ActionData.Data, tokenContract.Precision, tokenContract.Symbol)
-						if err == nil {
-							eosPushEvent.TxID = transactionReceipt.Transaction.ID
-							eosPushEvent.Account = action.Account
-							eosPushEvent.Name = action.Name
-							eosPushEvent.BlockNum = scanBlockResp.BlockNum
-							eosPushEvent.Index = index
-							eventChan <- eosPushEvent
-							break
-						}
-					}
-					// 扫块只需要扫溶币交易，不需要扫铸币交易
-					//
-					//} else if action.Name == tokenContract.ActionNameCreate {
-					//	eosPushEvent, err := ew.ActionDataParse(action.Name, action.ActionData.Data, tokenContract.Precision, tokenContract.Symbol)
-					//	if err == nil {
-					//		eosPushEvent.TxID = transactionReceipt.Transaction.ID
-					//		eosPushEvent.Account = action.Account
-					//		eosPushEvent.Name = action.Name
-					//		eosPushEvent.BlockNum = scanBlockResp.BlockNum
-					//		eosPushEvent.Index = 0
-					//		eventChan <- eosPushEvent
-					//	}
-					//	continue
-					//}
-				}
-			}
-
-		} //else {
-		//	// 暂时忽略特殊交易，比如misg 的exec 产生的交易。（待优化）
-		//	log.Error("Ignore transaction without transaction body.", "Block Height", ew.ScanBlockHeight)
-		//}
+// 从Blocks 获取链信息，未设置时使用Endpoints
+func (ew *EOSWatcherMain) chainInfo() (*eos.InfoResp, error) {
+	if ew.Blocks == nil {
+		return ew.Endpoints.GetInfo()
 	}
-}
-
-func (ew *EOSWatcherMain) ActionDataTransferParse(data interface{}, precision uint8, symbol string) (*token.Transfer, error){
-	var transferToken *token.Transfer
-	var ok bool
-
-	transferToken, ok = data.(*token.Transfer)
-	if ok == true {
-		// 扫块时，才会执行这里
-		// 扫块只扫溶到网关账户的交易
-		// 必须是转给网关的交易，才被认为是溶币操作
-		if transferToken.To != ew.Gateway {
-			return nil, errors.New("Action Data 'to' field is not gateway.")
-		}
-		if transferToken.Quantity.Symbol.Precision != precision {
-			return nil, errors.New("Action Data 'quantity' field precision error.")
-		}
-		if transferToken.Quantity.Symbol.Symbol != symbol {
-			return nil, errors.New("Action Data 'quantity' field symbol error.")
-		}
-	} else {
-		// GetEventByTxid的时候才会执行这里
-		//
-		var transfer map[string]interface{}
-
-		transfer, ok = data.(map[string]interface{})
-		if ok == false {
-			return nil, errors.New("Action Data reflect error.")
-		}
-
-		if len(transfer) != 4 {
-			return nil, errors.New("Action Data length error.")
-		}
-
-		// 解析actionData的具体字段
-		from, ok := transfer["from"].(string)
-		if ok == false {
-			return nil, errors.New("Action Data 'from' field error")
-		}
-
-		to, ok := transfer["to"].(string)
-		if ok == false {
-			return nil, errors.New("Action Data 'to' field error")
-		}
-
-		if eos.AN(from) != ew.Gateway && eos.AN(to) != ew.Gateway {
-			return nil, errors.New("Transaction is not related to the gateway")
-		}
-
-		quantity, ok := transfer["quantity"].(string)
-		if ok == false {
-			return nil, errors.New("Action Data 'quantity' field error")
-		}
-		assert, err := eos.NewAsset(quantity)
-		if err != nil {
-			return nil, errors.New("Action Data 'quantity' field unmarshal error.")
-		}
-		if assert.Symbol.Precision != precision {
-			return nil, errors.New("Action Data 'quantity' field precision error.")
-		}
-		if assert.Symbol.Symbol != symbol {
-			return nil, errors.New("Action Data 'quantity' field symbol error.")
-		}
-
-		memo, ok := transfer["memo"].(string)
-		if ok == false {
-			return nil, errors.New("Action Data 'user' field  error")
-		}
-
-		transferToken = &token.Transfer{
-			From:		eos.AN(from),
-			To:			eos.AN(to),
-			Quantity:	assert,
-			Memo:		memo,
-		}
+	data, err := ew.Blocks.GetInfo()
+	if err != nil {
+		return nil, err
 	}
-
-	return transferToken, nil
+	var infoResp eos.InfoResp
+	if err := json.Unmarshal(data, &infoResp); err != nil {
+		return nil, err
+	}
+	return &infoResp, nil
 }
 
-func (ew *EOSWatcherMain) ActionDataSolventParse(data interface{}, precision uint8, symbol string) (*Solvent, error){
-	var solventToken *Solvent
-	var ok bool
-
-	solventToken, ok = data.(*Solvent)
-	if ok == true {
-		// 扫块时，才会执行这里
-		//
-		if solventToken.Quantity.Symbol.Precision != precision  {
-			return nil, errors.New("Action Data 'quantity' field precision error.")
-		}
-		if solventToken.Quantity.Symbol.Symbol != symbol {
-			return nil, errors.New("Action Data 'quantity' field symbol error.")
-		}
-	} else {
-		// GetEventByTxid的时候才会执行这里
-		//
-		solvent, ok := data.(map[string]interface{})
-		if ok == false {
-			return nil, errors.New("Action Data reflect error.")
-		}
-
-		if len(solvent) != 3 {
-			return nil, errors.New("Action Data length error.")
-		}
-
-		// 解析actionData的具体字段
-		from, ok := solvent["from"].(string)
-		if ok == false {
-			return nil, errors.New("Action Data 'user' field error")
-		}
-
-		quantity, ok := solvent["quantity"].(string)
-		if ok == false {
-			return nil, errors.New("Action Data 'amount' field error")
-		}
-		assert, err := eos.NewAsset(quantity)
-		if err != nil {
-			return nil, errors.New("Action Data 'quantity' field unmarshal error.")
-		}
-		if assert.Symbol.Precision != precision {
-			return nil, errors.New("Action Data 'quantity' field precision error.")
-		}
-		if assert.Symbol.Symbol != symbol {
-			return nil, errors.New("Action Data 'quantity' field symbol error.")
-		}
-
-		memo, ok := solvent["memo"].(string)
-		if ok == false {
-			return nil, errors.New("Action Data 'user' field  error")
-		}
-
-		solventToken = &Solvent{
-			From:		eos.AN(from),
-			Quantity:	assert,
-			Memo:		memo,
-		}
+// 从Blocks 获取不可逆的块，未设置时使用Endpoints 中已不可逆的节点
+func (ew *EOSWatcherMain) block(blockNum uint32) (*eos.BlockResp, error) {
+	if ew.Blocks == nil {
+		return ew.Endpoints.GetIrreversibleBlock(blockNum)
 	}
-
-
-	return solventToken, nil
+	return ew.blockFromSource(blockNum)
 }
 
-func (ew *EOSWatcherMain) ActionDataIssueParse(data interface{}, precision uint8, symbol string) (*token.Issue, error){
-	// 扫块只需要扫溶币交易，不需要扫铸币交易
-	//
-	issue, ok := data.(map[string]interface{})
-	if ok == false {
-		return nil, errors.New("Action Data reflect error.")
+// 获取可能可逆的块（跟随最新块），未设置Blocks 时使用Endpoints 中最健康的节点
+func (ew *EOSWatcherMain) reversibleBlock(blockNum uint32) (*eos.BlockResp, error) {
+	if ew.Blocks == nil {
+		return ew.Endpoints.GetBlockByID(fmt.Sprintf("%d", blockNum))
 	}
+	return ew.blockFromSource(blockNum)
+}
 
-	if len(issue) != 3 {
-		return nil, errors.New("Action Data length error.")
+func (ew *EOSWatcherMain) blockFromSource(blockNum uint32) (*eos.BlockResp, error) {
+	data, err := ew.Blocks.GetBlock(blockNum)
+	if err != nil {
+		return nil, err
 	}
-
-	// 解析actionData的具体字段
-	to, ok := issue["to"].(string)
-	if ok == false {
-		return nil, errors.New("Action Data 'user' field error")
+	var blockResp eos.BlockResp
+	if err := json.Unmarshal(data, &blockResp); err != nil {
+		return nil, err
 	}
+	return &blockResp, nil
+}
 
-	quantity, ok := issue["quantity"].(string)
-	if ok == false {
-		return nil, errors.New("Action Data 'amount' field error")
+// 从Blocks 获取交易的执行结果，未设置时使用Endpoints
+func (ew *EOSWatcherMain) transaction(txid string) (*eos.TransactionResp, error) {
+	if ew.Blocks == nil {
+		return ew.Endpoints.GetTransaction(txid)
 	}
-	assert, err := eos.NewAsset(quantity)
+	data, err := ew.Blocks.GetTransaction(txid)
 	if err != nil {
-		return nil, errors.New("Action Data 'quantity' field unmarshal error.")
-	}
-	if assert.Symbol.Precision != precision {
-		return nil, errors.New("Action Data 'quantity' field precision error.")
+		return nil, err
 	}
-	if assert.Symbol.Symbol != symbol {
-		return nil, errors.New("Action Data 'quantity' field symbol error.")
+	var transactionResp eos.TransactionResp
+	if err := json.Unmarshal(data, &transactionResp); err != nil {
+		return nil, err
 	}
+	return &transactionResp, nil
+}
 
-	memo, ok := issue["memo"].(string)
-	if ok == false {
-		return nil, errors.New("Action Data 'user' field  error")
+// 从Blocks 获取合约当前的ABI，未设置时使用Endpoints
+func (ew *EOSWatcherMain) contractABI(account eos.AccountName) (*ContractABI, error) {
+	if ew.Blocks == nil {
+		return ew.Endpoints.GetABI(account)
+	}
+	data, err := ew.Blocks.GetABI(string(account))
+	if err != nil {
+		return nil, err
 	}
+	return parseABIResp(account, data)
+}
 
-	issueToken := &token.Issue{
-		To:			eos.AN(to),
-		Quantity:	assert,
-		Memo:		memo,
+// 更新 根据获得到的 块收据 信息，生成EOSPush事件，发给网关。 执行轨迹请求失败时一直重试，
+// ctx 结束时返回错误，不发出该块的事件
+func (ew *EOSWatcherMain) UpdateEOSPushEvent (ctx context.Context, scanBlockResp *eos.BlockResp, scanBlockIndex uint32, eventChan chan<- *EOSPushEvent) error {
+	eosPushEvents, err := ew.ExtractEOSPushEvents(ctx, scanBlockResp, scanBlockIndex)
+	if err != nil {
+		return err
 	}
-	return issueToken, nil
+	for _, eosPushEvent := range eosPushEvents {
+		eventChan <- eosPushEvent
+	}
+	return nil
 }
 
-func (ew *EOSWatcherMain) ActionDataParse(actionName eos.ActionName, data interface{}, precision uint8, symbol string) (*EOSPushEvent, error){
-	switch actionName {
-	case eos.ActN("transfer"):
-		transferToken, err := ew.ActionDataTransferParse(data, precision, symbol)
-		if err != nil {
-			return nil, err
-		}
-		eosPushEvent := &EOSPushEvent{
-			Memo:		transferToken.Memo,
-			Amount:		uint64(transferToken.Quantity.Amount),
-			Symbol:		transferToken.Quantity.Symbol.Symbol,
-			Precision:	transferToken.Quantity.Symbol.Precision,
-		}
-		return eosPushEvent, nil
-	case eos.ActN("solvent"):
-		solventToken, err := ew.ActionDataSolventParse(data, precision, symbol)
-		if err != nil {
-			return nil, err
-		}
-		eosPushEvent := &EOSPushEvent{
-			Memo:		solventToken.Memo,
-			Amount:		uint64(solventToken.Quantity.Amount),
-			Symbol:		solventToken.Quantity.Symbol.Symbol,
-			Precision:	solventToken.Quantity.Symbol.Precision,
-		}
-		return eosPushEvent, nil
-	case eos.ActN("issue"):
-		issueToken, err := ew.ActionDataIssueParse(data, precision, symbol)
-		if err != nil {
-			return nil, err
+// 根据获得到的 块收据 信息，按交易、action 顺序生成该块的EOSPush事件。
+// 执行轨迹请求失败时一直重试（否则其中的转账会丢失），ctx 结束时返回错误，这时块不能算作已扫描
+func (ew *EOSWatcherMain) ExtractEOSPushEvents(ctx context.Context, scanBlockResp *eos.BlockResp, scanBlockIndex uint32) ([]*EOSPushEvent, error) {
+	return ew.extractEOSPushEvents(ctx, scanBlockResp, scanBlockIndex, ew.watchedAccounts(), true)
+}
+
+// 按给定的监控账户生成块的EOSPush事件，一个块使用同一份配置。
+// recordABI 为true 时记录块中的setabi，只有不可逆的块才能记录，可逆的块可能被分叉掉
+func (ew *EOSWatcherMain) extractEOSPushEvents(ctx context.Context, scanBlockResp *eos.BlockResp, scanBlockIndex uint32, accounts []*WatchedAccount, recordABI bool) ([]*EOSPushEvent, error) {
+	var eosPushEvents []*EOSPushEvent
+	for index, transactionReceipt := range scanBlockResp.SignedBlock.Transactions{
+		if uint32(index) < scanBlockIndex {
+			continue
 		}
-		eosPushEvent := &EOSPushEvent{
-			Memo:		issueToken.Memo,
-			Amount:		uint64(issueToken.Quantity.Amount),
-			Symbol:		issueToken.Quantity.Symbol.Symbol,
-			Precision:	issueToken.Quantity.Symbol.Precision,
+		if transactionReceipt.Transaction.Packed != nil {
+			signedTx, err := transactionReceipt.Transaction.Packed.Unpack()
+			if err != nil {
+				// 如果解压失败，忽略该交易
+				log.Error("Unpack error", "TxID", hex.EncodeToString(transactionReceipt.Transaction.ID))
+				continue
+			}
+			// 一笔交易中可能有多个action，每个匹配的action 单独生成一个事件
+			for actionIndex, action := range signedTx.Transaction.Actions {
+				if recordABI {
+					ew.recordSetABI(action, scanBlockResp.BlockNum, accounts)
+				}
+				// 扫块只需要扫溶币、网关转出交易，不需要扫铸币交易
+				eosPushEvent := ew.parseTokenAction(action, false, accounts, scanBlockResp.BlockNum)
+				if eosPushEvent == nil {
+					continue
+				}
+				eosPushEvent.TxID = transactionReceipt.Transaction.ID
+				eosPushEvent.BlockNum = scanBlockResp.BlockNum
+				eosPushEvent.Index = index
+				eosPushEvent.ActionIndex = actionIndex
+				eosPushEvents = append(eosPushEvents, eosPushEvent)
+			}
+
+			// 交易体中只有顶层action，inline action 需要从执行轨迹中获取
+			if ew.TraceInlineActions {
+				tracedEvents, err := ew.tracedEOSPushEvents(ctx, transactionReceipt.Transaction.ID, len(signedTx.Transaction.Actions), 1, scanBlockResp.BlockNum, index, accounts, recordABI)
+				if err != nil {
+					return nil, err
+				}
+				eosPushEvents = append(eosPushEvents, tracedEvents...)
+			}
+		} else {
+			// 没有交易体的交易，比如misg 的exec 产生的交易、延迟交易，从执行轨迹中获取所有action
+			tracedEvents, err := ew.tracedEOSPushEvents(ctx, transactionReceipt.Transaction.ID, 0, 0, scanBlockResp.BlockNum, index, accounts, recordABI)
+			if err != nil {
+				return nil, err
+			}
+			eosPushEvents = append(eosPushEvents, tracedEvents...)
 		}
-		return eosPushEvent, nil
 	}
-	return nil, errors.New("Action data parse error.")
+	ew.applyProposalBindings(eosPushEvents)
+	return eosPushEvents, nil
 }
 
-func (ew *EOSWatcherMain) GetEventByTxid(txid string) (*EOSPushEvent, error) {
-	transactionResp, err := ew.EosAPI.GetTransaction(txid)
+// 请求交易的执行轨迹，生成EOSPush事件。 请求失败时一直重试，直到ctx 结束
+func (ew *EOSWatcherMain) tracedEOSPushEvents(ctx context.Context, txID eos.SHA256Bytes, topLevelCount, minDepth int, blockNum uint32, index int, accounts []*WatchedAccount, recordABI bool) ([]*EOSPushEvent, error) {
+	transactionResp, err := ew.transactionTraces(ctx, hex.EncodeToString(txID))
 	if err != nil {
 		return nil, err
 	}
-
-	// 暂时忽略一笔交易中有多个action 的情况。（待优化）
-	if len(transactionResp.Transaction.Transaction.Actions) != 1 {
-		return nil, errors.New("Transaction actions' length is not one.")
+	eosPushEvents := ew.traceEOSPushEvents(transactionResp, topLevelCount, minDepth, false, accounts, recordABI)
+	for _, eosPushEvent := range eosPushEvents {
+		eosPushEvent.BlockNum = blockNum
+		eosPushEvent.Index = index
 	}
-	action := transactionResp.Transaction.Transaction.Actions[0]
+	return eosPushEvents, nil
+}
 
-	var eosPushEvent *EOSPushEvent
-	for _, tokenContract := range ew.TokenContracts {
-		// 检查是否是需要的合约中交易
-		if action.Account == tokenContract.ActionAccount {
-			if action.Name == tokenContract.ActionNameDestroy {
-				eosPushEvent, err = ew.ActionDataParse(action.Name, action.ActionData.Data, tokenContract.Precision, tokenContract.Symbol)
-				if err == nil {
-					// 填充其他 event 参数
-					eosPushEvent.TxID = transactionResp.ID
-					eosPushEvent.Account = action.Account
-					eosPushEvent.Name = action.Name
-					eosPushEvent.BlockNum = transactionResp.BlockNum
-					eosPushEvent.Index = 0
-					return eosPushEvent, nil
-				}
-			} else if action.Name == tokenContract.ActionNameCreate {
-				eosPushEvent, err = ew.ActionDataParse(action.Name, action.ActionData.Data, tokenContract.Precision, tokenContract.Symbol)
-				if err == nil {
-					// 填充其他 event 参数
-					eosPushEvent.TxID = transactionResp.ID
-					eosPushEvent.Account = action.Account
-					eosPushEvent.Name = action.Name
-					eosPushEvent.BlockNum = transactionResp.BlockNum
-					eosPushEvent.Index = 0
-					return eosPushEvent, nil
+// 根据监控账户的TokenContracts 匹配并解析action，生成EOSPush事件（未填充交易相关字段）。
+// 不匹配任何合约、方法，或者解析失败，返回nil。 withCreate 为true时，同时匹配铸币方法。
+// 监控账户之间的转账，作为收款账户的溶币事件
+func (ew *EOSWatcherMain) ParseTokenAction(action *eos.Action, withCreate bool) *EOSPushEvent {
+	return ew.parseTokenAction(action, withCreate, ew.watchedAccounts(), 0)
+}
+
+// blockNum 为action 所在块高，用于选择合约ABI 的版本
+func (ew *EOSWatcherMain) parseTokenAction(action *eos.Action, withCreate bool, accounts []*WatchedAccount, blockNum uint32) *EOSPushEvent {
+	var withdrawalEvent *EOSPushEvent
+	for _, watchedAccount := range accounts {
+		for _, tokenContract := range watchedAccount.TokenContracts {
+			// 检查是否是需要的合约中交易
+			if action.Account != tokenContract.ActionAccount {
+				continue
+			}
+			if action.Name != tokenContract.ActionNameDestroy && !(withCreate && action.Name == tokenContract.ActionNameCreate) {
+				continue
+			}
+			ctx := &ActionDecodeContext{
+				Gateway:		watchedAccount.Account,
+				TokenContract:	tokenContract,
+				BlockNum:		blockNum,
+				ABI:			ew.actionABI(action, blockNum),
+			}
+			eosPushEvent, err := ew.ActionDecoders.Decode(action, ctx)
+			if err != nil {
+				continue
+			}
+			eosPushEvent.Account = action.Account
+			eosPushEvent.Name = action.Name
+			eosPushEvent.Business = tokenContract.Business
+			eosPushEvent.WatchedAccount = watchedAccount.Account
+			if eosPushEvent.EventType == EventTypeWithdrawalConfirmed {
+				// 转出方是监控账户，收款方也可能是，继续查找
+				if withdrawalEvent == nil {
+					withdrawalEvent = eosPushEvent
 				}
+				continue
 			}
+			// 用户溶币的memo 由用户填写，按配置的格式检查；格式错误的作为无效memo 事件发出
+			if action.Name == tokenContract.ActionNameDestroy {
+				ew.applyMemoSchema(eosPushEvent, tokenContract)
+			}
+			return eosPushEvent
 		}
 	}
+	return withdrawalEvent
+}
 
-	return nil, errors.New("Action Account doesn't match.")
-
-	//dataType := reflect.TypeOf(action.ActionData.Data)
-	//fmt.Println(dataType)
+// 查询交易中所有匹配的溶币、铸币事件，事件的Confirmation 为交易的确认信息
+func (ew *EOSWatcherMain) GetEventByTxid(txid string) ([]*EOSPushEvent, error) {
+	return ew.GetEventByTxidWithOptions(txid, nil)
 }
 
-// 根据multisig下的PKMSign代码，移植过来
-func (ew *EOSWatcherMain) PKMSign(tx *eos.SignedTransaction) (sig *ecc.Signature, err error) {
-	txdata, err := eos.MarshalBinary(tx.Transaction)
+// 同GetEventByTxid，按options 拒绝未执行成功（*TxNotExecutedError）、未不可逆（*TxNotIrreversibleError）的交易。
+// 交易所在块中查不到该交易时返回 *TxNotInBlockError
+func (ew *EOSWatcherMain) GetEventByTxidWithOptions(txid string, options *TxQueryOptions) ([]*EOSPushEvent, error) {
+	// 与确认用的块、不可逆块高来自同一来源
+	transactionResp, err := ew.transaction(txid)
 	if err != nil {
 		return nil, err
 	}
+	confirmation, err := ew.txConfirmation(transactionResp)
+	if err != nil {
+		return nil, err
+	}
+	if err := confirmation.check(txid, options); err != nil {
+		return nil, err
+	}
 
-	cfd := []byte{}
-	if len(tx.ContextFreeData) > 0 {
-		cfd, err = eos.MarshalBinary(tx.ContextFreeData)
-		if err != nil {
-			return nil, err
+	var eosPushEvents []*EOSPushEvent
+	accounts := ew.watchedAccounts()
+	actions := TransactionActions(transactionResp)
+	for actionIndex, action := range actions {
+		eosPushEvent := ew.parseTokenAction(action, true, accounts, transactionResp.BlockNum)
+		if eosPushEvent == nil {
+			continue
 		}
+		// 填充其他 event 参数
+		eosPushEvent.TxID = transactionResp.ID
+		eosPushEvent.BlockNum = transactionResp.BlockNum
+		eosPushEvent.Index = 0
+		eosPushEvent.ActionIndex = actionIndex
+		eosPushEvents = append(eosPushEvents, eosPushEvent)
+	}
+
+	// 执行轨迹中的inline action；没有交易体时（延迟交易等），顶层action 也从执行轨迹中获取
+	topLevelCount := len(actions)
+	minDepth := 1
+	if topLevelCount == 0 {
+		minDepth = 0
+	}
+	for _, eosPushEvent := range ew.traceEOSPushEvents(transactionResp, topLevelCount, minDepth, true, accounts, false) {
+		eosPushEvent.BlockNum = transactionResp.BlockNum
+		eosPushEvent.Index = 0
+		eosPushEvents = append(eosPushEvents, eosPushEvent)
 	}
-	blockInfo, err := ew.EosAPI.GetInfo()
+
+	if len(eosPushEvents) == 0 {
+		return nil, errors.New("Action Account doesn't match.")
+	}
+	for _, eosPushEvent := range eosPushEvents {
+		eosPushEvent.Confirmation = confirmation
+	}
+	ew.applyProposalBindings(eosPushEvents)
+	return eosPushEvents, nil
+}
+
+// 根据multisig下的PKMSign代码，移植过来
+func (ew *EOSWatcherMain) PKMSign(tx *eos.SignedTransaction) (sig *ecc.Signature, err error) {
+	return ew.PKMSignWithHash(tx, ew.PubKeyHash)
+}
+
+// 使用签名服务中pubKeyHash 对应的私钥签名
+func (ew *EOSWatcherMain) PKMSignWithHash(tx *eos.SignedTransaction, pubKeyHash string) (sig *ecc.Signature, err error) {
+	ew.trackOutgoingTx(tx)
+	sigDigest, err := ew.sigDigest(tx)
 	if err != nil {
-		log.Error("get blockInfo err", err)
+		log.Error("get sig digest err", "info", err)
 		return nil, err
 	}
-	chainID := blockInfo.ChainID
-
-	sigDigest := eos.SigDigest(chainID, txdata, cfd)
 
 	//通过调用签名服务来进行签名
-	sigResult, err := utils.Sign(sigDigest, ew.PubKeyHash)
+	sigResult, err := utils.Sign(sigDigest, pubKeyHash)
 	if err != nil {
 		log.Error("SIGN", "error:", err)
 		return sig, err
@@ -598,26 +676,11 @@ func (ew *EOSWatcherMain) PKMSign(tx *eos.SignedTransaction) (sig *ecc.Signature
 
 //根据multisig下的GetPublickeyFromTx代码，移植过来
 func (ew *EOSWatcherMain) GetPublickeyFromTx(tx *eos.SignedTransaction, sig *ecc.Signature) (out ecc.PublicKey, err error) {
-	txdata, err := eos.MarshalBinary(tx.Transaction)
-	if err != nil {
-		return ecc.PublicKey{}, err
-	}
-
-	cfd := []byte{}
-	if len(tx.ContextFreeData) > 0 {
-		cfd, err = eos.MarshalBinary(tx.ContextFreeData)
-		if err != nil {
-			return ecc.PublicKey{}, err
-		}
-	}
-	blockInfo, err := ew.EosAPI.GetInfo()
+	sigDigest, err := ew.sigDigest(tx)
 	if err != nil {
-		log.Error("get Info err", err)
+		log.Error("get sig digest err", "info", err)
 		return ecc.PublicKey{}, err
 	}
-	chainID := blockInfo.ChainID
-
-	sigDigest := eos.SigDigest(chainID, txdata, cfd)
 
 	return sig.PublicKey(sigDigest)
 }
@@ -628,6 +691,7 @@ func (ew *EOSWatcherMain) MergeSignedTx(tx *eos.SignedTransaction, sigs ...*ecc.
 	for _, sig := range sigs {
 		tx.Signatures = append(tx.Signatures, *sig)
 	}
+	ew.trackOutgoingTx(tx)
 	//交易打包
 	//log.Debug("for pack", "data", tx)
 	trx, err := tx.Pack(0)
@@ -639,9 +703,19 @@ func (ew *EOSWatcherMain) MergeSignedTx(tx *eos.SignedTransaction, sigs ...*ecc.
 
 //根据multisig下的SendTx代码，移植过来
 func (ew *EOSWatcherMain) SendTx(tx *eos.PackedTransaction) (out *eos.PushTransactionFullResp, err error) {
-	out, err = ew.EosAPI.PushTransaction(tx)
+	var txid string
+	if signedTx, err := tx.Unpack(); err != nil {
+		log.Error("unpack outgoing tx err", "info", err)
+	} else {
+		txid = ew.trackOutgoingTx(signedTx)
+	}
+
+	out, err = ew.Endpoints.PushTransaction(tx)
 	if err != nil {
 		log.Error("send tx err:", err.Error())
+		if txid != "" && !pushMaybeAccepted(err) {
+			ew.failOutgoingTx(txid, err)
+		}
 		return nil, err
 	}
 	return
@@ -748,32 +822,14 @@ func (ew *EOSWatcherMain) CreateSetCodeAction(wasmFile, abiFile string) ([]*eos.
 	return setContract, nil
 }
 
-// 根据action等，创建交易
+// 根据action等，创建交易，见BuildTx
 func (ew *EOSWatcherMain) CreateTx(action *eos.Action, duration time.Duration) (*eos.SignedTransaction, error) {
-	infoResp, err := ew.EosAPI.GetInfo()
-
-	//生成未签名交易
-	tx := eos.NewTransaction([]*eos.Action{action}, &eos.TxOptions{HeadBlockID: infoResp.HeadBlockID})
-	tx.SetExpiration(duration)
-
-	//生成签名交易
-	stx := eos.NewSignedTransaction(tx)
-
-	return stx, err
+	return ew.BuildTx([]*eos.Action{action}, &TxBuildOptions{Expiration: duration})
 }
 
-// 根据多个actions等，创建交易
+// 根据多个actions等，创建交易，见BuildTx
 func (ew *EOSWatcherMain) CreateActionsTx(action []*eos.Action, duration time.Duration) (*eos.SignedTransaction, error) {
-	infoResp, err := ew.EosAPI.GetInfo()
-
-	//生成未签名交易
-	tx := eos.NewTransaction(action, &eos.TxOptions{HeadBlockID: infoResp.HeadBlockID})
-	tx.SetExpiration(duration)
-
-	//生成签名交易
-	stx := eos.NewSignedTransaction(tx)
-
-	return stx, err
+	return ew.BuildTx(action, &TxBuildOptions{Expiration: duration})
 }
 
 func (ew *EOSWatcherMain) NewPublicKey(uncompresspubkey string) (*ecc.PublicKey, error) {
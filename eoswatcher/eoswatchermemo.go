@@ -0,0 +1,381 @@
+package eoswatcher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"math/big"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// memo 格式
+const (
+	// 不检查，原样交给网关
+	MemoFormatRaw = "raw"
+	// json 对象，RequiredFields 中的字段必须存在
+	MemoFormatJSON = "json"
+	// 目标链:地址，如 btc:1BoatSLRHtKNngkdXEeobR76b53LETtpyT
+	MemoFormatChainAddress = "chain:address"
+	// 只有地址，所在的链由Chain 指定
+	MemoFormatAddress = "address"
+)
+
+// 溶币memo 的格式。 除raw 外，规范化后都是json 对象，地址、目标链在Address、Chain 字段中
+type MemoSchema struct {
+	Format				string			`mapstructure:"format"`
+	// 目标链。 json 格式时写入Chain 字段；address 格式时为地址所在的链
+	Chain				string			`mapstructure:"chain"`
+	// json 格式中必须有的字段，大小写不敏感
+	RequiredFields		[]string		`mapstructure:"required_fields"`
+	// chain:address 格式中允许的链，为空时不限制
+	Chains				[]string		`mapstructure:"chains"`
+}
+
+// 没有配置memo 格式时，按货币名称使用的默认格式
+var DefaultMemoSchemas = map[string]*MemoSchema{
+	"WBCH": {Format: MemoFormatJSON, Chain: "bch"},
+	"WBTC": {Format: MemoFormatJSON, Chain: "btc"},
+}
+
+// 从配置中读取 货币名称 -> memo 格式，例如：
+//	[EOS.memo_schemas.WBTC]
+//	format = "json"
+//	chain = "btc"
+//	required_fields = ["Address"]
+func LoadMemoSchemas(key string) (map[string]*MemoSchema, error) {
+	schemas := make(map[string]*MemoSchema)
+	if err := viper.UnmarshalKey(key, &schemas); err != nil {
+		return nil, err
+	}
+	for _, schema := range schemas {
+		if err := schema.Check(); err != nil {
+			return nil, err
+		}
+	}
+	return schemas, nil
+}
+
+// 检查配置是否有效
+func (schema *MemoSchema) Check() error {
+	switch schema.Format {
+	case MemoFormatRaw, MemoFormatJSON, MemoFormatChainAddress:
+		return nil
+	case MemoFormatAddress:
+		if schema.Chain == "" {
+			return errors.New("Memo schema 'address' format needs chain.")
+		}
+		return nil
+	}
+	return errors.New("Memo schema format '" + schema.Format + "' error.")
+}
+
+// 按格式检查memo，返回交给网关的数据。 schema 为nil 时按raw 处理
+func (schema *MemoSchema) Normalize(memo string) ([]byte, error) {
+	if schema == nil {
+		return []byte(memo), nil
+	}
+	switch schema.Format {
+	case MemoFormatRaw:
+		return []byte(memo), nil
+	case MemoFormatJSON:
+		return schema.normalizeJSON(memo)
+	case MemoFormatChainAddress:
+		parts := strings.SplitN(strings.TrimSpace(memo), ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Memo is not 'chain:address'.")
+		}
+		chain := strings.ToLower(parts[0])
+		if len(schema.Chains) > 0 && !containsString(schema.Chains, chain) {
+			return nil, errors.New("Memo chain '" + chain + "' is not allowed.")
+		}
+		return marshalAddressMemo(chain, parts[1])
+	case MemoFormatAddress:
+		return marshalAddressMemo(schema.Chain, strings.TrimSpace(memo))
+	}
+	return nil, errors.New("Memo schema format '" + schema.Format + "' error.")
+}
+
+func (schema *MemoSchema) normalizeJSON(memo string) ([]byte, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(memo), &fields); err != nil {
+		return nil, errors.New("Memo is not a json object.")
+	}
+	// Address、Chain 统一大小写，与JsonMemo 一致
+	for key, value := range fields {
+		for _, name := range []string{"Address", "Chain"} {
+			if key != name && strings.EqualFold(key, name) {
+				delete(fields, key)
+				fields[name] = value
+			}
+		}
+	}
+	for _, required := range schema.RequiredFields {
+		found := false
+		for key, value := range fields {
+			if strings.EqualFold(key, required) && value != nil && value != "" {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.New("Memo field '" + required + "' is missing.")
+		}
+	}
+	if schema.Chain != "" {
+		fields["Chain"] = schema.Chain
+	}
+
+	if address, ok := fields["Address"].(string); ok {
+		if chain, ok := fields["Chain"].(string); ok {
+			if err := ValidateAddress(chain, address); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return json.Marshal(fields)
+}
+
+func marshalAddressMemo(chain, address string) ([]byte, error) {
+	if address == "" {
+		return nil, errors.New("Memo address is empty.")
+	}
+	if err := ValidateAddress(chain, address); err != nil {
+		return nil, err
+	}
+	return json.Marshal(&JsonMemo{Address: address, Chain: chain})
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// 根据合约配置、watcher 配置、默认配置，依次查找合约的memo 格式，都没有时返回nil（raw）
+func (ew *EOSWatcherMain) MemoSchemaFor(tokenContract *TokenContract) *MemoSchema {
+	if tokenContract.MemoSchema != nil {
+		return tokenContract.MemoSchema
+	}
+	if schema, ok := ew.MemoSchemas[tokenContract.Symbol]; ok {
+		return schema
+	}
+	return DefaultMemoSchemas[tokenContract.Symbol]
+}
+
+// 按合约的memo 格式规范化溶币事件的memo，不符合格式时标记为无效memo 事件
+func (ew *EOSWatcherMain) applyMemoSchema(eosPushEvent *EOSPushEvent, tokenContract *TokenContract) {
+	data, err := ew.MemoSchemaFor(tokenContract).Normalize(eosPushEvent.Memo)
+	if err != nil {
+		eosPushEvent.EventType = EventTypeInvalidMemo
+		eosPushEvent.MemoError = err.Error()
+		return
+	}
+	eosPushEvent.NormalizedMemo = data
+}
+
+// 各链的地址校验，没有注册校验的链不检查
+var (
+	addressValidatorsLock	sync.RWMutex
+	addressValidators		= map[string]func(address string) error{
+		"btc":	ValidateBTCAddress,
+		"bch":	ValidateBCHAddress,
+		"eth":	ValidateETHAddress,
+		"eos":	ValidateEOSAccount,
+	}
+)
+
+// 注册或替换链的地址校验
+func RegisterAddressValidator(chain string, validator func(address string) error) {
+	addressValidatorsLock.Lock()
+	defer addressValidatorsLock.Unlock()
+	addressValidators[strings.ToLower(chain)] = validator
+}
+
+// 校验链上的地址，没有注册校验的链直接通过
+func ValidateAddress(chain, address string) error {
+	addressValidatorsLock.RLock()
+	validator, ok := addressValidators[strings.ToLower(chain)]
+	addressValidatorsLock.RUnlock()
+	if !ok {
+		return nil
+	}
+	return validator(address)
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// base58check 解码，返回版本号和数据
+func decodeBase58Check(address string) (byte, []byte, error) {
+	value := big.NewInt(0)
+	radix := big.NewInt(58)
+	for _, c := range address {
+		index := strings.IndexRune(base58Alphabet, c)
+		if index < 0 {
+			return 0, nil, errors.New("Address has invalid base58 character.")
+		}
+		value.Mul(value, radix)
+		value.Add(value, big.NewInt(int64(index)))
+	}
+	decoded := value.Bytes()
+	for _, c := range address {
+		if c != '1' {
+			break
+		}
+		decoded = append([]byte{0}, decoded...)
+	}
+	if len(decoded) < 5 {
+		return 0, nil, errors.New("Address is too short.")
+	}
+	payload, checksum := decoded[:len(decoded)-4], decoded[len(decoded)-4:]
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	if !bytes.Equal(second[:4], checksum) {
+		return 0, nil, errors.New("Address checksum error.")
+	}
+	return payload[0], payload[1:], nil
+}
+
+// 比特币legacy 地址（P2PKH、P2SH，主网、测试网）
+func validateLegacyAddress(address string) error {
+	version, hash, err := decodeBase58Check(address)
+	if err != nil {
+		return err
+	}
+	if len(hash) != 20 {
+		return errors.New("Address hash length error.")
+	}
+	switch version {
+	case 0x00, 0x05, 0x6f, 0xc4:
+		return nil
+	}
+	return errors.New("Address version error.")
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// BTC 地址：legacy 或 bech32（bc1、tb1）
+func ValidateBTCAddress(address string) error {
+	lower := strings.ToLower(address)
+	if strings.HasPrefix(lower, "bc1") || strings.HasPrefix(lower, "tb1") {
+		if lower != address && strings.ToUpper(address) != address {
+			return errors.New("Bech32 address has mixed case.")
+		}
+		return validateBech32(lower)
+	}
+	return validateLegacyAddress(address)
+}
+
+func validateBech32(address string) error {
+	separator := strings.LastIndex(address, "1")
+	if separator < 1 || separator + 7 > len(address) || len(address) > 90 {
+		return errors.New("Bech32 address length error.")
+	}
+	values := make([]int, 0, len(address))
+	for _, c := range address[:separator] {
+		values = append(values, int(c) >> 5)
+	}
+	values = append(values, 0)
+	for _, c := range address[:separator] {
+		values = append(values, int(c) & 31)
+	}
+	for _, c := range address[separator+1:] {
+		index := strings.IndexRune(bech32Charset, c)
+		if index < 0 {
+			return errors.New("Bech32 address has invalid character.")
+		}
+		values = append(values, index)
+	}
+	generator := []int{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	checksum := 1
+	for _, value := range values {
+		top := checksum >> 25
+		checksum = (checksum & 0x1ffffff) << 5 ^ value
+		for i := 0; i < 5; i++ {
+			if (top >> uint(i)) & 1 == 1 {
+				checksum ^= generator[i]
+			}
+		}
+	}
+	// bech32（segwit v0）或 bech32m（segwit v1 以上）
+	if checksum != 1 && checksum != 0x2bc830a3 {
+		return errors.New("Bech32 address checksum error.")
+	}
+	return nil
+}
+
+// BCH 地址：legacy 或 cashaddr（可以省略 bitcoincash: 前缀）
+func ValidateBCHAddress(address string) error {
+	lower := strings.ToLower(address)
+	prefix := "bitcoincash"
+	payload := lower
+	if index := strings.Index(lower, ":"); index >= 0 {
+		prefix, payload = lower[:index], lower[index+1:]
+	} else if !strings.HasPrefix(lower, "q") && !strings.HasPrefix(lower, "p") {
+		return validateLegacyAddress(address)
+	}
+	if prefix != "bitcoincash" && prefix != "bchtest" {
+		return errors.New("Cashaddr prefix error.")
+	}
+	if lower != address && strings.ToUpper(address) != address {
+		return errors.New("Cashaddr has mixed case.")
+	}
+	if len(payload) != 42 {
+		return errors.New("Cashaddr length error.")
+	}
+
+	values := make([]uint64, 0, len(prefix) + 1 + len(payload))
+	for _, c := range prefix {
+		values = append(values, uint64(c) & 31)
+	}
+	values = append(values, 0)
+	for _, c := range payload {
+		index := strings.IndexRune(bech32Charset, c)
+		if index < 0 {
+			return errors.New("Cashaddr has invalid character.")
+		}
+		values = append(values, uint64(index))
+	}
+	generator := []uint64{0x98f2bc8e61, 0x79b76d99e2, 0xf33e5fb3c4, 0xae2eabe2a8, 0x1e4f43e470}
+	var checksum uint64 = 1
+	for _, value := range values {
+		top := checksum >> 35
+		checksum = ((checksum & 0x07ffffffff) << 5) ^ value
+		for i := 0; i < 5; i++ {
+			if (top >> uint(i)) & 1 == 1 {
+				checksum ^= generator[i]
+			}
+		}
+	}
+	if checksum ^ 1 != 0 {
+		return errors.New("Cashaddr checksum error.")
+	}
+	return nil
+}
+
+var (
+	ethAddressRegexp = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+	eosAccountRegexp = regexp.MustCompile(`^[a-z1-5.]{1,12}$`)
+)
+
+// ETH 地址，不检查大小写校验
+func ValidateETHAddress(address string) error {
+	if !ethAddressRegexp.MatchString(address) {
+		return errors.New("ETH address format error.")
+	}
+	return nil
+}
+
+// EOS 账户名
+func ValidateEOSAccount(address string) error {
+	if !eosAccountRegexp.MatchString(address) {
+		return errors.New("EOS account name format error.")
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package eoswatcher
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAddress(t *testing.T) {
+	assert.Nil(t, ValidateAddress("btc", "1BoatSLRHtKNngkdXEeobR76b53LETtpyT"))
+	assert.Nil(t, ValidateAddress("btc", "3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy"))
+	assert.Nil(t, ValidateAddress("btc", "BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4"))
+	assert.Nil(t, ValidateAddress("btc", "bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0"))
+	assert.NotNil(t, ValidateAddress("btc", "1BoatSLRHtKNngkdXEeobR76b53LETtpyU"))
+	assert.NotNil(t, ValidateAddress("btc", "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t5"))
+
+	assert.Nil(t, ValidateAddress("bch", "bitcoincash:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a"))
+	assert.Nil(t, ValidateAddress("BCH", "qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a"))
+	assert.Nil(t, ValidateAddress("bch", "1BoatSLRHtKNngkdXEeobR76b53LETtpyT"))
+	assert.NotNil(t, ValidateAddress("bch", "bitcoincash:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6b"))
+
+	assert.Nil(t, ValidateAddress("eth", "0x52908400098527886E0F7030069857D2E4169EE7"))
+	assert.NotNil(t, ValidateAddress("eth", "52908400098527886E0F7030069857D2E4169EE7"))
+	assert.Nil(t, ValidateAddress("eos", "gateway11111"))
+	assert.NotNil(t, ValidateAddress("eos", "Gateway11111"))
+
+	// 没有注册校验的链不检查
+	assert.Nil(t, ValidateAddress("doge", "anything"))
+}
+
+func TestMemoSchemaNormalize(t *testing.T) {
+	// 默认的WBTC 格式：json，注入Chain
+	data, err := DefaultMemoSchemas["WBTC"].Normalize(`{"address":"1BoatSLRHtKNngkdXEeobR76b53LETtpyT"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"Address":"1BoatSLRHtKNngkdXEeobR76b53LETtpyT","Chain":"btc"}`, string(data))
+
+	_, err = DefaultMemoSchemas["WBTC"].Normalize(`{"Address":"1BoatSLRHtKNngkdXEeobR76b53LETtpyU"}`)
+	assert.NotNil(t, err)
+	_, err = DefaultMemoSchemas["WBTC"].Normalize("1BoatSLRHtKNngkdXEeobR76b53LETtpyT")
+	assert.NotNil(t, err)
+
+	schema := &MemoSchema{Format: MemoFormatJSON, RequiredFields: []string{"Address", "Tag"}}
+	_, err = schema.Normalize(`{"Address":"abc"}`)
+	assert.NotNil(t, err)
+	data, err = schema.Normalize(`{"Address":"abc","tag":"1"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"Address":"abc","tag":"1"}`, string(data))
+
+	schema = &MemoSchema{Format: MemoFormatChainAddress, Chains: []string{"btc", "eth"}}
+	data, err = schema.Normalize("BTC:1BoatSLRHtKNngkdXEeobR76b53LETtpyT")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"Address":"1BoatSLRHtKNngkdXEeobR76b53LETtpyT","Chain":"btc"}`, string(data))
+	_, err = schema.Normalize("bch:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a")
+	assert.NotNil(t, err)
+	_, err = schema.Normalize("1BoatSLRHtKNngkdXEeobR76b53LETtpyT")
+	assert.NotNil(t, err)
+
+	schema = &MemoSchema{Format: MemoFormatAddress, Chain: "eth"}
+	data, err = schema.Normalize(" 0x52908400098527886E0F7030069857D2E4169EE7 ")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"Address":"0x52908400098527886E0F7030069857D2E4169EE7","Chain":"eth"}`, string(data))
+
+	var raw *MemoSchema
+	data, err = raw.Normalize("anything")
+	assert.Nil(t, err)
+	assert.Equal(t, "anything", string(data))
+
+	assert.NotNil(t, (&MemoSchema{Format: MemoFormatAddress}).Check())
+	assert.NotNil(t, (&MemoSchema{Format: "xml"}).Check())
+}
+
+func TestInvalidMemoEvent(t *testing.T) {
+	ew := &EOSWatcherMain{}
+	tokenContract := &TokenContract{Symbol: "WBCH", Precision: 8}
+
+	event := &EOSPushEvent{Memo: "not json", Symbol: "WBCH"}
+	ew.applyMemoSchema(event, tokenContract)
+	assert.Equal(t, EventTypeInvalidMemo, event.GetEventType())
+	_, err := event.GetData()
+	assert.NotNil(t, err)
+
+	event = &EOSPushEvent{Memo: `{"Address":"qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a"}`, Symbol: "WBCH"}
+	ew.applyMemoSchema(event, tokenContract)
+	assert.Equal(t, EventTypeUnknown, event.GetEventType())
+	data, err := event.GetData()
+	assert.Nil(t, err)
+	assert.Equal(t, `{"Address":"qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a","Chain":"bch"}`, string(data))
+}
@@ -0,0 +1,317 @@
+package eoswatcher
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/eoscanada/eos-go"
+	"github.com/eoscanada/eos-go/p2p"
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// 一次sync_request 请求的块数，与nodeos 的sync-fetch-span 默认值一致
+	p2pDefaultWindow = 100
+	// 等待一个块的默认超时，超时后由调用方回退到HTTP
+	p2pDefaultTimeout = 10 * time.Second
+	// 连接失败后，间隔这么久再重连
+	p2pReconnectInterval = 10 * time.Second
+	p2pDialTimeout = 5 * time.Second
+	p2pAgent = "eoswatcher"
+)
+
+// P2P 块来源：连接nodeos 的p2p 端口，用sync_request 按块高区间请求块，直接接收signed_block，
+// 省去每个块一次get_block 请求。 请求的块超时未收到（节点缺块、落后、连接断开）时返回错误，由调用方回退到HTTP。
+// 只用于不可逆块：sync_request 按块高返回节点当前分叉上的块
+type P2PBlockSource struct {
+	// nodeos p2p 地址，如 127.0.0.1:9876
+	Address				string
+	ChainID				eos.SHA256Bytes
+	// 一次sync_request 请求的块数，为0 时使用p2pDefaultWindow
+	Window				uint32
+	// 等待一个块的超时，为0 时使用p2pDefaultTimeout
+	Timeout				time.Duration
+
+	lock				sync.Mutex
+	conn				net.Conn
+	peer				*p2p.Peer
+	// 连接失败的时间，重连间隔内不再连接
+	connectFailed		time.Time
+	closed				bool
+	// 已请求的块高区间 [requestStart, requestEnd)，只保留区间内收到的块
+	requestStart		uint32
+	requestEnd			uint32
+	// 区间内收到的最高块高，节点按块高顺序发送
+	lastReceived		uint32
+	// 已收到、还没取走的块
+	blocks				map[uint32]*eos.BlockResp
+	// 收到新块、连接断开时关闭并替换，唤醒等待的GetBlock
+	notify				chan struct{}
+}
+
+func NewP2PBlockSource(address string, chainID eos.SHA256Bytes) *P2PBlockSource {
+	return &P2PBlockSource{
+		Address:		address,
+		ChainID:		chainID,
+		blocks:			make(map[uint32]*eos.BlockResp),
+		notify:			make(chan struct{}),
+	}
+}
+
+func (source *P2PBlockSource) window() uint32 {
+	if source.Window == 0 {
+		return p2pDefaultWindow
+	}
+	return source.Window
+}
+
+func (source *P2PBlockSource) timeout() time.Duration {
+	if source.Timeout == 0 {
+		return p2pDefaultTimeout
+	}
+	return source.Timeout
+}
+
+// 获取blockNum 处的块，不在已请求的区间内时发送新的sync_request。 未连接时先连接。
+// 超时、连接失败时返回错误，不重试
+func (source *P2PBlockSource) GetBlock(ctx context.Context, blockNum uint32) (*eos.BlockResp, error) {
+	timer := time.NewTimer(source.timeout())
+	defer timer.Stop()
+	for {
+		source.lock.Lock()
+		if blockResp, ok := source.blocks[blockNum]; ok {
+			delete(source.blocks, blockNum)
+			source.lock.Unlock()
+			return blockResp, nil
+		}
+		if err := source.request(blockNum); err != nil {
+			source.lock.Unlock()
+			return nil, err
+		}
+		notify := source.notify
+		source.lock.Unlock()
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			return nil, errors.New("EOS p2p block timeout.")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// 断开连接，之后GetBlock 都返回错误
+func (source *P2PBlockSource) Close() {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	source.closed = true
+	source.disconnect(source.conn)
+}
+
+// 确保blockNum 在已请求的区间内。 在区间之后一个窗口内时（并发扫块时，各协程请求的块高交错），延长区间，
+// 保留上一个窗口里还没收到的块，从还没收到的块开始重新请求（新的sync_request 会替换节点上正在发送的请求）；
+// 否则重新开始，丢弃区间外的块。 需持有lock
+func (source *P2PBlockSource) request(blockNum uint32) error {
+	if source.conn == nil {
+		if err := source.connect(); err != nil {
+			return err
+		}
+	}
+	if blockNum >= source.requestStart && blockNum < source.requestEnd {
+		return nil
+	}
+
+	start, from, end := blockNum, blockNum, blockNum + source.window()
+	extend := source.requestEnd > 0 && blockNum >= source.requestStart && blockNum < source.requestEnd + source.window()
+	if extend {
+		start, from = source.requestStart, source.requestStart
+		if source.requestEnd > source.window() && source.requestEnd - source.window() > start {
+			start = source.requestEnd - source.window()
+		}
+		if source.lastReceived >= from {
+			from = source.lastReceived + 1
+		}
+		if from < start {
+			from = start
+		}
+	}
+	if err := source.peer.SendSyncRequest(from, end); err != nil {
+		source.disconnect(source.conn)
+		return err
+	}
+	if !extend {
+		source.lastReceived = 0
+	}
+	source.requestStart, source.requestEnd = start, end
+	for height := range source.blocks {
+		if height < start || height >= end {
+			delete(source.blocks, height)
+		}
+	}
+	log.Debug("EOS p2p sync request", "Address", source.Address, "StartBlock", from, "EndBlock", end)
+	return nil
+}
+
+// 连接并握手，启动读取协程。 需持有lock
+func (source *P2PBlockSource) connect() error {
+	if source.closed {
+		return errors.New("EOS p2p block source closed.")
+	}
+	if time.Since(source.connectFailed) < p2pReconnectInterval {
+		return errors.New("EOS p2p peer " + source.Address + " not connected.")
+	}
+
+	conn, err := net.DialTimeout("tcp", source.Address, p2pDialTimeout)
+	if err != nil {
+		source.connectFailed = time.Now()
+		log.Error("EOS p2p connect error", "Address", source.Address, "info", err)
+		return err
+	}
+	peer := p2p.NewOutgoingPeer(source.Address, source.ChainID, p2pAgent, false)
+	peer.SetConnection(conn)
+	// 握手时声明自己没有块，节点不会主动推送同步块，只响应sync_request
+	if err := peer.SendHandshake(&p2p.HandshakeInfo{}); err != nil {
+		conn.Close()
+		source.connectFailed = time.Now()
+		log.Error("EOS p2p handshake error", "Address", source.Address, "info", err)
+		return err
+	}
+
+	source.conn, source.peer = conn, peer
+	source.requestStart, source.requestEnd, source.lastReceived = 0, 0, 0
+	log.Info("EOS p2p peer connected", "Address", source.Address)
+	go source.readBlocks(peer, conn)
+	return nil
+}
+
+// 关闭conn，唤醒等待的GetBlock 重新请求。 conn 已被替换时不处理。 需持有lock
+func (source *P2PBlockSource) disconnect(conn net.Conn) {
+	if conn == nil || source.conn != conn {
+		return
+	}
+	conn.Close()
+	source.conn, source.peer = nil, nil
+	source.requestStart, source.requestEnd, source.lastReceived = 0, 0, 0
+	source.wake()
+}
+
+func (source *P2PBlockSource) wake() {
+	close(source.notify)
+	source.notify = make(chan struct{})
+}
+
+// 读取协程：收到的块转为BlockResp 放入缓存，连接断开或节点发来go_away 时退出
+func (source *P2PBlockSource) readBlocks(peer *p2p.Peer, conn net.Conn) {
+	for {
+		packet, err := peer.Read()
+		if err != nil {
+			source.lock.Lock()
+			if source.conn == conn && !source.closed {
+				log.Error("EOS p2p read error", "Address", source.Address, "info", err)
+			}
+			source.disconnect(conn)
+			source.lock.Unlock()
+			return
+		}
+
+		switch message := packet.P2PMessage.(type) {
+		case *eos.SignedBlock:
+			blockResp, err := p2pBlockResp(message)
+			if err != nil {
+				log.Error("EOS p2p block error", "Address", source.Address, "info", err)
+				continue
+			}
+			source.addBlock(blockResp)
+		case *eos.GoAwayMessage:
+			log.Error("EOS p2p peer go away", "Address", source.Address, "Reason", message.Reason)
+			source.lock.Lock()
+			source.disconnect(conn)
+			source.lock.Unlock()
+			return
+		}
+	}
+}
+
+// 只保留已请求区间内的块，节点广播的新块等直接丢弃
+func (source *P2PBlockSource) addBlock(blockResp *eos.BlockResp) {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	if blockResp.BlockNum < source.requestStart || blockResp.BlockNum >= source.requestEnd {
+		return
+	}
+	source.blocks[blockResp.BlockNum] = blockResp
+	if blockResp.BlockNum > source.lastReceived {
+		source.lastReceived = blockResp.BlockNum
+	}
+	source.wake()
+}
+
+// signed_block 转为与get_block 一致的BlockResp。 p2p 传输的交易收据中只有打包的交易，没有交易ID，按交易内容计算
+func p2pBlockResp(signedBlock *eos.SignedBlock) (*eos.BlockResp, error) {
+	blockID, err := signedBlock.BlockID()
+	if err != nil {
+		return nil, err
+	}
+	if len(blockID) < 16 {
+		return nil, errors.New("EOS p2p block id error.")
+	}
+	blockResp := &eos.BlockResp{
+		SignedBlock:		*signedBlock,
+		ID:					blockID,
+		BlockNum:			signedBlock.BlockNumber(),
+		RefBlockPrefix:		binary.LittleEndian.Uint32(blockID[8:16]),
+	}
+	for i := range blockResp.Transactions {
+		transaction := &blockResp.Transactions[i].Transaction
+		if len(transaction.ID) > 0 || transaction.Packed == nil {
+			continue
+		}
+		signedTx, err := transaction.Packed.Unpack()
+		if err != nil {
+			return nil, err
+		}
+		txID, err := TransactionID(signedTx)
+		if err != nil {
+			return nil, err
+		}
+		if transaction.ID, err = hex.DecodeString(txID); err != nil {
+			return nil, err
+		}
+	}
+	return blockResp, nil
+}
+
+// 扫块时通过nodeos 的p2p 端口获取不可逆块，缺块时回退到HTTP。 需在StartWatch 之前调用，链ID 从节点获取
+func (ew *EOSWatcherMain) EnableP2P(address string) error {
+	chainID := ew.Endpoints.ChainID()
+	if chainID == nil {
+		infoResp, err := ew.Endpoints.GetInfo()
+		if err != nil {
+			return err
+		}
+		chainID = infoResp.ChainID
+	}
+	ew.P2PBlocks = NewP2PBlockSource(address, chainID)
+	return nil
+}
+
+// 获取扫描的不可逆块：配置了P2P 时先从p2p 连接获取，失败时回退到HTTP（见UpdateBlock）。
+// 回溯扫描、可逆块跟踪与主扫块的块高不连续，只使用HTTP，避免打乱p2p 的请求区间
+func (ew *EOSWatcherMain) scanBlock(ctx context.Context, scanBlockHeight uint32) (*eos.BlockResp, error) {
+	if ew.P2PBlocks != nil {
+		blockResp, err := ew.P2PBlocks.GetBlock(ctx, scanBlockHeight)
+		if err == nil {
+			return blockResp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.Debug("Get p2p block error! Fall back to http.", "ScanBlockHeight", scanBlockHeight, "info", err)
+	}
+	return ew.UpdateBlock(ctx, scanBlockHeight)
+}
@@ -0,0 +1,128 @@
+package eoswatcher
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/eoscanada/eos-go/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+// 已连接的P2PBlockSource，发出的请求直接丢弃，收到的块通过addBlock 模拟
+func newTestP2PBlockSource() *P2PBlockSource {
+	client, server := net.Pipe()
+	go io.Copy(ioutil.Discard, server)
+
+	source := NewP2PBlockSource("127.0.0.1:9876", nil)
+	source.Window = 10
+	source.Timeout = 50 * time.Millisecond
+	source.conn = client
+	source.peer = p2p.NewOutgoingPeer(source.Address, nil, p2pAgent, false)
+	source.peer.SetConnection(client)
+	return source
+}
+
+func TestP2PBlockSourceWindow(t *testing.T) {
+	source := newTestP2PBlockSource()
+	ctx := context.Background()
+
+	// 没有收到的块超时返回错误，由调用方回退到HTTP
+	_, err := source.GetBlock(ctx, 100)
+	assert.NotNil(t, err)
+	assert.Equal(t, uint32(100), source.requestStart)
+	assert.Equal(t, uint32(110), source.requestEnd)
+
+	// 区间外的块丢弃
+	source.addBlock(&eos.BlockResp{BlockNum: 105})
+	source.addBlock(&eos.BlockResp{BlockNum: 200})
+	assert.Len(t, source.blocks, 1)
+
+	blockResp, err := source.GetBlock(ctx, 105)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(105), blockResp.BlockNum)
+	_, err = source.GetBlock(ctx, 105)
+	assert.NotNil(t, err)
+
+	// 等待中收到块
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		source.addBlock(&eos.BlockResp{BlockNum: 102})
+	}()
+	blockResp, err = source.GetBlock(ctx, 102)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(102), blockResp.BlockNum)
+
+	// 紧接着的区间保留上一个区间里还在等的块
+	_, err = source.GetBlock(ctx, 110)
+	assert.NotNil(t, err)
+	assert.Equal(t, uint32(100), source.requestStart)
+	assert.Equal(t, uint32(120), source.requestEnd)
+	source.addBlock(&eos.BlockResp{BlockNum: 101})
+	assert.Len(t, source.blocks, 1)
+
+	// 不连续时重新开始
+	_, err = source.GetBlock(ctx, 500)
+	assert.NotNil(t, err)
+	assert.Equal(t, uint32(500), source.requestStart)
+	assert.Len(t, source.blocks, 0)
+
+	source.Close()
+	start := time.Now()
+	_, err = source.GetBlock(ctx, 500)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < source.Timeout)
+}
+
+func TestP2PBlockSourceConcurrentWindow(t *testing.T) {
+	source := newTestP2PBlockSource()
+	source.Timeout = 500 * time.Millisecond
+	defer source.Close()
+	ctx := context.Background()
+
+	// 并发扫块：前面的块还在等时，后面的协程请求了区间之后的块，区间延长，前面的块不丢
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	received := make(map[uint32]bool)
+	getBlock := func(blockNum uint32) {
+		defer wg.Done()
+		blockResp, err := source.GetBlock(ctx, blockNum)
+		if assert.Nil(t, err, "block %d", blockNum) {
+			lock.Lock()
+			received[blockResp.BlockNum] = true
+			lock.Unlock()
+		}
+	}
+	for blockNum := uint32(100); blockNum < 108; blockNum++ {
+		wg.Add(1)
+		go getBlock(blockNum)
+	}
+	time.Sleep(20 * time.Millisecond)
+	wg.Add(1)
+	go getBlock(112)
+	time.Sleep(20 * time.Millisecond)
+
+	source.lock.Lock()
+	assert.Equal(t, uint32(100), source.requestStart)
+	assert.Equal(t, uint32(122), source.requestEnd)
+	source.lock.Unlock()
+	for blockNum := uint32(100); blockNum < 113; blockNum++ {
+		source.addBlock(&eos.BlockResp{BlockNum: blockNum})
+	}
+	wg.Wait()
+	assert.Len(t, received, 9)
+
+	// 已收到的块之后重新请求
+	source.lock.Lock()
+	assert.Equal(t, uint32(112), source.lastReceived)
+	source.lock.Unlock()
+	_, err := source.GetBlock(ctx, 125)
+	assert.NotNil(t, err)
+	assert.Equal(t, uint32(112), source.requestStart)
+	assert.Equal(t, uint32(135), source.requestEnd)
+}
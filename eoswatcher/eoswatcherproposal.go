@@ -0,0 +1,74 @@
+package eoswatcher
+
+import (
+	"encoding/json"
+	log "github.com/inconshreveable/log15"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// leveldb 中提案关联的key 前缀，完整key 为 前缀 + txid
+const proposalKeyPrefix = "Proposal/"
+
+// 网关发起的交易与请求（提案）的关联
+type ProposalBinding struct {
+	Proposal			string				`json:"proposal"`
+	// 交易中网关转出、铸币事件的类型，为0 时不改变
+	EventType			uint32				`json:"event_type"`
+}
+
+// 网关发起提现、退款交易后调用，把交易关联到对应的请求。 之后该交易产生的事件带有Proposal，
+// 网关转出、铸币事件的类型改为eventType（EventTypeRefund、EventTypeWithdrawalConfirmed）
+func (ew *EOSWatcherMain) BindProposal(txid, proposal string, eventType uint32) error {
+	data, err := json.Marshal(&ProposalBinding{
+		Proposal:		proposal,
+		EventType:		eventType,
+	})
+	if err != nil {
+		return err
+	}
+	return ew.DB.Put([]byte(proposalKeyPrefix + txid), data, nil)
+}
+
+// 读取交易关联的请求，没有关联时返回nil
+func (ew *EOSWatcherMain) GetProposalBinding(txid string) (*ProposalBinding, error) {
+	data, err := ew.DB.Get([]byte(proposalKeyPrefix + txid), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var binding ProposalBinding
+	if err := json.Unmarshal(data, &binding); err != nil {
+		return nil, err
+	}
+	return &binding, nil
+}
+
+// 给事件填充关联的请求。 用户发起的溶币事件不改变类型
+func (ew *EOSWatcherMain) applyProposalBindings(eosPushEvents []*EOSPushEvent) {
+	bindings := make(map[string]*ProposalBinding)
+	for _, eosPushEvent := range eosPushEvents {
+		txid := eosPushEvent.GetTxID()
+		binding, ok := bindings[txid]
+		if !ok {
+			var err error
+			binding, err = ew.GetProposalBinding(txid)
+			if err != nil {
+				log.Error("read eos leveldb proposal binding err", "TxID", txid, "info", err)
+			}
+			bindings[txid] = binding
+		}
+		if binding == nil {
+			continue
+		}
+		eosPushEvent.Proposal = binding.Proposal
+		switch eosPushEvent.EventType {
+		case EventTypeDeposit, EventTypeSolvent, EventTypeInvalidMemo:
+			continue
+		}
+		if binding.EventType != EventTypeUnknown {
+			eosPushEvent.EventType = binding.EventType
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package eoswatcher
+
+import (
+	"testing"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyProposalBindings(t *testing.T) {
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+	ew := &EOSWatcherMain{DB: db}
+
+	assert.Nil(t, ew.BindProposal("abcd", "refund-42", EventTypeRefund))
+
+	refund := &EOSPushEvent{TxID: eos.SHA256Bytes{0xab, 0xcd}, EventType: EventTypeWithdrawalConfirmed}
+	deposit := &EOSPushEvent{TxID: eos.SHA256Bytes{0xab, 0xcd}, ActionIndex: 1, EventType: EventTypeDeposit}
+	other := &EOSPushEvent{TxID: eos.SHA256Bytes{0xef}, EventType: EventTypeWithdrawalConfirmed}
+	ew.applyProposalBindings([]*EOSPushEvent{refund, deposit, other})
+
+	assert.Equal(t, "refund-42", refund.GetProposal())
+	assert.Equal(t, EventTypeRefund, refund.GetEventType())
+	// 用户发起的溶币不改变类型
+	assert.Equal(t, "refund-42", deposit.GetProposal())
+	assert.Equal(t, EventTypeDeposit, deposit.GetEventType())
+	assert.Equal(t, "", other.GetProposal())
+	assert.Equal(t, EventTypeWithdrawalConfirmed, other.GetEventType())
+}
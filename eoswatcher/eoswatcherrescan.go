@@ -0,0 +1,190 @@
+package eoswatcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"time"
+)
+
+// leveldb 中重新扫描任务的key 前缀，完整key 为 前缀 + 任务ID
+const rescanKeyPrefix = "Rescan/"
+
+// 重新扫描任务：按选择的合约重新扫描[From, To) 的块，只发出没有交付过的事件。
+// 进度单独保存，不影响主扫块进度（ScanBlockHeight）
+type RescanTask struct {
+	ID					string				`json:"id"`
+	// 选择的合约，"合约名" 或 "合约名/货币名称"
+	Contracts			[]string			`json:"contracts"`
+	// 创建任务时按Contracts 过滤后的监控账户
+	Accounts			[]*WatchedAccount	`json:"accounts"`
+	From				uint32				`json:"from"`
+	To					uint32				`json:"to"`
+	// 下一个要扫描的块高
+	Next				uint32				`json:"next"`
+	// 新发出的事件数，已交付过的事件不计
+	Emitted				int					`json:"emitted"`
+	Done				bool				`json:"done"`
+}
+
+func rescanKey(id string) []byte {
+	return []byte(rescanKeyPrefix + id)
+}
+
+// 重新扫描[from, to) 的块（to 不能超过当前不可逆块 + 1），只匹配contracts 选择的合约（当前监控配置中的），
+// 事件发给StartWatch 的eventChan（与主扫块的事件交错，已交付的事件不再发出）。
+// 扫块未开始时任务只保存到leveldb，StartWatch 时启动；重启后从中断的地方继续
+func (ew *EOSWatcherMain) Rescan(from, to uint32, contracts []string) (*RescanTask, error) {
+	if from == 0 || from >= to {
+		return nil, errors.New("Rescan range is empty.")
+	}
+	infoResp, err := ew.chainInfo()
+	if err != nil {
+		return nil, err
+	}
+	if to > infoResp.LastIrreversibleBlockNum + 1 {
+		return nil, errors.New(fmt.Sprintf("Rescan range must end at or below last irreversible block %d.", infoResp.LastIrreversibleBlockNum))
+	}
+	accounts, err := selectRescanAccounts(ew.watchedAccounts(), contracts)
+	if err != nil {
+		return nil, err
+	}
+
+	task := &RescanTask{
+		ID:					fmt.Sprintf("%020d", time.Now().UnixNano()),
+		Contracts:			contracts,
+		Accounts:			accounts,
+		From:				from,
+		To:					to,
+		Next:				from,
+	}
+	if err := ew.putRescanTask(task); err != nil {
+		return nil, err
+	}
+	log.Info("EOS rescan scheduled", "ID", task.ID, "Contracts", contracts, "From", from, "To", to)
+	// 扫描协程会修改task，返回副本
+	created := *task
+	ew.launchScanTask(func(ctx context.Context, eventChan chan<- *EOSPushEvent) {
+		ew.runRescan(ctx, task, eventChan)
+	})
+	return &created, nil
+}
+
+// 按选择的合约过滤监控账户，每个选择都要匹配到合约
+func selectRescanAccounts(accounts []*WatchedAccount, contracts []string) ([]*WatchedAccount, error) {
+	if len(contracts) == 0 {
+		return nil, errors.New("Rescan needs at least one token contract.")
+	}
+	matched := make(map[string]bool)
+	var selected []*WatchedAccount
+	for _, account := range accounts {
+		var tokenContracts []*TokenContract
+		for _, tokenContract := range account.TokenContracts {
+			for _, contract := range contracts {
+				if contract == string(tokenContract.ActionAccount) || contract == tokenContract.key() {
+					matched[contract] = true
+					tokenContracts = append(tokenContracts, tokenContract)
+					break
+				}
+			}
+		}
+		if len(tokenContracts) > 0 {
+			selected = append(selected, &WatchedAccount{Account: account.Account, TokenContracts: tokenContracts})
+		}
+	}
+	for _, contract := range contracts {
+		if !matched[contract] {
+			return nil, errors.New("Token contract '" + contract + "' is not watched.")
+		}
+	}
+	return selected, nil
+}
+
+// 所有重新扫描任务，按创建时间排序
+func (ew *EOSWatcherMain) GetRescanTasks() ([]*RescanTask, error) {
+	iter := ew.DB.NewIterator(util.BytesPrefix([]byte(rescanKeyPrefix)), nil)
+	defer iter.Release()
+
+	var tasks []*RescanTask
+	for iter.Next() {
+		var task RescanTask
+		if err := json.Unmarshal(iter.Value(), &task); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, &task)
+	}
+	return tasks, iter.Error()
+}
+
+func (ew *EOSWatcherMain) GetRescanTask(id string) (*RescanTask, error) {
+	data, err := ew.DB.Get(rescanKey(id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var task RescanTask
+	if err := json.Unmarshal(data, &task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+func (ew *EOSWatcherMain) putRescanTask(task *RescanTask) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	return ew.DB.Put(rescanKey(task.ID), data, nil)
+}
+
+// StartWatch 时调用，继续未完成的重新扫描
+func (ew *EOSWatcherMain) startRescans() {
+	tasks, err := ew.GetRescanTasks()
+	if err != nil {
+		log.Error("read eos leveldb rescan tasks err", "info", err)
+		return
+	}
+	for _, task := range tasks {
+		if task.Done {
+			continue
+		}
+		task := task
+		ew.launchScanTask(func(ctx context.Context, eventChan chan<- *EOSPushEvent) {
+			ew.runRescan(ctx, task, eventChan)
+		})
+	}
+}
+
+// 按块高顺序扫描，每个块的事件交付后保存进度
+func (ew *EOSWatcherMain) runRescan(ctx context.Context, task *RescanTask, eventChan chan<- *EOSPushEvent) {
+	for task.Next < task.To {
+		blockResp, err := ew.UpdateBlock(ctx, task.Next)
+		if err != nil {
+			return
+		}
+		eosPushEvents, err := ew.extractEOSPushEvents(ctx, blockResp, 0, task.Accounts, true)
+		if err != nil {
+			return
+		}
+		for _, eosPushEvent := range eosPushEvents {
+			if ew.deliverEvent(eosPushEvent, eventChan) {
+				task.Emitted++
+			}
+		}
+		task.Next++
+		if err := ew.putRescanTask(task); err != nil {
+			log.Error("write eos leveldb rescan task err", "ID", task.ID, "info", err)
+		}
+	}
+	task.Done = true
+	if err := ew.putRescanTask(task); err != nil {
+		log.Error("write eos leveldb rescan task err", "ID", task.ID, "info", err)
+	}
+	log.Info("EOS rescan done", "ID", task.ID, "From", task.From, "To", task.To, "Emitted", task.Emitted)
+}
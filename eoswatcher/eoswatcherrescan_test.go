@@ -0,0 +1,101 @@
+package eoswatcher
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"eosc/tools/blocksource"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectRescanAccounts(t *testing.T) {
+	accounts := []*WatchedAccount{
+		{Account: eos.AN("gatewayhot11"), TokenContracts: []*TokenContract{
+			{ActionAccount: eos.AN("eosio.token"), Symbol: "EOS"},
+			{ActionAccount: eos.AN("issuer111111"), Symbol: "WBTC"},
+		}},
+		{Account: eos.AN("gatewaycold1"), TokenContracts: []*TokenContract{
+			{ActionAccount: eos.AN("issuer111111"), Symbol: "WETH"},
+		}},
+	}
+
+	selected, err := selectRescanAccounts(accounts, []string{"issuer111111"})
+	assert.Nil(t, err)
+	assert.Len(t, selected, 2)
+	assert.Equal(t, "WBTC", selected[0].TokenContracts[0].Symbol)
+	assert.Len(t, selected[0].TokenContracts, 1)
+
+	selected, err = selectRescanAccounts(accounts, []string{"issuer111111/WETH"})
+	assert.Nil(t, err)
+	assert.Len(t, selected, 1)
+	assert.Equal(t, eos.AN("gatewaycold1"), selected[0].Account)
+
+	_, err = selectRescanAccounts(accounts, []string{"eosio.token", "issuer111111/EOS"})
+	assert.NotNil(t, err)
+	_, err = selectRescanAccounts(accounts, nil)
+	assert.NotNil(t, err)
+}
+
+func TestRescan(t *testing.T) {
+	dirName, err := ioutil.TempDir("", "eoswatcherrescan")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dirName)
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+
+	blocksDir := filepath.Join(dirName, "blocks")
+	assert.Nil(t, os.Mkdir(blocksDir, 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(blocksDir, "get_info.json"), []byte(`{"head_block_num": 110, "last_irreversible_block_num": 105}`), 0644))
+	for blockNum := 100; blockNum <= 105; blockNum++ {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(blocksDir, fmt.Sprintf("get_block_%d.json", blockNum)), []byte(fmt.Sprintf(`{"block_num": %d}`, blockNum)), 0644))
+	}
+
+	ew := &EOSWatcherMain{
+		Gateway:			eos.AN("gateway11111"),
+		TokenContracts:		[]*TokenContract{{ActionAccount: eos.AN("eosio.token"), Symbol: "EOS", Precision: 4}},
+		DB:					db,
+		Blocks:				blocksource.NewFileSource(blocksDir),
+		ScanBlockHeight:	200,
+	}
+
+	_, err = ew.Rescan(100, 107, []string{"eosio.token"})
+	assert.NotNil(t, err)
+	_, err = ew.Rescan(100, 100, []string{"eosio.token"})
+	assert.NotNil(t, err)
+
+	// 扫块未开始，任务只保存
+	task, err := ew.Rescan(100, 106, []string{"eosio.token/EOS"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(100), task.Next)
+	assert.Equal(t, eos.AN("gateway11111"), task.Accounts[0].Account)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ew.startBackfills(ctx, make(chan *EOSPushEvent, 10))
+	for i := 0; i < 100; i++ {
+		if saved, _ := ew.GetRescanTask(task.ID); saved != nil && saved.Done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	ew.stopBackfills()
+
+	saved, err := ew.GetRescanTask(task.ID)
+	assert.Nil(t, err)
+	assert.True(t, saved.Done)
+	assert.Equal(t, uint32(106), saved.Next)
+	// 不影响主扫块进度
+	assert.Equal(t, uint32(200), ew.ScanBlockHeight)
+
+	tasks, err := ew.GetRescanTasks()
+	assert.Nil(t, err)
+	assert.Len(t, tasks, 1)
+}
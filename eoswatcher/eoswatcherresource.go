@@ -0,0 +1,377 @@
+package eoswatcher
+
+import (
+	"context"
+	"fmt"
+	"github.com/eoscanada/eos-go"
+	"github.com/eoscanada/eos-go/system"
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/syndtr/goleveldb/leveldb"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// leveldb 中每天充值花费的key 前缀，完整key 为 前缀 + funder/日期（UTC），值为EOS 最小单位的十进制字符串
+	resourceSpentKeyPrefix = "ResourceTopUp/"
+	// leveldb 中最近一笔充值交易的key 前缀，完整key 为 前缀 + 账户，值为txid
+	resourceTopUpTxKeyPrefix = "ResourceTopUpTx/"
+	resourceDefaultInterval = time.Minute
+	// buyrambytes 的手续费为0.5%
+	ramFeeRate = 0.005
+)
+
+// 资源监控配置
+type ResourceMonitorConfig struct {
+	// 轮询间隔，为0 时1 分钟
+	Interval			time.Duration		`mapstructure:"interval"`
+	// 剩余比例（0-1）低于阈值时告警，为0 时不检查该资源
+	CPUThreshold		float64				`mapstructure:"cpu_threshold"`
+	NETThreshold		float64				`mapstructure:"net_threshold"`
+	RAMThreshold		float64				`mapstructure:"ram_threshold"`
+	// 不为nil 时，资源不足时自动充值
+	TopUp				*ResourceTopUp		`mapstructure:"top_up"`
+}
+
+// 自动充值：由付款账户为监控账户抵押CPU、NET（delegatebw，不转移所有权），购买RAM（buyrambytes）
+type ResourceTopUp struct {
+	// 付款账户，交易通过签名方法（默认PKMSign）签名，需要付款账户的active 权限
+	Funder				string				`mapstructure:"funder"`
+	// CPU、NET 不足时抵押的数量，如 "1.0000 EOS"
+	StakeCPU			string				`mapstructure:"stake_cpu"`
+	StakeNET			string				`mapstructure:"stake_net"`
+	// RAM 不足时购买的字节数
+	BuyRAMBytes			uint32				`mapstructure:"buy_ram_bytes"`
+	// 每天（UTC）最多花费，如 "10.0000 EOS"。 发出交易前计入，交易失败不退回
+	DailyCap			string				`mapstructure:"daily_cap"`
+}
+
+// 从viper 配置中读取资源监控配置，例如：
+//	[EOS.resource_monitor]
+//	interval = "1m"
+//	cpu_threshold = 0.2
+//	ram_threshold = 0.1
+//	[EOS.resource_monitor.top_up]
+//	funder = "gatewayfund1"
+//	stake_cpu = "1.0000 EOS"
+//	daily_cap = "10.0000 EOS"
+func LoadResourceMonitorConfig(key string) (*ResourceMonitorConfig, error) {
+	var config ResourceMonitorConfig
+	if err := viper.UnmarshalKey(key, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// 资源不足的告警
+type ResourceWarning struct {
+	Account				string				`json:"account"`
+	// cpu、net、ram
+	Resource			string				`json:"resource"`
+	Used				int64				`json:"used"`
+	Max					int64				`json:"max"`
+	// 剩余比例
+	Remaining			float64				`json:"remaining"`
+	// 充值交易，没有充值时为空
+	TopUpTxID			string				`json:"top_up_txid,omitempty"`
+	// 没有充值的原因（超过每天上限等）或充值失败的原因
+	TopUpError			string				`json:"top_up_error,omitempty"`
+	Time				time.Time			`json:"time"`
+}
+
+// 网关账户资源监控
+type ResourceMonitor struct {
+	Account				eos.AccountName
+	Config				*ResourceMonitorConfig
+	// 不为nil 时，告警发到这里。 在监控协程中同步发送，需要及时读取，ctx 结束时不再等待
+	Warnings			chan<- *ResourceWarning
+	// 充值交易的签名方法，为nil 时使用PKMSign
+	Signer				TxSigner
+
+	ew					*EOSWatcherMain
+	stakeCPU			eos.Asset
+	stakeNET			eos.Asset
+	dailyCap			eos.Asset
+	running				sync.WaitGroup
+
+	// 读取账户、RAM 价格、发交易，测试时替换
+	getAccount			func() (*eos.AccountResp, error)
+	ramCost				func(bytes uint32) (int64, error)
+	push				func(ctx context.Context, actions []*eos.Action) (*BroadcastResult, error)
+	getOutgoingTx		func(txid string) (*OutgoingTx, error)
+}
+
+// 监控account 的资源，Start 后按Config.Interval 轮询
+func (ew *EOSWatcherMain) NewResourceMonitor(account string, config *ResourceMonitorConfig) (*ResourceMonitor, error) {
+	rm := &ResourceMonitor{
+		Account:			eos.AN(account),
+		Config:				config,
+		ew:					ew,
+	}
+	rm.getAccount = func() (*eos.AccountResp, error) {
+		return ew.Endpoints.GetAccount(rm.Account)
+	}
+	rm.ramCost = ew.ramCost
+	rm.push = func(ctx context.Context, actions []*eos.Action) (*BroadcastResult, error) {
+		return ew.BuildAndPushTx(ctx, actions, nil, rm.Signer, nil)
+	}
+	rm.getOutgoingTx = ew.GetOutgoingTx
+	if err := rm.parseTopUp(); err != nil {
+		return nil, err
+	}
+	return rm, nil
+}
+
+func (rm *ResourceMonitor) parseTopUp() error {
+	topUp := rm.Config.TopUp
+	if topUp == nil {
+		return nil
+	}
+	if topUp.Funder == "" {
+		return errors.New("Resource top-up needs a funder.")
+	}
+	var err error
+	if rm.dailyCap, err = eos.NewAsset(topUp.DailyCap); err != nil {
+		return errors.New("Resource top-up daily cap '" + topUp.DailyCap + "' is invalid.")
+	}
+	rm.stakeCPU = eos.Asset{Symbol: rm.dailyCap.Symbol}
+	rm.stakeNET = eos.Asset{Symbol: rm.dailyCap.Symbol}
+	for _, stake := range []struct {
+		value				string
+		asset				*eos.Asset
+	}{{topUp.StakeCPU, &rm.stakeCPU}, {topUp.StakeNET, &rm.stakeNET}} {
+		if stake.value == "" {
+			continue
+		}
+		asset, err := eos.NewAsset(stake.value)
+		if err != nil || asset.Symbol != rm.dailyCap.Symbol {
+			return errors.New("Resource top-up stake '" + stake.value + "' is invalid.")
+		}
+		*stake.asset = asset
+	}
+	return nil
+}
+
+// 按当前RAM 市场估算购买bytes 字节的花费（EOS 最小单位，含手续费）
+func (ew *EOSWatcherMain) ramCost(bytes uint32) (int64, error) {
+	ramBytes, quote, err := ew.Endpoints.GetRAMMarket()
+	if err != nil {
+		return 0, err
+	}
+	return estimateRAMCost(ramBytes, quote, bytes)
+}
+
+// Bancor 兑换：买走bytes 字节RAM 需要的EOS，加上手续费，向上取整
+func estimateRAMCost(ramBytes, quote int64, bytes uint32) (int64, error) {
+	if int64(bytes) >= ramBytes {
+		return 0, errors.New("Not enough RAM in market.")
+	}
+	cost := float64(quote) * float64(bytes) / float64(ramBytes - int64(bytes))
+	cost = cost / (1 - ramFeeRate)
+	return int64(cost) + 1, nil
+}
+
+func (rm *ResourceMonitor) Start(ctx context.Context) {
+	interval := rm.Config.Interval
+	if interval <= 0 {
+		interval = resourceDefaultInterval
+	}
+	rm.running.Add(1)
+	go func() {
+		defer rm.running.Done()
+		for {
+			if _, err := rm.Check(ctx); err != nil {
+				log.Error("check eos account resources err", "Account", rm.Account, "info", err)
+			}
+			if !sleepContext(ctx, interval) {
+				return
+			}
+		}
+	}()
+}
+
+// 等待监控协程退出（ctx 已结束）
+func (rm *ResourceMonitor) Stop() {
+	rm.running.Wait()
+}
+
+// 检查一次资源，返回低于阈值的告警，配置了充值时发出充值交易
+func (rm *ResourceMonitor) Check(ctx context.Context) ([]*ResourceWarning, error) {
+	accountResp, err := rm.getAccount()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var warnings []*ResourceWarning
+	check := func(resource string, threshold float64, used, available, max int64) {
+		// 为负数时不限制（特权账户）
+		if threshold <= 0 || max < 0 {
+			return
+		}
+		remaining := 0.0
+		if max > 0 && available > 0 {
+			remaining = float64(available) / float64(max)
+		}
+		if remaining < threshold {
+			warnings = append(warnings, &ResourceWarning{
+				Account:		string(rm.Account),
+				Resource:		resource,
+				Used:			used,
+				Max:			max,
+				Remaining:		remaining,
+				Time:			now,
+			})
+		}
+	}
+	// CPU、NET 的可用量随全网负载变化，按Available 计算
+	cpu, net := accountResp.CPULimit, accountResp.NetLimit
+	check("cpu", rm.Config.CPUThreshold, int64(cpu.Used), int64(cpu.Available), int64(cpu.Max))
+	check("net", rm.Config.NETThreshold, int64(net.Used), int64(net.Available), int64(net.Max))
+	ramUsage, ramQuota := int64(accountResp.RAMUsage), int64(accountResp.RAMQuota)
+	check("ram", rm.Config.RAMThreshold, ramUsage, ramQuota - ramUsage, ramQuota)
+	if len(warnings) == 0 {
+		return nil, nil
+	}
+
+	if rm.Config.TopUp != nil {
+		txid, err := rm.topUp(ctx, warnings)
+		for _, warning := range warnings {
+			warning.TopUpTxID = txid
+			if err != nil {
+				warning.TopUpError = err.Error()
+			}
+		}
+	}
+	for _, warning := range warnings {
+		log.Warn("EOS account resource low", "Account", warning.Account, "Resource", warning.Resource, "Used", warning.Used, "Max", warning.Max,
+			"TopUpTxID", warning.TopUpTxID, "TopUpError", warning.TopUpError)
+		if rm.Warnings != nil {
+			select {
+			case rm.Warnings <- warning:
+			case <-ctx.Done():
+				return warnings, ctx.Err()
+			}
+		}
+	}
+	return warnings, nil
+}
+
+// 按告警的资源充值，一笔交易中包含delegatebw、buyrambytes。 超过每天上限、上一笔充值还没结束时不充值
+func (rm *ResourceMonitor) topUp(ctx context.Context, warnings []*ResourceWarning) (string, error) {
+	topUp := rm.Config.TopUp
+	// 上一笔充值不可逆或过期前，可能还会上链，再次充值会重复花费
+	if err := rm.checkPendingTopUp(); err != nil {
+		return "", err
+	}
+	funder := eos.AN(topUp.Funder)
+	stakeCPU := eos.Asset{Symbol: rm.dailyCap.Symbol}
+	stakeNET := eos.Asset{Symbol: rm.dailyCap.Symbol}
+	var ramBytes uint32
+	for _, warning := range warnings {
+		switch warning.Resource {
+		case "cpu":
+			stakeCPU = rm.stakeCPU
+		case "net":
+			stakeNET = rm.stakeNET
+		case "ram":
+			ramBytes = topUp.BuyRAMBytes
+		}
+	}
+
+	var actions []*eos.Action
+	cost := int64(stakeCPU.Amount + stakeNET.Amount)
+	if cost > 0 {
+		actions = append(actions, system.NewDelegateBW(funder, rm.Account, stakeCPU, stakeNET, false))
+	}
+	if ramBytes > 0 {
+		ramCost, err := rm.ramCost(ramBytes)
+		if err != nil {
+			return "", err
+		}
+		cost += ramCost
+		actions = append(actions, system.NewBuyRAMBytes(funder, rm.Account, ramBytes))
+	}
+	if len(actions) == 0 {
+		return "", errors.New("No top-up configured for the low resources.")
+	}
+
+	if err := rm.reserveSpending(cost, time.Now()); err != nil {
+		return "", err
+	}
+	result, err := rm.push(ctx, actions)
+	// 广播失败时交易仍可能上链，同样等它确认或过期
+	if result != nil && result.TxID != "" {
+		if err := rm.ew.DB.Put(rm.topUpTxKey(), []byte(result.TxID), nil); err != nil {
+			log.Warn("save eos top-up txid err", "Account", rm.Account, "TxID", result.TxID, "info", err)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	log.Info("EOS account resources topped up", "Account", rm.Account, "Funder", funder, "TxID", result.TxID,
+		"Cost", formatAsset(cost, rm.dailyCap.Symbol.Precision, rm.dailyCap.Symbol.Symbol))
+	return result.TxID, nil
+}
+
+func (rm *ResourceMonitor) topUpTxKey() []byte {
+	return []byte(resourceTopUpTxKeyPrefix + string(rm.Account))
+}
+
+// 上一笔充值交易还没有结束（等待上链，或广播失败但还没过期）时返回错误。 没有跟踪记录（数据已清理）时不阻止充值
+func (rm *ResourceMonitor) checkPendingTopUp() error {
+	data, err := rm.ew.DB.Get(rm.topUpTxKey(), nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	txid := string(data)
+	outgoingTx, err := rm.getOutgoingTx(txid)
+	if err != nil {
+		return err
+	}
+	// 广播失败（Failed）的交易过期前仍可能上链
+	if outgoingTx != nil && !outgoingTx.Final() {
+		return errors.New(fmt.Sprintf("Previous top-up tx %s not confirmed yet.", txid))
+	}
+	return nil
+}
+
+// 每天上限按funder 计算，多个账户使用同一个funder 时共用
+func (rm *ResourceMonitor) spentKey(now time.Time) []byte {
+	return []byte(resourceSpentKeyPrefix + rm.Config.TopUp.Funder + "/" + now.UTC().Format("2006-01-02"))
+}
+
+// funder 当天已花费的金额（最小单位）
+func (rm *ResourceMonitor) Spent(now time.Time) (int64, error) {
+	if rm.Config.TopUp == nil {
+		return 0, nil
+	}
+	data, err := rm.ew.DB.Get(rm.spentKey(now), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(data), 10, 64)
+}
+
+// 计入当天的花费，超过上限时返回错误
+func (rm *ResourceMonitor) reserveSpending(cost int64, now time.Time) error {
+	spent, err := rm.Spent(now)
+	if err != nil {
+		return err
+	}
+	if spent + cost > int64(rm.dailyCap.Amount) {
+		return errors.New(fmt.Sprintf("Top-up daily cap reached, spent %s, cost %s.",
+			formatAsset(spent, rm.dailyCap.Symbol.Precision, rm.dailyCap.Symbol.Symbol),
+			formatAsset(cost, rm.dailyCap.Symbol.Precision, rm.dailyCap.Symbol.Symbol)))
+	}
+	return rm.ew.DB.Put(rm.spentKey(now), []byte(strconv.FormatInt(spent + cost, 10)), nil)
+}
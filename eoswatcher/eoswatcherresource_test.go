@@ -0,0 +1,182 @@
+package eoswatcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimateRAMCost(t *testing.T) {
+	// 1,000,000 字节，100.0000 EOS：买1000 字节约0.1001 EOS，加0.5% 手续费后向上取整
+	cost, err := estimateRAMCost(1000000, 1000000, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1007), cost)
+
+	_, err = estimateRAMCost(1000, 1000000, 1000)
+	assert.NotNil(t, err)
+}
+
+func TestResourceMonitor(t *testing.T) {
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+	ew := &EOSWatcherMain{DB: db}
+
+	_, err := ew.NewResourceMonitor("gateway11111", &ResourceMonitorConfig{TopUp: &ResourceTopUp{
+		Funder: "gatewayfund1", StakeCPU: "1.0000 SYS", DailyCap: "10.0000 EOS"}})
+	assert.NotNil(t, err)
+
+	rm, err := ew.NewResourceMonitor("gateway11111", &ResourceMonitorConfig{
+		CPUThreshold:		0.2,
+		NETThreshold:		0.2,
+		RAMThreshold:		0.1,
+		TopUp:				&ResourceTopUp{
+			Funder:				"gatewayfund1",
+			StakeCPU:			"4.0000 EOS",
+			StakeNET:			"1.0000 EOS",
+			BuyRAMBytes:		1024,
+			DailyCap:			"10.0000 EOS",
+		},
+	})
+	assert.Nil(t, err)
+
+	account := &eos.AccountResp{
+		CPULimit:			eos.AccountResourceLimit{Used: 90, Available: 10, Max: 100},
+		NetLimit:			eos.AccountResourceLimit{Used: 10, Available: 90, Max: 100},
+		RAMQuota:			1000,
+		RAMUsage:			500,
+	}
+	rm.getAccount = func() (*eos.AccountResp, error) { return account, nil }
+	rm.ramCost = func(bytes uint32) (int64, error) { return 5000, nil }
+	var pushed [][]*eos.Action
+	rm.push = func(ctx context.Context, actions []*eos.Action) (*BroadcastResult, error) {
+		pushed = append(pushed, actions)
+		return &BroadcastResult{TxID: "topup"}, nil
+	}
+
+	// 只有CPU 不足，只抵押CPU
+	warnings, err := rm.Check(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, warnings, 1)
+	assert.Equal(t, "cpu", warnings[0].Resource)
+	assert.Equal(t, "topup", warnings[0].TopUpTxID)
+	assert.Len(t, pushed, 1)
+	spent, err := rm.Spent(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(40000), spent)
+
+	// CPU、RAM 不足，抵押加购买RAM 在一笔交易中
+	account.RAMUsage = 950
+	warnings, err = rm.Check(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, warnings, 2)
+	assert.Len(t, pushed[1], 2)
+	spent, _ = rm.Spent(time.Now())
+	assert.Equal(t, int64(85000), spent)
+
+	// 超过每天上限，只告警
+	warnings, err = rm.Check(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, warnings, 2)
+	assert.Equal(t, "", warnings[0].TopUpTxID)
+	assert.NotEqual(t, "", warnings[0].TopUpError)
+	assert.Len(t, pushed, 2)
+
+	// 资源充足时不告警，读取账户失败时返回错误
+	account.CPULimit = eos.AccountResourceLimit{Used: 10, Available: 90, Max: 100}
+	account.RAMUsage = 100
+	warnings, err = rm.Check(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, warnings, 0)
+	rm.getAccount = func() (*eos.AccountResp, error) { return nil, errors.New("connection refused") }
+	_, err = rm.Check(context.Background())
+	assert.NotNil(t, err)
+}
+
+func TestResourceMonitorTopUpLimits(t *testing.T) {
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+	ew := &EOSWatcherMain{DB: db}
+
+	account := &eos.AccountResp{
+		CPULimit:			eos.AccountResourceLimit{Used: 90, Available: 10, Max: 100},
+		NetLimit:			eos.AccountResourceLimit{Used: 10, Available: 90, Max: 100},
+	}
+	status := OutgoingTxPending
+	var pushed int
+	newMonitor := func(name string) *ResourceMonitor {
+		rm, err := ew.NewResourceMonitor(name, &ResourceMonitorConfig{
+			CPUThreshold:		0.2,
+			TopUp:				&ResourceTopUp{Funder: "gatewayfund1", StakeCPU: "4.0000 EOS", DailyCap: "10.0000 EOS"},
+		})
+		assert.Nil(t, err)
+		rm.getAccount = func() (*eos.AccountResp, error) { return account, nil }
+		rm.push = func(ctx context.Context, actions []*eos.Action) (*BroadcastResult, error) {
+			pushed++
+			return &BroadcastResult{TxID: name}, nil
+		}
+		rm.getOutgoingTx = func(txid string) (*OutgoingTx, error) {
+			return &OutgoingTx{TxID: txid, Status: status}, nil
+		}
+		return rm
+	}
+	first, second := newMonitor("gateway11111"), newMonitor("gateway22222")
+
+	// 上一笔充值没结束时不再充值
+	warnings, err := first.Check(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "gateway11111", warnings[0].TopUpTxID)
+	warnings, _ = first.Check(context.Background())
+	assert.Equal(t, "", warnings[0].TopUpTxID)
+	assert.NotEqual(t, "", warnings[0].TopUpError)
+	// 广播失败的交易过期前仍可能上链
+	status = OutgoingTxFailed
+	warnings, _ = first.Check(context.Background())
+	assert.Equal(t, "", warnings[0].TopUpTxID)
+	assert.Equal(t, 1, pushed)
+
+	// 打包进可逆块后仍可能被撤回，不可逆后才继续充值；同一个funder 的上限由所有账户共用
+	status = OutgoingTxIncluded
+	warnings, _ = first.Check(context.Background())
+	assert.Equal(t, "", warnings[0].TopUpTxID)
+	status = OutgoingTxIrreversible
+	warnings, _ = first.Check(context.Background())
+	assert.Equal(t, "gateway11111", warnings[0].TopUpTxID)
+	warnings, _ = second.Check(context.Background())
+	assert.Equal(t, "", warnings[0].TopUpTxID)
+	assert.NotEqual(t, "", warnings[0].TopUpError)
+	assert.Equal(t, 2, pushed)
+	spent, _ := second.Spent(time.Now())
+	assert.Equal(t, int64(80000), spent)
+}
+
+func TestResourceMonitorStopWithoutReader(t *testing.T) {
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+	ew := &EOSWatcherMain{DB: db}
+	rm, err := ew.NewResourceMonitor("gateway11111", &ResourceMonitorConfig{CPUThreshold: 0.2})
+	assert.Nil(t, err)
+	rm.getAccount = func() (*eos.AccountResp, error) {
+		return &eos.AccountResp{CPULimit: eos.AccountResourceLimit{Used: 90, Available: 10, Max: 100}}, nil
+	}
+	// 没有读取方时，ctx 结束后监控协程退出
+	rm.Warnings = make(chan *ResourceWarning)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rm.Start(ctx)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		rm.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("resource monitor blocked on Warnings after ctx done")
+	}
+}
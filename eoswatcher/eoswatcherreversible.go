@@ -0,0 +1,274 @@
+package eoswatcher
+
+import (
+	"context"
+	"encoding/hex"
+	"github.com/eoscanada/eos-go"
+	log "github.com/inconshreveable/log15"
+	"time"
+)
+
+// 可逆块事件类型
+type ReversibleEventType int
+
+const (
+	// 可逆块中出现的临时事件，块可能被微分叉替换，不能作为入账依据
+	ReversibleEventProvisional ReversibleEventType = iota
+	// 临时事件所在的块被微分叉替换，新的分支中没有该事件
+	ReversibleEventRetracted
+	// 临时事件所在的块变为不可逆
+	ReversibleEventConfirmed
+)
+
+func (t ReversibleEventType) String() string {
+	switch t {
+	case ReversibleEventProvisional:
+		return "provisional"
+	case ReversibleEventRetracted:
+		return "retracted"
+	case ReversibleEventConfirmed:
+		return "confirmed"
+	}
+	return "unknown"
+}
+
+// 跟随最新块模式下发出的事件
+type ReversibleEvent struct {
+	Type				ReversibleEventType
+	// 事件所在块的块高、块ID。 撤回事件为被替换的块
+	BlockNum			uint32
+	BlockID				string
+	Event				*EOSPushEvent
+}
+
+// 跟踪中的可逆块
+type trackedBlock struct {
+	BlockNum			uint32
+	BlockID				string
+	Events				[]*EOSPushEvent
+}
+
+// 分叉跟踪：记录每个可逆块高的块ID 和事件，块被替换时计算被丢弃的事件，块不可逆时确认事件
+type forkTracker struct {
+	// 不可逆块高，该高度及以下的块不再跟踪
+	irreversible		uint32
+	// 跟踪的最高块高
+	top					uint32
+	blocks				map[uint32]*trackedBlock
+	// 已发出临时事件、还未撤回或确认的事件key
+	announced			map[string]bool
+}
+
+func newForkTracker(irreversible uint32) *forkTracker {
+	return &forkTracker{
+		irreversible:	irreversible,
+		top:			irreversible,
+		blocks:			make(map[uint32]*trackedBlock),
+		announced:		make(map[string]bool),
+	}
+}
+
+func (ft *forkTracker) Irreversible() uint32 {
+	return ft.irreversible
+}
+
+// 跟踪的最高块高，没有跟踪的块时为不可逆块高
+func (ft *forkTracker) Top() uint32 {
+	return ft.top
+}
+
+// 跟踪中的块ID，该高度没有跟踪的块时返回false
+func (ft *forkTracker) BlockID(blockNum uint32) (string, bool) {
+	block, ok := ft.blocks[blockNum]
+	if !ok {
+		return "", false
+	}
+	return block.BlockID, true
+}
+
+// 加入一个可逆块，返回要发出的事件。
+// 该高度已有同ID 的块时忽略；已有不同ID 的块时，该高度及以上的块都属于被丢弃的分支，
+// 其中不在新块中的事件发出撤回事件（之后在新分支中再次出现时，会重新发出临时事件）
+func (ft *forkTracker) AddBlock(blockNum uint32, blockID string, events []*EOSPushEvent) []*ReversibleEvent {
+	if blockNum <= ft.irreversible {
+		return nil
+	}
+	if block, ok := ft.blocks[blockNum]; ok && block.BlockID == blockID {
+		return nil
+	}
+
+	newKeys := make(map[string]bool)
+	for _, event := range events {
+		newKeys[event.GetEventKey()] = true
+	}
+
+	var reversibleEvents []*ReversibleEvent
+	for height := blockNum; height <= ft.top; height++ {
+		dropped, ok := ft.blocks[height]
+		if !ok {
+			continue
+		}
+		delete(ft.blocks, height)
+		for _, event := range dropped.Events {
+			key := event.GetEventKey()
+			if newKeys[key] || !ft.announced[key] {
+				continue
+			}
+			delete(ft.announced, key)
+			reversibleEvents = append(reversibleEvents, &ReversibleEvent{
+				Type:		ReversibleEventRetracted,
+				BlockNum:	dropped.BlockNum,
+				BlockID:	dropped.BlockID,
+				Event:		event,
+			})
+		}
+	}
+
+	ft.blocks[blockNum] = &trackedBlock{
+		BlockNum:	blockNum,
+		BlockID:	blockID,
+		Events:		events,
+	}
+	ft.top = blockNum
+
+	for _, event := range events {
+		key := event.GetEventKey()
+		if ft.announced[key] {
+			continue
+		}
+		ft.announced[key] = true
+		reversibleEvents = append(reversibleEvents, &ReversibleEvent{
+			Type:		ReversibleEventProvisional,
+			BlockNum:	blockNum,
+			BlockID:	blockID,
+			Event:		event,
+		})
+	}
+	return reversibleEvents
+}
+
+// 推进不可逆块高，返回变为不可逆的块中事件的确认事件。
+// 调用前需要保证跟踪的块与链上不可逆的块一致
+func (ft *forkTracker) Confirm(irreversible uint32) []*ReversibleEvent {
+	var reversibleEvents []*ReversibleEvent
+	for height := ft.irreversible + 1; height <= irreversible && height <= ft.top; height++ {
+		block, ok := ft.blocks[height]
+		if !ok {
+			continue
+		}
+		delete(ft.blocks, height)
+		for _, event := range block.Events {
+			delete(ft.announced, event.GetEventKey())
+			reversibleEvents = append(reversibleEvents, &ReversibleEvent{
+				Type:		ReversibleEventConfirmed,
+				BlockNum:	block.BlockNum,
+				BlockID:	block.BlockID,
+				Event:		event,
+			})
+		}
+	}
+	if irreversible > ft.irreversible {
+		ft.irreversible = irreversible
+	}
+	if ft.top < ft.irreversible {
+		ft.top = ft.irreversible
+	}
+	return reversibleEvents
+}
+
+// 跟随最新块：扫描不可逆块之后的可逆块，把临时事件、撤回事件、确认事件发给reversibleChan。
+// 只对跟随期间扫描过的块发出确认事件；启动时已不可逆、或跟随落后时直接变为不可逆的块，只通过eventChan 交付。
+// ctx 结束后关闭reversibleChan
+func (ew *EOSWatcherMain) followReversibleBlocks(ctx context.Context, reversibleChan chan<- *ReversibleEvent) {
+	defer close(reversibleChan)
+
+	// 与扫块协程并发，不修改HeadBlockNum、LastIrreversibleBlockNum
+	infoResp, err := ew.getInfo(ctx)
+	if err != nil {
+		return
+	}
+	tracker := newForkTracker(infoResp.LastIrreversibleBlockNum)
+	for {
+		infoResp, err := ew.getInfo(ctx)
+		if err != nil {
+			return
+		}
+		headBlockNum, lastIrreversibleBlockNum := infoResp.HeadBlockNum, infoResp.LastIrreversibleBlockNum
+
+		// 确认前，检查不可逆块高处的块与跟踪的是否一致；链接关系保证更低的块也一致
+		if confirmHeight := minUint32(lastIrreversibleBlockNum, tracker.Top()); confirmHeight > tracker.Irreversible() {
+			reversibleEvents, err := ew.trackReversibleBlock(ctx, tracker, confirmHeight)
+			if err != nil || !sendReversibleEvents(ctx, reversibleChan, reversibleEvents) {
+				return
+			}
+		}
+		if !sendReversibleEvents(ctx, reversibleChan, tracker.Confirm(lastIrreversibleBlockNum)) {
+			return
+		}
+
+		for tracker.Top() < headBlockNum {
+			reversibleEvents, err := ew.trackReversibleBlock(ctx, tracker, tracker.Top() + 1)
+			if err != nil || !sendReversibleEvents(ctx, reversibleChan, reversibleEvents) {
+				return
+			}
+		}
+
+		if !sleepContext(ctx, 500 * time.Millisecond) {
+			return
+		}
+	}
+}
+
+// 扫描blockNum 处的块加入分叉跟踪。 块的previous 与跟踪的前一个块不一致时（微分叉），回退扫描前一个块，
+// 直到与跟踪的块连上，再按块高顺序加入
+func (ew *EOSWatcherMain) trackReversibleBlock(ctx context.Context, tracker *forkTracker, blockNum uint32) ([]*ReversibleEvent, error) {
+	var blockResps []*eos.BlockResp
+	for height := blockNum; height > tracker.Irreversible(); height-- {
+		blockResp, err := ew.retryBlock(ctx, height, ew.reversibleBlock)
+		if err != nil {
+			return nil, err
+		}
+		if blockID, ok := tracker.BlockID(height); ok && blockID == hex.EncodeToString(blockResp.ID) {
+			break
+		}
+		blockResps = append(blockResps, blockResp)
+
+		previousID, ok := tracker.BlockID(height - 1)
+		if !ok || previousID == hex.EncodeToString(blockResp.SignedBlock.Previous) {
+			break
+		}
+		log.Info("EOS microfork detected, rescan previous block", "BlockNum", height - 1, "BlockID", previousID)
+	}
+
+	var reversibleEvents []*ReversibleEvent
+	for i := len(blockResps) - 1; i >= 0; i-- {
+		blockResp := blockResps[i]
+		// 可逆的块可能被分叉掉，不记录其中的setabi
+		eosPushEvents, err := ew.extractEOSPushEvents(ctx, blockResp, 0, ew.watchedAccounts(), false)
+		if err != nil {
+			return nil, err
+		}
+		ew.observeOutgoingTxs(blockResp, false)
+		reversibleEvents = append(reversibleEvents, tracker.AddBlock(blockResp.BlockNum, hex.EncodeToString(blockResp.ID), eosPushEvents)...)
+	}
+	return reversibleEvents, nil
+}
+
+// 发送事件，ctx 结束时返回false
+func sendReversibleEvents(ctx context.Context, reversibleChan chan<- *ReversibleEvent, reversibleEvents []*ReversibleEvent) bool {
+	for _, reversibleEvent := range reversibleEvents {
+		select {
+		case reversibleChan <- reversibleEvent:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+func minUint32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,64 @@
+package eoswatcher
+
+import (
+	"testing"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestEvent(txid string, actionIndex int) *EOSPushEvent {
+	return &EOSPushEvent{TxID: eos.SHA256Bytes(txid), ActionIndex: actionIndex}
+}
+
+func reversibleEventTypes(reversibleEvents []*ReversibleEvent) []ReversibleEventType {
+	var types []ReversibleEventType
+	for _, reversibleEvent := range reversibleEvents {
+		types = append(types, reversibleEvent.Type)
+	}
+	return types
+}
+
+func TestForkTrackerMicrofork(t *testing.T) {
+	tracker := newForkTracker(100)
+
+	a := newTestEvent("a", 0)
+	b := newTestEvent("b", 0)
+	c := newTestEvent("c", 0)
+
+	reversibleEvents := tracker.AddBlock(101, "101a", []*EOSPushEvent{a})
+	assert.Equal(t, []ReversibleEventType{ReversibleEventProvisional}, reversibleEventTypes(reversibleEvents))
+	reversibleEvents = tracker.AddBlock(102, "102a", []*EOSPushEvent{b, c})
+	assert.Len(t, reversibleEvents, 2)
+
+	// 同一个块重复加入，忽略
+	assert.Nil(t, tracker.AddBlock(102, "102a", []*EOSPushEvent{b, c}))
+
+	// 101 被替换：a 被打包进新块，不撤回；102 上的b、c 属于被丢弃的分支
+	reversibleEvents = tracker.AddBlock(101, "101b", []*EOSPushEvent{a, b})
+	assert.Len(t, reversibleEvents, 1)
+	assert.Equal(t, ReversibleEventRetracted, reversibleEvents[0].Type)
+	assert.Equal(t, c, reversibleEvents[0].Event)
+	assert.Equal(t, "102a", reversibleEvents[0].BlockID)
+	assert.Equal(t, uint32(101), tracker.Top())
+
+	_, ok := tracker.BlockID(102)
+	assert.False(t, ok)
+
+	// c 在新分支中再次出现，重新发出临时事件
+	reversibleEvents = tracker.AddBlock(102, "102b", []*EOSPushEvent{c})
+	assert.Equal(t, []ReversibleEventType{ReversibleEventProvisional}, reversibleEventTypes(reversibleEvents))
+
+	// 101 不可逆，确认a、b
+	reversibleEvents = tracker.Confirm(101)
+	assert.Equal(t, []ReversibleEventType{ReversibleEventConfirmed, ReversibleEventConfirmed}, reversibleEventTypes(reversibleEvents))
+	assert.Equal(t, "101b", reversibleEvents[0].BlockID)
+
+	// 不可逆的块不再接受替换
+	assert.Nil(t, tracker.AddBlock(101, "101c", nil))
+
+	reversibleEvents = tracker.Confirm(105)
+	assert.Equal(t, []ReversibleEventType{ReversibleEventConfirmed}, reversibleEventTypes(reversibleEvents))
+	assert.Equal(t, uint32(105), tracker.Irreversible())
+	assert.Equal(t, uint32(105), tracker.Top())
+}
@@ -0,0 +1,104 @@
+package eoswatcher
+
+import (
+	"encoding/hex"
+	"eosc/tools/utils"
+	"github.com/eoscanada/eos-go"
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"time"
+)
+
+// 从节点池请求链ID
+func endpointsChainID(endpoints *EndpointPool) func() (eos.SHA256Bytes, error) {
+	return func() (eos.SHA256Bytes, error) {
+		infoResp, err := endpoints.GetInfo()
+		if err != nil {
+			return nil, err
+		}
+		return infoResp.ChainID, nil
+	}
+}
+
+// 读取配置EOS.chain_id（hex，期望的链ID，为空时不固定）、EOS.offline（离线签名，需要EOS.chain_id），同tools/multisig
+func loadChainIDConfig() (eos.SHA256Bytes, bool, error) {
+	return parseChainIDConfig(viper.GetString("EOS.chain_id"), viper.GetBool("EOS.offline"))
+}
+
+func parseChainIDConfig(expected string, offline bool) (eos.SHA256Bytes, bool, error) {
+	if expected == "" {
+		if offline {
+			return nil, false, errors.New("EOS offline signing needs EOS.chain_id.")
+		}
+		return nil, false, nil
+	}
+	chainID, err := hex.DecodeString(expected)
+	if err != nil || len(chainID) != 32 {
+		return nil, false, errors.New("Invalid EOS.chain_id '" + expected + "'.")
+	}
+	return eos.SHA256Bytes(chainID), offline, nil
+}
+
+// 签名用的链ID：离线时直接使用chainID，否则向节点池请求，chainID 不为nil 时必须一致
+func newChainIDPin(endpoints *EndpointPool, chainID eos.SHA256Bytes, offline bool) (*utils.ChainIDPin, error) {
+	if offline {
+		return utils.NewOfflineChainIDPin(hex.EncodeToString(chainID))
+	}
+	return utils.NewChainIDPin(hex.EncodeToString(chainID), endpointsChainID(endpoints))
+}
+
+// 配置期望的链ID（hex），节点返回的链ID 不一致时之后的签名全部失败（*utils.ChainIDMismatchError）
+func (ew *EOSWatcherMain) PinChainID(expected string) error {
+	chainIDPin, err := utils.NewChainIDPin(expected, endpointsChainID(ew.Endpoints))
+	if err != nil {
+		return err
+	}
+	ew.ChainIDPin = chainIDPin
+	log.Info("EOS chain id pinned", "ChainID", expected)
+	return nil
+}
+
+// 离线签名：链ID 由调用方提供，签名、解析公钥不再请求节点。 交易用CreateOfflineTx 创建
+func (ew *EOSWatcherMain) EnableOfflineSigning(chainID string) error {
+	chainIDPin, err := utils.NewOfflineChainIDPin(chainID)
+	if err != nil {
+		return err
+	}
+	ew.ChainIDPin = chainIDPin
+	log.Info("EOS offline signing enabled", "ChainID", chainID)
+	return nil
+}
+
+// 交易的签名摘要，使用缓存的链ID
+func (ew *EOSWatcherMain) sigDigest(tx *eos.SignedTransaction) ([]byte, error) {
+	if ew.ChainIDPin == nil {
+		return nil, errors.New("Chain id is not configured.")
+	}
+	chainID, err := ew.ChainIDPin.ChainID()
+	if err != nil {
+		return nil, err
+	}
+	return utils.TxSigDigest(tx, chainID)
+}
+
+// 不访问节点创建交易：refBlockID 为调用方提供的参考块ID（hex，TaPoS），expiration 为过期时间，
+// 不能超过参考块之后1 小时（nodeos 的限制）
+func (ew *EOSWatcherMain) CreateOfflineTx(actions []*eos.Action, refBlockID string, expiration time.Time) (*eos.SignedTransaction, error) {
+	blockID, err := hex.DecodeString(refBlockID)
+	if err != nil || len(blockID) != 32 {
+		return nil, errors.New("Invalid reference block id '" + refBlockID + "'.")
+	}
+	if expiration.IsZero() {
+		return nil, errors.New("Offline transaction needs an expiration.")
+	}
+
+	//生成未签名交易
+	tx := eos.NewTransaction(actions, &eos.TxOptions{HeadBlockID: eos.SHA256Bytes(blockID)})
+	tx.Expiration = eos.JSONTime{Time: expiration.UTC()}
+
+	//生成签名交易
+	stx := eos.NewSignedTransaction(tx)
+	ew.trackOutgoingTx(stx)
+	return stx, nil
+}
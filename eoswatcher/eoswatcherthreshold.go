@@ -0,0 +1,181 @@
+package eoswatcher
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/eoscanada/eos-go"
+	"github.com/eoscanada/eos-go/ecc"
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+)
+
+// 门限多签协调：从链上读取 账户@权限 的公钥、权重和门限，按顺序向签名服务请求签名，
+// 用GetPublickeyFromTx 恢复并校验每个签名的公钥，累计权重达到门限后停止。
+// 只统计权限中的公钥，账户权限（accounts）、等待（waits）的权重不计入
+type ThresholdSigner struct {
+	Account				eos.AccountName
+	Permission			eos.PermissionName
+	// 签名服务中的公钥哈希，按顺序请求
+	PubKeyHashes		[]string
+
+	// 读取权限、签名、恢复公钥，默认使用链上权限、PKMSignWithHash、GetPublickeyFromTx
+	authority			func() (*eos.Authority, error)
+	sign				func(tx *eos.SignedTransaction, pubKeyHash string) (*ecc.Signature, error)
+	recover				func(tx *eos.SignedTransaction, sig *ecc.Signature) (ecc.PublicKey, error)
+}
+
+// 一个公钥哈希的签名结果
+type KeySignature struct {
+	PubKeyHash			string				`json:"pub_key_hash"`
+	// 从签名恢复的公钥，签名失败时为空
+	PublicKey			string				`json:"public_key,omitempty"`
+	// 公钥在权限中的权重，无效签名为0
+	Weight				uint16				`json:"weight"`
+	Signature			*ecc.Signature		`json:"-"`
+	// 无效的原因：签名失败、恢复公钥失败、公钥不在权限中、公钥重复
+	Error				string				`json:"error,omitempty"`
+}
+
+// 签名结果
+type ThresholdResult struct {
+	Threshold			uint32				`json:"threshold"`
+	// 有效签名的累计权重
+	Weight				uint32				`json:"weight"`
+	// 有效签名，按请求顺序
+	Signatures			[]*ecc.Signature	`json:"-"`
+	Signed				[]*KeySignature		`json:"signed"`
+	Invalid				[]*KeySignature		`json:"invalid"`
+	// 权限中没有有效签名的公钥
+	Missing				[]string			`json:"missing"`
+	// 达到门限后没有请求的公钥哈希
+	Skipped				[]string			`json:"skipped"`
+}
+
+func (result *ThresholdResult) Reached() bool {
+	return result.Threshold > 0 && result.Weight >= result.Threshold
+}
+
+// 所有公钥哈希都请求过，有效签名的权重仍未达到门限
+type ThresholdNotReachedError struct {
+	Result				*ThresholdResult
+}
+
+func (err *ThresholdNotReachedError) Error() string {
+	return fmt.Sprintf("Signature weight %d is below threshold %d, %d invalid, %d keys missing.",
+		err.Result.Weight, err.Result.Threshold, len(err.Result.Invalid), len(err.Result.Missing))
+}
+
+func (ew *EOSWatcherMain) NewThresholdSigner(account, permission string, pubKeyHashes []string) *ThresholdSigner {
+	ts := &ThresholdSigner{
+		Account:			eos.AN(account),
+		Permission:			eos.PN(permission),
+		PubKeyHashes:		pubKeyHashes,
+		sign:				ew.PKMSignWithHash,
+		recover:			ew.GetPublickeyFromTx,
+	}
+	ts.authority = func() (*eos.Authority, error) {
+		return ew.GetPermissionAuthority(ts.Account, ts.Permission)
+	}
+	return ts
+}
+
+// 链上 账户@权限 当前的权限要求
+func (ew *EOSWatcherMain) GetPermissionAuthority(account eos.AccountName, permission eos.PermissionName) (*eos.Authority, error) {
+	accountResp, err := ew.Endpoints.GetAccount(account)
+	if err != nil {
+		return nil, err
+	}
+	for _, perm := range accountResp.Permissions {
+		if perm.PermName == string(permission) {
+			return &perm.RequiredAuth, nil
+		}
+	}
+	return nil, errors.New("Permission '" + string(account) + "@" + string(permission) + "' not found.")
+}
+
+// 按顺序请求签名，达到门限后停止。 未达到门限时返回结果和 *ThresholdNotReachedError
+func (ts *ThresholdSigner) Sign(tx *eos.SignedTransaction) (*ThresholdResult, error) {
+	authority, err := ts.authority()
+	if err != nil {
+		return nil, err
+	}
+	if authority.Threshold == 0 {
+		return nil, errors.New("Permission '" + string(ts.Account) + "@" + string(ts.Permission) + "' has no threshold.")
+	}
+	if len(authority.Accounts) > 0 || len(authority.Waits) > 0 {
+		log.Warn("EOS permission has account or wait weights, only keys are counted", "Account", ts.Account, "Permission", ts.Permission)
+	}
+
+	result := &ThresholdResult{Threshold: authority.Threshold}
+	signedKeys := make([]bool, len(authority.Keys))
+	for i, pubKeyHash := range ts.PubKeyHashes {
+		if result.Reached() {
+			result.Skipped = append(result.Skipped, ts.PubKeyHashes[i:]...)
+			break
+		}
+
+		keySignature := &KeySignature{PubKeyHash: pubKeyHash}
+		sig, err := ts.sign(tx, pubKeyHash)
+		if err != nil {
+			keySignature.Error = err.Error()
+			result.Invalid = append(result.Invalid, keySignature)
+			continue
+		}
+		keySignature.Signature = sig
+		publicKey, err := ts.recover(tx, sig)
+		if err != nil {
+			keySignature.Error = err.Error()
+			result.Invalid = append(result.Invalid, keySignature)
+			continue
+		}
+		keySignature.PublicKey = publicKey.String()
+
+		index := authorityKeyIndex(authority, publicKey)
+		switch {
+		case index < 0:
+			keySignature.Error = "key is not in permission"
+		case signedKeys[index]:
+			keySignature.Error = "key already signed"
+		}
+		if keySignature.Error != "" {
+			log.Warn("EOS threshold signature invalid", "PubKeyHash", pubKeyHash, "PublicKey", keySignature.PublicKey, "info", keySignature.Error)
+			result.Invalid = append(result.Invalid, keySignature)
+			continue
+		}
+		signedKeys[index] = true
+		keySignature.Weight = authority.Keys[index].Weight
+		result.Weight += uint32(keySignature.Weight)
+		result.Signatures = append(result.Signatures, sig)
+		result.Signed = append(result.Signed, keySignature)
+	}
+
+	for i, keyWeight := range authority.Keys {
+		if !signedKeys[i] {
+			result.Missing = append(result.Missing, keyWeight.PublicKey.String())
+		}
+	}
+	if !result.Reached() {
+		return result, &ThresholdNotReachedError{Result: result}
+	}
+	return result, nil
+}
+
+// 作为BuildAndPushTx 的签名方法
+func (ts *ThresholdSigner) Signer() TxSigner {
+	return func(tx *eos.SignedTransaction) ([]*ecc.Signature, error) {
+		result, err := ts.Sign(tx)
+		if err != nil {
+			return nil, err
+		}
+		return result.Signatures, nil
+	}
+}
+
+func authorityKeyIndex(authority *eos.Authority, publicKey ecc.PublicKey) int {
+	for i, keyWeight := range authority.Keys {
+		if keyWeight.PublicKey.Curve == publicKey.Curve && bytes.Equal(keyWeight.PublicKey.Content, publicKey.Content) {
+			return i
+		}
+	}
+	return -1
+}
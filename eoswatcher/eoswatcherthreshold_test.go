@@ -0,0 +1,74 @@
+package eoswatcher
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/eoscanada/eos-go/ecc"
+	"github.com/stretchr/testify/assert"
+)
+
+// 签名内容为公钥内容，恢复出的公钥即签名内容
+func newTestThresholdSigner(authority *eos.Authority, keys map[string]byte, hashes ...string) (*ThresholdSigner, *[]string) {
+	var requested []string
+	return &ThresholdSigner{
+		Account:			eos.AN("gateway11111"),
+		Permission:			eos.PN("active"),
+		PubKeyHashes:		hashes,
+		authority:			func() (*eos.Authority, error) { return authority, nil },
+		sign: func(tx *eos.SignedTransaction, pubKeyHash string) (*ecc.Signature, error) {
+			requested = append(requested, pubKeyHash)
+			key, ok := keys[pubKeyHash]
+			if !ok {
+				return nil, errors.New("keystore unavailable")
+			}
+			return &ecc.Signature{Content: []byte{key}}, nil
+		},
+		recover: func(tx *eos.SignedTransaction, sig *ecc.Signature) (ecc.PublicKey, error) {
+			return ecc.PublicKey{Content: sig.Content}, nil
+		},
+	}, &requested
+}
+
+func TestThresholdSigner(t *testing.T) {
+	authority := &eos.Authority{Threshold: 3, Keys: []eos.KeyWeight{
+		{PublicKey: ecc.PublicKey{Content: []byte{1}}, Weight: 1},
+		{PublicKey: ecc.PublicKey{Content: []byte{2}}, Weight: 1},
+		{PublicKey: ecc.PublicKey{Content: []byte{3}}, Weight: 2},
+		{PublicKey: ecc.PublicKey{Content: []byte{4}}, Weight: 1},
+	}}
+	keys := map[string]byte{"h1": 1, "h2": 2, "h3": 3, "h4": 4, "h9": 9, "h1b": 1}
+	tx := &eos.SignedTransaction{Transaction: &eos.Transaction{}}
+
+	// 达到门限后停止请求
+	ts, requested := newTestThresholdSigner(authority, keys, "h1", "h3", "h2", "h4")
+	result, err := ts.Sign(tx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"h1", "h3"}, *requested)
+	assert.Equal(t, uint32(3), result.Weight)
+	assert.Len(t, result.Signatures, 2)
+	assert.Equal(t, []string{"h2", "h4"}, result.Skipped)
+	assert.Len(t, result.Missing, 2)
+
+	// 签名失败、公钥不在权限中、重复的公钥不计入
+	ts, _ = newTestThresholdSigner(authority, keys, "h5", "h9", "h1", "h1b", "h2", "h4")
+	result, err = ts.Sign(tx)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), result.Weight)
+	assert.Len(t, result.Invalid, 3)
+	assert.Equal(t, "keystore unavailable", result.Invalid[0].Error)
+	assert.Equal(t, "key is not in permission", result.Invalid[1].Error)
+	assert.Equal(t, "key already signed", result.Invalid[2].Error)
+
+	// 未达到门限
+	ts, _ = newTestThresholdSigner(authority, keys, "h1", "h2", "h9")
+	result, err = ts.Sign(tx)
+	notReached, ok := err.(*ThresholdNotReachedError)
+	assert.True(t, ok)
+	assert.Equal(t, result, notReached.Result)
+	assert.Equal(t, uint32(2), result.Weight)
+	assert.Len(t, result.Missing, 2)
+	_, err = ts.Signer()(tx)
+	assert.NotNil(t, err)
+}
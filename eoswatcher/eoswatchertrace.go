@@ -0,0 +1,204 @@
+package eoswatcher
+
+import (
+	"context"
+	"github.com/eoscanada/eos-go"
+	"github.com/eoscanada/eos-go/token"
+	log "github.com/inconshreveable/log15"
+	"sort"
+	"time"
+)
+
+// 执行轨迹中的一个action
+type TracedAction struct {
+	Action				*eos.Action
+	// 调用深度，交易中直接声明的action 为0，inline action 依次加1
+	Depth				int
+	// 产生该action 的父action，交易中直接声明的action 为nil
+	Creator				*eos.Action
+	// action 序号：交易中直接声明的action 为 0..n-1，inline action 按执行顺序从n 开始编号
+	ActionIndex			int
+}
+
+// 展开交易的执行轨迹，先返回顶层action，再按执行顺序返回inline action。
+// history 插件返回的traces 中，inline action 既可能单独出现，也可能出现在父action 的inline_traces 中，
+// 这里按 global_sequence 去重；require_recipient 产生的通知（receiver 不是合约本身）不作为单独的action 返回。
+// topLevelCount 为交易中直接声明的action 个数，未知时传0，按traces 中的顶层action 计算
+func FlattenActionTraces(traces []eos.ActionTrace, topLevelCount int) []*TracedAction {
+	// 出现在inline_traces 中的轨迹，都不是顶层action
+	inlineSeqs := make(map[int64]bool)
+	var collect func(trace *eos.ActionTrace)
+	collect = func(trace *eos.ActionTrace) {
+		for i := range trace.InlineTraces {
+			inlineSeqs[trace.InlineTraces[i].Receipt.GlobalSequence] = true
+			collect(&trace.InlineTraces[i])
+		}
+	}
+	for i := range traces {
+		collect(&traces[i])
+	}
+
+	var roots []*eos.ActionTrace
+	for i := range traces {
+		if traces[i].Action == nil || inlineSeqs[traces[i].Receipt.GlobalSequence] {
+			continue
+		}
+		roots = append(roots, &traces[i])
+	}
+	sort.SliceStable(roots, func(i, j int) bool {
+		return roots[i].Receipt.GlobalSequence < roots[j].Receipt.GlobalSequence
+	})
+
+	var topLevel, inline []*TracedAction
+	visited := make(map[int64]bool)
+
+	var walk func(trace *eos.ActionTrace, depth int, creator *eos.Action)
+	walk = func(trace *eos.ActionTrace, depth int, creator *eos.Action) {
+		if trace.Action == nil || visited[trace.Receipt.GlobalSequence] {
+			return
+		}
+		visited[trace.Receipt.GlobalSequence] = true
+
+		// receiver 不是合约本身的是通知轨迹，不单独返回
+		if trace.Receipt.Receiver == trace.Action.Account {
+			tracedAction := &TracedAction{
+				Action:			trace.Action,
+				Depth:			depth,
+				Creator:		creator,
+			}
+			if depth == 0 {
+				topLevel = append(topLevel, tracedAction)
+			} else {
+				inline = append(inline, tracedAction)
+			}
+		}
+
+		for i := range trace.InlineTraces {
+			child := &trace.InlineTraces[i]
+			// 通知轨迹与被通知的action 同一深度
+			if child.Action != nil && child.Receipt.Receiver != child.Action.Account {
+				walk(child, depth, creator)
+			} else {
+				walk(child, depth+1, trace.Action)
+			}
+		}
+	}
+	for _, root := range roots {
+		walk(root, 0, nil)
+	}
+
+	if topLevelCount < len(topLevel) {
+		topLevelCount = len(topLevel)
+	}
+	tracedActions := make([]*TracedAction, 0, len(topLevel)+len(inline))
+	for i, tracedAction := range topLevel {
+		tracedAction.ActionIndex = i
+		tracedActions = append(tracedActions, tracedAction)
+	}
+	for i, tracedAction := range inline {
+		tracedAction.ActionIndex = topLevelCount + i
+		tracedActions = append(tracedActions, tracedAction)
+	}
+	return tracedActions
+}
+
+// 交易体中直接声明的action，延迟交易等没有交易体时返回nil
+func TransactionActions(transactionResp *eos.TransactionResp) []*eos.Action {
+	if transactionResp.Transaction.Transaction.Transaction == nil {
+		return nil
+	}
+	return transactionResp.Transaction.Transaction.Actions
+}
+
+// 请求交易的执行结果，rpc 报错时重试几次。 history 插件中可能查不到该交易，所以不会一直阻塞
+func (ew *EOSWatcherMain) UpdateTransaction(txid string) (*eos.TransactionResp, error) {
+	var err error
+	for i := 0; i < 3; i++ {
+		var transactionResp *eos.TransactionResp
+		transactionResp, err = ew.transaction(txid)
+		if err == nil {
+			return transactionResp, nil
+		}
+		log.Debug("Get transaction error! Wait 100ms to request.", "TxID", txid, "info", err)
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, err
+}
+
+// 请求扫描到的块中交易的执行轨迹，rpc 报错时一直重试，直到ctx 结束。
+// 块已不可逆，查不到说明history 插件落后或不可用，跳过会丢失其中的转账
+func (ew *EOSWatcherMain) transactionTraces(ctx context.Context, txid string) (*eos.TransactionResp, error) {
+	for {
+		transactionResp, err := ew.UpdateTransaction(txid)
+		if err == nil {
+			return transactionResp, nil
+		}
+		log.Error("Get transaction traces error! Wait 1s to request.", "TxID", txid, "info", err)
+		if !sleepContext(ctx, 1 * time.Second) {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// 根据交易的执行轨迹，生成EOSPush事件（未填充BlockNum、Index）。
+// 只返回调用深度不小于minDepth 的action；转账只接受转入、转出监控账户的，不限制发起方（可以是任何合约的inline 转账）。
+// 交易可能还未不可逆，不记录其中的setabi
+func (ew *EOSWatcherMain) TraceEOSPushEvents(transactionResp *eos.TransactionResp, topLevelCount, minDepth int, withCreate bool) []*EOSPushEvent {
+	return ew.traceEOSPushEvents(transactionResp, topLevelCount, minDepth, withCreate, ew.watchedAccounts(), false)
+}
+
+func (ew *EOSWatcherMain) traceEOSPushEvents(transactionResp *eos.TransactionResp, topLevelCount, minDepth int, withCreate bool, accounts []*WatchedAccount, recordABI bool) []*EOSPushEvent {
+	var eosPushEvents []*EOSPushEvent
+	for _, tracedAction := range FlattenActionTraces(transactionResp.Traces, topLevelCount) {
+		if tracedAction.Depth < minDepth {
+			continue
+		}
+		action := tracedAction.Action
+		if recordABI {
+			ew.recordSetABI(action, transactionResp.BlockNum, accounts)
+		}
+		if action.Name == eos.ActN("transfer") && !isWatchedTransfer(action, accounts) {
+			continue
+		}
+		eosPushEvent := ew.parseTokenAction(action, withCreate, accounts, transactionResp.BlockNum)
+		if eosPushEvent == nil {
+			continue
+		}
+		eosPushEvent.TxID = transactionResp.ID
+		eosPushEvent.ActionIndex = tracedAction.ActionIndex
+		eosPushEvent.TraceDepth = tracedAction.Depth
+		if tracedAction.Creator != nil {
+			eosPushEvent.CreatorAccount = tracedAction.Creator.Account
+			eosPushEvent.CreatorName = tracedAction.Creator.Name
+		}
+		eosPushEvents = append(eosPushEvents, eosPushEvent)
+	}
+	return eosPushEvents
+}
+
+// 判断转账的转出方或收款方是否是监控的账户。 扫块时data 为二进制数据，查询交易时为json
+func (ew *EOSWatcherMain) isWatchedAccountTransfer(action *eos.Action) bool {
+	return isWatchedTransfer(action, ew.watchedAccounts())
+}
+
+func isWatchedTransfer(action *eos.Action, accounts []*WatchedAccount) bool {
+	var from, to eos.AccountName
+	if data, ok := action.ActionData.Data.(map[string]interface{}); ok {
+		fromName, ok := data["from"].(string)
+		if !ok {
+			return false
+		}
+		toName, ok := data["to"].(string)
+		if !ok {
+			return false
+		}
+		from, to = eos.AN(fromName), eos.AN(toName)
+	} else {
+		var transfer token.Transfer
+		if err := UnmarshalActionData(action, &transfer); err != nil {
+			return false
+		}
+		from, to = transfer.From, transfer.To
+	}
+	return findWatchedAccount(accounts, from) != nil || findWatchedAccount(accounts, to) != nil
+}
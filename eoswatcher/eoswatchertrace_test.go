@@ -0,0 +1,143 @@
+package eoswatcher
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"eosc/tools/blocksource"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTrace(seq int64, receiver, account, name string, inlines ...eos.ActionTrace) eos.ActionTrace {
+	trace := eos.ActionTrace{
+		Action:			&eos.Action{Account: eos.AN(account), Name: eos.ActN(name)},
+		InlineTraces:	inlines,
+	}
+	trace.Receipt.Receiver = eos.AN(receiver)
+	trace.Receipt.GlobalSequence = seq
+	return trace
+}
+
+func TestFlattenActionTraces(t *testing.T) {
+	// 交易所合约 payout，inline 调用 eosio.token::transfer 转给网关；transfer 通知收款方，收款方再inline 调用 issue
+	issue := newTrace(5, "gatewaytoken", "gatewaytoken", "issue")
+	notifyTo := newTrace(4, "gateway11111", "eosio.token", "transfer", issue)
+	notifyFrom := newTrace(3, "exchange1111", "eosio.token", "transfer")
+	transfer := newTrace(2, "eosio.token", "eosio.token", "transfer", notifyFrom, notifyTo)
+	payout := newTrace(1, "exchange1111", "exchange1111", "payout", transfer)
+
+	// history 插件会把inline 轨迹再单独列出来
+	traces := []eos.ActionTrace{payout, transfer, notifyFrom, notifyTo, issue}
+	tracedActions := FlattenActionTraces(traces, 1)
+
+	assert.Len(t, tracedActions, 3)
+
+	assert.Equal(t, eos.ActN("payout"), tracedActions[0].Action.Name)
+	assert.Equal(t, 0, tracedActions[0].Depth)
+	assert.Equal(t, 0, tracedActions[0].ActionIndex)
+	assert.Nil(t, tracedActions[0].Creator)
+
+	assert.Equal(t, eos.ActN("transfer"), tracedActions[1].Action.Name)
+	assert.Equal(t, 1, tracedActions[1].Depth)
+	assert.Equal(t, 1, tracedActions[1].ActionIndex)
+	assert.Equal(t, eos.ActN("payout"), tracedActions[1].Creator.Name)
+
+	assert.Equal(t, eos.ActN("issue"), tracedActions[2].Action.Name)
+	assert.Equal(t, 2, tracedActions[2].Depth)
+	assert.Equal(t, 2, tracedActions[2].ActionIndex)
+	assert.Equal(t, eos.ActN("transfer"), tracedActions[2].Creator.Name)
+}
+
+func TestFlattenActionTracesTopLevelCount(t *testing.T) {
+	first := newTrace(10, "eosio.token", "eosio.token", "transfer", newTrace(12, "eosio.token", "eosio.token", "transfer"))
+	second := newTrace(11, "dgateway1111", "dgateway1111", "solvent")
+
+	tracedActions := FlattenActionTraces([]eos.ActionTrace{second, first}, 0)
+
+	assert.Len(t, tracedActions, 3)
+	assert.Equal(t, 0, tracedActions[0].ActionIndex)
+	assert.Equal(t, eos.ActN("transfer"), tracedActions[0].Action.Name)
+	assert.Equal(t, 1, tracedActions[1].ActionIndex)
+	assert.Equal(t, eos.ActN("solvent"), tracedActions[1].Action.Name)
+	assert.Equal(t, 2, tracedActions[2].ActionIndex)
+	assert.Equal(t, 1, tracedActions[2].Depth)
+}
+
+// 回放录制的执行轨迹、ABI，不请求节点
+func TestTracedEventsReplay(t *testing.T) {
+	dirName, err := ioutil.TempDir("", "eoswatchertrace")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dirName)
+	// 延迟交易：交易所合约 payout，inline 转账给网关；网关转出的为提现，与网关无关的转账忽略
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dirName, "get_transaction_aa01.json"), []byte(`{
+		"id": "aa01",
+		"block_num": 100,
+		"traces": [{
+			"receipt": {"receiver": "exchange1111", "global_sequence": 1},
+			"act": {"account": "exchange1111", "name": "payout", "data": {}},
+			"inline_traces": [{
+				"receipt": {"receiver": "eosio.token", "global_sequence": 2},
+				"act": {"account": "eosio.token", "name": "transfer", "data": {"from": "exchange1111", "to": "gateway11111", "quantity": "1.0000 EOS", "memo": "alice"}}
+			}, {
+				"receipt": {"receiver": "eosio.token", "global_sequence": 3},
+				"act": {"account": "eosio.token", "name": "transfer", "data": {"from": "exchange1111", "to": "bob111111111", "quantity": "1.0000 EOS", "memo": "bob"}}
+			}, {
+				"receipt": {"receiver": "eosio.token", "global_sequence": 4},
+				"act": {"account": "eosio.token", "name": "transfer", "data": {"from": "gateway11111", "to": "alice1111111", "quantity": "0.5000 EOS", "memo": "refund"}}
+			}]
+		}]
+	}`), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dirName, "get_abi_gatewaytoken.json"), []byte(`{"account_name": "gatewaytoken", "abi": {"version": "eosio::abi/1.0"}}`), 0644))
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+
+	ew := &EOSWatcherMain{
+		EosAPI:				&eos.API{},
+		DB:					db,
+		Gateway:			eos.AN("gateway11111"),
+		Blocks:				blocksource.NewFileSource(dirName),
+		ActionDecoders:		NewActionDecoderRegistry(),
+		TokenContracts:		[]*TokenContract{{ActionAccount: eos.AN("eosio.token"), ActionNameDestroy: eos.ActN("transfer"), Symbol: "EOS", Precision: 4}},
+	}
+	txID, _ := hex.DecodeString("aa01")
+	blockResp := &eos.BlockResp{BlockNum: 100}
+	blockResp.SignedBlock.Transactions = []eos.TransactionReceipt{{Transaction: eos.TransactionWithID{ID: txID}}}
+
+	eosPushEvents, err := ew.ExtractEOSPushEvents(context.Background(), blockResp, 0)
+	assert.Nil(t, err)
+	assert.Len(t, eosPushEvents, 2)
+	assert.Equal(t, uint64(10000), eosPushEvents[0].Amount)
+	assert.Equal(t, "alice", eosPushEvents[0].Memo)
+	assert.Equal(t, uint32(100), eosPushEvents[0].BlockNum)
+	assert.Equal(t, 1, eosPushEvents[0].TraceDepth)
+	assert.Equal(t, eos.ActN("payout"), eosPushEvents[0].CreatorName)
+	assert.Equal(t, EventTypeDeposit, eosPushEvents[0].GetEventType())
+	assert.Equal(t, uint64(5000), eosPushEvents[1].Amount)
+	assert.Equal(t, "alice1111111", eosPushEvents[1].GetTo())
+	assert.Equal(t, EventTypeWithdrawalConfirmed, eosPushEvents[1].GetEventType())
+
+	// 执行轨迹缺失时一直重试，ctx 结束后返回错误，块不能算作已扫描
+	missingID, _ := hex.DecodeString("aa02")
+	blockResp.SignedBlock.Transactions = []eos.TransactionReceipt{{Transaction: eos.TransactionWithID{ID: missingID}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 1500 * time.Millisecond)
+	defer cancel()
+	eosPushEvents, err = ew.ExtractEOSPushEvents(ctx, blockResp, 0)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Nil(t, eosPushEvents)
+	eventChan := make(chan *EOSPushEvent, 1)
+	assert.Equal(t, context.DeadlineExceeded, ew.UpdateEOSPushEvent(ctx, blockResp, 0, eventChan))
+	assert.Len(t, eventChan, 0)
+
+	abi, err := ew.contractABI(eos.AN("gatewaytoken"))
+	assert.Nil(t, err)
+	assert.Equal(t, "eosio::abi/1.0", abi.Version)
+	_, err = ew.contractABI(eos.AN("eosio.token"))
+	assert.Equal(t, blocksource.ErrNotFound, err)
+}
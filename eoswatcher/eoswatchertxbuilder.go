@@ -0,0 +1,283 @@
+package eoswatcher
+
+import (
+	"context"
+	"github.com/eoscanada/eos-go"
+	"github.com/eoscanada/eos-go/ecc"
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+const (
+	txDefaultExpiration = 30 * time.Second
+	txDefaultMaxAttempts = 5
+	txDefaultRetryInterval = time.Second
+	txDefaultMaxRebuilds = 2
+)
+
+// 创建交易的选项
+type TxBuildOptions struct {
+	// 过期时长，为0 时30 秒。 TaPoS 使用不可逆块，过期时间从当前时间算起
+	Expiration				time.Duration
+	DelaySecs				uint32
+	// 交易最多使用的CPU（毫秒）、NET（8 字节为单位），为0 时不限制
+	MaxCPUUsageMS			uint8
+	MaxNetUsageWords		uint32
+	ContextFreeActions		[]*eos.Action
+}
+
+// 创建交易：TaPoS 取自当前不可逆块（不会因分叉失效），节点不可用时返回错误。 离线签名时使用CreateOfflineTx
+func (ew *EOSWatcherMain) BuildTx(actions []*eos.Action, options *TxBuildOptions) (*eos.SignedTransaction, error) {
+	if options == nil {
+		options = &TxBuildOptions{}
+	}
+	if ew.ChainIDPin != nil && ew.ChainIDPin.Offline() {
+		return nil, errors.New("Offline signing is enabled, use CreateOfflineTx.")
+	}
+	infoResp, err := ew.Endpoints.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	refBlock, err := ew.Endpoints.GetIrreversibleBlock(infoResp.LastIrreversibleBlockNum)
+	if err != nil {
+		return nil, err
+	}
+
+	expiration := options.Expiration
+	if expiration == 0 {
+		expiration = txDefaultExpiration
+	}
+	//生成未签名交易
+	tx := &eos.Transaction{Actions: actions, ContextFreeActions: options.ContextFreeActions}
+	tx.Fill(refBlock.ID, options.DelaySecs, options.MaxNetUsageWords, options.MaxCPUUsageMS)
+	tx.SetExpiration(expiration)
+
+	//生成签名交易
+	stx := eos.NewSignedTransaction(tx)
+	ew.trackOutgoingTx(stx)
+	return stx, nil
+}
+
+// 广播失败的原因，按nodeos 返回的异常分类
+type PushErrorKind int
+
+const (
+	// 其他错误（合约断言失败、权限不足等），重试没有意义
+	PushErrorUnknown PushErrorKind = iota
+	// 没有收到节点的响应，交易可能已被接收
+	PushErrorNetwork
+	// expired_tx_exception：交易已过期，不会再上链
+	PushErrorExpired
+	// tx_duplicate：节点已收到过该交易
+	PushErrorDuplicate
+	// tx_cpu_usage_exceeded、leeway_deadline_exception：CPU 不足
+	PushErrorCPUExceeded
+	// invalid_ref_block_exception：节点上没有TaPoS 参考块（节点落后或在其他分叉上）
+	PushErrorTaPoSMismatch
+)
+
+func (kind PushErrorKind) String() string {
+	switch kind {
+	case PushErrorNetwork:
+		return "network"
+	case PushErrorExpired:
+		return "expired"
+	case PushErrorDuplicate:
+		return "duplicate"
+	case PushErrorCPUExceeded:
+		return "cpu_exceeded"
+	case PushErrorTaPoSMismatch:
+		return "tapos_mismatch"
+	}
+	return "unknown"
+}
+
+// 按异常名、错误码分类。 节点返回的错误中含有响应体（status code=...），没有时视为网络错误。
+// 节点池返回的 *PushTransactionError：有节点返回重复时为重复，否则按最后一个节点的错误分类
+func ClassifyPushError(err error) PushErrorKind {
+	if err == nil {
+		return PushErrorUnknown
+	}
+	if pushErr, ok := err.(*PushTransactionError); ok {
+		kind := PushErrorUnknown
+		for _, endpointErr := range pushErr.Errors {
+			kind = ClassifyPushError(endpointErr.Err)
+			if kind == PushErrorDuplicate {
+				return kind
+			}
+		}
+		return kind
+	}
+	message := err.Error()
+	for _, class := range []struct {
+		kind				PushErrorKind
+		markers				[]string
+	}{
+		{PushErrorExpired, []string{"expired_tx_exception", "3040005"}},
+		{PushErrorDuplicate, []string{"tx_duplicate", "3040008"}},
+		{PushErrorCPUExceeded, []string{"tx_cpu_usage_exceeded", "3080004", "leeway_deadline_exception", "3081001"}},
+		{PushErrorTaPoSMismatch, []string{"invalid_ref_block_exception", "3040007"}},
+	} {
+		for _, marker := range class.markers {
+			if strings.Contains(message, marker) {
+				return class.kind
+			}
+		}
+	}
+	if !strings.Contains(message, "status code=") {
+		return PushErrorNetwork
+	}
+	return PushErrorUnknown
+}
+
+// 是否有节点没有响应（可能已接收交易）。 节点池依次尝试各节点，最后一个节点的错误不能说明前面的节点没有接收
+func pushMaybeAccepted(err error) bool {
+	if pushErr, ok := err.(*PushTransactionError); ok {
+		for _, endpointErr := range pushErr.Errors {
+			if ClassifyPushError(endpointErr.Err) == PushErrorNetwork {
+				return true
+			}
+		}
+		return false
+	}
+	return ClassifyPushError(err) == PushErrorNetwork
+}
+
+// 对交易签名，返回所有签名，例如PKMSign 或多签协调
+type TxSigner func(tx *eos.SignedTransaction) ([]*ecc.Signature, error)
+
+// 广播的重试选项
+type BroadcastOptions struct {
+	// 同一笔交易最多广播的次数，为0 时5 次
+	MaxAttempts				int
+	// 重试间隔，为0 时1 秒
+	RetryInterval			time.Duration
+	// 交易过期后最多重新创建、签名的次数，为0 时2 次
+	MaxRebuilds				int
+}
+
+// 广播结果
+type BroadcastResult struct {
+	TxID					string
+	// 节点返回的结果，Duplicate 时为nil
+	Resp					*eos.PushTransactionFullResp
+	// 节点已收到过该交易（之前的广播已成功）
+	Duplicate				bool
+	Attempts				int
+	Rebuilds				int
+}
+
+// 创建、签名并广播交易。 失败时按原因处理：
+//   重复（tx_duplicate）视为成功；
+//   网络错误、CPU 不足、TaPoS 不匹配 重新广播同一笔交易（旧交易仍可能上链，重新创建会导致重复转账）；
+//   过期（expired_tx_exception）时旧交易不会再上链，才重新创建、签名（之前有任一节点网络错误时，旧交易可能已上链，不重新创建）；
+//   其他错误直接返回
+func (ew *EOSWatcherMain) BuildAndPushTx(ctx context.Context, actions []*eos.Action, buildOptions *TxBuildOptions, signer TxSigner, broadcastOptions *BroadcastOptions) (*BroadcastResult, error) {
+	if signer == nil {
+		signer = ew.pkmSigner
+	}
+	build := func() (*eos.SignedTransaction, error) {
+		return ew.BuildTx(actions, buildOptions)
+	}
+	return ew.pushWithRetry(ctx, build, signer, ew.Endpoints.PushTransaction, broadcastOptions)
+}
+
+// 默认签名：PubKeyHash 对应的一个签名
+func (ew *EOSWatcherMain) pkmSigner(tx *eos.SignedTransaction) ([]*ecc.Signature, error) {
+	sig, err := ew.PKMSign(tx)
+	if err != nil {
+		return nil, err
+	}
+	return []*ecc.Signature{sig}, nil
+}
+
+func (ew *EOSWatcherMain) pushWithRetry(ctx context.Context, build func() (*eos.SignedTransaction, error), signer TxSigner,
+	push func(tx *eos.PackedTransaction) (*eos.PushTransactionFullResp, error), options *BroadcastOptions) (*BroadcastResult, error) {
+	maxAttempts, retryInterval, maxRebuilds := txDefaultMaxAttempts, txDefaultRetryInterval, txDefaultMaxRebuilds
+	if options != nil {
+		if options.MaxAttempts > 0 {
+			maxAttempts = options.MaxAttempts
+		}
+		if options.RetryInterval > 0 {
+			retryInterval = options.RetryInterval
+		}
+		if options.MaxRebuilds > 0 {
+			maxRebuilds = options.MaxRebuilds
+		}
+	}
+
+	result := &BroadcastResult{}
+	signAndPack := func() (*eos.PackedTransaction, error) {
+		tx, err := build()
+		if err != nil {
+			return nil, err
+		}
+		sigs, err := signer(tx)
+		if err != nil {
+			return nil, err
+		}
+		result.TxID = ew.trackOutgoingTx(tx)
+		return ew.MergeSignedTx(tx, sigs...)
+	}
+	packedTx, err := signAndPack()
+	if err != nil {
+		return nil, err
+	}
+
+	attempts := 0
+	// 当前交易的广播出现过网络错误，节点可能已接收
+	maybeAccepted := false
+	for {
+		attempts++
+		result.Attempts++
+		resp, err := push(packedTx)
+		if err == nil {
+			result.Resp = resp
+			return result, nil
+		}
+
+		kind := ClassifyPushError(err)
+		log.Warn("push eos tx err", "TxID", result.TxID, "Kind", kind, "Attempts", attempts, "info", err)
+		if pushMaybeAccepted(err) {
+			maybeAccepted = true
+		}
+		switch kind {
+		case PushErrorDuplicate:
+			result.Duplicate = true
+			return result, nil
+		case PushErrorExpired:
+			if maybeAccepted || result.Rebuilds >= maxRebuilds {
+				return ew.failBroadcast(result, err, maybeAccepted)
+			}
+			if !sleepContext(ctx, retryInterval) {
+				return result, ctx.Err()
+			}
+			result.Rebuilds++
+			attempts = 0
+			maybeAccepted = false
+			if packedTx, err = signAndPack(); err != nil {
+				return result, err
+			}
+			continue
+		case PushErrorNetwork, PushErrorCPUExceeded, PushErrorTaPoSMismatch:
+			if attempts >= maxAttempts {
+				return ew.failBroadcast(result, err, maybeAccepted)
+			}
+			if !sleepContext(ctx, retryInterval) {
+				return result, ctx.Err()
+			}
+		default:
+			return ew.failBroadcast(result, err, maybeAccepted)
+		}
+	}
+}
+
+// 节点可能已接收交易时不标记失败，继续跟踪到上链或过期
+func (ew *EOSWatcherMain) failBroadcast(result *BroadcastResult, err error, maybeAccepted bool) (*BroadcastResult, error) {
+	if result.TxID != "" && !maybeAccepted {
+		ew.failOutgoingTx(result.TxID, err)
+	}
+	return result, err
+}
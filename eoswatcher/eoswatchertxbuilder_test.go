@@ -0,0 +1,138 @@
+package eoswatcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/eoscanada/eos-go/ecc"
+	"github.com/stretchr/testify/assert"
+)
+
+func nodeosError(name string, code int) error {
+	return fmt.Errorf(`http://127.0.0.1:8888/v1/chain/push_transaction: status code=500, body={"code":500,"error":{"code":%d,"name":"%s"}}`, code, name)
+}
+
+func TestClassifyPushError(t *testing.T) {
+	assert.Equal(t, PushErrorExpired, ClassifyPushError(nodeosError("expired_tx_exception", 3040005)))
+	assert.Equal(t, PushErrorDuplicate, ClassifyPushError(nodeosError("tx_duplicate", 3040008)))
+	assert.Equal(t, PushErrorCPUExceeded, ClassifyPushError(nodeosError("tx_cpu_usage_exceeded", 3080004)))
+	assert.Equal(t, PushErrorCPUExceeded, ClassifyPushError(errors.New(`status code=500, body={"error":{"code":3081001}}`)))
+	assert.Equal(t, PushErrorTaPoSMismatch, ClassifyPushError(nodeosError("invalid_ref_block_exception", 3040007)))
+	assert.Equal(t, PushErrorUnknown, ClassifyPushError(nodeosError("eosio_assert_message_exception", 3050003)))
+	assert.Equal(t, PushErrorNetwork, ClassifyPushError(errors.New("dial tcp 127.0.0.1:8888: connect: connection refused")))
+}
+
+func TestPushWithRetry(t *testing.T) {
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+	ew := &EOSWatcherMain{DB: db}
+
+	builds := 0
+	build := func() (*eos.SignedTransaction, error) {
+		builds++
+		return &eos.SignedTransaction{Transaction: &eos.Transaction{}}, nil
+	}
+	signer := func(tx *eos.SignedTransaction) ([]*ecc.Signature, error) {
+		return []*ecc.Signature{{}}, nil
+	}
+	pushErrors := func(errs ...error) func(tx *eos.PackedTransaction) (*eos.PushTransactionFullResp, error) {
+		return func(tx *eos.PackedTransaction) (*eos.PushTransactionFullResp, error) {
+			if len(errs) == 0 {
+				return &eos.PushTransactionFullResp{}, nil
+			}
+			err := errs[0]
+			errs = errs[1:]
+			return nil, err
+		}
+	}
+	options := &BroadcastOptions{RetryInterval: time.Millisecond}
+
+	// CPU 不足时重新广播同一笔交易
+	result, err := ew.pushWithRetry(context.Background(), build, signer, pushErrors(nodeosError("tx_cpu_usage_exceeded", 3080004)), options)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, result.Attempts)
+	assert.Equal(t, 0, result.Rebuilds)
+	assert.Equal(t, 1, builds)
+
+	// 过期后重新创建、签名，之后的重复视为成功
+	builds = 0
+	result, err = ew.pushWithRetry(context.Background(), build, signer,
+		pushErrors(nodeosError("expired_tx_exception", 3040005), nodeosError("tx_duplicate", 3040008)), options)
+	assert.Nil(t, err)
+	assert.True(t, result.Duplicate)
+	assert.Equal(t, 1, result.Rebuilds)
+	assert.Equal(t, 2, builds)
+
+	// 网络错误后旧交易可能已上链，过期时不重新创建
+	builds = 0
+	_, err = ew.pushWithRetry(context.Background(), build, signer,
+		pushErrors(errors.New("read: connection reset by peer"), nodeosError("expired_tx_exception", 3040005)), options)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, builds)
+
+	// 其他错误不重试
+	result, err = ew.pushWithRetry(context.Background(), build, signer, pushErrors(nodeosError("eosio_assert_message_exception", 3050003)), options)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, result.Attempts)
+
+	result, err = ew.pushWithRetry(context.Background(), build, signer,
+		pushErrors(errors.New("timeout"), errors.New("timeout"), errors.New("timeout")), &BroadcastOptions{MaxAttempts: 3, RetryInterval: time.Millisecond})
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, result.Attempts)
+}
+
+func TestPushWithRetryThroughPool(t *testing.T) {
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+	pool := NewEndpointPool([]string{"http://a", "http://b"}, nil)
+	ew := &EOSWatcherMain{DB: db, Endpoints: pool}
+
+	// a 超时（可能已接收交易），b 返回过期
+	var pushed []string
+	pool.pushTransaction = func(api *eos.API, tx *eos.PackedTransaction) (*eos.PushTransactionFullResp, error) {
+		pushed = append(pushed, api.BaseURL)
+		if api.BaseURL == "http://a" {
+			return nil, errors.New(`Post "http://a/v1/chain/push_transaction": context deadline exceeded (Client.Timeout exceeded while awaiting headers)`)
+		}
+		return nil, nodeosError("expired_tx_exception", 3040005)
+	}
+	builds := 0
+	build := func() (*eos.SignedTransaction, error) {
+		builds++
+		return newOutgoingTestTx("withdraw", time.Now().Add(time.Minute)), nil
+	}
+	signer := func(tx *eos.SignedTransaction) ([]*ecc.Signature, error) {
+		return []*ecc.Signature{{}}, nil
+	}
+
+	result, err := ew.pushWithRetry(context.Background(), build, signer, pool.PushTransaction, &BroadcastOptions{RetryInterval: time.Millisecond})
+	assert.NotNil(t, err)
+	assert.Equal(t, PushErrorExpired, ClassifyPushError(err))
+	assert.True(t, pushMaybeAccepted(err))
+	assert.Equal(t, []string{"http://a", "http://b"}, pushed)
+	// 不重新创建交易，旧交易继续跟踪
+	assert.Equal(t, 1, builds)
+	assert.Equal(t, 0, result.Rebuilds)
+	outgoingTx, err := ew.GetOutgoingTx(result.TxID)
+	assert.Nil(t, err)
+	assert.Equal(t, OutgoingTxPending, outgoingTx.Status)
+
+	// 所有节点都明确拒绝时才重新创建
+	pushed = nil
+	pool.pushTransaction = func(api *eos.API, tx *eos.PackedTransaction) (*eos.PushTransactionFullResp, error) {
+		pushed = append(pushed, api.BaseURL)
+		if len(pushed) <= 2 {
+			return nil, nodeosError("expired_tx_exception", 3040005)
+		}
+		return &eos.PushTransactionFullResp{}, nil
+	}
+	builds = 0
+	result, err = ew.pushWithRetry(context.Background(), build, signer, pool.PushTransaction, &BroadcastOptions{RetryInterval: time.Millisecond})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, builds)
+	assert.Equal(t, 1, result.Rebuilds)
+}
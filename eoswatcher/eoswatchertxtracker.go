@@ -0,0 +1,319 @@
+package eoswatcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/eoscanada/eos-go"
+	log "github.com/inconshreveable/log15"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"sync"
+	"time"
+)
+
+// leveldb 中网关发出交易的key 前缀，完整key 为 前缀 + txid
+const outgoingTxKeyPrefix = "OutgoingTx/"
+
+// 网关发出交易的状态
+type OutgoingTxStatus int
+
+const (
+	// 已创建、签名或广播，还没有打包进块
+	OutgoingTxPending OutgoingTxStatus = 1
+	// 已打包进可逆块，可能因分叉被撤回
+	OutgoingTxIncluded OutgoingTxStatus = 2
+	// 已打包进不可逆块，执行成功
+	OutgoingTxIrreversible OutgoingTxStatus = 3
+	// 过期前没有打包进块，不会再上链，可以重新发起
+	OutgoingTxExpired OutgoingTxStatus = 4
+	// 广播失败（过期前仍可能上链，过期后变为Expired），或在不可逆块中执行失败
+	OutgoingTxFailed OutgoingTxStatus = 5
+)
+
+func (s OutgoingTxStatus) String() string {
+	switch s {
+	case OutgoingTxPending:
+		return "pending"
+	case OutgoingTxIncluded:
+		return "included"
+	case OutgoingTxIrreversible:
+		return "irreversible"
+	case OutgoingTxExpired:
+		return "expired"
+	case OutgoingTxFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// 不会再变化的状态。 广播失败的交易仍可能被其他节点转发上链，过期前继续跟踪
+func (s OutgoingTxStatus) Final() bool {
+	return s == OutgoingTxIrreversible || s == OutgoingTxExpired
+}
+
+// 网关发出的一笔交易的生命周期记录，状态变化时发到OutgoingTxChan
+type OutgoingTx struct {
+	TxID				string				`json:"txid"`
+	Status				OutgoingTxStatus	`json:"status"`
+	// 交易过期时间，unix 秒
+	Expiration			int64				`json:"expiration"`
+	// 打包交易的块，Included、Irreversible 时有效
+	BlockNum			uint32				`json:"block_num,omitempty"`
+	BlockID				string				`json:"block_id,omitempty"`
+	// 失败原因，Failed 时有效
+	Error				string				`json:"error,omitempty"`
+	// 状态更新时间，unix 秒
+	Time				int64				`json:"time"`
+}
+
+// 交易不会再变化：状态已结束，或在不可逆块中执行失败（有BlockID 的Failed）
+func (outgoingTx *OutgoingTx) Final() bool {
+	return outgoingTx.Status.Final() || outgoingTx.Status == OutgoingTxFailed && outgoingTx.BlockID != ""
+}
+
+// 网关发出交易的跟踪器，内存中保存未结束的交易，启动后第一次使用时从leveldb 加载
+type outgoingTxTracker struct {
+	lock				sync.Mutex
+	loaded				bool
+	open				map[string]*OutgoingTx
+	// OutgoingTxChan 满时排队的事件，按状态变化顺序由一个发送协程发出
+	queue				[]*OutgoingTx
+	sending				bool
+}
+
+// 交易ID：交易体（不含签名）序列化后的sha256
+func TransactionID(tx *eos.SignedTransaction) (string, error) {
+	txdata, err := eos.MarshalBinary(tx.Transaction)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(txdata)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func outgoingTxKey(txid string) []byte {
+	return []byte(outgoingTxKeyPrefix + txid)
+}
+
+// 读取网关发出交易的记录，没有记录时返回nil
+func (ew *EOSWatcherMain) GetOutgoingTx(txid string) (*OutgoingTx, error) {
+	data, err := ew.DB.Get(outgoingTxKey(txid), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var outgoingTx OutgoingTx
+	if err := json.Unmarshal(data, &outgoingTx); err != nil {
+		return nil, err
+	}
+	return &outgoingTx, nil
+}
+
+// 开始跟踪网关发出的交易，返回交易ID。 CreateTx、PKMSign、MergeSignedTx、SendTx 会自动调用，
+// 其他方式构造的交易可以手动调用。 已跟踪的交易不重复记录
+func (ew *EOSWatcherMain) TrackOutgoingTx(tx *eos.SignedTransaction) (string, error) {
+	txid, err := TransactionID(tx)
+	if err != nil {
+		return "", err
+	}
+
+	ew.outgoingTxs.lock.Lock()
+	ew.loadOutgoingTxs()
+	if _, ok := ew.outgoingTxs.open[txid]; ok {
+		ew.outgoingTxs.lock.Unlock()
+		return txid, nil
+	}
+	if record, err := ew.GetOutgoingTx(txid); err != nil || record != nil {
+		ew.outgoingTxs.lock.Unlock()
+		return txid, err
+	}
+	outgoingTx := &OutgoingTx{
+		TxID:			txid,
+		Status:			OutgoingTxPending,
+		Expiration:		tx.Expiration.Unix(),
+	}
+	ew.outgoingTxs.open[txid] = outgoingTx
+	ew.sendOutgoingTxs(ew.putOutgoingTx(outgoingTx))
+	ew.outgoingTxs.lock.Unlock()
+	return txid, nil
+}
+
+// 跟踪交易，失败只记录日志，不影响发交易流程
+func (ew *EOSWatcherMain) trackOutgoingTx(tx *eos.SignedTransaction) string {
+	if tx == nil || tx.Transaction == nil {
+		return ""
+	}
+	txid, err := ew.TrackOutgoingTx(tx)
+	if err != nil {
+		log.Error("track eos outgoing tx err", "info", err)
+	}
+	return txid
+}
+
+// 广播失败
+func (ew *EOSWatcherMain) failOutgoingTx(txid string, cause error) {
+	ew.outgoingTxs.lock.Lock()
+	var changed []*OutgoingTx
+	if outgoingTx, ok := ew.outgoingTxs.open[txid]; ok && outgoingTx.Status == OutgoingTxPending {
+		outgoingTx.Status = OutgoingTxFailed
+		outgoingTx.Error = cause.Error()
+		changed = ew.putOutgoingTx(outgoingTx)
+	}
+	ew.sendOutgoingTxs(changed)
+	ew.outgoingTxs.lock.Unlock()
+}
+
+// 检查块中是否有跟踪的交易。 irreversible 为false 时是跟随最新块扫到的可逆块，只标记Included；
+// 为true 时是按块高顺序交付的不可逆块，交易结束跟踪，同时把块时间之前过期的交易标记为Expired
+func (ew *EOSWatcherMain) observeOutgoingTxs(blockResp *eos.BlockResp, irreversible bool) {
+	ew.outgoingTxs.lock.Lock()
+	ew.loadOutgoingTxs()
+	var changed []*OutgoingTx
+	if len(ew.outgoingTxs.open) == 0 {
+		ew.outgoingTxs.lock.Unlock()
+		return
+	}
+
+	blockID := hex.EncodeToString(blockResp.ID)
+	for _, transactionReceipt := range blockResp.SignedBlock.Transactions {
+		txid := hex.EncodeToString(transactionReceipt.Transaction.ID)
+		outgoingTx, ok := ew.outgoingTxs.open[txid]
+		if !ok {
+			continue
+		}
+
+		switch transactionReceipt.Status {
+		case eos.TransactionStatusExecuted:
+			if outgoingTx.Status != OutgoingTxIncluded || outgoingTx.BlockID != blockID {
+				outgoingTx.Status = OutgoingTxIncluded
+				outgoingTx.BlockNum = blockResp.BlockNum
+				outgoingTx.BlockID = blockID
+				outgoingTx.Error = ""
+				changed = append(changed, ew.putOutgoingTx(outgoingTx)...)
+			}
+			if irreversible {
+				outgoingTx.Status = OutgoingTxIrreversible
+				changed = append(changed, ew.putOutgoingTx(outgoingTx)...)
+				delete(ew.outgoingTxs.open, txid)
+			}
+		case eos.TransactionStatusDelayed:
+			// 延迟交易，执行时会再出现在块中
+			continue
+		default:
+			if !irreversible {
+				continue
+			}
+			outgoingTx.Status = OutgoingTxFailed
+			if transactionReceipt.Status == eos.TransactionStatusExpired {
+				outgoingTx.Status = OutgoingTxExpired
+			}
+			outgoingTx.BlockNum = blockResp.BlockNum
+			outgoingTx.BlockID = blockID
+			outgoingTx.Error = "transaction receipt status " + transactionReceipt.Status.String()
+			changed = append(changed, ew.putOutgoingTx(outgoingTx)...)
+			// 执行失败也不会再上链
+			delete(ew.outgoingTxs.open, txid)
+		}
+	}
+
+	if irreversible {
+		// 交易只能打包进块时间不晚于过期时间的块，不可逆块已扫过过期时间，交易不会再上链
+		blockTime := blockResp.Timestamp.Unix()
+		for txid, outgoingTx := range ew.outgoingTxs.open {
+			if outgoingTx.Expiration >= blockTime {
+				continue
+			}
+			delete(ew.outgoingTxs.open, txid)
+			// 打包进可逆块后被分叉撤回、广播失败的交易，同样过期。 广播失败的保留Error
+			outgoingTx.Status = OutgoingTxExpired
+			changed = append(changed, ew.putOutgoingTx(outgoingTx)...)
+		}
+	}
+	ew.sendOutgoingTxs(changed)
+	ew.outgoingTxs.lock.Unlock()
+}
+
+// 从leveldb 加载未结束的交易，调用前需要持有锁
+func (ew *EOSWatcherMain) loadOutgoingTxs() {
+	if ew.outgoingTxs.loaded {
+		return
+	}
+	ew.outgoingTxs.loaded = true
+	ew.outgoingTxs.open = make(map[string]*OutgoingTx)
+
+	iter := ew.DB.NewIterator(util.BytesPrefix([]byte(outgoingTxKeyPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var outgoingTx OutgoingTx
+		if err := json.Unmarshal(iter.Value(), &outgoingTx); err != nil {
+			log.Error("unmarshal eos outgoing tx err", "key", string(iter.Key()), "info", err)
+			continue
+		}
+		if !outgoingTx.Final() {
+			ew.outgoingTxs.open[outgoingTx.TxID] = &outgoingTx
+		}
+	}
+	if err := iter.Error(); err != nil {
+		log.Error("read eos leveldb outgoing tx err", "info", err)
+	}
+}
+
+// 写入交易的新状态，返回要发出的事件（记录的副本）
+func (ew *EOSWatcherMain) putOutgoingTx(outgoingTx *OutgoingTx) []*OutgoingTx {
+	outgoingTx.Time = time.Now().Unix()
+	data, err := json.Marshal(outgoingTx)
+	if err != nil {
+		log.Error("marshal eos outgoing tx err", "info", err)
+		return nil
+	}
+	// 提现交易的状态，同步写入
+	if err := ew.DB.Put(outgoingTxKey(outgoingTx.TxID), data, &opt.WriteOptions{Sync: true}); err != nil {
+		log.Error("write eos leveldb outgoing tx err", "TxID", outgoingTx.TxID, "Status", outgoingTx.Status, "info", err)
+	}
+	log.Info("EOS outgoing tx", "TxID", outgoingTx.TxID, "Status", outgoingTx.Status, "BlockNum", outgoingTx.BlockNum)
+	event := *outgoingTx
+	return []*OutgoingTx{&event}
+}
+
+// 把事件发到OutgoingTxChan，调用前需要持有锁。 不阻塞扫块、发交易的协程：channel 满时事件排队，
+// 由发送协程按顺序发出，不丢弃
+func (ew *EOSWatcherMain) sendOutgoingTxs(outgoingTxs []*OutgoingTx) {
+	if ew.OutgoingTxChan == nil {
+		return
+	}
+	tracker := &ew.outgoingTxs
+	for _, outgoingTx := range outgoingTxs {
+		if !tracker.sending {
+			select {
+			case ew.OutgoingTxChan <- outgoingTx:
+				continue
+			default:
+			}
+			tracker.sending = true
+			go ew.drainOutgoingTxs()
+		}
+		tracker.queue = append(tracker.queue, outgoingTx)
+	}
+}
+
+// 发送排队的事件，队列为空时退出
+func (ew *EOSWatcherMain) drainOutgoingTxs() {
+	tracker := &ew.outgoingTxs
+	for {
+		tracker.lock.Lock()
+		if len(tracker.queue) == 0 {
+			tracker.sending = false
+			tracker.lock.Unlock()
+			return
+		}
+		outgoingTx := tracker.queue[0]
+		tracker.queue = tracker.queue[1:]
+		tracker.lock.Unlock()
+
+		ew.OutgoingTxChan <- outgoingTx
+	}
+}
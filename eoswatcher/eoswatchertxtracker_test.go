@@ -0,0 +1,151 @@
+package eoswatcher
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func newOutgoingTestTx(memo string, expiration time.Time) *eos.SignedTransaction {
+	tx := &eos.Transaction{Actions: []*eos.Action{{Account: eos.AN("eosio.token"), Name: eos.ActN(memo)}}}
+	tx.Expiration = eos.JSONTime{Time: expiration}
+	return &eos.SignedTransaction{Transaction: tx}
+}
+
+func newOutgoingTestBlock(blockNum uint32, blockTime time.Time, status eos.TransactionStatus, txids ...string) *eos.BlockResp {
+	blockResp := &eos.BlockResp{BlockNum: blockNum, ID: eos.SHA256Bytes{byte(blockNum)}}
+	blockResp.Timestamp = eos.BlockTimestamp{Time: blockTime}
+	for _, txid := range txids {
+		id, _ := hex.DecodeString(txid)
+		receipt := eos.TransactionReceipt{Transaction: eos.TransactionWithID{ID: id}}
+		receipt.Status = status
+		blockResp.SignedBlock.Transactions = append(blockResp.SignedBlock.Transactions, receipt)
+	}
+	return blockResp
+}
+
+func TestOutgoingTxLifecycle(t *testing.T) {
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+	outgoingTxChan := make(chan *OutgoingTx, 20)
+	ew := &EOSWatcherMain{DB: db, OutgoingTxChan: outgoingTxChan}
+
+	now := time.Unix(1540000000, 0)
+	included, err := ew.TrackOutgoingTx(newOutgoingTestTx("included", now.Add(time.Minute)))
+	assert.Nil(t, err)
+	expired, err := ew.TrackOutgoingTx(newOutgoingTestTx("expired", now.Add(time.Minute)))
+	assert.Nil(t, err)
+	failed, err := ew.TrackOutgoingTx(newOutgoingTestTx("failed", now.Add(time.Minute)))
+	assert.Nil(t, err)
+	// 重复跟踪不重复记录
+	_, err = ew.TrackOutgoingTx(newOutgoingTestTx("included", now.Add(time.Minute)))
+	assert.Nil(t, err)
+	assert.Len(t, outgoingTxChan, 3)
+
+	ew.failOutgoingTx(failed, errors.New("push transaction error."))
+	ew.observeOutgoingTxs(newOutgoingTestBlock(10, now, eos.TransactionStatusExecuted, included), false)
+
+	// 重启后从leveldb 恢复未结束的交易
+	ew = &EOSWatcherMain{DB: db, OutgoingTxChan: outgoingTxChan}
+	ew.observeOutgoingTxs(newOutgoingTestBlock(10, now, eos.TransactionStatusExecuted, included), true)
+	ew.observeOutgoingTxs(newOutgoingTestBlock(11, now.Add(2 * time.Minute), eos.TransactionStatusExecuted), true)
+
+	var statuses []OutgoingTxStatus
+	for len(outgoingTxChan) > 0 {
+		outgoingTx := <-outgoingTxChan
+		if outgoingTx.TxID == included {
+			statuses = append(statuses, outgoingTx.Status)
+		}
+	}
+	assert.Equal(t, []OutgoingTxStatus{OutgoingTxPending, OutgoingTxIncluded, OutgoingTxIrreversible}, statuses)
+
+	outgoingTx, err := ew.GetOutgoingTx(included)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(10), outgoingTx.BlockNum)
+
+	outgoingTx, err = ew.GetOutgoingTx(expired)
+	assert.Nil(t, err)
+	assert.Equal(t, OutgoingTxExpired, outgoingTx.Status)
+
+	// 广播失败的交易过期后不再跟踪，记为过期
+	outgoingTx, err = ew.GetOutgoingTx(failed)
+	assert.Nil(t, err)
+	assert.Equal(t, OutgoingTxExpired, outgoingTx.Status)
+	assert.Len(t, ew.outgoingTxs.open, 0)
+}
+
+func TestOutgoingTxChanFull(t *testing.T) {
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+	// 没有读取方时不阻塞扫块、发交易，状态仍写入leveldb
+	outgoingTxChan := make(chan *OutgoingTx, 1)
+	ew := &EOSWatcherMain{DB: db, OutgoingTxChan: outgoingTxChan}
+
+	now := time.Unix(1540000000, 0)
+	var first, second string
+	done := make(chan struct{})
+	go func() {
+		first, _ = ew.TrackOutgoingTx(newOutgoingTestTx("first", now.Add(time.Minute)))
+		second, _ = ew.TrackOutgoingTx(newOutgoingTestTx("second", now.Add(time.Minute)))
+		ew.observeOutgoingTxs(newOutgoingTestBlock(10, now, eos.TransactionStatusExecuted, first, second), false)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("outgoing tx status blocked on a full OutgoingTxChan")
+	}
+
+	outgoingTx, err := ew.GetOutgoingTx(second)
+	assert.Nil(t, err)
+	assert.Equal(t, OutgoingTxIncluded, outgoingTx.Status)
+
+	// 排队的事件按顺序发出，不丢弃
+	var events []string
+	for len(events) < 4 {
+		select {
+		case outgoingTx := <-outgoingTxChan:
+			events = append(events, outgoingTx.TxID[:4] + ":" + outgoingTx.Status.String())
+		case <-time.After(time.Second):
+			t.Fatal("queued outgoing tx status not sent")
+		}
+	}
+	assert.Equal(t, []string{first[:4] + ":pending", second[:4] + ":pending", first[:4] + ":included", second[:4] + ":included"}, events)
+}
+
+func TestOutgoingTxFailedExpires(t *testing.T) {
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+	ew := &EOSWatcherMain{DB: db}
+
+	// 广播失败的交易过期后记为Expired，重启后不再加载
+	now := time.Unix(1540000000, 0)
+	failed, err := ew.TrackOutgoingTx(newOutgoingTestTx("failed", now.Add(time.Minute)))
+	assert.Nil(t, err)
+	ew.failOutgoingTx(failed, errors.New("push transaction error."))
+	ew.observeOutgoingTxs(newOutgoingTestBlock(11, now.Add(2 * time.Minute), eos.TransactionStatusExecuted), true)
+
+	outgoingTx, err := ew.GetOutgoingTx(failed)
+	assert.Nil(t, err)
+	assert.Equal(t, OutgoingTxExpired, outgoingTx.Status)
+	assert.Equal(t, "push transaction error.", outgoingTx.Error)
+
+	// 在不可逆块中执行失败的交易同样结束
+	hardFail, err := ew.TrackOutgoingTx(newOutgoingTestTx("hardfail", now.Add(10 * time.Minute)))
+	assert.Nil(t, err)
+	ew.observeOutgoingTxs(newOutgoingTestBlock(12, now.Add(3 * time.Minute), eos.TransactionStatusHardFail, hardFail), true)
+	outgoingTx, err = ew.GetOutgoingTx(hardFail)
+	assert.Nil(t, err)
+	assert.Equal(t, OutgoingTxFailed, outgoingTx.Status)
+	assert.True(t, outgoingTx.Final())
+
+	ew = &EOSWatcherMain{DB: db}
+	ew.outgoingTxs.lock.Lock()
+	ew.loadOutgoingTxs()
+	assert.Len(t, ew.outgoingTxs.open, 0)
+	ew.outgoingTxs.lock.Unlock()
+}
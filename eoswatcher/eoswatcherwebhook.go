@@ -0,0 +1,433 @@
+package eoswatcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leveldb 中webhook 重试队列的key 前缀，完整key 为 前缀 + 序号（20 位，补0），按入队顺序排列
+const webhookKeyPrefix = "Webhook/"
+
+const (
+	// 请求头：body 的HMAC-SHA256 签名（"sha256=" + hex），密钥为WebhookEndpoint.Secret，见VerifyWebhookSignature
+	WebhookSignatureHeader = "X-Eoswatcher-Signature"
+	// 请求头：事件唯一标识（txid:actionIndex），重试、重新扫块时不变，接收方据此去重
+	WebhookIdempotencyHeader = "Idempotency-Key"
+)
+
+const (
+	webhookDefaultInitialBackoff = time.Second
+	webhookDefaultMaxBackoff = 10 * time.Minute
+	webhookRequestTimeout = 10 * time.Second
+	// 队列为空时的检查间隔
+	webhookIdleInterval = time.Minute
+)
+
+// webhook 地址及过滤条件。 过滤条件为空时不过滤，不为空时事件需匹配其中之一
+type WebhookEndpoint struct {
+	// 唯一名称，用于重试队列和日志
+	Name				string				`mapstructure:"name"`
+	URL					string				`mapstructure:"url"`
+	// 签名密钥
+	Secret				string				`mapstructure:"secret"`
+
+	// 合约名
+	Contracts			[]string			`mapstructure:"contracts"`
+	// 货币名称
+	Symbols				[]string			`mapstructure:"symbols"`
+	// 事件类型，见EventType*
+	EventTypes			[]uint32			`mapstructure:"event_types"`
+}
+
+// 读取webhook 配置（[[key]] 数组）
+func LoadWebhookEndpoints(key string) ([]*WebhookEndpoint, error) {
+	var endpoints []*WebhookEndpoint
+	if err := viper.UnmarshalKey(key, &endpoints); err != nil {
+		return nil, err
+	}
+	if err := checkWebhookEndpoints(endpoints); err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+// 检查webhook 配置：名称、地址不能为空，名称不能重复
+func checkWebhookEndpoints(endpoints []*WebhookEndpoint) error {
+	seen := make(map[string]bool)
+	for _, endpoint := range endpoints {
+		if endpoint.Name == "" || endpoint.URL == "" {
+			return errors.New("Webhook endpoint needs name and url.")
+		}
+		if seen[endpoint.Name] {
+			return errors.New("Webhook endpoint '" + endpoint.Name + "' is duplicated.")
+		}
+		seen[endpoint.Name] = true
+	}
+	return nil
+}
+
+// 事件是否符合过滤条件，合约名、货币名称不区分大小写
+func (endpoint *WebhookEndpoint) Match(event *EOSPushEvent) bool {
+	if len(endpoint.Contracts) > 0 && !containsString(endpoint.Contracts, string(event.Account)) {
+		return false
+	}
+	if len(endpoint.Symbols) > 0 && !containsString(endpoint.Symbols, event.Symbol) {
+		return false
+	}
+	if len(endpoint.EventTypes) > 0 {
+		for _, eventType := range endpoint.EventTypes {
+			if eventType == event.EventType {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// 事件的json 表示：POST 给webhook，查询API 也返回这个格式
+type WebhookEvent struct {
+	IdempotencyKey		string				`json:"idempotency_key"`
+	TxID				string				`json:"tx_id"`
+	BlockNum			uint32				`json:"block_num"`
+	Index				int					`json:"index"`
+	ActionIndex			int					`json:"action_index"`
+	TraceDepth			int					`json:"trace_depth"`
+
+	Account				string				`json:"account"`
+	Name				string				`json:"name"`
+	From				string				`json:"from"`
+	To					string				`json:"to"`
+	Memo				string				`json:"memo"`
+	Amount				uint64				`json:"amount"`
+	Symbol				string				`json:"symbol"`
+	Precision			uint8				`json:"precision"`
+	// 如 "1.2345 EOS"
+	Quantity			string				`json:"quantity"`
+
+	// 见EventType*
+	EventType			uint32				`json:"event_type"`
+	Business			string				`json:"business"`
+	Proposal			string				`json:"proposal"`
+	WatchedAccount		string				`json:"watched_account"`
+	// 规范化后的memo 数据（GetData），memo 不符合格式时为空，原因见MemoError
+	Data				string				`json:"data"`
+	MemoError			string				`json:"memo_error,omitempty"`
+	// 交易的确认信息，见EOSPushEvent.Confirmation
+	Confirmation		*TxConfirmation		`json:"confirmation,omitempty"`
+}
+
+func NewWebhookEvent(event *EOSPushEvent) *WebhookEvent {
+	webhookEvent := &WebhookEvent{
+		IdempotencyKey:		event.GetEventKey(),
+		TxID:				event.GetTxID(),
+		BlockNum:			event.BlockNum,
+		Index:				event.Index,
+		ActionIndex:		event.ActionIndex,
+		TraceDepth:			event.TraceDepth,
+		Account:			string(event.Account),
+		Name:				string(event.Name),
+		From:				event.GetFrom(),
+		To:					event.GetTo(),
+		Memo:				event.Memo,
+		Amount:				event.Amount,
+		Symbol:				event.Symbol,
+		Precision:			event.Precision,
+		Quantity:			formatAsset(int64(event.Amount), event.Precision, event.Symbol),
+		EventType:			event.EventType,
+		Business:			event.Business,
+		Proposal:			event.Proposal,
+		WatchedAccount:		event.GetWatchedAccount(),
+		Confirmation:		event.Confirmation,
+	}
+	if data, err := event.GetData(); err != nil {
+		webhookEvent.MemoError = err.Error()
+	} else {
+		webhookEvent.Data = string(data)
+	}
+	return webhookEvent
+}
+
+// body 的签名，"sha256=" + hex
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// 接收方校验WebhookSignatureHeader
+func VerifyWebhookSignature(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhook(secret, body)), []byte(signature))
+}
+
+// 重试队列中的一次投递
+type WebhookDelivery struct {
+	Endpoint			string				`json:"endpoint"`
+	IdempotencyKey		string				`json:"idempotency_key"`
+	Payload				json.RawMessage		`json:"payload"`
+	// 已失败的次数
+	Attempts			int					`json:"attempts"`
+	NextAttempt			time.Time			`json:"next_attempt"`
+	LastError			string				`json:"last_error,omitempty"`
+}
+
+// webhook 投递：事件先写入leveldb 重试队列，再由发送协程按入队顺序POST，失败后按指数退避重试，直到成功。
+// 同一地址的事件按顺序投递，前面的事件失败时后面的等待；不同地址互不影响。 重启后继续投递队列中的事件
+type WebhookSink struct {
+	// 第一次重试的间隔，之后每次翻倍，最大MaxBackoff。 为0 时使用默认值
+	InitialBackoff		time.Duration
+	MaxBackoff			time.Duration
+
+	db					*leveldb.DB
+	client				*http.Client
+	lock				sync.Mutex
+	endpoints			map[string]*WebhookEndpoint
+	// 最后入队的序号
+	seq					uint64
+	// 有新事件入队时唤醒发送协程
+	wake				chan struct{}
+	running				sync.WaitGroup
+}
+
+func NewWebhookSink(db *leveldb.DB, endpoints []*WebhookEndpoint) (*WebhookSink, error) {
+	if err := checkWebhookEndpoints(endpoints); err != nil {
+		return nil, err
+	}
+	sink := &WebhookSink{
+		db:				db,
+		client:			&http.Client{Timeout: webhookRequestTimeout},
+		endpoints:		make(map[string]*WebhookEndpoint),
+		wake:			make(chan struct{}, 1),
+	}
+	for _, endpoint := range endpoints {
+		sink.endpoints[endpoint.Name] = endpoint
+	}
+
+	iter := db.NewIterator(util.BytesPrefix([]byte(webhookKeyPrefix)), nil)
+	defer iter.Release()
+	if iter.Last() {
+		fmt.Sscanf(strings.TrimPrefix(string(iter.Key()), webhookKeyPrefix), "%d", &sink.seq)
+	}
+	return sink, iter.Error()
+}
+
+func webhookKey(seq uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", webhookKeyPrefix, seq))
+}
+
+// 对每个匹配的地址，把事件写入重试队列（同步写盘），唤醒发送协程
+func (sink *WebhookSink) Push(event *EOSPushEvent) error {
+	payload, err := json.Marshal(NewWebhookEvent(event))
+	if err != nil {
+		return err
+	}
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	batch := new(leveldb.Batch)
+	seq := sink.seq
+	for _, endpoint := range sink.endpoints {
+		if !endpoint.Match(event) {
+			continue
+		}
+		data, err := json.Marshal(&WebhookDelivery{
+			Endpoint:			endpoint.Name,
+			IdempotencyKey:		event.GetEventKey(),
+			Payload:			payload,
+		})
+		if err != nil {
+			return err
+		}
+		seq++
+		batch.Put(webhookKey(seq), data)
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	if err := sink.db.Write(batch, &opt.WriteOptions{Sync: true}); err != nil {
+		return err
+	}
+	sink.seq = seq
+
+	select {
+	case sink.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// 重试队列中还没投递成功的事件，按入队顺序
+func (sink *WebhookSink) Pending() ([]*WebhookDelivery, error) {
+	iter := sink.db.NewIterator(util.BytesPrefix([]byte(webhookKeyPrefix)), nil)
+	defer iter.Release()
+
+	var deliveries []*WebhookDelivery
+	for iter.Next() {
+		var delivery WebhookDelivery
+		if err := json.Unmarshal(iter.Value(), &delivery); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	return deliveries, iter.Error()
+}
+
+// 启动发送协程，ctx 结束后退出，见Stop
+func (sink *WebhookSink) Start(ctx context.Context) {
+	sink.running.Add(1)
+	go func() {
+		defer sink.running.Done()
+		for {
+			wait := webhookIdleInterval
+			if next, ok := sink.deliverDue(ctx); ok {
+				wait = time.Until(next)
+			}
+			select {
+			case <-sink.wake:
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// 等待发送协程退出（ctx 已结束）。 leveldb 关闭前调用
+func (sink *WebhookSink) Stop() {
+	sink.running.Wait()
+}
+
+// 按入队顺序投递到期的事件，返回最早的下次重试时间，队列为空时返回false
+func (sink *WebhookSink) deliverDue(ctx context.Context) (time.Time, bool) {
+	iter := sink.db.NewIterator(util.BytesPrefix([]byte(webhookKeyPrefix)), nil)
+	defer iter.Release()
+
+	var next time.Time
+	pending := false
+	// 本轮已有事件没投递成功的地址，后面的事件等待
+	blocked := make(map[string]bool)
+	for iter.Next() && ctx.Err() == nil {
+		key := append([]byte{}, iter.Key()...)
+		var delivery WebhookDelivery
+		if err := json.Unmarshal(iter.Value(), &delivery); err != nil {
+			log.Error("decode eos webhook delivery err", "key", string(key), "info", err)
+			sink.db.Delete(key, nil)
+			continue
+		}
+		sink.lock.Lock()
+		endpoint, ok := sink.endpoints[delivery.Endpoint]
+		sink.lock.Unlock()
+		if !ok {
+			log.Error("EOS webhook endpoint removed, drop delivery", "Endpoint", delivery.Endpoint, "IdempotencyKey", delivery.IdempotencyKey)
+			sink.db.Delete(key, nil)
+			continue
+		}
+
+		if blocked[delivery.Endpoint] {
+			// 等待前面的事件，下次重试时间由前面的事件决定（这里的可能从没尝试过，是零值）
+			pending = true
+			continue
+		}
+		if time.Now().Before(delivery.NextAttempt) {
+			blocked[delivery.Endpoint] = true
+			if next.IsZero() || delivery.NextAttempt.Before(next) {
+				next = delivery.NextAttempt
+			}
+			pending = true
+			continue
+		}
+
+		if err := sink.post(endpoint, &delivery); err != nil {
+			delivery.Attempts++
+			delivery.NextAttempt = time.Now().Add(sink.backoff(delivery.Attempts))
+			delivery.LastError = err.Error()
+			log.Error("EOS webhook delivery err", "Endpoint", delivery.Endpoint, "IdempotencyKey", delivery.IdempotencyKey,
+				"Attempts", delivery.Attempts, "NextAttempt", delivery.NextAttempt, "info", err)
+			if data, err := json.Marshal(&delivery); err == nil {
+				if err := sink.db.Put(key, data, nil); err != nil {
+					log.Error("write eos leveldb webhook delivery err", "key", string(key), "info", err)
+				}
+			}
+			blocked[delivery.Endpoint] = true
+			if next.IsZero() || delivery.NextAttempt.Before(next) {
+				next = delivery.NextAttempt
+			}
+			pending = true
+			continue
+		}
+		if err := sink.db.Delete(key, &opt.WriteOptions{Sync: true}); err != nil {
+			log.Error("delete eos leveldb webhook delivery err", "key", string(key), "info", err)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		log.Error("read eos leveldb webhook queue err", "info", err)
+	}
+	return next, pending
+}
+
+func (sink *WebhookSink) backoff(attempts int) time.Duration {
+	initial, max := sink.InitialBackoff, sink.MaxBackoff
+	if initial <= 0 {
+		initial = webhookDefaultInitialBackoff
+	}
+	if max <= 0 {
+		max = webhookDefaultMaxBackoff
+	}
+	backoff := initial
+	for i := 1; i < attempts && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// 返回非2xx 时视为失败
+func (sink *WebhookSink) post(endpoint *WebhookEndpoint, delivery *WebhookDelivery) error {
+	req, err := http.NewRequest("POST", endpoint.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(endpoint.Secret, delivery.Payload))
+	req.Header.Set(WebhookIdempotencyHeader, delivery.IdempotencyKey)
+
+	resp, err := sink.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("Webhook status code %d.", resp.StatusCode))
+	}
+	return nil
+}
+
+// 把扫到的事件同时投递到webhook，事件先发给eventChan，再写入重试队列。 需在StartWatch 之前调用，使用ew.DB 保存重试队列
+func (ew *EOSWatcherMain) EnableWebhooks(endpoints []*WebhookEndpoint) error {
+	sink, err := NewWebhookSink(ew.DB, endpoints)
+	if err != nil {
+		return err
+	}
+	ew.Webhooks = sink
+	return nil
+}
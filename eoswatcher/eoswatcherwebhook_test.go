@@ -0,0 +1,141 @@
+package eoswatcher
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookEndpointMatch(t *testing.T) {
+	event := &EOSPushEvent{Account: eos.AN("eosio.token"), Symbol: "EOS", EventType: EventTypeDeposit}
+	assert.True(t, (&WebhookEndpoint{}).Match(event))
+	assert.True(t, (&WebhookEndpoint{Contracts: []string{"eosio.token"}, Symbols: []string{"eos"}}).Match(event))
+	assert.False(t, (&WebhookEndpoint{Symbols: []string{"WBTC"}}).Match(event))
+	assert.True(t, (&WebhookEndpoint{EventTypes: []uint32{EventTypeDeposit, EventTypeRefund}}).Match(event))
+	assert.False(t, (&WebhookEndpoint{EventTypes: []uint32{EventTypeWithdrawalConfirmed}}).Match(event))
+}
+
+func TestWebhookSinkRetry(t *testing.T) {
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+
+	// 第一次请求失败，之后成功
+	var lock sync.Mutex
+	var received []*WebhookEvent
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.True(t, VerifyWebhookSignature("secret", body, r.Header.Get(WebhookSignatureHeader)))
+		var event WebhookEvent
+		assert.Nil(t, json.Unmarshal(body, &event))
+		assert.Equal(t, event.IdempotencyKey, r.Header.Get(WebhookIdempotencyHeader))
+		received = append(received, &event)
+	}))
+	defer server.Close()
+
+	sink, err := NewWebhookSink(db, []*WebhookEndpoint{
+		{Name: "deposits", URL: server.URL, Secret: "secret", EventTypes: []uint32{EventTypeDeposit}},
+	})
+	assert.Nil(t, err)
+	sink.InitialBackoff = 20 * time.Millisecond
+
+	deposit := &EOSPushEvent{TxID: eos.SHA256Bytes{0x01}, Account: eos.AN("eosio.token"), From: eos.AN("alice1111111"), To: eos.AN("gateway11111"),
+		Memo: "memo", Amount: 12345, Symbol: "EOS", Precision: 4, EventType: EventTypeDeposit}
+	second := *deposit
+	second.ActionIndex = 1
+	assert.Nil(t, sink.Push(deposit))
+	assert.Nil(t, sink.Push(&second))
+	// 不匹配过滤条件，不入队
+	assert.Nil(t, sink.Push(&EOSPushEvent{TxID: eos.SHA256Bytes{0x02}, EventType: EventTypeRefund}))
+	pending, err := sink.Pending()
+	assert.Nil(t, err)
+	assert.Len(t, pending, 2)
+
+	// 重启后从上次的序号继续入队
+	restarted, err := NewWebhookSink(db, []*WebhookEndpoint{{Name: "deposits", URL: server.URL, Secret: "secret"}})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), restarted.seq)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sink.Start(ctx)
+	for i := 0; i < 100; i++ {
+		if pending, _ := sink.Pending(); len(pending) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	sink.Stop()
+
+	pending, _ = sink.Pending()
+	assert.Len(t, pending, 0)
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, 3, requests)
+	// 失败后按入队顺序重新投递
+	assert.Len(t, received, 2)
+	assert.Equal(t, "01:0", received[0].IdempotencyKey)
+	assert.Equal(t, "01:1", received[1].IdempotencyKey)
+	assert.Equal(t, "1.2345 EOS", received[0].Quantity)
+	assert.Equal(t, "gateway11111", received[0].To)
+
+	assert.Equal(t, 20 * time.Millisecond, sink.backoff(1))
+	assert.Equal(t, 80 * time.Millisecond, sink.backoff(3))
+	assert.Equal(t, webhookDefaultMaxBackoff, sink.backoff(100))
+}
+
+func TestWebhookSinkEndpointDown(t *testing.T) {
+	db, closeDB := newTestDB(t)
+	defer closeDB()
+
+	// 地址一直不可用，只有队首的事件按退避时间重试，后面的事件等待
+	var lock sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	sink, err := NewWebhookSink(db, []*WebhookEndpoint{{Name: "deposits", URL: server.URL, Secret: "secret"}})
+	assert.Nil(t, err)
+	sink.InitialBackoff = 200 * time.Millisecond
+	sink.MaxBackoff = 200 * time.Millisecond
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, sink.Push(&EOSPushEvent{TxID: eos.SHA256Bytes{0x01}, ActionIndex: i, EventType: EventTypeDeposit}))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sink.Start(ctx)
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+	sink.Stop()
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.True(t, requests >= 2 && requests <= 3, "requests %d", requests)
+	pending, _ := sink.Pending()
+	assert.Len(t, pending, 3)
+	assert.Equal(t, 0, pending[1].Attempts)
+	// 下次重试时间取队首事件的，不能是等待中事件的零值（否则发送协程空转）
+	next, ok := sink.deliverDue(context.Background())
+	assert.True(t, ok)
+	assert.True(t, next.After(time.Now()))
+}
@@ -1,12 +0,0 @@
-package eoswatcher
-
-func init() {
-	//eos.RegisterAction(eos.AN("multisigpkm2"), eos.ActN("destroytoken"), DestroyToken{})
-	//eos.RegisterAction(eos.AN("multisigpkm2"), eos.ActN("createtoken"), CreateToken{})
-	//
-	//eos.RegisterAction(eos.AN("dgateway1111"), eos.ActN("destroytoken"), DestroyToken{})
-	//eos.RegisterAction(eos.AN("dgateway1111"), eos.ActN("createtoken"), CreateToken{})
-	//
-	//eos.RegisterAction(eos.AN("ringleaieos"), eos.ActN("destroytoken"), DestroyToken{})
-	//eos.RegisterAction(eos.AN("ringleaieos"), eos.ActN("createtoken"), CreateToken{})
-}
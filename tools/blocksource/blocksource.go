@@ -0,0 +1,281 @@
+package blocksource
+
+import (
+	"bytes"
+	"encoding/json"
+	"eosc/tools/metrics"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//块来源：返回get_info、get_block 的原始json，由扫块程序按各自的结构解析（eoswatcher 为eos.BlockResp，eosmanager 为model.BlockResp）。
+//get_transaction（history 插件，含执行轨迹）、get_abi 用于解析inline 转账、按ABI 解析action，回放时也不需要节点
+type BlockSource interface {
+	GetInfo() ([]byte, error)
+	GetBlock(blockNum uint32) ([]byte, error)
+	GetTransaction(txid string) ([]byte, error)
+	GetABI(account string) ([]byte, error)
+}
+
+//块不存在（节点返回404，或回放目录中没有该块）
+var ErrNotFound = errors.New("resource not found")
+
+//通过节点的chain、history API 获取
+type HTTPSource struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+//client 为nil 时使用http.DefaultClient
+func NewHTTPSource(baseURL string, client *http.Client) *HTTPSource {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPSource{BaseURL: baseURL, Client: client}
+}
+
+func (source *HTTPSource) GetInfo() ([]byte, error) {
+	return source.call("chain", "get_info", nil)
+}
+
+func (source *HTTPSource) GetBlock(blockNum uint32) ([]byte, error) {
+	return source.call("chain", "get_block", map[string]interface{}{"block_num_or_id": blockNum})
+}
+
+func (source *HTTPSource) GetTransaction(txid string) ([]byte, error) {
+	return source.call("history", "get_transaction", map[string]interface{}{"id": txid})
+}
+
+func (source *HTTPSource) GetABI(account string) ([]byte, error) {
+	return source.call("chain", "get_abi", map[string]interface{}{"account_name": account})
+}
+
+func (source *HTTPSource) call(api, endpoint string, body interface{}) (data []byte, err error) {
+	start := time.Now()
+	defer func() {
+		metrics.ObserveRPC(source.BaseURL, endpoint, time.Since(start), err)
+	}()
+
+	var reqBody []byte
+	if body != nil {
+		if reqBody, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	targetURL := fmt.Sprintf("%s/v1/%s/%s", source.BaseURL, api, endpoint)
+	resp, err := source.Client.Post(targetURL, "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", targetURL, err)
+	}
+	defer resp.Body.Close()
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Copy: %s", err)
+	}
+	if resp.StatusCode == 404 {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s: status code=%d, body=%s", targetURL, resp.StatusCode, string(data))
+	}
+	return data, nil
+}
+
+//回放目录中录制的json（见Record），用于离线测试：
+//  get_info.json
+//  get_block_<块高>.json
+//  get_transaction_<交易ID>.json
+//  get_abi_<账户>.json
+type FileSource struct {
+	Dir string
+}
+
+func NewFileSource(dir string) *FileSource {
+	return &FileSource{Dir: dir}
+}
+
+func (source *FileSource) GetInfo() ([]byte, error) {
+	return source.read(infoFile)
+}
+
+func (source *FileSource) GetBlock(blockNum uint32) ([]byte, error) {
+	return source.read(blockFile(blockNum))
+}
+
+func (source *FileSource) GetTransaction(txid string) ([]byte, error) {
+	return source.read(transactionFile(txid))
+}
+
+func (source *FileSource) GetABI(account string) ([]byte, error) {
+	return source.read(abiFile(account))
+}
+
+func (source *FileSource) read(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(source.Dir, name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+const infoFile = "get_info.json"
+
+func blockFile(blockNum uint32) string {
+	return fmt.Sprintf("get_block_%d.json", blockNum)
+}
+
+func transactionFile(txid string) string {
+	return fmt.Sprintf("get_transaction_%s.json", txid)
+}
+
+func abiFile(account string) string {
+	return fmt.Sprintf("get_abi_%s.json", account)
+}
+
+//从source 录制[from, to) 的块到dir，供FileSource 回放。
+//get_info 中的最新块、不可逆块高改为to，回放时扫块程序正好扫到to-1 为止。
+//withTransactions 为true 时，同时录制块中每笔交易的get_transaction（需要history 插件），
+//及交易中出现的合约的get_abi，eoswatcher 回放时解析inline 转账、按ABI 解析action 不需要节点
+func Record(source BlockSource, dir string, from, to uint32, withTransactions bool) error {
+	if from >= to {
+		return errors.New("empty block range")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := source.GetInfo()
+	if err != nil {
+		return err
+	}
+	var info map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&info); err != nil {
+		return err
+	}
+	if number, ok := info["last_irreversible_block_num"].(json.Number); ok {
+		if lib, err := number.Int64(); err == nil && lib+1 < int64(to) {
+			return fmt.Errorf("block %d is not irreversible, last irreversible block is %d", to-1, lib)
+		}
+	}
+	info["head_block_num"] = to
+	info["last_irreversible_block_num"] = to
+	if data, err = json.Marshal(info); err != nil {
+		return err
+	}
+	if err := writeJSON(filepath.Join(dir, infoFile), data); err != nil {
+		return err
+	}
+
+	accounts := make(map[string]bool)
+	for blockNum := from; blockNum < to; blockNum++ {
+		data, err := source.GetBlock(blockNum)
+		if err != nil {
+			return fmt.Errorf("get block %d: %s", blockNum, err)
+		}
+		if err := writeJSON(filepath.Join(dir, blockFile(blockNum)), data); err != nil {
+			return fmt.Errorf("get block %d: %s", blockNum, err)
+		}
+		if !withTransactions {
+			continue
+		}
+
+		txids, err := blockTransactionIDs(data)
+		if err != nil {
+			return fmt.Errorf("get block %d: %s", blockNum, err)
+		}
+		for _, txid := range txids {
+			data, err := source.GetTransaction(txid)
+			if err != nil {
+				return fmt.Errorf("get transaction %s: %s", txid, err)
+			}
+			if err := writeJSON(filepath.Join(dir, transactionFile(txid)), data); err != nil {
+				return fmt.Errorf("get transaction %s: %s", txid, err)
+			}
+			if err := transactionAccounts(data, accounts); err != nil {
+				return fmt.Errorf("get transaction %s: %s", txid, err)
+			}
+		}
+	}
+
+	for account := range accounts {
+		data, err := source.GetABI(account)
+		if err != nil {
+			return fmt.Errorf("get abi %s: %s", account, err)
+		}
+		if err := writeJSON(filepath.Join(dir, abiFile(account)), data); err != nil {
+			return fmt.Errorf("get abi %s: %s", account, err)
+		}
+	}
+	return nil
+}
+
+//块中所有交易的ID。 trx 为交易ID（延迟交易等没有交易体的），或含id 的交易体
+func blockTransactionIDs(data []byte) ([]string, error) {
+	var block struct {
+		Transactions []struct {
+			Trx json.RawMessage `json:"trx"`
+		} `json:"transactions"`
+	}
+	if err := json.Unmarshal(data, &block); err != nil {
+		return nil, err
+	}
+	var txids []string
+	for _, receipt := range block.Transactions {
+		var txid string
+		if err := json.Unmarshal(receipt.Trx, &txid); err != nil {
+			var trx struct {
+				ID string `json:"id"`
+			}
+			if err := json.Unmarshal(receipt.Trx, &trx); err != nil {
+				return nil, err
+			}
+			txid = trx.ID
+		}
+		txids = append(txids, txid)
+	}
+	return txids, nil
+}
+
+//交易中出现的合约：交易体中的action、执行轨迹中的action（含inline）
+func transactionAccounts(data []byte, accounts map[string]bool) error {
+	type action struct {
+		Account string `json:"account"`
+	}
+	var transaction struct {
+		Trx struct {
+			Trx struct {
+				Actions []action `json:"actions"`
+			} `json:"trx"`
+		} `json:"trx"`
+		Traces []struct {
+			Act action `json:"act"`
+		} `json:"traces"`
+	}
+	if err := json.Unmarshal(data, &transaction); err != nil {
+		return err
+	}
+	for _, act := range transaction.Trx.Trx.Actions {
+		accounts[act.Account] = true
+	}
+	for _, trace := range transaction.Traces {
+		accounts[trace.Act.Account] = true
+	}
+	delete(accounts, "")
+	return nil
+}
+
+//缩进保存，方便在测试用例中查看、修改。 只调整格式，不改变数值（uint64 等大整数不经过float64）
+func writeJSON(name string, data []byte) error {
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, data, "", "  "); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, indented.Bytes(), 0644)
+}
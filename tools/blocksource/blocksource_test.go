@@ -0,0 +1,95 @@
+package blocksource
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//模拟节点：get_info 返回不可逆块高lib，get_block 返回只有块高的块；
+//块100 有一笔延迟交易（只有交易ID），执行时inline 调用eosio.token
+func newTestNode(lib uint32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/history/get_transaction":
+			fmt.Fprint(w, `{"id":"aa01","block_num":100,"traces":[{"act":{"account":"exchange1111"}},{"act":{"account":"eosio.token"}}]}`)
+		case "/v1/chain/get_abi":
+			var body struct {
+				AccountName string `json:"account_name"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			fmt.Fprintf(w, `{"account_name":"%s","abi":{"version":"eosio::abi/1.0"}}`, body.AccountName)
+		case "/v1/chain/get_info":
+			fmt.Fprintf(w, `{"head_block_num":%d,"last_irreversible_block_num":%d,"chain_id":"cf057bbfb72640471fd910bcb67639c22df9f92470936cddc1ade0e2f2e7dc4f"}`, lib+10, lib)
+		case "/v1/chain/get_block":
+			var body struct {
+				BlockNumOrID uint32 `json:"block_num_or_id"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.BlockNumOrID > lib+10 {
+				http.NotFound(w, r)
+				return
+			}
+			if body.BlockNumOrID == 100 {
+				fmt.Fprint(w, `{"block_num":100,"ref_block_prefix":18446744073709551615,"transactions":[{"status":"executed","trx":"aa01"}]}`)
+				return
+			}
+			fmt.Fprintf(w, `{"block_num":%d,"ref_block_prefix":18446744073709551615}`, body.BlockNumOrID)
+		}
+	}))
+}
+
+func TestRecordReplay(t *testing.T) {
+	node := newTestNode(100)
+	defer node.Close()
+	source := NewHTTPSource(node.URL, nil)
+
+	_, err := source.GetBlock(200)
+	assert.Equal(t, ErrNotFound, err)
+
+	dir, err := ioutil.TempDir("", "blocksource")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	//录制的块必须不可逆
+	assert.NotNil(t, Record(source, dir, 95, 103, true))
+	assert.Nil(t, Record(source, dir, 95, 101, true))
+
+	replay := NewFileSource(dir)
+	data, err := replay.GetInfo()
+	assert.Nil(t, err)
+	var info struct {
+		HeadBlockNum             uint32 `json:"head_block_num"`
+		LastIrreversibleBlockNum uint32 `json:"last_irreversible_block_num"`
+		ChainID                  string `json:"chain_id"`
+	}
+	assert.Nil(t, json.Unmarshal(data, &info))
+	assert.Equal(t, uint32(101), info.HeadBlockNum)
+	assert.Equal(t, uint32(101), info.LastIrreversibleBlockNum)
+	assert.Equal(t, "cf057bbfb72640471fd910bcb67639c22df9f92470936cddc1ade0e2f2e7dc4f", info.ChainID)
+
+	data, err = replay.GetBlock(100)
+	assert.Nil(t, err)
+	//大整数原样保存
+	assert.Contains(t, string(data), "18446744073709551615")
+	_, err = replay.GetBlock(101)
+	assert.Equal(t, ErrNotFound, err)
+
+	//块中交易的执行轨迹，及其中出现的合约的ABI
+	data, err = replay.GetTransaction("aa01")
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "exchange1111")
+	for _, account := range []string{"exchange1111", "eosio.token"} {
+		data, err = replay.GetABI(account)
+		assert.Nil(t, err)
+		assert.Contains(t, string(data), account)
+	}
+	_, err = replay.GetABI("eosio")
+	assert.Equal(t, ErrNotFound, err)
+}
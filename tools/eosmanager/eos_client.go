@@ -3,8 +3,9 @@ package eosmanager
 import (
 	"bytes"
 	"encoding/json"
+	"eosc/tools/blocksource"
+	"eosc/tools/metrics"
 	"eosc/tools/model"
-	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -20,28 +21,32 @@ type EosClient struct {
 	EosAPI     *eos.API
 	BaseURL    string
 	ChainID    []byte
+	//get_info、get_block 的来源，默认为BaseURL 节点，离线测试时为录制的文件（见blocksource.FileSource）
+	Source blocksource.BlockSource
 }
 
 func NewEosClient(baseURL string) *EosClient {
 	api := eos.New(baseURL)
-	newEosClient := &EosClient{
-		HttpClient: &http.Client{
-			Transport: &http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-				DialContext: (&net.Dialer{
-					Timeout:   30 * time.Second,
-					KeepAlive: 30 * time.Second,
-					DualStack: true,
-				}).DialContext,
-				MaxIdleConns:          100,
-				IdleConnTimeout:       90 * time.Second,
-				TLSHandshakeTimeout:   10 * time.Second,
-				ExpectContinueTimeout: 1 * time.Second,
-				DisableKeepAlives:     true, // default behavior, because of `nodeos`'s lack of support for Keep alives.
-			},
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+				DualStack: true,
+			}).DialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			DisableKeepAlives:     true, // default behavior, because of `nodeos`'s lack of support for Keep alives.
 		},
-		EosAPI:  api,
-		BaseURL: baseURL,
+	}
+	newEosClient := &EosClient{
+		HttpClient: httpClient,
+		EosAPI:     api,
+		BaseURL:    baseURL,
+		Source:     blocksource.NewHTTPSource(baseURL, httpClient),
 	}
 	return newEosClient
 }
@@ -55,7 +60,12 @@ func (ec *EosClient) SetChainID() {
 	ec.ChainID = resp.ChainID
 }
 
-func (ec *EosClient) call(baseAPI string, endpoint string, body interface{}, out interface{}) error {
+func (ec *EosClient) call(baseAPI string, endpoint string, body interface{}, out interface{}) (err error) {
+	start := time.Now()
+	defer func() {
+		metrics.ObserveRPC(ec.BaseURL, endpoint, time.Since(start), err)
+	}()
+
 	jsonBody, err := enc(body)
 	if err != nil {
 		return err
@@ -91,7 +101,7 @@ func (ec *EosClient) call(baseAPI string, endpoint string, body interface{}, out
 	return nil
 }
 
-var ErrNotFound = errors.New("resource not found")
+var ErrNotFound = blocksource.ErrNotFound
 
 func enc(v interface{}) (io.Reader, error) {
 	if v == nil {
@@ -106,7 +116,10 @@ func enc(v interface{}) (io.Reader, error) {
 }
 
 func (ec *EosClient) GetInfo() (out *eos.InfoResp, err error) {
-	err = ec.call("chain", "get_info", nil, &out)
+	data, err := ec.Source.GetInfo()
+	if err == nil {
+		err = json.Unmarshal(data, &out)
+	}
 	if err != nil {
 		log.Error("API_GETINFO", "error:", err)
 		return nil, err
@@ -149,12 +162,18 @@ func (ec *EosClient) GetTransaction(id string) (out interface{}, err error) {
 }
 
 func (ec *EosClient) GetTransactionFormat(id string) (out *eos.TransactionResp, err error) {
-	return ec.EosAPI.GetTransaction(id)
+	start := time.Now()
+	out, err = ec.EosAPI.GetTransaction(id)
+	metrics.ObserveRPC(ec.BaseURL, "get_transaction", time.Since(start), err)
+	return
 }
 
 func (ec *EosClient) GetBlockByID(query uint32) (resp *model.BlockResp, err error) {
 	out := model.BlockResp{}
-	err = ec.call("chain", "get_block", map[string]interface{}{"block_num_or_id": query}, &out)
+	data, err := ec.Source.GetBlock(query)
+	if err == nil {
+		err = json.Unmarshal(data, &out)
+	}
 	if err != nil {
 		log.Error("API_GETBLOCKBYID", "error:", err)
 		return nil, err
@@ -1,7 +1,10 @@
 package eosmanager
 
 import (
+	"eosc/tools/blocksource"
+	"eosc/tools/metrics"
 	"eosc/tools/model"
+	"net/http"
 	"sync"
 	"time"
 
@@ -33,6 +36,29 @@ func NewEosWatcher(baseURL string, scanHeight uint32, redisPool *redis.Pool) *Eo
 	return &ew
 }
 
+//从指定的块来源扫块，如回放blocksource.FileSource 录制的块做离线测试。 redisPool 为nil 时不保存扫块高度
+func NewEosWatcherWithSource(source blocksource.BlockSource, scanHeight uint32, redisPool *redis.Pool) *EosWatcher {
+	eosClient := NewEosClient("")
+	eosClient.Source = source
+	eosClient.SetChainID()
+	return &EosWatcher{
+		eosClient:             eosClient,
+		scanHeight:            scanHeight,
+		scanIrHeight:          scanHeight,
+		irreversibleBlockChan: make(chan *model.BlockResp, 250),
+		unConfirmBlockChan:    make(chan *model.BlockResp, 250),
+		redisPool:             redisPool,
+	}
+}
+
+//监控指标中的扫块程序名
+const metricsScanner = "eosmanager"
+
+//在addr 上提供prometheus 监控指标（/metrics），不调用则不监听
+func (ew *EosWatcher) ServeMetrics(addr string) (*http.Server, error) {
+	return metrics.StartServer(addr)
+}
+
 func (ew *EosWatcher) GetEosClient() *EosClient {
 	return ew.eosClient
 }
@@ -113,6 +139,7 @@ func (ew *EosWatcher) WatchAllBlock() {
 				}
 				blockHeight := infoResp.HeadBlockNum
 				lastIrreversibleBlockHeight := infoResp.LastIrreversibleBlockNum
+				metrics.SetChainHeights(metricsScanner, blockHeight, lastIrreversibleBlockHeight, ew.scanIrHeight)
 				if ew.scanIrHeight < lastIrreversibleBlockHeight {
 					for {
 						if ew.scanIrHeight == lastIrreversibleBlockHeight {
@@ -128,6 +155,7 @@ func (ew *EosWatcher) WatchAllBlock() {
 							break
 						}
 						ew.irreversibleBlockChan <- blockData
+						metrics.SetScanHeight(metricsScanner, lastIrreversibleBlockHeight, ew.scanIrHeight + 1)
 						//每1000个区块存一次区块高度到redis
 						if ew.scanIrHeight%1000 == 0 {
 							ew.UpdateScanHeightToRedis(ew.scanIrHeight)
@@ -180,15 +208,20 @@ func (ew *EosWatcher) WatchAllBlock() {
 }
 
 func (ew *EosWatcher) UpdateScanHeightToRedis(height uint32) bool {
+	if ew.redisPool == nil {
+		return false
+	}
 	conn := ew.redisPool.Get()
 	defer conn.Close()
 	conn.Do("SELECT", 6) //确定redis
 	n, err := conn.Do("SET", "eosscanirheight", int64(height))
 	if err != nil {
+		metrics.CheckpointWriteFailures.WithLabelValues(metricsScanner).Inc()
 		log.Error("Update ScanHeight To Redis", "err", err)
 		return false
 	}
 	if n != "OK" {
+		metrics.CheckpointWriteFailures.WithLabelValues(metricsScanner).Inc()
 		log.Error("Update ScanHeight To Redis", "resp n", n)
 		return false
 	}
@@ -199,6 +232,9 @@ func (ew *EosWatcher) UpdateScanHeightToRedis(height uint32) bool {
 }
 
 func (ew *EosWatcher) GetScanHeightFromRedis() uint32 {
+	if ew.redisPool == nil {
+		return 0
+	}
 	conn := ew.redisPool.Get()
 	defer conn.Close()
 	conn.Do("SELECT", 6)
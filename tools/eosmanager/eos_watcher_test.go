@@ -1,8 +1,11 @@
 package eosmanager
 
 import (
+	"eosc/tools/blocksource"
+	"eosc/tools/model"
 	"eosc/tools/utils"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -25,3 +28,30 @@ func TestGetScanHeightFromRedis(t *testing.T) {
 	result := client.GetScanHeightFromRedis()
 	assert.Equal(t, uint32(998), result)
 }
+
+//回放testdata/replay 中录制的块（blocksource.Record 的格式），不需要节点和redis
+func TestWatchAllBlockReplay(t *testing.T) {
+	watcher := NewEosWatcherWithSource(blocksource.NewFileSource("testdata/replay"), 1001, nil)
+	go watcher.WatchAllBlock()
+
+	var blocks []*model.BlockResp
+	for len(blocks) < 2 {
+		select {
+		case block := <-watcher.GetIrreversibleBlockChan():
+			blocks = append(blocks, block)
+		case <-time.After(5 * time.Second):
+			t.Fatal("replay timeout")
+		}
+	}
+
+	assert.Equal(t, uint32(1001), blocks[0].BlockNum)
+	assert.Len(t, blocks[0].Transactions, 1)
+	action := blocks[0].Transactions[0].Trx.TransactionInfo.Actions[0]
+	assert.Equal(t, "eosio.token", action.Account)
+	assert.Equal(t, "transfer", action.Name)
+	data := action.Data.(map[string]interface{})
+	assert.Equal(t, "gateway11111", data["to"])
+	assert.Equal(t, "1.2345 EOS", data["quantity"])
+	assert.Equal(t, uint32(1002), blocks[1].BlockNum)
+	assert.Len(t, blocks[1].Transactions, 0)
+}
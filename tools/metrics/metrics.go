@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "eos_scanner"
+
+//扫块程序的监控指标，scanner 标签区分扫块程序（eoswatcher、eosmanager）
+var (
+	ScanHeight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "scan_height",
+		Help:      "Next block height to be scanned and delivered.",
+	}, []string{"scanner"})
+
+	HeadBlockNum = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "head_block_num",
+		Help:      "Head block height reported by get_info.",
+	}, []string{"scanner"})
+
+	LastIrreversibleBlockNum = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_irreversible_block_num",
+		Help:      "Last irreversible block height reported by get_info.",
+	}, []string{"scanner"})
+
+	IrreversibleLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "irreversible_lag_blocks",
+		Help:      "Blocks between the last irreversible block and the scan height.",
+	}, []string{"scanner"})
+
+	RPCLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rpc_latency_seconds",
+		Help:      "Latency of nodeos RPC requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "method"})
+
+	RPCErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_errors_total",
+		Help:      "Failed nodeos RPC requests.",
+	}, []string{"endpoint", "method"})
+
+	EventsEmitted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_emitted_total",
+		Help:      "Events delivered to the gateway.",
+	}, []string{"scanner", "contract", "symbol"})
+
+	WorkerPoolSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "worker_pool_size",
+		Help:      "Maximum number of blocks fetched concurrently.",
+	}, []string{"scanner"})
+
+	WorkerPoolInUse = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "worker_pool_in_use",
+		Help:      "Blocks being fetched or waiting to be delivered.",
+	}, []string{"scanner"})
+
+	CheckpointWriteFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "checkpoint_write_failures_total",
+		Help:      "Failed writes of the scan height checkpoint.",
+	}, []string{"scanner"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		ScanHeight,
+		HeadBlockNum,
+		LastIrreversibleBlockNum,
+		IrreversibleLag,
+		RPCLatency,
+		RPCErrors,
+		EventsEmitted,
+		WorkerPoolSize,
+		WorkerPoolInUse,
+		CheckpointWriteFailures,
+	)
+}
+
+//更新链上块高，以及扫块进度落后不可逆块的块数
+func SetChainHeights(scanner string, headBlockNum, lastIrreversibleBlockNum, scanHeight uint32) {
+	HeadBlockNum.WithLabelValues(scanner).Set(float64(headBlockNum))
+	LastIrreversibleBlockNum.WithLabelValues(scanner).Set(float64(lastIrreversibleBlockNum))
+	SetScanHeight(scanner, lastIrreversibleBlockNum, scanHeight)
+}
+
+//更新扫块进度
+func SetScanHeight(scanner string, lastIrreversibleBlockNum, scanHeight uint32) {
+	ScanHeight.WithLabelValues(scanner).Set(float64(scanHeight))
+	var lag float64
+	if lastIrreversibleBlockNum > scanHeight {
+		lag = float64(lastIrreversibleBlockNum - scanHeight)
+	}
+	IrreversibleLag.WithLabelValues(scanner).Set(lag)
+}
+
+//记录一次rpc 请求的耗时和结果
+func ObserveRPC(endpoint, method string, latency time.Duration, err error) {
+	RPCLatency.WithLabelValues(endpoint, method).Observe(latency.Seconds())
+	if err != nil {
+		RPCErrors.WithLabelValues(endpoint, method).Inc()
+	}
+}
+
+//监听addr，在 /metrics 上提供监控指标。 地址被占用等错误直接返回，之后的错误只记录日志
+func StartServer(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error("metrics server stopped", "addr", addr, "err", err)
+		}
+	}()
+	return server, nil
+}
@@ -0,0 +1,88 @@
+package multisig
+
+import (
+	"encoding/hex"
+	"eosc/tools/utils"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/eoscanada/eos-go/token"
+	"github.com/spf13/viper"
+)
+
+var chainID struct {
+	lock sync.Mutex
+	pin  *utils.ChainIDPin
+}
+
+//签名用的链ID，第一次使用时按配置创建：EOS.offline 为true 时直接使用EOS.chain_id，不请求节点；
+//否则向EOS.base_url 请求一次并缓存，配置了EOS.chain_id 时必须一致，不一致时之后的签名全部失败
+func ChainID() (eos.SHA256Bytes, error) {
+	chainID.lock.Lock()
+	if chainID.pin == nil {
+		var pin *utils.ChainIDPin
+		var err error
+		if viper.GetBool("EOS.offline") {
+			pin, err = utils.NewOfflineChainIDPin(viper.GetString("EOS.chain_id"))
+		} else {
+			pin, err = utils.NewChainIDPin(viper.GetString("EOS.chain_id"), fetchChainID)
+		}
+		if err != nil {
+			chainID.lock.Unlock()
+			return nil, err
+		}
+		chainID.pin = pin
+	}
+	pin := chainID.pin
+	chainID.lock.Unlock()
+	return pin.ChainID()
+}
+
+func fetchChainID() (eos.SHA256Bytes, error) {
+	api := eos.New(viper.GetString("EOS.base_url"))
+	blockInfo, err := api.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	return blockInfo.ChainID, nil
+}
+
+//离线签名：使用调用方提供的链ID（hex），之后签名、解析公钥不再请求节点
+func SetOfflineChainID(offlineChainID string) error {
+	pin, err := utils.NewOfflineChainIDPin(offlineChainID)
+	if err != nil {
+		return err
+	}
+	chainID.lock.Lock()
+	chainID.pin = pin
+	chainID.lock.Unlock()
+	return nil
+}
+
+func txSigDigest(tx *eos.SignedTransaction) ([]byte, error) {
+	id, err := ChainID()
+	if err != nil {
+		return nil, err
+	}
+	return utils.TxSigDigest(tx, id)
+}
+
+//不访问节点创建转账交易：refBlockID 为调用方提供的参考块ID（hex，TaPoS），expiration 为过期时间
+func BuildOfflineTokenTransferTx(from, to, memo string, quantity int64, refBlockID string, expiration time.Time) (signedTx *eos.SignedTransaction, err error) {
+	blockID, err := hex.DecodeString(refBlockID)
+	if err != nil || len(blockID) != 32 {
+		return nil, errors.New("invalid reference block id '" + refBlockID + "'")
+	}
+	if expiration.IsZero() {
+		return nil, errors.New("offline transaction needs an expiration")
+	}
+
+	action := token.NewTransfer(eos.AN(from), eos.AN(to), NewEOSAsset(quantity), memo)
+	tx := &eos.Transaction{Actions: []*eos.Action{action}}
+	tx.Fill(eos.SHA256Bytes(blockID), 0, 0, 0)
+	tx.Expiration = eos.JSONTime{Time: expiration.UTC()}
+
+	return eos.NewSignedTransaction(tx), nil
+}
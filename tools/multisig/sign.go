@@ -45,28 +45,12 @@ func NewEOSAsset(in int64) eos.Asset {
 }
 
 func LocalSign(tx *eos.SignedTransaction, privkey string) (sig *ecc.Signature, err error) {
-	txdata, err := eos.MarshalBinary(tx.Transaction)
+	sigDigest, err := txSigDigest(tx)
 	if err != nil {
+		log.Error("get sig digest err", "info", err)
 		return nil, err
 	}
 
-	cfd := []byte{}
-	if len(tx.ContextFreeData) > 0 {
-		cfd, err = eos.MarshalBinary(tx.ContextFreeData)
-		if err != nil {
-			return nil, err
-		}
-	}
-	api := eos.New(viper.GetString("EOS.base_url"))
-	blockInfo, err := api.GetInfo()
-	if err != nil {
-		log.Error("get blockInfo err", err)
-		return nil, err
-	}
-	chainID := blockInfo.ChainID
-
-	sigDigest := eos.SigDigest(chainID, txdata, cfd)
-
 	/*通过调用签名服务来进行签名
 	sig, err := utils.Sign(sigDigest, mw.pubKeyHash)
 	if err != nil {
@@ -91,27 +75,11 @@ func LocalSign(tx *eos.SignedTransaction, privkey string) (sig *ecc.Signature, e
 }
 
 func PKMSign(tx *eos.SignedTransaction, pubKeyHash string) (sig *ecc.Signature, err error) {
-	txdata, err := eos.MarshalBinary(tx.Transaction)
-	if err != nil {
-		return nil, err
-	}
-
-	cfd := []byte{}
-	if len(tx.ContextFreeData) > 0 {
-		cfd, err = eos.MarshalBinary(tx.ContextFreeData)
-		if err != nil {
-			return nil, err
-		}
-	}
-	api := eos.New(viper.GetString("EOS.base_url"))
-	blockInfo, err := api.GetInfo()
+	sigDigest, err := txSigDigest(tx)
 	if err != nil {
-		log.Error("get blockInfo err", err)
+		log.Error("get sig digest err", "info", err)
 		return nil, err
 	}
-	chainID := blockInfo.ChainID
-
-	sigDigest := eos.SigDigest(chainID, txdata, cfd)
 
 	//通过调用签名服务来进行签名
 	sigResult, err := utils.Sign(sigDigest, pubKeyHash)
@@ -150,27 +118,11 @@ func SendTx(tx *eos.PackedTransaction) (out *eos.PushTransactionFullResp, err er
 
 //根据交易 和签名，推出对应的公钥
 func GetPublickeyFromTx(tx *eos.SignedTransaction, sig *ecc.Signature) (out ecc.PublicKey, err error) {
-	txdata, err := eos.MarshalBinary(tx.Transaction)
-	if err != nil {
-		return ecc.PublicKey{}, err
-	}
-
-	cfd := []byte{}
-	if len(tx.ContextFreeData) > 0 {
-		cfd, err = eos.MarshalBinary(tx.ContextFreeData)
-		if err != nil {
-			return ecc.PublicKey{}, err
-		}
-	}
-	api := eos.New(viper.GetString("EOS.base_url"))
-	blockInfo, err := api.GetInfo()
+	sigDigest, err := txSigDigest(tx)
 	if err != nil {
-		log.Error("get blockInfo err", err)
+		log.Error("get sig digest err", "info", err)
 		return ecc.PublicKey{}, err
 	}
-	chainID := blockInfo.ChainID
-
-	sigDigest := eos.SigDigest(chainID, txdata, cfd)
 
 	return GetPublickey(sigDigest, sig)
 }
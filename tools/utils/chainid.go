@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/eoscanada/eos-go"
+	log "github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+)
+
+//节点返回的链ID 与配置的不一致。 视为致命错误：之后不再请求节点，所有签名都失败
+type ChainIDMismatchError struct {
+	Expected eos.SHA256Bytes
+	Actual   eos.SHA256Bytes
+}
+
+func (err *ChainIDMismatchError) Error() string {
+	return fmt.Sprintf("chain id mismatch, expected %s, node returned %s", hex.EncodeToString(err.Expected), hex.EncodeToString(err.Actual))
+}
+
+//签名用的链ID：只向节点请求一次并缓存，配置了期望值时必须一致。
+//离线模式下不请求节点，直接使用期望值，签名机不需要访问节点
+type ChainIDPin struct {
+	expected eos.SHA256Bytes
+	offline  bool
+	fetch    func() (eos.SHA256Bytes, error)
+
+	lock    sync.Mutex
+	chainID eos.SHA256Bytes
+	err     error
+}
+
+//expected 为hex 编码的期望链ID，为空时使用节点第一次返回的链ID。 fetch 向节点请求链ID
+func NewChainIDPin(expected string, fetch func() (eos.SHA256Bytes, error)) (*ChainIDPin, error) {
+	expectedID, err := parseChainID(expected)
+	if err != nil {
+		return nil, err
+	}
+	return &ChainIDPin{expected: expectedID, fetch: fetch}, nil
+}
+
+//离线模式，chainID 由调用方提供，不能为空
+func NewOfflineChainIDPin(chainID string) (*ChainIDPin, error) {
+	if chainID == "" {
+		return nil, errors.New("offline signing needs a chain id")
+	}
+	expectedID, err := parseChainID(chainID)
+	if err != nil {
+		return nil, err
+	}
+	return &ChainIDPin{expected: expectedID, offline: true, chainID: expectedID}, nil
+}
+
+func parseChainID(chainID string) (eos.SHA256Bytes, error) {
+	if chainID == "" {
+		return nil, nil
+	}
+	id, err := hex.DecodeString(chainID)
+	if err != nil || len(id) != 32 {
+		return nil, errors.New("invalid chain id '" + chainID + "'")
+	}
+	return eos.SHA256Bytes(id), nil
+}
+
+func (pin *ChainIDPin) Offline() bool {
+	return pin.offline
+}
+
+//返回缓存的链ID，还没有时向节点请求。 请求失败时下次重试，链ID 不一致时一直返回*ChainIDMismatchError
+func (pin *ChainIDPin) ChainID() (eos.SHA256Bytes, error) {
+	pin.lock.Lock()
+	defer pin.lock.Unlock()
+	if pin.err != nil {
+		return nil, pin.err
+	}
+	if pin.chainID != nil {
+		return pin.chainID, nil
+	}
+	if pin.fetch == nil {
+		return nil, errors.New("no way to get chain id")
+	}
+
+	chainID, err := pin.fetch()
+	if err != nil {
+		return nil, err
+	}
+	if pin.expected != nil && !bytes.Equal(pin.expected, chainID) {
+		pin.err = &ChainIDMismatchError{Expected: pin.expected, Actual: chainID}
+		log.Crit("EOS chain id mismatch, signing disabled", "Expected", hex.EncodeToString(pin.expected), "ChainID", hex.EncodeToString(chainID))
+		return nil, pin.err
+	}
+	pin.chainID = chainID
+	return chainID, nil
+}
+
+//交易的签名摘要
+func TxSigDigest(tx *eos.SignedTransaction, chainID eos.SHA256Bytes) ([]byte, error) {
+	txdata, err := eos.MarshalBinary(tx.Transaction)
+	if err != nil {
+		return nil, err
+	}
+
+	cfd := []byte{}
+	if len(tx.ContextFreeData) > 0 {
+		cfd, err = eos.MarshalBinary(tx.ContextFreeData)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return eos.SigDigest(chainID, txdata, cfd), nil
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/stretchr/testify/assert"
+)
+
+var testChainID = strings.Repeat("ab", 32)
+
+func TestChainIDPinCached(t *testing.T) {
+	calls := 0
+	var fetchErr error
+	pin, err := NewChainIDPin(testChainID, func() (eos.SHA256Bytes, error) {
+		calls++
+		if fetchErr != nil {
+			return nil, fetchErr
+		}
+		return eos.SHA256Bytes(make([]byte, 32)), nil
+	})
+	assert.Nil(t, err)
+
+	//节点不可用时下次重试
+	fetchErr = errors.New("node down")
+	_, err = pin.ChainID()
+	assert.Equal(t, fetchErr, err)
+
+	//链ID 不一致，之后不再请求节点
+	fetchErr = nil
+	_, err = pin.ChainID()
+	_, ok := err.(*ChainIDMismatchError)
+	assert.True(t, ok)
+	_, err = pin.ChainID()
+	_, ok = err.(*ChainIDMismatchError)
+	assert.True(t, ok)
+	assert.Equal(t, 2, calls)
+
+	//没有期望值时使用节点第一次返回的链ID
+	pin, err = NewChainIDPin("", func() (eos.SHA256Bytes, error) {
+		calls++
+		return eos.SHA256Bytes(make([]byte, 32)), nil
+	})
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		chainID, err := pin.ChainID()
+		assert.Nil(t, err)
+		assert.Len(t, chainID, 32)
+	}
+	assert.Equal(t, 3, calls)
+
+	_, err = NewChainIDPin("abcd", nil)
+	assert.NotNil(t, err)
+}
+
+func TestOfflineChainIDPin(t *testing.T) {
+	_, err := NewOfflineChainIDPin("")
+	assert.NotNil(t, err)
+
+	pin, err := NewOfflineChainIDPin(testChainID)
+	assert.Nil(t, err)
+	assert.True(t, pin.Offline())
+	chainID, err := pin.ChainID()
+	assert.Nil(t, err)
+	assert.Equal(t, byte(0xab), chainID[0])
+}